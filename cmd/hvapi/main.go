@@ -5,9 +5,12 @@ import (
 	"TraceForge/internals/commons"
 	"TraceForge/internals/hvapi"
 	"TraceForge/pkg/hvlib"
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -46,8 +49,29 @@ func initRouter(server *hvapi.Server) *mux.Router {
 
 	// Define routes
 	apiRouter.HandleFunc("/providers", server.ListProvidersHandler).Methods("GET")
+	apiRouter.HandleFunc("/providers/{name}", server.ProviderHealthHandler).Methods("GET")
+	apiRouter.HandleFunc("/providers/{name}/reload", server.ReloadProviderHandler).Methods("POST")
+	apiRouter.HandleFunc("/audit", server.AuditHandler).Methods("GET")
+	apiRouter.HandleFunc("/events", server.EventsHandler).Methods("GET")
+	apiRouter.HandleFunc("/metrics", server.MetricsHandler).Methods("GET")
+	apiRouter.HandleFunc("/operations", server.ListOperationsHandler).Methods("GET")
+	apiRouter.HandleFunc("/operations/{id}", server.GetOperationHandler).Methods("GET")
+	apiRouter.HandleFunc("/leases", server.ListLeasesHandler).Methods("GET")
+	apiRouter.HandleFunc("/leases/{id}", server.ReleaseLeaseHandler).Methods("DELETE")
+	apiRouter.HandleFunc("/leases/{id}/renew", server.RenewLeaseHandler).Methods("POST")
+	apiRouter.HandleFunc("/images", server.ListImagesHandler).Methods("GET")
+	apiRouter.HandleFunc("/images/{image}", server.GetImageHandler).Methods("GET")
+	apiRouter.HandleFunc("/images/{image}/build", server.BuildImageHandler).Methods("POST")
+	apiRouter.HandleFunc("/images/{image}/versions/{version}/promote", server.PromoteImageHandler).Methods("POST")
+	apiRouter.HandleFunc("/pools", server.ListPoolsHandler).Methods("GET")
+	apiRouter.HandleFunc("/pools/{pool}", server.PoolStatusHandler).Methods("GET")
+	apiRouter.HandleFunc("/pools/{pool}/acquire", server.AcquireCloneHandler).Methods("POST")
+	apiRouter.HandleFunc("/pools/{pool}/release/{vmname}", server.ReleaseCloneHandler).Methods("POST")
 	apiRouter.HandleFunc("/{provider}/{vmname}/snapshots", server.SnapshotsVMHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/{vmname}/snapshots/tree", server.SnapshotTreeVMHandler).Methods("GET")
 	apiRouter.HandleFunc("/{provider}", server.ListVMsHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/network_profiles", server.ListNetworkProfilesHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/bulk", server.BulkHandler).Methods("POST")
 
 	apiRouter.HandleFunc("/{provider}/{vmname}/snapshot/{snapshotname}", server.TakeSnapshotHandler).Methods("GET")
 	apiRouter.HandleFunc("/{provider}/{vmname}/snapshot/{snapshotname}", server.DeleteSnapshotHandler).Methods("DELETE")
@@ -55,9 +79,24 @@ func initRouter(server *hvapi.Server) *mux.Router {
 	apiRouter.HandleFunc("/{provider}/{vmname}/stop", server.StopVMHandler).Methods("GET")
 	apiRouter.HandleFunc("/{provider}/{vmname}/suspend", server.SuspendVMHandler).Methods("GET")
 	apiRouter.HandleFunc("/{provider}/{vmname}/revert", server.RevertVMHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/{vmname}/revert/{snapshotname}", server.RevertToSnapshotHandler).Methods("GET")
 	apiRouter.HandleFunc("/{provider}/{vmname}/reset", server.ResetVMHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/{vmname}/lease", server.AcquireLeaseHandler).Methods("POST")
+	apiRouter.HandleFunc("/{provider}/{vmname}/wait", server.WaitVMHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/{vmname}/screenshot", server.CaptureScreenHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/{vmname}/memory", server.DownloadMemoryDumpHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/{vmname}/memory", server.UploadMemoryDumpHandler).Methods("POST")
+	apiRouter.HandleFunc("/{provider}/{vmname}/capture/start", server.StartCaptureHandler).Methods("POST")
+	apiRouter.HandleFunc("/{provider}/{vmname}/capture/stop", server.StopCaptureHandler).Methods("POST")
+	apiRouter.HandleFunc("/{provider}/{vmname}/network/{profile}", server.SetNetworkProfileHandler).Methods("POST")
+
+	apiRouter.HandleFunc("/{provider}/{vmname}/guest/processes", server.ListGuestProcessesHandler).Methods("GET")
+	apiRouter.HandleFunc("/{provider}/{vmname}/guest/run", server.RunInGuestHandler).Methods("POST")
+	apiRouter.HandleFunc("/{provider}/{vmname}/guest/file", server.CopyFileToGuestHandler).Methods("PUT")
+	apiRouter.HandleFunc("/{provider}/{vmname}/guest/file", server.CopyFileFromGuestHandler).Methods("GET")
 
 	apiRouter.Use(server.LoggingMiddleware())
+	apiRouter.Use(server.AuditMiddleware)
 	apiRouter.Use(server.AuthMiddleware)
 	return router
 }
@@ -87,22 +126,166 @@ func main() {
 		logger.Fatalf("Error loading configuration: %v", err)
 	}
 
-	vmware := hvapi.InitializeProvider(&hvlib.VmwareVP{}, configLoader, "VMware")
-	hyperv := hvapi.InitializeProvider(&hvlib.HypervVP{}, configLoader, "Hyper-V")
+	// Every provider that can be enabled from api.providers
+	availableProviders := map[string]hvlib.VirtualizationProvider{
+		"vmware":     &hvlib.VmwareVP{},
+		"hyperv":     &hvlib.HypervVP{},
+		"libvirt":    &hvlib.LibvirtVP{},
+		"virtualbox": &hvlib.VirtualBoxVP{},
+		"fake":       &hvlib.FakeVP{},
+	}
+
+	// VMware and Hyper-V are enabled when api.providers is not set
+	enabledProviders := []interface{}{"vmware", "hyperv"}
+	if names, ok := configLoader.Get("api.providers").([]interface{}); ok {
+		enabledProviders = names
+	}
+
+	// Directory where the vmrun/PowerShell/... transcripts are recorded
+	// to build test fixtures, one JSON lines file per provider
+	recordDir := configLoader.GetString("api.record_commands")
 
 	providers := hvapi.NewProvider()
-	providers.RegisterProvider("vmware", vmware)
-	providers.RegisterProvider("hyperv", hyperv)
+	var providerNames []string
+	for _, n := range enabledProviders {
+		name := fmt.Sprint(n)
+		providerNames = append(providerNames, name)
+		provider, exists := availableProviders[name]
+		if !exists {
+			logger.Fatalf("Unknown provider %s in api.providers", name)
+		}
+		if recordDir != "" {
+			if p, ok := provider.(interface{ SetRunner(hvlib.CommandRunner) }); ok {
+				p.SetRunner(&hvlib.RecordingRunner{
+					Runner: hvlib.ExecRunner{},
+					Path:   filepath.Join(recordDir, name+".jsonl"),
+					OnError: func(err error) {
+						logger.WithError(err).Warnf("Failed to record a %s command", name)
+					},
+				})
+			}
+		}
+		// A provider failing to load is reported as unhealthy, the others
+		// are still served
+		if err := providers.InitializeProvider(context.Background(), name, provider, configLoader); err != nil {
+			logger.WithError(err).Errorf("Error loading %s VMs, the provider is unhealthy until it is reloaded", name)
+		}
+	}
+
+	tokens, err := hvapi.LoadTokens(configLoader)
+	if err != nil {
+		logger.Fatalf("Error loading API tokens: %v", err)
+	}
+
+	timeouts, err := hvapi.LoadTimeouts(configLoader)
+	if err != nil {
+		logger.Fatalf("Error loading timeouts: %v", err)
+	}
+
+	baselines, err := hvapi.LoadBaselines(configLoader, providerNames)
+	if err != nil {
+		logger.Fatalf("Error loading baselines: %v", err)
+	}
+
+	artifacts, err := hvapi.LoadArtifactStore(configLoader)
+	if err != nil {
+		logger.Fatalf("Error loading S3 configuration: %v", err)
+	}
+
+	// Packet captures are written on the host until they are stopped
+	captureDir := configLoader.GetString("api.capture_dir")
+	if captureDir == "" {
+		captureDir = filepath.Join(os.TempDir(), "hvapi-captures")
+	}
+	if err := os.MkdirAll(captureDir, 0o755); err != nil {
+		logger.Fatalf("Error creating capture directory: %v", err)
+	}
+
+	// The VMs registered after startup are discovered every reload_interval,
+	// or on demand with POST /providers/{name}/reload
+	reloadInterval := 5 * time.Minute
+	if value := configLoader.GetString("api.reload_interval"); value != "" {
+		if reloadInterval, err = time.ParseDuration(value); err != nil {
+			logger.Fatalf("Invalid api.reload_interval: %v", err)
+		}
+	}
+
+	// Number of asynchronous operations kept for GET /operations/{id}
+	operationHistory, ok := configLoader.Get("api.operation_history").(int64)
+	if !ok && configLoader.Get("api.operation_history") != nil {
+		logger.Fatal("Invalid api.operation_history, expected an integer")
+	}
+
+	// The state changes made outside hvapi are detected every
+	// state_watch_interval, 0 disables the watcher. The hvapi_vm_power_state
+	// metric then only has the providers operated since the start.
+	stateWatchInterval := 10 * time.Second
+	if value := configLoader.GetString("api.state_watch_interval"); value != "" {
+		if stateWatchInterval, err = time.ParseDuration(value); err != nil {
+			logger.Fatalf("Invalid api.state_watch_interval: %v", err)
+		}
+	}
+
+	// Every hypervisor action is appended to the audit log, an empty
+	// api.audit_log disables it
+	var auditLog *hvapi.AuditLog
+	auditPath := "hvapi-audit.jsonl"
+	if value, ok := configLoader.Get("api.audit_log").(string); ok {
+		auditPath = value
+	}
+	if auditPath != "" {
+		if auditLog, err = hvapi.OpenAuditLog(auditPath); err != nil {
+			logger.Fatalf("Error opening audit log: %v", err)
+		}
+	}
 
-	authToken := configLoader.GetString("api.auth_token")
-	if authToken == "" {
-		logrus.Fatal("api.auth_token is not set")
+	pools, err := hvapi.LoadPools(configLoader, providers)
+	if err != nil {
+		logger.Fatalf("Error loading pools: %v", err)
+	}
+
+	images, err := hvapi.LoadImages(configLoader, providers)
+	if err != nil {
+		logger.Fatalf("Error loading images: %v", err)
+	}
+
+	// Versions of the golden images, the promoted ones replace the
+	// configured baselines
+	catalogPath := "hvapi-images.json"
+	if value, ok := configLoader.Get("api.image_catalog").(string); ok {
+		catalogPath = value
+	}
+	imageCatalog, err := hvapi.OpenImageCatalog(catalogPath)
+	if err != nil {
+		logger.Fatalf("Error opening image catalog: %v", err)
 	}
+	imageCatalog.ApplyBaselines(baselines)
 
+	events := hvapi.NewEventBus()
 	server := &hvapi.Server{
-		Server:    &commons.Server{Logger: logger},
-		AuthToken: authToken,
-		Providers: providers,
+		Server:       &commons.Server{Logger: logger},
+		Tokens:       tokens,
+		Providers:    providers,
+		Timeouts:     timeouts,
+		Baselines:    baselines,
+		Artifacts:    artifacts,
+		CaptureDir:   captureDir,
+		Pools:        pools,
+		Operations:   hvapi.NewOperationStore(int(operationHistory)),
+		Events:       events,
+		Metrics:      hvapi.NewMetrics(events),
+		Leases:       hvapi.NewLeaseStore(),
+		Audit:        auditLog,
+		Images:       images,
+		ImageCatalog: imageCatalog,
+	}
+	server.StartPools(context.Background())
+	server.StartLeaseReaper(context.Background())
+	if reloadInterval > 0 {
+		server.StartReloads(context.Background(), reloadInterval)
+	}
+	if stateWatchInterval > 0 {
+		server.StartStateWatcher(context.Background(), stateWatchInterval)
 	}
 
 	router := initRouter(server)
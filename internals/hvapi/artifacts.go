@@ -0,0 +1,120 @@
+package hvapi
+
+import (
+	"TraceForge/pkg/hvlib"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// maxArtifactKey is the maximum length of an S3 key
+const maxArtifactKey = 1024
+
+// defaultArtifactPrefix is the root of the uploaded keys when api.s3.prefix
+// isn't set
+const defaultArtifactPrefix = "hvapi"
+
+// ArtifactStore uploads the files produced on the hypervisor host, such as
+// memory dumps, to an S3 bucket
+type ArtifactStore struct {
+	Client *s3.Client
+	Bucket string
+	Prefix string // Root of the keys given by the clients, see Key
+}
+
+// LoadArtifactStore reads the bucket from the [api.s3] section, nil is
+// returned when it isn't configured:
+//
+//	[api.s3]
+//	bucket = "traceforge"
+//	region = "fr-par"
+//	endpoint = "https://s3.fr-par.scw.cloud"
+//	prefix = "hvapi"
+//	access_key = "..."
+//	secret_key = "..."
+func LoadArtifactStore(loader *hvlib.ConfigLoader) (*ArtifactStore, error) {
+	bucket := loader.GetString("api.s3.bucket")
+	if bucket == "" {
+		return nil, nil
+	}
+
+	accessKey := loader.GetString("api.s3.access_key")
+	secretKey := loader.GetString("api.s3.secret_key")
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("api.s3.access_key and api.s3.secret_key are required")
+	}
+
+	config := aws.Config{
+		Region:      loader.GetString("api.s3.region"),
+		Credentials: credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
+	}
+	if endpoint := loader.GetString("api.s3.endpoint"); endpoint != "" {
+		config.BaseEndpoint = aws.String(endpoint)
+	}
+
+	prefix := strings.Trim(loader.GetString("api.s3.prefix"), "/")
+	if prefix == "" {
+		prefix = defaultArtifactPrefix
+	}
+	if err := validateArtifactKey(prefix); err != nil {
+		return nil, fmt.Errorf("invalid api.s3.prefix: %w", err)
+	}
+	return &ArtifactStore{Client: s3.NewFromConfig(config), Bucket: bucket, Prefix: prefix}, nil
+}
+
+// Key returns the S3 key of name, a key relative to the configured prefix
+// given by a client. The clients can't write outside of the prefix: empty,
+// "." and ".." segments are rejected, as well as the backslashes and the
+// control characters.
+func (a *ArtifactStore) Key(name string) (string, error) {
+	if err := validateArtifactKey(name); err != nil {
+		return "", err
+	}
+	key := path.Join(a.Prefix, name)
+	if len(key) > maxArtifactKey {
+		return "", &hvlib.InvalidNameError{Name: name, Reason: fmt.Sprintf("key is longer than %d bytes", maxArtifactKey)}
+	}
+	return key, nil
+}
+
+func validateArtifactKey(key string) error {
+	if key == "" {
+		return &hvlib.InvalidNameError{Name: key, Reason: "key is empty"}
+	}
+	for _, r := range key {
+		if r == '\\' || unicode.IsControl(r) {
+			return &hvlib.InvalidNameError{Name: key, Reason: "backslashes and control characters are not allowed"}
+		}
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return &hvlib.InvalidNameError{Name: key, Reason: "empty, '.' and '..' segments are not allowed"}
+		}
+	}
+	return nil
+}
+
+// Upload stores a local file under key, large files are sent in parts
+func (a *ArtifactStore) Upload(ctx context.Context, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	uploader := manager.NewUploader(a.Client)
+	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(a.Bucket),
+		Key:    aws.String(key),
+		Body:   file,
+	})
+	return err
+}
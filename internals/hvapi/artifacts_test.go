@@ -0,0 +1,91 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestArtifactKey(t *testing.T) {
+	store := &ArtifactStore{Prefix: "hvapi"}
+	tests := []struct {
+		name     string
+		expected string // Empty when the key is rejected
+	}{
+		{name: "dumps/win10", expected: "hvapi/dumps/win10"},
+		{name: "win10.pcap", expected: "hvapi/win10.pcap"},
+		{name: "a..b/c", expected: "hvapi/a..b/c"},
+		{name: ""},
+		{name: "/dumps"},
+		{name: "dumps/"},
+		{name: "dumps//win10"},
+		{name: ".."},
+		{name: "../other/win10"},
+		{name: "dumps/../../other"},
+		{name: "./dumps"},
+		{name: `..\other`},
+		{name: "dumps/win10\n"},
+		{name: strings.Repeat("a", maxArtifactKey)},
+	}
+
+	for _, tt := range tests {
+		got, err := store.Key(tt.name)
+		var invalidName *hvlib.InvalidNameError
+		if tt.expected == "" && !errors.As(err, &invalidName) {
+			t.Errorf("%q: got %q and error %v, expected an InvalidNameError", tt.name, got, err)
+		}
+		if tt.expected != "" && (err != nil || got != tt.expected) {
+			t.Errorf("%q: got %q and error %v, expected %q", tt.name, got, err, tt.expected)
+		}
+	}
+}
+
+func newArtifactServer(t *testing.T) *Server {
+	t.Helper()
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(context.Background(), "fake", &hvlib.FakeVP{}, loader); err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		Server:    &commons.Server{Logger: quietLogger()},
+		Providers: providers,
+		Leases:    NewLeaseStore(),
+		Artifacts: &ArtifactStore{Prefix: "hvapi"},
+	}
+}
+
+func TestUploadMemoryDumpKey(t *testing.T) {
+	s := newArtifactServer(t)
+
+	for _, body := range []string{`{}`, `{"s3_prefix": "../other"}`, `{"s3_prefix": "/other"}`, `{"s3_prefix": "dumps/./win10/"}`} {
+		r := httptest.NewRequest(http.MethodPost, "/fake/win10/memory", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"provider": "fake", "vmname": "win10"})
+		w := httptest.NewRecorder()
+		s.UploadMemoryDumpHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, expected 400", body, w.Code)
+		}
+	}
+}
+
+func TestStopCaptureKey(t *testing.T) {
+	s := newArtifactServer(t)
+
+	for _, body := range []string{`{"s3_key": "../other.pcap"}`, `{"s3_key": "tasks//capture.pcap"}`, `{"s3_key": "tasks\\capture.pcap"}`} {
+		r := httptest.NewRequest(http.MethodPost, "/fake/win10/capture/stop", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"provider": "fake", "vmname": "win10"})
+		w := httptest.NewRecorder()
+		s.StopCaptureHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, expected 400", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Outcome of an AuditEntry
+const (
+	AuditSuccess  = "success"
+	AuditError    = "error"
+	AuditAccepted = "accepted" // Asynchronous operation, its outcome is a later entry
+)
+
+// auditedRoutes are the actions recorded in the audit log, by method and
+// path template of their route
+var auditedRoutes = map[string]string{
+	"GET /{provider}/{vmname}/start":                      hvlib.OpStart,
+	"GET /{provider}/{vmname}/stop":                       hvlib.OpStop,
+	"GET /{provider}/{vmname}/suspend":                    hvlib.OpSuspend,
+	"GET /{provider}/{vmname}/revert":                     hvlib.OpRevert,
+	"GET /{provider}/{vmname}/revert/{snapshotname}":      hvlib.OpRevert,
+	"GET /{provider}/{vmname}/reset":                      hvlib.OpReset,
+	"GET /{provider}/{vmname}/snapshot/{snapshotname}":    hvlib.OpTakeSnapshot,
+	"DELETE /{provider}/{vmname}/snapshot/{snapshotname}": hvlib.OpDeleteSnapshot,
+	"GET /{provider}/{vmname}/memory":                     hvlib.OpDumpMemory,
+	"POST /{provider}/{vmname}/memory":                    hvlib.OpDumpMemory,
+	"POST /{provider}/{vmname}/capture/start":             hvlib.OpStartCapture,
+	"POST /{provider}/{vmname}/capture/stop":              hvlib.OpStopCapture,
+	"POST /{provider}/{vmname}/network/{profile}":         hvlib.OpSetNetworkProfile,
+	"POST /{provider}/{vmname}/guest/run":                 hvlib.OpRunInGuest,
+	"PUT /{provider}/{vmname}/guest/file":                 hvlib.OpCopyToGuest,
+	"GET /{provider}/{vmname}/guest/file":                 hvlib.OpCopyFromGuest,
+	"POST /{provider}/{vmname}/lease":                     "acquire_lease",
+	"POST /leases/{id}/renew":                             "renew_lease",
+	"DELETE /leases/{id}":                                 "release_lease",
+	"POST /pools/{pool}/acquire":                          "acquire_clone",
+	"POST /pools/{pool}/release/{vmname}":                 "release_clone",
+	"POST /providers/{name}/reload":                       hvlib.OpLoadVMs,
+	"POST /{provider}/bulk":                               "bulk",
+	"POST /images/{image}/build":                          OpBuildImage,
+	"POST /images/{image}/versions/{version}/promote":     OpPromoteImage,
+}
+
+// maxAuditedBody is the size up to which a JSON request body is recorded
+const maxAuditedBody = 16 * 1024
+
+// auditRedacted replaces the lease IDs in the audit log, an ID gives the use
+// of its VM: the {id} of the lease routes and the fields of the bodies in
+// auditRedactedFields
+const auditRedacted = "[redacted]"
+
+// auditRedactedFields are the redacted fields of the JSON request bodies
+var auditRedactedFields = []string{"leases"} // BulkRequest.Leases
+
+// AuditEntry is a line of the audit log
+type AuditEntry struct {
+	Time       time.Time         `json:"time"`
+	Token      string            `json:"token"` // Name of the API token
+	Provider   string            `json:"provider,omitempty"`
+	VM         string            `json:"vm,omitempty"`
+	Action     string            `json:"action"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Params     map[string]string `json:"params,omitempty"` // Route and query parameters
+	Body       json.RawMessage   `json:"body,omitempty"`   // JSON request body
+	Operation  string            `json:"operation,omitempty"`
+	DurationMs int64             `json:"duration_ms"`
+	Status     int               `json:"status"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// AuditFilter selects the entries of AuditLog.Query, empty fields match
+// every entry
+type AuditFilter struct {
+	Token    string
+	Provider string
+	VM       string
+	Action   string
+	Outcome  string
+	Since    time.Time
+	Until    time.Time
+	Scope    *APIToken // Only the entries of the providers and VMs of the token
+}
+
+func (f *AuditFilter) match(entry *AuditEntry) bool {
+	return (f.Scope == nil || f.Scope.allows(RoleReadOnly, entry.Provider, entry.VM)) &&
+		(f.Token == "" || entry.Token == f.Token) &&
+		(f.Provider == "" || entry.Provider == f.Provider) &&
+		(f.VM == "" || entry.VM == f.VM) &&
+		(f.Action == "" || entry.Action == f.Action) &&
+		(f.Outcome == "" || entry.Outcome == f.Outcome) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until))
+}
+
+// AuditLog appends the entries as JSON lines to a file which is never
+// rewritten
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+// Append writes an entry, a nil AuditLog drops it
+func (a *AuditLog) Append(entry AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// Query returns the matching entries, the most recent first, skipping
+// offset of them, with the total number of matching entries
+func (a *AuditLog) Query(filter AuditFilter, offset, limit int) ([]AuditEntry, int, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var matches []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line cut by a crash
+			continue
+		}
+		if filter.match(&entry) {
+			matches = append(matches, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	total := len(matches)
+	entries := make([]AuditEntry, 0, limit)
+	for i := total - 1 - offset; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, matches[i])
+	}
+	return entries, total, nil
+}
+
+type auditContextKey struct{}
+
+// auditEntryFromContext returns the entry of an audited request, handlers
+// complete it (operation ID...)
+func auditEntryFromContext(ctx context.Context) *AuditEntry {
+	entry, _ := ctx.Value(auditContextKey{}).(*AuditEntry)
+	return entry
+}
+
+// auditRecorder captures the status of the response and the body of the
+// error responses
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if auditFailed(rec.status) && rec.body.Len() < maxAuditedBody {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// auditFailed reports whether a response status is an error, a bulk
+// operation which failed on some VMs included
+func auditFailed(status int) bool {
+	return status >= 400 || status == http.StatusMultiStatus
+}
+
+// AuditMiddleware records the audited routes in the audit log. It runs
+// before AuthMiddleware, which sets the token of the entry, so that the
+// requests refused 401 or 403 are recorded too.
+func (s *Server) AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				action = auditedRoutes[r.Method+" "+template]
+			}
+		}
+		if action == "" || s.Audit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, providerName, vmName := s.routePermission(r)
+		entry := &AuditEntry{
+			Time:     time.Now(),
+			Provider: providerName,
+			VM:       vmName,
+			Action:   action,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Params:   map[string]string{},
+		}
+		for key, value := range mux.Vars(r) {
+			if key != "provider" && key != "vmname" {
+				entry.Params[key] = value
+			}
+		}
+		if id, exists := entry.Params["id"]; exists {
+			// /leases/{id}
+			entry.Params["id"] = auditRedacted
+			entry.Path = strings.Replace(entry.Path, "/"+id, "/"+auditRedacted, 1)
+		}
+		for key := range r.URL.Query() {
+			entry.Params[key] = r.URL.Query().Get(key)
+		}
+		if r.Header.Get("Content-Type") == "application/json" && r.ContentLength > 0 && r.ContentLength <= maxAuditedBody {
+			body, err := io.ReadAll(r.Body)
+			if err == nil && json.Valid(body) {
+				entry.Body = redactAuditBody(body)
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		rec := &auditRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, entry)))
+
+		entry.DurationMs = time.Since(entry.Time).Milliseconds()
+		entry.Status = rec.status
+		switch {
+		case rec.status == http.StatusAccepted:
+			entry.Outcome = AuditAccepted
+		case auditFailed(rec.status):
+			entry.Outcome = AuditError
+			var resp commons.HttpResp
+			if json.Unmarshal(rec.body.Bytes(), &resp) == nil {
+				entry.Error = resp.Message
+			}
+		default:
+			entry.Outcome = AuditSuccess
+		}
+		if err := s.Audit.Append(*entry); err != nil {
+			s.Logger.WithError(err).Error("Failed to write the audit log")
+		}
+	})
+}
+
+// redactAuditBody returns a JSON body with the auditRedactedFields of an
+// object replaced
+func redactAuditBody(body []byte) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return body
+	}
+	redacted := false
+	for _, field := range auditRedactedFields {
+		if _, exists := fields[field]; exists {
+			fields[field] = json.RawMessage(`"` + auditRedacted + `"`)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return body
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// auditOperation records the outcome of an asynchronous operation accepted
+// by the audited request of entry
+func (s *Server) auditOperation(entry *AuditEntry, op Operation) {
+	if entry == nil {
+		return
+	}
+	done := *entry
+	done.Time = time.Now()
+	done.Operation = op.ID
+	done.Status = op.StatusCode
+	done.Error = op.Error
+	done.Outcome = AuditSuccess
+	if op.Status == OperationFailed {
+		done.Outcome = AuditError
+	}
+	if op.StartedAt != nil && op.FinishedAt != nil {
+		done.DurationMs = op.FinishedAt.Sub(*op.StartedAt).Milliseconds()
+	}
+	if err := s.Audit.Append(done); err != nil {
+		s.Logger.WithError(err).Error("Failed to write the audit log")
+	}
+}
+
+// auditBulkResult records the action of a bulk operation on a VM, entry is
+// the entry of the bulk request
+func (s *Server) auditBulkResult(entry *AuditEntry, action string, result BulkResult) {
+	if entry == nil {
+		return
+	}
+	done := *entry
+	done.Time = time.Now()
+	done.VM = result.VM
+	done.Action = action
+	done.Status = result.Status
+	done.Error = result.Error
+	done.DurationMs = result.DurationMs
+	done.Outcome = AuditSuccess
+	if result.Error != "" {
+		done.Outcome = AuditError
+	}
+	if err := s.Audit.Append(done); err != nil {
+		s.Logger.WithError(err).Error("Failed to write the audit log")
+	}
+}
+
+// AuditPage is a page of the audit log
+type AuditPage struct {
+	Total   int          `json:"total"` // Number of matching entries
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditHandler godoc
+// @Summary Query the audit log
+// @Description List the recorded hypervisor actions, the most recent first, with the token, provider, VM, parameters, duration and outcome. An asynchronous operation has an accepted entry then an entry with its outcome. Requires an admin token, only the entries of its providers and VMs are listed. The lease IDs are redacted.
+// @Tags audit
+// @Produce  json
+// @Param token query string false "Token name"
+// @Param provider query string false "Provider name"
+// @Param vm query string false "Virtual Machine name"
+// @Param action query string false "Action, e.g. revert or delete_snapshot"
+// @Param outcome query string false "success, error or accepted"
+// @Param since query string false "RFC 3339 time"
+// @Param until query string false "RFC 3339 time"
+// @Param offset query int false "Entries to skip"
+// @Param limit query int false "Entries per page, 100 by default, up to 1000"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 403 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /audit [get]
+func (s *Server) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Audit == nil {
+		commons.WriteErrorResponse(w, "The audit log is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Token:    query.Get("token"),
+		Provider: query.Get("provider"),
+		VM:       query.Get("vm"),
+		Action:   query.Get("action"),
+		Outcome:  query.Get("outcome"),
+		Scope:    TokenFromContext(r.Context()),
+	}
+	for key, value := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if query.Get(key) == "" {
+			continue
+		}
+		var err error
+		if *value, err = time.Parse(time.RFC3339, query.Get(key)); err != nil {
+			commons.WriteErrorResponse(w, fmt.Sprintf("Invalid %s parameter, expected an RFC 3339 time", key), http.StatusBadRequest)
+			return
+		}
+	}
+	page := AuditPage{Limit: defaultAuditLimit}
+	var err error
+	if value := query.Get("offset"); value != "" {
+		if page.Offset, err = strconv.Atoi(value); err != nil || page.Offset < 0 {
+			commons.WriteErrorResponse(w, "Invalid offset parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if page.Limit, err = strconv.Atoi(value); err != nil || page.Limit <= 0 {
+			commons.WriteErrorResponse(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	page.Limit = min(page.Limit, maxAuditLimit)
+
+	page.Entries, page.Total, err = s.Audit.Query(filter, page.Offset, page.Limit)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	commons.WriteSuccessResponse(w, "", page)
+}
@@ -0,0 +1,306 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func openTestAuditLog(t *testing.T) *AuditLog {
+	t.Helper()
+	audit, err := OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.file.Close() })
+	return audit
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	audit := openTestAuditLog(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []AuditEntry{
+		{Token: "ci", Provider: "fake", VM: "win10", Action: "revert", Outcome: AuditSuccess},
+		{Token: "ci", Provider: "fake", VM: "win11", Action: "start", Outcome: AuditError},
+		{Token: "ops", Provider: "vmware", VM: "win10", Action: "revert", Outcome: AuditAccepted},
+		{Token: "ci", Provider: "fake", VM: "win10", Action: "start", Outcome: AuditSuccess},
+		{Token: "ops", Provider: "fake", VM: "win10", Action: "delete_snapshot", Outcome: AuditSuccess},
+	}
+	for i, entry := range entries {
+		entry.Time = start.Add(time.Duration(i) * time.Minute)
+		if err := audit.Append(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filter   AuditFilter
+		expected []int // Indexes of the entries, the most recent first
+	}{
+		{name: "all", expected: []int{4, 3, 2, 1, 0}},
+		{name: "token", filter: AuditFilter{Token: "ops"}, expected: []int{4, 2}},
+		{name: "provider", filter: AuditFilter{Provider: "vmware"}, expected: []int{2}},
+		{name: "vm", filter: AuditFilter{VM: "win10"}, expected: []int{4, 3, 2, 0}},
+		{name: "action", filter: AuditFilter{Action: "revert"}, expected: []int{2, 0}},
+		{name: "outcome", filter: AuditFilter{Outcome: AuditError}, expected: []int{1}},
+		{name: "since", filter: AuditFilter{Since: start.Add(3 * time.Minute)}, expected: []int{4, 3}},
+		{name: "until", filter: AuditFilter{Until: start.Add(time.Minute)}, expected: []int{0}},
+		{name: "since and until", filter: AuditFilter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, expected: []int{2, 1}},
+		{name: "combined", filter: AuditFilter{Token: "ci", VM: "win10", Action: "start"}, expected: []int{3}},
+		{name: "no match", filter: AuditFilter{Token: "unknown"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, total, err := audit.Query(tt.filter, 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != len(tt.expected) || len(got) != len(tt.expected) {
+				t.Fatalf("got %d entries of %d, expected %d", len(got), total, len(tt.expected))
+			}
+			for i, index := range tt.expected {
+				if !got[i].Time.Equal(start.Add(time.Duration(index) * time.Minute)) {
+					t.Errorf("got entry %+v at %d, expected entry %d", got[i], i, index)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogQueryPagination(t *testing.T) {
+	audit := openTestAuditLog(t)
+	for i := 0; i < 5; i++ {
+		audit.Append(AuditEntry{Action: "start", Status: i})
+	}
+	// A line cut by a crash is skipped
+	audit.file.WriteString(`{"action": "st` + "\n")
+	audit.Append(AuditEntry{Action: "start", Status: 5})
+
+	tests := []struct {
+		offset   int
+		limit    int
+		expected []int // Status of the entries
+	}{
+		{offset: 0, limit: 2, expected: []int{5, 4}},
+		{offset: 2, limit: 2, expected: []int{3, 2}},
+		{offset: 4, limit: 5, expected: []int{1, 0}},
+		{offset: 6, limit: 2},
+		{offset: 10, limit: 2},
+	}
+
+	for _, tt := range tests {
+		entries, total, err := audit.Query(AuditFilter{}, tt.offset, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 6 {
+			t.Errorf("offset %d: got total %d, expected 6", tt.offset, total)
+		}
+		if len(entries) != len(tt.expected) {
+			t.Fatalf("offset %d: got %+v, expected statuses %v", tt.offset, entries, tt.expected)
+		}
+		for i, status := range tt.expected {
+			if entries[i].Status != status {
+				t.Errorf("offset %d: got status %d at %d, expected %d", tt.offset, entries[i].Status, i, status)
+			}
+		}
+	}
+
+	os.Remove(audit.path)
+	if _, _, err := audit.Query(AuditFilter{}, 0, 10); err == nil {
+		t.Error("expected an error querying a removed log")
+	}
+}
+
+func TestAuditRefusedRequests(t *testing.T) {
+	s := testAuthServer(t)
+	s.Audit = openTestAuditLog(t)
+	router := testRouter(func(w http.ResponseWriter, r *http.Request) {
+		commons.WriteSuccessResponse(w, "", nil)
+	})
+	router.Use(s.AuditMiddleware)
+	router.Use(s.AuthMiddleware)
+
+	for _, authorization := range []string{"", "Bearer unknown", "Bearer dashboard", "Bearer ci"} {
+		r := httptest.NewRequest(http.MethodGet, "/fake/win10-1/start", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	// Not audited
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fake", nil))
+
+	entries, _, err := s.Audit.Query(AuditFilter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		token   string
+		status  int
+		outcome string
+	}{
+		{token: "ci", status: http.StatusOK, outcome: AuditSuccess},
+		{token: "dashboard", status: http.StatusForbidden, outcome: AuditError},
+		{status: http.StatusUnauthorized, outcome: AuditError},
+		{status: http.StatusUnauthorized, outcome: AuditError},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d entries, expected %d", len(entries), len(expected))
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if entry.Token != e.token || entry.Status != e.status || entry.Outcome != e.outcome {
+			t.Errorf("got %s %d %s, expected %s %d %s", entry.Token, entry.Status, entry.Outcome, e.token, e.status, e.outcome)
+		}
+		if entry.Action != "start" || entry.Provider != "fake" || entry.VM != "win10-1" {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+	}
+	if entries[1].Error == "" {
+		t.Error("reason of the refusal not recorded")
+	}
+}
+
+func TestAuditRedaction(t *testing.T) {
+	s := testAuthServer(t)
+	s.Audit = openTestAuditLog(t)
+	s.Leases = NewLeaseStore()
+	lease, err := s.Leases.Acquire("fake", "win10-1", "sbapi", "ci", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/leases/{id}/renew", s.RenewLeaseHandler).Methods("POST")
+	router.HandleFunc("/{provider}/bulk", func(w http.ResponseWriter, r *http.Request) {
+		commons.WriteSuccessResponse(w, "", nil)
+	}).Methods("POST")
+	router.Use(s.AuditMiddleware)
+	router.Use(s.AuthMiddleware)
+
+	requests := []struct {
+		path string
+		body string
+	}{
+		{path: "/leases/" + lease.ID + "/renew", body: `{"ttl": "5m"}`},
+		{path: "/fake/bulk", body: `{"action": "start", "vms": ["win10-1"], "leases": {"win10-1": "` + lease.ID + `"}}`},
+	}
+	for _, request := range requests {
+		r := httptest.NewRequest(http.MethodPost, request.path, strings.NewReader(request.body))
+		r.Header.Set("Authorization", "Bearer ci")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, expected 200: %s", request.path, w.Code, w.Body)
+		}
+	}
+
+	data, err := os.ReadFile(s.Audit.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), lease.ID) {
+		t.Errorf("lease ID recorded: %s", data)
+	}
+	entries, _, err := s.Audit.Query(AuditFilter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, expected 2", len(entries))
+	}
+
+	bulk := entries[0]
+	var body map[string]interface{}
+	if err := json.Unmarshal(bulk.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["action"] != "start" || body["leases"] != auditRedacted {
+		t.Errorf("got body %s, expected the leases redacted", bulk.Body)
+	}
+	// The VM of the lease is recorded for the lease routes
+	renew := entries[1]
+	if renew.Path != "/leases/"+auditRedacted+"/renew" || renew.Params["id"] != auditRedacted {
+		t.Errorf("got path %s and parameters %v, expected the lease ID redacted", renew.Path, renew.Params)
+	}
+	if renew.Provider != "fake" || renew.VM != "win10-1" || renew.Token != "ci" {
+		t.Errorf("unexpected entry %+v", renew)
+	}
+}
+
+func TestRedactAuditBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{body: `{"leases": {"win10": "id"}, "vms": ["win10"]}`, expected: `{"leases":"[redacted]","vms":["win10"]}`},
+		{body: `{"owner": "sbapi", "ttl": "5m"}`, expected: `{"owner": "sbapi", "ttl": "5m"}`},
+		{body: `["leases"]`, expected: `["leases"]`},
+	}
+
+	for _, tt := range tests {
+		if got := string(redactAuditBody([]byte(tt.body))); got != tt.expected {
+			t.Errorf("got %s, expected %s", got, tt.expected)
+		}
+	}
+}
+
+func TestAuditHandlerScope(t *testing.T) {
+	s := testAuthServer(t)
+	s.Audit = openTestAuditLog(t)
+	for _, entry := range []AuditEntry{
+		{Token: "ci", Provider: "fake", VM: "win10-1", Action: "start"},
+		{Token: "default", Provider: "vmware", VM: "win10", Action: "revert"},
+		{Token: "default", Provider: "vmware", Action: "load_vms"},
+		{Token: "ops", Action: "renew_lease"}, // Unknown lease
+	} {
+		s.Audit.Append(entry)
+	}
+
+	tests := []struct {
+		token    string
+		expected int
+	}{
+		{token: "default", expected: 4},
+		{token: "ops", expected: 2}, // Scoped to fake
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			var token *APIToken
+			for i := range s.Tokens {
+				if s.Tokens[i].Name == tt.token {
+					token = &s.Tokens[i]
+				}
+			}
+			r := httptest.NewRequest(http.MethodGet, "/audit", nil)
+			w := httptest.NewRecorder()
+			s.AuditHandler(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
+
+			var page AuditPage
+			if err := json.NewDecoder(w.Body).Decode(&commons.HttpResp{Data: &page}); err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != tt.expected || len(page.Entries) != tt.expected {
+				t.Fatalf("got %d entries of %d, expected %d", len(page.Entries), page.Total, tt.expected)
+			}
+			for _, entry := range page.Entries {
+				if !token.allows(RoleAdmin, entry.Provider, entry.VM) {
+					t.Errorf("got entry %+v out of the token scope", entry)
+				}
+			}
+		})
+	}
+}
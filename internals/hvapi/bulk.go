@@ -0,0 +1,310 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultBulkParallelism = 4
+	maxBulkParallelism     = 16
+)
+
+// ErrBulkFailed is returned by a bulk operation which failed on some VMs
+var ErrBulkFailed = errors.New("bulk operation failed")
+
+// BulkRequest is the body of a bulk operation
+type BulkRequest struct {
+	Action      string            `json:"action"`      // start, stop, suspend, reset, revert, take_snapshot or delete_snapshot
+	VMs         []string          `json:"vms"`         // VM names
+	Pattern     string            `json:"pattern"`     // path.Match pattern of VM names, e.g. "win10-*"
+	Snapshot    string            `json:"snapshot"`    // Required to take or delete a snapshot, optional to revert instead of the baseline
+	Parallelism int               `json:"parallelism"` // VMs processed at once, 4 by default, up to 16
+	Leases      map[string]string `json:"leases"`      // Lease IDs of the VMs already leased by the caller, by VM name
+}
+
+// BulkResult is the result of a bulk operation on a VM
+type BulkResult struct {
+	VM         string `json:"vm"`
+	Status     int    `json:"status"` // HTTP status the single VM endpoint would have answered
+	Message    string `json:"message,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// BulkReport is the per VM report of a bulk operation
+type BulkReport struct {
+	Action    string       `json:"action"`
+	Snapshot  string       `json:"snapshot,omitempty"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"` // By VM name
+}
+
+// BulkHandler godoc
+// @Summary Run an action on several virtual machines
+// @Description Start, stop, suspend, reset, revert, take or delete a snapshot of the VMs listed and/or matching a name pattern, a few VMs at a time. Each VM is leased for the action unless its lease ID is given, a VM leased by another owner or locked by another operation is reported 409 and skipped. Deleting snapshots requires an admin token, the VMs out of the token scope are reported 403. The report has the result of every VM, the response is 207 when some VMs failed. With async=true the operation is answered 202 and its report is in the result of the operation.
+// @Tags vms
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param request body BulkRequest true "Action and VMs"
+// @Param async query bool false "Run the operation in the background and answer 202 with its ID"
+// @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
+// @Success 207 {object} commons.HttpResp // Failed on some VMs
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /{provider}/bulk [post]
+func (s *Server) BulkHandler(w http.ResponseWriter, r *http.Request) {
+	providerName := mux.Vars(r)["provider"]
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return
+	}
+
+	var params BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		commons.WriteErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	switch params.Action {
+	case hvlib.OpStart, hvlib.OpStop, hvlib.OpSuspend, hvlib.OpReset, hvlib.OpRevert:
+	case hvlib.OpTakeSnapshot, hvlib.OpDeleteSnapshot:
+		if params.Snapshot == "" {
+			commons.WriteErrorResponse(w, fmt.Sprintf("snapshot is required to %s", params.Action), http.StatusBadRequest)
+			return
+		}
+	default:
+		commons.WriteErrorResponse(w, "invalid action", http.StatusBadRequest)
+		return
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = defaultBulkParallelism
+	}
+	if params.Parallelism < 0 || params.Parallelism > maxBulkParallelism {
+		commons.WriteErrorResponse(w,
+			fmt.Sprintf("Invalid parallelism, expected 1 to %d", maxBulkParallelism),
+			http.StatusBadRequest)
+		return
+	}
+	if len(params.VMs) == 0 && params.Pattern == "" {
+		commons.WriteErrorResponse(w, "vms or pattern is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(params.Pattern, ""); err != nil {
+		commons.WriteErrorResponse(w, fmt.Sprintf("Invalid pattern %q", params.Pattern), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.operationContext(r, hvlib.OpList)
+	start := time.Now()
+	vms, err := provider.List(ctx)
+	s.Metrics.ObserveOperation(providerName, hvlib.OpList, start, err)
+	cancel()
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	vmNames := bulkVMNames(params, vms)
+	if len(vmNames) == 0 {
+		commons.WriteErrorResponse(w, fmt.Sprintf("No VM matches %q", params.Pattern), http.StatusNotFound)
+		return
+	}
+	known := make(map[string]bool, len(vms))
+	for _, vm := range vms {
+		known[vm.Name] = true
+	}
+
+	bulk := &bulkOperation{
+		server:       s,
+		params:       params,
+		providerName: providerName,
+		provider:     provider,
+		token:        TokenFromContext(r.Context()),
+		owner:        "bulk " + uuid.NewString(),
+		known:        known,
+	}
+	if entry := auditEntryFromContext(r.Context()); entry != nil {
+		audit := *entry
+		bulk.audit = &audit
+	}
+
+	if isAsync(r) {
+		// Each VM action has its own timeout, the batches bound the operation
+		batches := (len(vmNames) + params.Parallelism - 1) / params.Parallelism
+		s.startOperation(w, r, params.Action, providerName, "", time.Duration(batches)*s.timeout(params.Action),
+			func(ctx context.Context, progress func(string)) (string, interface{}, error) {
+				report := bulk.run(ctx, vmNames, progress)
+				return bulkMessage(report), report, bulkError(report)
+			},
+			func() {})
+		return
+	}
+
+	report := bulk.run(r.Context(), vmNames, func(string) {})
+	if report.Failed > 0 {
+		commons.WriteJSONResponse(w, http.StatusMultiStatus, &commons.HttpResp{
+			Status:  "error",
+			Data:    report,
+			Message: bulkMessage(report),
+		})
+		return
+	}
+	commons.WriteSuccessResponse(w, bulkMessage(report), report)
+}
+
+// bulkVMNames returns the sorted VM names listed or matching the pattern,
+// the listed VMs which don't exist are kept to report them
+func bulkVMNames(params BulkRequest, vms []hvlib.VMStatus) []string {
+	selected := map[string]bool{}
+	for _, name := range params.VMs {
+		selected[name] = true
+	}
+	if params.Pattern != "" {
+		for _, vm := range vms {
+			if matched, _ := path.Match(params.Pattern, vm.Name); matched {
+				selected[vm.Name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func bulkMessage(report BulkReport) string {
+	if report.Failed > 0 {
+		return fmt.Sprintf("%s failed on %d of %d VMs", report.Action, report.Failed, len(report.Results))
+	}
+	return fmt.Sprintf("%s succeeded on %d VMs", report.Action, report.Succeeded)
+}
+
+func bulkError(report BulkReport) error {
+	if report.Failed > 0 {
+		return fmt.Errorf("%w: %s", ErrBulkFailed, bulkMessage(report))
+	}
+	return nil
+}
+
+// bulkOperation runs an action on several VMs of a provider
+type bulkOperation struct {
+	server       *Server
+	params       BulkRequest
+	providerName string
+	provider     hvlib.VirtualizationProvider
+	token        *APIToken
+	owner        string          // Owner of the leases taken for the operation
+	known        map[string]bool // Names of the VMs of the provider
+	audit        *AuditEntry     // Entry of the request, copied for every VM
+}
+
+// run performs the action on the VMs, params.Parallelism at a time
+func (b *bulkOperation) run(ctx context.Context, vmNames []string, progress func(string)) BulkReport {
+	report := BulkReport{
+		Action:   b.params.Action,
+		Snapshot: b.params.Snapshot,
+		Results:  make([]BulkResult, len(vmNames)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	slots := make(chan struct{}, b.params.Parallelism)
+	for i, vmName := range vmNames {
+		wg.Add(1)
+		go func(i int, vmName string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result := b.runVM(ctx, vmName)
+			b.server.auditBulkResult(b.audit, b.params.Action, result)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Results[i] = result
+			if result.Error != "" {
+				report.Failed++
+			} else {
+				report.Succeeded++
+			}
+			done++
+			progress(fmt.Sprintf("%d of %d VMs done", done, len(vmNames)))
+		}(i, vmName)
+	}
+	wg.Wait()
+	return report
+}
+
+// runVM performs the action on a VM holding its lease and its lock
+func (b *bulkOperation) runVM(ctx context.Context, vmName string) BulkResult {
+	s := b.server
+	start := time.Now()
+	result := BulkResult{VM: vmName}
+	fail := func(status int, message string) BulkResult {
+		result.Status = status
+		result.Error = message
+		result.DurationMs = time.Since(start).Milliseconds()
+		return result
+	}
+
+	if !b.known[vmName] {
+		err := &hvlib.VmNotFoundError{VmName: vmName}
+		return fail(errorStatus(err), err.Error())
+	}
+	role := RoleOperator
+	if b.params.Action == hvlib.OpDeleteSnapshot {
+		role = RoleAdmin
+	}
+	if b.token != nil && !b.token.allows(role, b.providerName, vmName) {
+		return fail(http.StatusForbidden, fmt.Sprintf("Token %s is not allowed to %s VM %s", b.token.Name, b.params.Action, vmName))
+	}
+
+	if id, leased := b.params.Leases[vmName]; leased {
+		if err := s.Leases.Check(b.providerName, vmName, id, b.token.name()); err != nil {
+			return fail(errorStatus(err), err.Error())
+		}
+	} else {
+		// Outlives the action so that the VM isn't reclaimed while it times out
+		release, err := s.holdLease(b.providerName, vmName, b.owner, s.timeout(b.params.Action)+time.Minute)
+		if err != nil {
+			return fail(errorStatus(err), err.Error())
+		}
+		defer release()
+	}
+
+	if !s.TryAcquireLock(vmName) {
+		return fail(http.StatusConflict, "Another operation is in progress for this VM")
+	}
+	defer s.ReleaseLock(vmName)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout(b.params.Action))
+	defer cancel()
+	message, err := s.vmAction(ctx, b.providerName, b.provider, vmName, b.params.Action, b.params.Snapshot, func(string) {})
+	if err != nil {
+		return fail(errorStatus(err), err.Error())
+	}
+	result.Status = http.StatusOK
+	result.Message = message
+	result.DurationMs = time.Since(start).Milliseconds()
+	return result
+}
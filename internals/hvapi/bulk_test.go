@@ -0,0 +1,158 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func newBulkServer(t *testing.T) (*Server, *hvlib.FakeVP) {
+	t.Helper()
+	fake := &hvlib.FakeVP{}
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10-1\", \"win10-2\", \"win11\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(context.Background(), "fake", fake, loader); err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		Server:    &commons.Server{Logger: quietLogger()},
+		Providers: providers,
+		Leases:    NewLeaseStore(),
+	}, fake
+}
+
+// runBulk posts a bulk request authenticated by token and returns the
+// status and the report
+func runBulk(t *testing.T, s *Server, token *APIToken, body string) (int, BulkReport) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/fake/bulk", strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"provider": "fake"})
+	r = r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token))
+	w := httptest.NewRecorder()
+	s.BulkHandler(w, r)
+
+	var report BulkReport
+	if err := json.NewDecoder(w.Body).Decode(&commons.HttpResp{Data: &report}); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, report
+}
+
+func TestBulkScope(t *testing.T) {
+	s, fake := newBulkServer(t)
+	ci := &APIToken{Name: "ci", Role: RoleOperator, Providers: []string{"fake"}, VMs: []string{"win10-*"}}
+
+	status, report := runBulk(t, s, ci, `{"action": "start", "pattern": "win*"}`)
+	if status != http.StatusMultiStatus {
+		t.Fatalf("got status %d, expected 207", status)
+	}
+	if report.Succeeded != 2 || report.Failed != 1 || len(report.Results) != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	expected := []struct {
+		vm     string
+		status int
+		state  string
+	}{
+		{vm: "win10-1", status: http.StatusOK, state: "running"},
+		{vm: "win10-2", status: http.StatusOK, state: "running"},
+		{vm: "win11", status: http.StatusForbidden, state: "stopped"},
+	}
+	vms, err := fake.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]string{}
+	for _, vm := range vms {
+		states[vm.Name] = vm.State
+	}
+	for i, e := range expected {
+		result := report.Results[i]
+		if result.VM != e.vm || result.Status != e.status {
+			t.Errorf("got %+v, expected VM %s with status %d", result, e.vm, e.status)
+		}
+		if states[e.vm] != e.state {
+			t.Errorf("got VM %s %s, expected %s", e.vm, states[e.vm], e.state)
+		}
+	}
+	if report.Results[2].Error == "" {
+		t.Error("reason of the refusal not reported")
+	}
+	// The leases taken for the operation are released
+	if leases := s.Leases.List(); len(leases) != 0 {
+		t.Errorf("got leases %+v, expected none", leases)
+	}
+
+	// Deleting snapshots requires the admin role on every VM
+	status, report = runBulk(t, s, ci, `{"action": "delete_snapshot", "vms": ["win10-1"], "snapshot": "clean"}`)
+	if status != http.StatusMultiStatus || report.Failed != 1 || report.Results[0].Status != http.StatusForbidden {
+		t.Errorf("got status %d and report %+v, expected the VM refused", status, report)
+	}
+	admin := &APIToken{Name: "ops", Role: RoleAdmin}
+	status, report = runBulk(t, s, admin, `{"action": "delete_snapshot", "vms": ["win10-1"], "snapshot": "clean"}`)
+	if status != http.StatusOK || report.Succeeded != 1 {
+		t.Errorf("got status %d and report %+v, expected the snapshot deleted", status, report)
+	}
+}
+
+func TestBulkAggregation(t *testing.T) {
+	s, _ := newBulkServer(t)
+	admin := &APIToken{Name: "ops", Role: RoleAdmin}
+	held, err := s.Leases.Acquire("fake", "win10-2", "sbapi", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, err := s.Leases.Acquire("fake", "win11", "ops", "ops", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"action": "start", "vms": ["win10-1", "win10-2", "win11", "win12"], "parallelism": 2, "leases": {"win11": "` + mine.ID + `"}}`
+	status, report := runBulk(t, s, admin, body)
+	if status != http.StatusMultiStatus {
+		t.Fatalf("got status %d, expected 207", status)
+	}
+	expected := map[string]int{
+		"win10-1": http.StatusOK,
+		"win10-2": http.StatusConflict, // Leased by another owner
+		"win11":   http.StatusOK,       // With the lease of the caller
+		"win12":   http.StatusNotFound,
+	}
+	if report.Action != hvlib.OpStart || report.Succeeded != 2 || report.Failed != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	for _, result := range report.Results {
+		if result.Status != expected[result.VM] {
+			t.Errorf("got VM %s status %d, expected %d", result.VM, result.Status, expected[result.VM])
+		}
+		if failed := result.Status != http.StatusOK; failed != (result.Error != "") {
+			t.Errorf("got VM %s status %d with error %q", result.VM, result.Status, result.Error)
+		}
+	}
+	// The leases of the caller and of the other owner are kept
+	for _, id := range []string{held.ID, mine.ID} {
+		if _, exists := s.Leases.Get(id); !exists {
+			t.Errorf("lease %s released", id)
+		}
+	}
+
+	// The leases of the other tokens can't be used
+	status, report = runBulk(t, s, admin, `{"action": "start", "vms": ["win10-2"], "leases": {"win10-2": "`+held.ID+`"}}`)
+	if status != http.StatusMultiStatus || report.Results[0].Status != http.StatusForbidden {
+		t.Errorf("got status %d and report %+v, expected the lease refused", status, report)
+	}
+
+	// Every VM succeeded
+	status, report = runBulk(t, s, admin, `{"action": "stop", "pattern": "win10-1"}`)
+	if status != http.StatusOK || report.Succeeded != 1 || report.Failed != 0 {
+		t.Errorf("got status %d and report %+v, expected 200", status, report)
+	}
+}
@@ -0,0 +1,192 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CaptureStopRequest is the optional body of StopCaptureHandler
+type CaptureStopRequest struct {
+	S3Key string `json:"s3_key"` // Upload the capture to S3 under <api.s3.prefix>/<s3_key> instead of returning it
+}
+
+// StartCaptureHandler godoc
+// @Summary Start a packet capture of a virtual machine
+// @Description Record the network traffic of a virtual machine into a pcap file on the hypervisor host. Start the capture before the VM: VMware only applies it at power on.
+// @Tags capture
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/capture/start [post]
+func (s *Server) StartCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	capturer := s.getPacketCapturerFromRequest(w, r)
+	if capturer == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+
+	if !s.checkLease(w, r, vars["provider"], vmName) {
+		return
+	}
+
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return
+	}
+	defer s.ReleaseLock(vmName)
+
+	ctx, cancel := s.operationContext(r, hvlib.OpStartCapture)
+	defer cancel()
+
+	hostPath := filepath.Join(s.CaptureDir,
+		fmt.Sprintf("%s-%s-%s.pcap", vars["provider"], vmName, time.Now().Format("20060102-150405")))
+	start := time.Now()
+	err := capturer.StartCapture(ctx, vmName, hostPath)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpStartCapture, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("Packet capture of VM %s started", vmName),
+		nil)
+}
+
+// StopCaptureHandler godoc
+// @Summary Stop the packet capture of a virtual machine
+// @Description Stop the capture and return the pcap file, or upload it to the bucket configured in [api.s3] when an s3_key is given, under the configured prefix. The file is removed from the host.
+// @Tags capture
+// @Accept  json
+// @Produce  application/vnd.tcpdump.pcap
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param request body CaptureStopRequest false "S3 destination of the capture"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {file} binary
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/capture/stop [post]
+func (s *Server) StopCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	capturer := s.getPacketCapturerFromRequest(w, r)
+	if capturer == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+
+	var params CaptureStopRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		commons.WriteErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var key string
+	if params.S3Key != "" {
+		if s.Artifacts == nil {
+			commons.WriteErrorResponse(w, "S3 upload is not configured", http.StatusNotImplemented)
+			return
+		}
+		var err error
+		if key, err = s.Artifacts.Key(params.S3Key); err != nil {
+			commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	if !s.checkLease(w, r, vars["provider"], vmName) {
+		return
+	}
+
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return
+	}
+	defer s.ReleaseLock(vmName)
+
+	ctx, cancel := s.operationContext(r, hvlib.OpStopCapture)
+	defer cancel()
+
+	start := time.Now()
+	hostPath, err := capturer.StopCapture(ctx, vmName)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpStopCapture, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer func() {
+		// VMware keeps the file open while the VM runs
+		if err := os.Remove(hostPath); err != nil {
+			s.Logger.WithError(err).Warnf("Failed to remove capture %s", hostPath)
+		}
+	}()
+
+	if key != "" {
+		if err := s.Artifacts.Upload(r.Context(), key, hostPath); err != nil {
+			commons.WriteErrorResponse(w, fmt.Sprintf("Failed to upload %s: %v", key, err), http.StatusInternalServerError)
+			return
+		}
+		commons.WriteSuccessResponse(w,
+			fmt.Sprintf("Packet capture of VM %s uploaded", vmName),
+			key)
+		return
+	}
+
+	file, err := os.Open(hostPath)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(hostPath)))
+	if _, err := io.Copy(w, file); err != nil {
+		s.Logger.WithError(err).Errorf("Failed to send capture of VM %s", vmName)
+	}
+}
+
+// getPacketCapturerFromRequest returns the provider of the request when it
+// supports packet captures, otherwise the error response is written
+func (s *Server) getPacketCapturerFromRequest(w http.ResponseWriter, r *http.Request) hvlib.PacketCapturer {
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return nil
+	}
+	capturer, ok := provider.(hvlib.PacketCapturer)
+	if !ok || !hvlib.HasCapability(provider, hvlib.CapPacketCapture) {
+		commons.WriteErrorResponse(w, "Packet capture is not supported by this provider", http.StatusNotImplemented)
+		return nil
+	}
+	return capturer
+}
@@ -0,0 +1,84 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// keepAliveInterval is the delay between two SSE comments sent to keep an
+// idle stream open through proxies
+const keepAliveInterval = 30 * time.Second
+
+// EventsHandler godoc
+// @Summary Stream the VM events
+// @Description Server-Sent Events stream of the power state changes (including the ones made outside hvapi, detected by the state watcher), snapshot operations, reverts and lock acquisitions/releases. Each event is sent with its type as SSE event name and the Event as JSON data. A client reconnecting with the Last-Event-ID header receives the recent events it missed.
+// @Tags events
+// @Produce  text/event-stream
+// @Param provider query string false "Only the events of this provider, lock events have no provider"
+// @Param vm query string false "Only the events of this VM"
+// @Success 200 {object} Event
+// @Failure 400 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /events [get]
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || s.Events == nil {
+		commons.WriteErrorResponse(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(value, 10, 64); err != nil {
+			commons.WriteErrorResponse(w, "Invalid Last-Event-ID header", http.StatusBadRequest)
+			return
+		}
+	}
+	providerName := r.URL.Query().Get("provider")
+	vmName := r.URL.Query().Get("vm")
+
+	events, unsubscribe := s.Events.Subscribe(lastID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Disconnected for falling behind
+				return
+			}
+			if (providerName != "" && event.Provider != providerName) || (vmName != "" && event.VM != vmName) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				s.Logger.WithError(err).Error("Failed to encode event")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,219 @@
+package hvapi
+
+import (
+	"TraceForge/pkg/hvlib"
+	"context"
+	"sync"
+	"time"
+)
+
+// Types of Event
+const (
+	EventState            = "state" // Power state change, made by hvapi or out-of-band
+	EventSnapshotTaken    = "snapshot_taken"
+	EventSnapshotDeleted  = "snapshot_deleted"
+	EventReverted         = "reverted"
+	EventLockAcquired     = "lock_acquired"
+	EventLockReleased     = "lock_released"
+	EventLeaseAcquired    = "lease_acquired"
+	EventLeaseReleased    = "lease_released"
+	EventLeaseExpired     = "lease_expired"     // The VM is then reclaimed
+	EventBaselinePromoted = "baseline_promoted" // A golden image became the baseline of the VM
+)
+
+// eventHistory is the number of events kept to replay them to the clients
+// reconnecting with Last-Event-ID
+const eventHistory = 256
+
+// subscriberBuffer is the number of events queued for a subscriber, a
+// subscriber falling further behind is disconnected
+const subscriberBuffer = 64
+
+// Event is a change of a VM published to the subscribers of GET /events
+type Event struct {
+	ID            uint64    `json:"id"`
+	Type          string    `json:"type"`
+	Provider      string    `json:"provider,omitempty"` // Empty for lock events, the locks are by VM name
+	VM            string    `json:"vm"`
+	State         string    `json:"state,omitempty"`
+	PreviousState string    `json:"previous_state,omitempty"` // Empty for a VM discovered after startup
+	Snapshot      string    `json:"snapshot,omitempty"`
+	Owner         string    `json:"owner,omitempty"` // Owner of the lease of lease events
+	Time          time.Time `json:"time"`
+}
+
+// EventBus dispatches the events to the subscribers and keeps the last
+// known power state of the VMs to detect state changes. A nil EventBus
+// drops the events.
+type EventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	history     []Event
+	subscribers map[chan Event]struct{}
+
+	checkMu sync.Mutex                   // Serializes CheckStates
+	states  map[string]map[string]string // Power state by provider then VM name, written under both locks
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+		states:      make(map[string]map[string]string),
+	}
+}
+
+// Publish assigns an ID to the event and sends it to the subscribers
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	event.ID = b.nextID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.history = append(b.history, event)
+	if len(b.history) > eventHistory {
+		b.history = b.history[len(b.history)-eventHistory:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Too slow, it can reconnect and replay from its last event
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published after the
+// event lastID, with the ones still in the history, and a function
+// unsubscribing it. The channel is closed when the subscriber falls behind.
+func (b *EventBus) Subscribe(lastID uint64) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var missed []Event
+	if lastID > 0 {
+		for _, event := range b.history {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	ch := make(chan Event, subscriberBuffer+len(missed))
+	for _, event := range missed {
+		ch <- event
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, exists := b.subscribers[ch]; exists {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// CheckStates lists the VMs of the provider and publishes an EventState for
+// each VM whose power state changed since the previous check. The first
+// check of a provider only records the states.
+func (b *EventBus) CheckStates(ctx context.Context, providerName string, provider hvlib.VirtualizationProvider) error {
+	if b == nil {
+		return nil
+	}
+	b.checkMu.Lock()
+	defer b.checkMu.Unlock()
+
+	vms, err := provider.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	previous, known := b.states[providerName]
+	states := make(map[string]string, len(vms))
+	for _, vm := range vms {
+		states[vm.Name] = vm.State
+		if known && previous[vm.Name] != vm.State {
+			b.Publish(Event{
+				Type:          EventState,
+				Provider:      providerName,
+				VM:            vm.Name,
+				State:         vm.State,
+				PreviousState: previous[vm.Name],
+			})
+		}
+	}
+	b.mu.Lock()
+	b.states[providerName] = states
+	b.mu.Unlock()
+	return nil
+}
+
+// States returns the power states seen by the last check of every
+// provider, by provider then VM name
+func (b *EventBus) States() map[string]map[string]string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	states := make(map[string]map[string]string, len(b.states))
+	for providerName, vms := range b.states {
+		states[providerName] = make(map[string]string, len(vms))
+		for vmName, state := range vms {
+			states[providerName][vmName] = state
+		}
+	}
+	return states
+}
+
+// StartStateWatcher checks the power state of the VMs of every loaded
+// provider at the given interval until ctx ends, to report the changes made
+// outside hvapi (a VM powered off from the hypervisor GUI...)
+func (s *Server) StartStateWatcher(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, name := range s.Providers.Names() {
+				if !s.Providers.Health(name).Loaded {
+					continue
+				}
+				s.checkStates(ctx, name)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// checkStates publishes the power state changes of the VMs of a provider,
+// it is called by the state watcher and after the operations changing the
+// state of a VM
+func (s *Server) checkStates(ctx context.Context, providerName string) {
+	provider := s.Providers.GetProvider(providerName)
+	if provider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout(hvlib.OpList))
+	defer cancel()
+	start := time.Now()
+	err := s.Events.CheckStates(ctx, providerName, provider)
+	s.Metrics.ObserveOperation(providerName, hvlib.OpList, start, err)
+	if err != nil {
+		s.Logger.WithError(err).Warnf("Failed to check the state of the %s VMs", providerName)
+	}
+}
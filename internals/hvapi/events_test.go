@@ -0,0 +1,251 @@
+package hvapi
+
+import (
+	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+// receive returns the events queued in ch and whether ch is closed
+func receive(ch <-chan Event) ([]Event, bool) {
+	var events []Event
+	for {
+		select {
+		case event, open := <-ch:
+			if !open {
+				return events, true
+			}
+			events = append(events, event)
+		default:
+			return events, false
+		}
+	}
+}
+
+func TestEventBusPublish(t *testing.T) {
+	sent := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		events   int
+		expected []uint64 // IDs of the events in the history
+	}{
+		{name: "none"},
+		{name: "one", events: 1, expected: []uint64{1}},
+		{name: "full history", events: eventHistory},
+		{name: "history trimmed", events: eventHistory + 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewEventBus()
+			ch, unsubscribe := bus.Subscribe(0)
+			defer unsubscribe()
+			for i := 0; i < tt.events; i++ {
+				event := Event{Type: EventState, Provider: "fake", VM: "win10"}
+				if i == 0 {
+					event.Time = sent
+				}
+				bus.Publish(event)
+				// Drained as a subscriber keeping up
+				if received, closed := receive(ch); closed || len(received) != 1 || received[0].ID != uint64(i+1) {
+					t.Fatalf("got %+v and closed %v, expected event %d", received, closed, i+1)
+				}
+			}
+
+			first := uint64(1)
+			if tt.events > eventHistory {
+				first = uint64(tt.events - eventHistory + 1)
+			}
+			if len(bus.history) != min(tt.events, eventHistory) {
+				t.Fatalf("got %d events in the history, expected %d", len(bus.history), min(tt.events, eventHistory))
+			}
+			for i, event := range bus.history {
+				if event.ID != first+uint64(i) {
+					t.Errorf("got event %d at %d, expected %d", event.ID, i, first+uint64(i))
+				}
+				if event.Time.IsZero() {
+					t.Errorf("time of event %d not set", event.ID)
+				}
+			}
+			if tt.events > 0 && tt.events <= eventHistory && !bus.history[0].Time.Equal(sent) {
+				t.Errorf("got time %v, expected the time of the publisher kept", bus.history[0].Time)
+			}
+		})
+	}
+
+	// A nil bus drops the events
+	var bus *EventBus
+	bus.Publish(Event{Type: EventState})
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	tests := []struct {
+		name     string
+		events   int
+		closed   bool
+		received int
+	}{
+		{name: "buffered", events: subscriberBuffer, received: subscriberBuffer},
+		{name: "behind", events: subscriberBuffer + 1, closed: true, received: subscriberBuffer},
+		{name: "far behind", events: 2 * subscriberBuffer, closed: true, received: subscriberBuffer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewEventBus()
+			slow, unsubscribeSlow := bus.Subscribe(0)
+			fast, unsubscribeFast := bus.Subscribe(0)
+			defer unsubscribeFast()
+
+			for i := 0; i < tt.events; i++ {
+				bus.Publish(Event{Type: EventLockAcquired, VM: "win10"})
+				if _, closed := receive(fast); closed {
+					t.Fatal("subscriber keeping up disconnected")
+				}
+			}
+
+			received, closed := receive(slow)
+			if closed != tt.closed || len(received) != tt.received {
+				t.Errorf("got %d events and closed %v, expected %d and %v", len(received), closed, tt.received, tt.closed)
+			}
+			if len(bus.subscribers) != map[bool]int{true: 1, false: 2}[tt.closed] {
+				t.Errorf("got %d subscribers", len(bus.subscribers))
+			}
+			// Unsubscribing a disconnected subscriber doesn't close it again
+			unsubscribeSlow()
+			unsubscribeSlow()
+		})
+	}
+}
+
+func TestEventBusReplay(t *testing.T) {
+	const published = eventHistory + 10
+	tests := []struct {
+		name   string
+		lastID uint64
+		first  uint64 // IDs of the replayed events, from first to the last published, none when 0
+	}{
+		{name: "new subscriber", lastID: 0},
+		{name: "up to date", lastID: published},
+		{name: "missed events", lastID: published - 3, first: published - 2},
+		{name: "unknown future event", lastID: 1000},
+		// What is left of the history is replayed
+		{name: "missed events out of the history", lastID: 5, first: published - eventHistory + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewEventBus()
+			for i := 0; i < published; i++ {
+				bus.Publish(Event{Type: EventState, VM: "win10"})
+			}
+
+			ch, unsubscribe := bus.Subscribe(tt.lastID)
+			defer unsubscribe()
+			received, closed := receive(ch)
+			if closed {
+				t.Fatal("subscriber disconnected")
+			}
+			expected := 0
+			if tt.first > 0 {
+				expected = int(published - tt.first + 1)
+			}
+			if len(received) != expected {
+				t.Fatalf("got %d events, expected %d", len(received), expected)
+			}
+			for i, event := range received {
+				if event.ID != tt.first+uint64(i) {
+					t.Errorf("got event %d at %d, expected %d", event.ID, i, tt.first+uint64(i))
+				}
+			}
+
+			// Followed by the new events
+			bus.Publish(Event{Type: EventState, VM: "win11"})
+			if received, _ := receive(ch); len(received) != 1 || received[0].ID != published+1 {
+				t.Errorf("got %+v, expected the new event", received)
+			}
+		})
+	}
+}
+
+func TestCheckStates(t *testing.T) {
+	ctx := context.Background()
+	fake := &hvlib.FakeVP{}
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\", \"win11\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(ctx, "fake", fake, loader); err != nil {
+		t.Fatal(err)
+	}
+	bus := NewEventBus()
+	ch, unsubscribe := bus.Subscribe(0)
+	defer unsubscribe()
+
+	tests := []struct {
+		name     string
+		change   func() error
+		err      bool
+		expected []Event // Sorted by VM name
+	}{
+		{name: "first check", change: func() error { return nil }},
+		{name: "unchanged", change: func() error { return nil }},
+		{name: "started", change: func() error { return fake.Start(ctx, "win10") }, expected: []Event{
+			{VM: "win10", State: "running", PreviousState: "stopped"},
+		}},
+		{name: "both changed", change: func() error {
+			if err := fake.Suspend(ctx, "win10"); err != nil {
+				return err
+			}
+			return fake.Start(ctx, "win11")
+		}, expected: []Event{
+			{VM: "win10", State: "suspended", PreviousState: "running"},
+			{VM: "win11", State: "running", PreviousState: "stopped"},
+		}},
+		{name: "list failure", change: func() error {
+			fake.InjectFailure(hvlib.OpList, errors.New("hypervisor unreachable"))
+			return fake.Stop(ctx, "win11", true)
+		}, err: true},
+		{name: "changed during the failure", change: func() error { return nil }, expected: []Event{
+			{VM: "win11", State: "stopped", PreviousState: "running"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); err != nil {
+				t.Fatal(err)
+			}
+			if err := bus.CheckStates(ctx, "fake", fake); (err != nil) != tt.err {
+				t.Fatalf("got error %v, expected error %v", err, tt.err)
+			}
+
+			received, _ := receive(ch)
+			sort.Slice(received, func(i, j int) bool { return received[i].VM < received[j].VM })
+			if len(received) != len(tt.expected) {
+				t.Fatalf("got events %+v, expected %+v", received, tt.expected)
+			}
+			for i, e := range tt.expected {
+				got := received[i]
+				if got.Type != EventState || got.Provider != "fake" || got.VM != e.VM || got.State != e.State || got.PreviousState != e.PreviousState {
+					t.Errorf("got %+v, expected %+v", got, e)
+				}
+			}
+		})
+	}
+
+	expected := map[string]string{"win10": "suspended", "win11": "stopped"}
+	states := bus.States()["fake"]
+	for vm, state := range expected {
+		if states[vm] != state {
+			t.Errorf("got VM %s %s, expected %s", vm, states[vm], state)
+		}
+	}
+
+	// A nil bus checks nothing
+	var nilBus *EventBus
+	if err := nilBus.CheckStates(ctx, "fake", fake); err != nil || nilBus.States() != nil {
+		t.Errorf("got %v, expected nothing checked", err)
+	}
+}
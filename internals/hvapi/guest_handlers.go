@@ -0,0 +1,300 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GuestRunRequest is the body of RunInGuestHandler
+type GuestRunRequest struct {
+	Program string   `json:"program"`
+	Args    []string `json:"args"`
+	Wait    bool     `json:"wait"`
+}
+
+// GuestRunResult is returned by RunInGuestHandler, ExitCode is only
+// meaningful when the request waited for the program
+type GuestRunResult struct {
+	ExitCode int `json:"exit_code"`
+}
+
+// ListGuestProcessesHandler godoc
+// @Summary List the processes running inside a virtual machine
+// @Description List the guest processes through the hypervisor, without relying on the in-guest agent
+// @Tags guest
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/guest/processes [get]
+func (s *Server) ListGuestProcessesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	guest := s.getGuestOperationsFromRequest(w, r)
+	if guest == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+
+	ctx, cancel := s.operationContext(r, hvlib.OpListGuestProcesses)
+	defer cancel()
+
+	start := time.Now()
+	processes, err := guest.ListProcessesInGuest(ctx, vmName)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpListGuestProcesses, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	commons.WriteSuccessResponse(w, "", processes)
+}
+
+// RunInGuestHandler godoc
+// @Summary Run a program inside a virtual machine
+// @Description Start a program in the guest with the configured guest credentials, optionally waiting for its exit code
+// @Tags guest
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param request body GuestRunRequest true "Program to run"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/guest/run [post]
+func (s *Server) RunInGuestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	guest := s.getGuestOperationsFromRequest(w, r)
+	if guest == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+
+	var params GuestRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Program == "" {
+		commons.WriteErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !s.checkLease(w, r, vars["provider"], vmName) {
+		return
+	}
+
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return
+	}
+	defer s.ReleaseLock(vmName)
+
+	ctx, cancel := s.operationContext(r, hvlib.OpRunInGuest)
+	defer cancel()
+
+	start := time.Now()
+	exitCode, err := guest.RunProgramInGuest(ctx, vmName, params.Program, params.Args, params.Wait)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpRunInGuest, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("%s started in VM %s", params.Program, vmName),
+		GuestRunResult{ExitCode: exitCode})
+}
+
+// CopyFileToGuestHandler godoc
+// @Summary Copy a file into a virtual machine
+// @Description Write the request body to the given path inside the guest
+// @Tags guest
+// @Accept  octet-stream
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param path query string true "Destination path in the guest"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/guest/file [put]
+func (s *Server) CopyFileToGuestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	guest := s.getGuestOperationsFromRequest(w, r)
+	if guest == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+	guestPath := r.URL.Query().Get("path")
+	if guestPath == "" {
+		commons.WriteErrorResponse(w, "Missing path parameter", http.StatusBadRequest)
+		return
+	}
+
+	// The hypervisor tools copy from a file on the host
+	tmpFile, err := os.CreateTemp("", "hvapi-guest-*")
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = io.Copy(tmpFile, r.Body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		commons.WriteErrorResponse(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !s.checkLease(w, r, vars["provider"], vmName) {
+		return
+	}
+
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return
+	}
+	defer s.ReleaseLock(vmName)
+
+	ctx, cancel := s.operationContext(r, hvlib.OpCopyToGuest)
+	defer cancel()
+
+	start := time.Now()
+	err = guest.CopyFileToGuest(ctx, vmName, tmpFile.Name(), guestPath)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpCopyToGuest, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("File copied to %s in VM %s", guestPath, vmName),
+		nil)
+}
+
+// CopyFileFromGuestHandler godoc
+// @Summary Copy a file out of a virtual machine
+// @Description Download a file from the given path inside the guest
+// @Tags guest
+// @Produce  octet-stream
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param path query string true "Source path in the guest"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {file} binary
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/guest/file [get]
+func (s *Server) CopyFileFromGuestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	guest := s.getGuestOperationsFromRequest(w, r)
+	if guest == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+	guestPath := r.URL.Query().Get("path")
+	if guestPath == "" {
+		commons.WriteErrorResponse(w, "Missing path parameter", http.StatusBadRequest)
+		return
+	}
+
+	if !s.checkLease(w, r, vars["provider"], vmName) {
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "hvapi-guest-*")
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	hostPath := filepath.Join(tmpDir, "file")
+
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return
+	}
+	defer s.ReleaseLock(vmName)
+
+	ctx, cancel := s.operationContext(r, hvlib.OpCopyFromGuest)
+	defer cancel()
+
+	start := time.Now()
+	err = guest.CopyFileFromGuest(ctx, vmName, guestPath, hostPath)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpCopyFromGuest, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	file, err := os.Open(hostPath)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	// Guest paths may use either separator whatever the host OS
+	fileName := guestPath[strings.LastIndexAny(guestPath, `/\`)+1:]
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	if _, err := io.Copy(w, file); err != nil {
+		s.Logger.WithError(err).Error("Failed to send guest file")
+	}
+}
+
+// getGuestOperationsFromRequest returns the provider of the request if it
+// supports guest operations, 501 is returned otherwise
+func (s *Server) getGuestOperationsFromRequest(w http.ResponseWriter, r *http.Request) hvlib.GuestOperations {
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return nil
+	}
+
+	guest, ok := provider.(hvlib.GuestOperations)
+	if !ok || !hvlib.HasCapability(provider, hvlib.CapGuestOperations) {
+		commons.WriteErrorResponse(w, "Guest operations are not supported by this provider", http.StatusNotImplemented)
+		return nil
+	}
+	return guest
+}
@@ -0,0 +1,80 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCopyFileFromGuestLease(t *testing.T) {
+	ctx := context.Background()
+	fake := &hvlib.FakeVP{}
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\", \"win11\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(ctx, "fake", fake, loader); err != nil {
+		t.Fatal(err)
+	}
+	hostPath := filepath.Join(t.TempDir(), "report.json")
+	if err := os.WriteFile(hostPath, []byte(`{"verdict": "clean"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Start(ctx, "win10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.CopyFileToGuest(ctx, "win10", hostPath, "C:/report.json"); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Server:    &commons.Server{Logger: quietLogger()},
+		Providers: providers,
+		Leases:    NewLeaseStore(),
+	}
+	lease, err := s.Leases.Acquire("fake", "win10", "sbapi", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Leases.Acquire("fake", "win11", "sbapi", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		leaseID  string
+		expected int
+	}{
+		{name: "without lease", expected: http.StatusConflict},
+		{name: "lease of another VM", leaseID: other.ID, expected: http.StatusPreconditionRequired},
+		{name: "unknown lease", leaseID: "unknown", expected: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/fake/win10/guest/file?path=C:/report.json", nil)
+		r = mux.SetURLVars(r, map[string]string{"provider": "fake", "vmname": "win10"})
+		if tt.leaseID != "" {
+			r.Header.Set(LeaseHeader, tt.leaseID)
+		}
+		w := httptest.NewRecorder()
+		s.CopyFileFromGuestHandler(w, r)
+		if w.Code != tt.expected {
+			t.Errorf("%s: got status %d, expected %d", tt.name, w.Code, tt.expected)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/fake/win10/guest/file?path=C:/report.json", nil)
+	r = mux.SetURLVars(r, map[string]string{"provider": "fake", "vmname": "win10"})
+	r.Header.Set(LeaseHeader, lease.ID)
+	w := httptest.NewRecorder()
+	s.CopyFileFromGuestHandler(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{"verdict": "clean"}` {
+		t.Errorf("got status %d and %q, expected the file downloaded with the lease of the VM", w.Code, w.Body)
+	}
+}
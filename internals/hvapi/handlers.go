@@ -3,15 +3,25 @@ package hvapi
 import (
 	"TraceForge/internals/commons"
 	"TraceForge/pkg/hvlib"
+	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// ProviderInfo describes what a provider supports
+type ProviderInfo struct {
+	Name         string         `json:"name"`
+	Version      string         `json:"version,omitempty"` // Empty when the hypervisor can't be reached
+	Capabilities []string       `json:"capabilities"`
+	Health       ProviderHealth `json:"health"`
+}
+
 // ListProvidersHandler godoc
 // @Summary List available providers
-// @Description Get a list of available virtualization providers
+// @Description Get the available virtualization providers with their hypervisor version, health and capabilities (snapshots, suspend, guest_operations, packet_capture, clone...). The operations of a missing capability answer 501.
 // @Tags providers
 // @Accept  json
 // @Produce  json
@@ -20,11 +30,81 @@ import (
 // @Security ApiKeyAuth
 // @Router /providers [get]
 func (s *Server) ListProvidersHandler(w http.ResponseWriter, r *http.Request) {
-	providerNames := make([]string, 0, len(s.Providers.Providers))
-	for name := range s.Providers.Providers {
-		providerNames = append(providerNames, name)
+	names := s.Providers.Names()
+	providers := make([]ProviderInfo, 0, len(names))
+	for _, name := range names {
+		provider := s.Providers.GetProvider(name)
+		info := ProviderInfo{
+			Name:         name,
+			Capabilities: provider.Capabilities(),
+			Health:       s.Providers.Health(name),
+		}
+
+		if info.Health.Loaded {
+			ctx, cancel := s.operationContext(r, hvlib.OpVersion)
+			start := time.Now()
+			version, err := provider.Version(ctx)
+			s.Metrics.ObserveOperation(name, hvlib.OpVersion, start, err)
+			cancel()
+			if err != nil {
+				s.Logger.WithError(err).Warnf("Failed to get %s version", name)
+			}
+			info.Version = version
+		}
+		providers = append(providers, info)
 	}
-	commons.WriteSuccessResponse(w, "", providerNames)
+	commons.WriteSuccessResponse(w, "", providers)
+}
+
+// ProviderHealthHandler godoc
+// @Summary Get the health of a provider
+// @Description Get the result of the last load of the VMs of a provider. A provider which failed to load answers 503 until a reload succeeds.
+// @Tags providers
+// @Produce  json
+// @Param name path string true "Provider name"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /providers/{name} [get]
+func (s *Server) ProviderHealthHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if s.Providers.GetProvider(name) == nil {
+		commons.WriteErrorResponse(w, "Provider not found", http.StatusNotFound)
+		return
+	}
+	commons.WriteSuccessResponse(w, "", s.Providers.Health(name))
+}
+
+// ReloadProviderHandler godoc
+// @Summary Reload the VMs of a provider
+// @Description Discover the VMs registered or deleted since the provider was loaded, without restarting hvapi. A provider which failed to load is loaded again. The operations in progress are not affected.
+// @Tags providers
+// @Produce  json
+// @Param name path string true "Provider name"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /providers/{name}/reload [post]
+func (s *Server) ReloadProviderHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if s.Providers.GetProvider(name) == nil {
+		commons.WriteErrorResponse(w, "Provider not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := s.operationContext(r, hvlib.OpLoadVMs)
+	defer cancel()
+
+	start := time.Now()
+	_, err := s.Providers.Reload(ctx, name)
+	s.Metrics.ObserveOperation(name, hvlib.OpLoadVMs, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, fmt.Sprintf("Failed to reload %s: %v", name, err), errorStatus(err))
+		return
+	}
+	commons.WriteSuccessResponse(w, fmt.Sprintf("Provider %s reloaded", name), s.Providers.Health(name))
 }
 
 // ListVMsHandler godoc
@@ -38,6 +118,7 @@ func (s *Server) ListProvidersHandler(w http.ResponseWriter, r *http.Request) {
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
 // @Security ApiKeyAuth
 // @Router /{provider} [get]
 func (s *Server) ListVMsHandler(w http.ResponseWriter, r *http.Request) {
@@ -46,9 +127,14 @@ func (s *Server) ListVMsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vms, err := provider.List()
+	ctx, cancel := s.operationContext(r, hvlib.OpList)
+	defer cancel()
+
+	start := time.Now()
+	vms, err := provider.List(ctx)
+	s.Metrics.ObserveOperation(mux.Vars(r)["provider"], hvlib.OpList, start, err)
 	if err != nil {
-		commons.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
 		return
 	}
 	commons.WriteSuccessResponse(w, "", vms)
@@ -66,6 +152,7 @@ func (s *Server) ListVMsHandler(w http.ResponseWriter, r *http.Request) {
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/snapshots [get]
 func (s *Server) SnapshotsVMHandler(w http.ResponseWriter, r *http.Request) {
@@ -77,18 +164,56 @@ func (s *Server) SnapshotsVMHandler(w http.ResponseWriter, r *http.Request) {
 
 	vmName := vars["vmname"]
 
-	snapshots, err := provider.ListSnapshots(vmName)
+	ctx, cancel := s.operationContext(r, hvlib.OpListSnapshots)
+	defer cancel()
+
+	start := time.Now()
+	snapshots, err := provider.ListSnapshots(ctx, vmName)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpListSnapshots, start, err)
 	if err != nil {
-		httpStatus := http.StatusInternalServerError
-		if _, ok := err.(*hvlib.VmNotFoundError); ok {
-			httpStatus = http.StatusNotFound
-		}
-		commons.WriteErrorResponse(w, err.Error(), httpStatus)
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
 		return
 	}
 	commons.WriteSuccessResponse(w, "", snapshots)
 }
 
+// SnapshotTreeVMHandler godoc
+// @Summary Get the snapshot tree of a virtual machine
+// @Description Get the snapshots of a specific virtual machine arranged by parent, with the current snapshot flagged
+// @Tags snapshots
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/snapshots/tree [get]
+func (s *Server) SnapshotTreeVMHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+
+	ctx, cancel := s.operationContext(r, hvlib.OpListSnapshots)
+	defer cancel()
+
+	start := time.Now()
+	snapshots, err := provider.ListSnapshots(ctx, vmName)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpListSnapshots, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	commons.WriteSuccessResponse(w, "", hvlib.BuildSnapshotTree(snapshots))
+}
+
 // StartVMHandler godoc
 // @Summary Start a virtual machine
 // @Description Start a specific virtual machine
@@ -97,15 +222,20 @@ func (s *Server) SnapshotsVMHandler(w http.ResponseWriter, r *http.Request) {
 // @Produce  json
 // @Param provider path string true "Provider name"
 // @Param vmname path string true "Virtual Machine name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
 // @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 409 {object} commons.HttpResp // Conflict
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/start [get]
 func (s *Server) StartVMHandler(w http.ResponseWriter, r *http.Request) {
-	s.basicVMActionHandler(w, r, "start")
+	s.basicVMActionHandler(w, r, hvlib.OpStart)
 }
 
 // StopVMHandler godoc
@@ -116,15 +246,20 @@ func (s *Server) StartVMHandler(w http.ResponseWriter, r *http.Request) {
 // @Produce  json
 // @Param provider path string true "Provider name"
 // @Param vmname path string true "Virtual Machine name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
 // @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 409 {object} commons.HttpResp // Conflict
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/stop [get]
 func (s *Server) StopVMHandler(w http.ResponseWriter, r *http.Request) {
-	s.basicVMActionHandler(w, r, "stop")
+	s.basicVMActionHandler(w, r, hvlib.OpStop)
 }
 
 // SuspendVMHandler godoc
@@ -135,34 +270,84 @@ func (s *Server) StopVMHandler(w http.ResponseWriter, r *http.Request) {
 // @Produce  json
 // @Param provider path string true "Provider name"
 // @Param vmname path string true "Virtual Machine name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
 // @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 409 {object} commons.HttpResp // Conflict
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/suspend [get]
 func (s *Server) SuspendVMHandler(w http.ResponseWriter, r *http.Request) {
-	s.basicVMActionHandler(w, r, "suspend")
+	s.basicVMActionHandler(w, r, hvlib.OpSuspend)
 }
 
 // RevertVMHandler godoc
 // @Summary Revert a virtual machine
-// @Description Revert a specific virtual machine
+// @Description Revert a specific virtual machine to its baseline snapshot when configured, to its current snapshot otherwise
 // @Tags vms
 // @Accept  json
 // @Produce  json
 // @Param provider path string true "Provider name"
 // @Param vmname path string true "Virtual Machine name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
 // @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 409 {object} commons.HttpResp // Conflict
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/revert [get]
 func (s *Server) RevertVMHandler(w http.ResponseWriter, r *http.Request) {
-	s.basicVMActionHandler(w, r, "revert")
+	s.basicVMActionHandler(w, r, hvlib.OpRevert)
+}
+
+// RevertToSnapshotHandler godoc
+// @Summary Revert a virtual machine to a snapshot
+// @Description Revert a specific virtual machine to the named snapshot, after checking the snapshot exists
+// @Tags snapshots
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param snapshotname path string true "Snapshot name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/revert/{snapshotname} [get]
+func (s *Server) RevertToSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+	snapshotName := vars["snapshotname"]
+
+	if !s.checkLease(w, r, vars["provider"], vmName) {
+		return
+	}
+
+	s.runVMOperation(w, r, hvlib.OpRevert, vars["provider"], vmName, func(ctx context.Context, progress func(string)) (string, error) {
+		return s.vmAction(ctx, vars["provider"], provider, vmName, hvlib.OpRevert, snapshotName, progress)
+	})
 }
 
 // ResetVMHandler godoc
@@ -173,15 +358,64 @@ func (s *Server) RevertVMHandler(w http.ResponseWriter, r *http.Request) {
 // @Produce  json
 // @Param provider path string true "Provider name"
 // @Param vmname path string true "Virtual Machine name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
 // @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 409 {object} commons.HttpResp // Conflict
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/reset [get]
 func (s *Server) ResetVMHandler(w http.ResponseWriter, r *http.Request) {
-	s.basicVMActionHandler(w, r, "reset")
+	s.basicVMActionHandler(w, r, hvlib.OpReset)
+}
+
+// CaptureScreenHandler godoc
+// @Summary Capture the screen of a virtual machine
+// @Description Get a PNG image of the current display of a running virtual machine
+// @Tags vms
+// @Produce  png
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Success 200 {file} binary
+// @Failure 404 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/screenshot [get]
+func (s *Server) CaptureScreenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return
+	}
+
+	capturer, ok := provider.(hvlib.ScreenCapturer)
+	if !ok || !hvlib.HasCapability(provider, hvlib.CapScreenCapture) {
+		commons.WriteErrorResponse(w, "Screen capture is not supported by this provider", http.StatusNotImplemented)
+		return
+	}
+
+	vmName := vars["vmname"]
+
+	ctx, cancel := s.operationContext(r, hvlib.OpCaptureScreen)
+	defer cancel()
+
+	start := time.Now()
+	image, err := capturer.CaptureScreen(ctx, vmName)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpCaptureScreen, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(image)
 }
 
 // TakeSnapshotHandler godoc
@@ -193,11 +427,16 @@ func (s *Server) ResetVMHandler(w http.ResponseWriter, r *http.Request) {
 // @Param provider path string true "Provider name"
 // @Param vmname path string true "Virtual Machine name"
 // @Param snapshotname path string true "Snapshot name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
 // @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 409 {object} commons.HttpResp // Conflict
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/snapshot/{snapshotname} [get]
 func (s *Server) TakeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
@@ -210,27 +449,13 @@ func (s *Server) TakeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vmName := vars["vmname"]
 	snapshotName := vars["snapshotname"]
 
-	// Acquire the lock for this VM
-	if !s.TryAcquireLock(vmName) {
-		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
-		return
-	}
-	defer s.ReleaseLock(vmName) // Ensure the lock is released
-
-	err := provider.TakeSnapshot(vmName, snapshotName)
-	if err != nil {
-		httpStatus := http.StatusInternalServerError
-		if _, ok := err.(*hvlib.VmNotFoundError); ok {
-			httpStatus = http.StatusNotFound
-		}
-		commons.WriteErrorResponse(w, err.Error(), httpStatus)
+	if !s.checkLease(w, r, vars["provider"], vmName) {
 		return
 	}
 
-	commons.WriteSuccessResponse(w,
-		fmt.Sprintf("Snapshot %s taken for VM %s",
-			snapshotName, vmName),
-		nil)
+	s.runVMOperation(w, r, hvlib.OpTakeSnapshot, vars["provider"], vmName, func(ctx context.Context, progress func(string)) (string, error) {
+		return s.vmAction(ctx, vars["provider"], provider, vmName, hvlib.OpTakeSnapshot, snapshotName, progress)
+	})
 }
 
 // DeleteSnapshotHandler godoc
@@ -242,11 +467,16 @@ func (s *Server) TakeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 // @Param provider path string true "Provider name"
 // @Param vmname path string true "Virtual Machine name"
 // @Param snapshotname path string true "Snapshot name"
+// @Param async query bool false "Run in the background and answer 202 with the operation to poll at /operations/{id}"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
 // @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
 // @Failure 400 {object} commons.HttpResp
 // @Failure 404 {object} commons.HttpResp
 // @Failure 409 {object} commons.HttpResp // Conflict
 // @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
 // @Security ApiKeyAuth
 // @Router /{provider}/{vmname}/snapshot/{snapshotname} [delete]
 func (s *Server) DeleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
@@ -259,27 +489,20 @@ func (s *Server) DeleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vmName := vars["vmname"]
 	snapshotName := vars["snapshotname"]
 
-	// Acquire the lock for this VM
-	if !s.TryAcquireLock(vmName) {
-		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+	if !s.checkLease(w, r, vars["provider"], vmName) {
 		return
 	}
-	defer s.ReleaseLock(vmName) // Ensure the lock is released
 
-	err := provider.DeleteSnapshot(vmName, snapshotName)
-	if err != nil {
-		httpStatus := http.StatusInternalServerError
-		if _, ok := err.(*hvlib.VmNotFoundError); ok {
-			httpStatus = http.StatusNotFound
-		}
-		commons.WriteErrorResponse(w, err.Error(), httpStatus)
-		return
-	}
+	s.runVMOperation(w, r, hvlib.OpDeleteSnapshot, vars["provider"], vmName, func(ctx context.Context, progress func(string)) (string, error) {
+		return s.vmAction(ctx, vars["provider"], provider, vmName, hvlib.OpDeleteSnapshot, snapshotName, progress)
+	})
+}
 
-	commons.WriteSuccessResponse(w,
-		fmt.Sprintf("Snapshot %s deleted for VM %s",
-			snapshotName, vmName),
-		nil)
+// actionCapabilities are the capabilities needed by the basic VM actions
+// which some providers don't support
+var actionCapabilities = map[string]string{
+	hvlib.OpSuspend: hvlib.CapSuspend,
+	hvlib.OpReset:   hvlib.CapReset,
 }
 
 // Helper function for basic VM actions
@@ -292,42 +515,78 @@ func (s *Server) basicVMActionHandler(w http.ResponseWriter, r *http.Request, ac
 
 	vmName := vars["vmname"]
 
-	// Acquire the lock for this VM
-	if !s.TryAcquireLock(vmName) {
-		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+	if capability, optional := actionCapabilities[action]; optional && !hvlib.HasCapability(provider, capability) {
+		commons.WriteErrorResponse(w, fmt.Sprintf("%s is not supported by this provider", action), http.StatusNotImplemented)
 		return
 	}
-	defer s.ReleaseLock(vmName)
-	var err error
 
-	// Perform action
 	switch action {
-	case "start":
-		err = provider.Start(vmName)
-	case "stop":
-		err = provider.Stop(vmName, true)
-	case "suspend":
-		err = provider.Suspend(vmName)
-	case "revert":
-		err = provider.Revert(vmName)
-	case "reset":
-		err = provider.Reset(vmName)
+	case hvlib.OpStart, hvlib.OpStop, hvlib.OpSuspend, hvlib.OpRevert, hvlib.OpReset:
 	default:
 		commons.WriteErrorResponse(w, "invalid action", http.StatusBadRequest)
 		return
 	}
 
-	if err != nil {
-		httpStatus := http.StatusInternalServerError
-		if _, ok := err.(*hvlib.VmNotFoundError); ok {
-			httpStatus = http.StatusNotFound
-		}
-		commons.WriteErrorResponse(w, err.Error(), httpStatus)
+	if !s.checkLease(w, r, vars["provider"], vmName) {
 		return
 	}
 
-	commons.WriteSuccessResponse(w,
-		fmt.Sprintf("%s on %s completed successfully",
-			action, vmName),
-		nil)
+	s.runVMOperation(w, r, action, vars["provider"], vmName, func(ctx context.Context, progress func(string)) (string, error) {
+		return s.vmAction(ctx, vars["provider"], provider, vmName, action, "", progress)
+	})
+}
+
+// vmAction performs a power or snapshot action on a VM, the caller holds
+// its lock. A revert without snapshot restores the baseline snapshot when
+// one is configured, the current snapshot otherwise. It returns the message
+// of the successful response.
+func (s *Server) vmAction(ctx context.Context, providerName string, provider hvlib.VirtualizationProvider,
+	vmName, action, snapshotName string, progress func(string)) (string, error) {
+	var err error
+	message := fmt.Sprintf("%s on %s completed successfully", action, vmName)
+	start := time.Now()
+	switch action {
+	case hvlib.OpStart:
+		err = provider.Start(ctx, vmName)
+	case hvlib.OpStop:
+		err = provider.Stop(ctx, vmName, true)
+	case hvlib.OpSuspend:
+		err = provider.Suspend(ctx, vmName)
+	case hvlib.OpReset:
+		err = provider.Reset(ctx, vmName)
+	case hvlib.OpRevert:
+		if snapshotName != "" {
+			err = hvlib.RevertTo(ctx, provider, vmName, snapshotName)
+			message = fmt.Sprintf("VM %s reverted to snapshot %s", vmName, snapshotName)
+		} else if baseline, ok := s.getBaseline(providerName, vmName); ok {
+			progress(fmt.Sprintf("reverting to baseline snapshot %s", baseline))
+			err = hvlib.RevertTo(ctx, provider, vmName, baseline)
+			snapshotName = baseline
+		} else {
+			err = provider.Revert(ctx, vmName)
+		}
+		if err == nil {
+			s.Events.Publish(Event{Type: EventReverted, Provider: providerName, VM: vmName, Snapshot: snapshotName})
+		}
+	case hvlib.OpTakeSnapshot:
+		err = provider.TakeSnapshot(ctx, vmName, snapshotName)
+		s.Metrics.ObserveOperation(providerName, action, start, err)
+		if err == nil {
+			s.Events.Publish(Event{Type: EventSnapshotTaken, Provider: providerName, VM: vmName, Snapshot: snapshotName})
+		}
+		return fmt.Sprintf("Snapshot %s taken for VM %s", snapshotName, vmName), err
+	case hvlib.OpDeleteSnapshot:
+		err = provider.DeleteSnapshot(ctx, vmName, snapshotName)
+		s.Metrics.ObserveOperation(providerName, action, start, err)
+		if err == nil {
+			s.Events.Publish(Event{Type: EventSnapshotDeleted, Provider: providerName, VM: vmName, Snapshot: snapshotName})
+		}
+		return fmt.Sprintf("Snapshot %s deleted for VM %s", snapshotName, vmName), err
+	default:
+		return "", &hvlib.InvalidNameError{Name: action, Reason: "unknown action"}
+	}
+	s.Metrics.ObserveOperation(providerName, action, start, err)
+	// Even a failed operation may have changed the state
+	s.checkStates(context.WithoutCancel(ctx), providerName)
+	return message, err
 }
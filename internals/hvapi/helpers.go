@@ -3,10 +3,15 @@ package hvapi
 import (
 	"TraceForge/internals/commons"
 	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pelletier/go-toml"
 )
 
 // Helper: Get provider from request
@@ -19,9 +24,130 @@ func (s *Server) getProviderFromRequest(w http.ResponseWriter, r *http.Request)
 		commons.WriteErrorResponse(w, "Provider not found", http.StatusNotFound)
 		return nil
 	}
+	if health := s.Providers.Health(providerName); !health.Loaded {
+		commons.WriteErrorResponse(w,
+			fmt.Sprintf("Provider %s is unhealthy: %s", providerName, health.Error),
+			http.StatusServiceUnavailable)
+		return nil
+	}
 	return provider
 }
 
+// defaultTimeout is used for operations without a configured timeout
+const defaultTimeout = 5 * time.Minute
+
+// LoadTimeouts reads the per-operation timeouts from the [api.timeouts]
+// section, the "default" key applies to operations not listed
+func LoadTimeouts(loader *hvlib.ConfigLoader) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	tree, ok := loader.Get("api.timeouts").(*toml.Tree)
+	if !ok {
+		return timeouts, nil
+	}
+
+	for op, value := range tree.ToMap() {
+		timeout, err := time.ParseDuration(fmt.Sprint(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid api.timeouts.%s: %w", op, err)
+		}
+		timeouts[op] = timeout
+	}
+	return timeouts, nil
+}
+
+// LoadBaselines reads the baseline snapshot of the VMs of every provider
+// from the [<provider>.baselines] sections, mapping VM name to snapshot
+func LoadBaselines(loader *hvlib.ConfigLoader, providerNames []string) (map[string]map[string]string, error) {
+	baselines := make(map[string]map[string]string)
+	for _, providerName := range providerNames {
+		tree, ok := loader.Get(providerName + ".baselines").(*toml.Tree)
+		if !ok {
+			continue
+		}
+
+		baselines[providerName] = make(map[string]string)
+		for vmName, value := range tree.ToMap() {
+			snapshotName, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid %s.baselines.%s: %v", providerName, vmName, value)
+			}
+			baselines[providerName][vmName] = snapshotName
+		}
+	}
+	return baselines, nil
+}
+
+// getBaseline returns the baseline snapshot configured for a VM
+func (s *Server) getBaseline(providerName, vmName string) (string, bool) {
+	s.baselinesMu.RLock()
+	defer s.baselinesMu.RUnlock()
+	snapshotName, ok := s.Baselines[providerName][vmName]
+	return snapshotName, ok
+}
+
+// setBaseline replaces the baseline snapshot of a VM
+func (s *Server) setBaseline(providerName, vmName, snapshotName string) {
+	s.baselinesMu.Lock()
+	defer s.baselinesMu.Unlock()
+	if s.Baselines == nil {
+		s.Baselines = make(map[string]map[string]string)
+	}
+	if s.Baselines[providerName] == nil {
+		s.Baselines[providerName] = make(map[string]string)
+	}
+	s.Baselines[providerName][vmName] = snapshotName
+}
+
+// operationContext derives the context of a provider operation from the
+// request context, bounded by the timeout configured for the operation
+func (s *Server) operationContext(r *http.Request, operation string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), s.timeout(operation))
+}
+
+// timeout returns the timeout configured for the operation
+func (s *Server) timeout(operation string) time.Duration {
+	timeout, ok := s.Timeouts[operation]
+	if !ok {
+		if timeout, ok = s.Timeouts["default"]; !ok {
+			timeout = defaultTimeout
+		}
+	}
+	return timeout
+}
+
+// errorStatus maps a provider error to the HTTP status returned to the client
+func errorStatus(err error) int {
+	var notFound *hvlib.VmNotFoundError
+	var snapshotNotFound *hvlib.SnapshotNotFoundError
+	var snapshotExists *hvlib.SnapshotExistsError
+	var invalidName *hvlib.InvalidNameError
+	switch {
+	case errors.As(err, &notFound), errors.As(err, &snapshotNotFound),
+		errors.Is(err, hvlib.ErrNoCapture), errors.Is(err, hvlib.ErrUnknownNetworkProfile),
+		errors.Is(err, ErrNotLeased), errors.Is(err, ErrLeaseNotFound), errors.Is(err, ErrImageVersionNotFound):
+		return http.StatusNotFound
+	case errors.As(err, &snapshotExists), errors.Is(err, hvlib.ErrCaptureInProgress),
+		errors.Is(err, ErrLeaseHeld), errors.Is(err, ErrImageVersionExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrLeaseNotHeld):
+		return http.StatusForbidden
+	case errors.As(err, &invalidName):
+		return http.StatusBadRequest
+	case errors.Is(err, hvlib.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrLeaseRequired):
+		return http.StatusPreconditionRequired
+	case errors.Is(err, ErrPoolExhausted):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrBulkFailed):
+		return http.StatusMultiStatus
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // AcquireLock acquires the mutex for the given vmName.
 // If the mutex doesn't exist, it creates one.
 func (s *Server) AcquireLock(vmName string) {
@@ -32,6 +158,7 @@ func (s *Server) AcquireLock(vmName string) {
 	// If the mutex was already present, loaded is true
 	// In either case, lock the mutex
 	lock.Lock()
+	s.Events.Publish(Event{Type: EventLockAcquired, VM: vmName})
 }
 
 // TryAcquireLock attempts to acquire the lock for the given vmName.
@@ -41,7 +168,12 @@ func (s *Server) TryAcquireLock(vmName string) bool {
 	lockInterface, _ := s.vmLocks.LoadOrStore(vmName, &sync.Mutex{})
 	lock := lockInterface.(*sync.Mutex)
 
-	return lock.TryLock()
+	if !lock.TryLock() {
+		s.Metrics.LockContended(vmName)
+		return false
+	}
+	s.Events.Publish(Event{Type: EventLockAcquired, VM: vmName})
+	return true
 }
 
 // ReleaseLock releases the mutex for the given vmName.
@@ -56,6 +188,7 @@ func (s *Server) ReleaseLock(vmName string) {
 
 	lock := lockInterface.(*sync.Mutex)
 	lock.Unlock()
+	s.Events.Publish(Event{Type: EventLockReleased, VM: vmName})
 
 	// Could delete the mutex to prevent the  map from growing
 	// but since the number if VM don't change is not necessary
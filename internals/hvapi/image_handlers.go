@@ -0,0 +1,231 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ImageBuildRequest is the body of BuildImageHandler
+type ImageBuildRequest struct {
+	Version string            `json:"version"` // Suffix of the snapshot name, the UTC build time by default
+	Promote bool              `json:"promote"` // Smoke test then promote the version as baseline, requires an admin token
+	Tools   map[string]string `json:"tools"`   // Versions of the provisioned tools, recorded in the metadata
+	Notes   string            `json:"notes"`
+}
+
+// ImageStatus is an image recipe with its versions
+type ImageStatus struct {
+	*Image
+	Baseline string         `json:"baseline,omitempty"` // Current baseline snapshot of the VM
+	Versions []ImageVersion `json:"versions"`           // The oldest first
+}
+
+// ListImagesHandler godoc
+// @Summary List the golden images
+// @Description List the golden image recipes of [api.images] with their versions and the current baseline of their VM
+// @Tags images
+// @Produce  json
+// @Success 200 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /images [get]
+func (s *Server) ListImagesHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.Images))
+	for name := range s.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]ImageStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, s.imageStatus(s.Images[name]))
+	}
+	commons.WriteSuccessResponse(w, "", statuses)
+}
+
+// GetImageHandler godoc
+// @Summary Get a golden image
+// @Description Get the recipe of a golden image, its versions with their metadata and the current baseline of its VM
+// @Tags images
+// @Produce  json
+// @Param image path string true "Image name"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /images/{image} [get]
+func (s *Server) GetImageHandler(w http.ResponseWriter, r *http.Request) {
+	image, _ := s.getImageFromRequest(w, r)
+	if image == nil {
+		return
+	}
+	commons.WriteSuccessResponse(w, "", s.imageStatus(image))
+}
+
+// BuildImageHandler godoc
+// @Summary Build a version of a golden image
+// @Description Boot the VM of the image from its "from" snapshot, run the provisioning steps through guest operations, shut it down cleanly and take the snapshot <image>-<version>. The version is recorded with its builder, build time, hypervisor and tool versions. With promote the smoke test runs on the new snapshot, which becomes the baseline of the VM when it passes. The VM is leased for the build unless the X-Lease-ID header is set. Set api.timeouts.build_image to bound the whole build.
+// @Tags images
+// @Accept  json
+// @Produce  json
+// @Param image path string true "Image name"
+// @Param request body ImageBuildRequest false "Version and metadata"
+// @Param async query bool false "Run the operation in the background and answer 202 with its ID"
+// @Param X-Lease-ID header string false "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 403 {object} commons.HttpResp // Promotion without an admin token
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Version exists, VM leased or locked
+// @Failure 500 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /images/{image}/build [post]
+func (s *Server) BuildImageHandler(w http.ResponseWriter, r *http.Request) {
+	image, provider := s.getImageFromRequest(w, r)
+	if image == nil {
+		return
+	}
+
+	var params ImageBuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		commons.WriteErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if params.Version == "" {
+		params.Version = time.Now().UTC().Format("20060102-150405")
+	}
+	if !imageNameRegexp.MatchString(params.Version) {
+		commons.WriteErrorResponse(w, fmt.Sprintf("Invalid version %q", params.Version), http.StatusBadRequest)
+		return
+	}
+	if _, exists := s.ImageCatalog.Get(image.Name, params.Version); exists {
+		commons.WriteErrorResponse(w,
+			fmt.Sprintf("%s: %s %s", ErrImageVersionExists, image.Name, params.Version),
+			http.StatusConflict)
+		return
+	}
+
+	builtBy := ""
+	if token := TokenFromContext(r.Context()); token != nil {
+		if params.Promote && !token.allows(RoleAdmin, image.Provider, image.VM) {
+			commons.WriteErrorResponse(w, "Forbidden, promoting a baseline needs the admin role", http.StatusForbidden)
+			return
+		}
+		builtBy = token.Name
+	}
+
+	s.runImageOperation(w, r, OpBuildImage, image, func(ctx context.Context, progress func(string)) (string, error) {
+		version, err := s.buildImage(ctx, image, provider, params, builtBy, progress)
+		if err != nil {
+			return "", err
+		}
+		if version.Baseline {
+			return fmt.Sprintf("Image %s version %s built and promoted as baseline of VM %s",
+				image.Name, version.Version, image.VM), nil
+		}
+		return fmt.Sprintf("Image %s version %s built as snapshot %s",
+			image.Name, version.Version, version.Snapshot), nil
+	})
+}
+
+// PromoteImageHandler godoc
+// @Summary Promote a version of a golden image as baseline
+// @Description Run the smoke test of the image on the snapshot of the version, when it passes the snapshot becomes the baseline of the VM, restored by every revert. The promoted baselines are kept across restarts. The VM is leased for the promotion unless the X-Lease-ID header is set.
+// @Tags images
+// @Produce  json
+// @Param image path string true "Image name"
+// @Param version path string true "Image version"
+// @Param async query bool false "Run the operation in the background and answer 202 with its ID"
+// @Param X-Lease-ID header string false "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Success 202 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // VM leased or locked
+// @Failure 500 {object} commons.HttpResp // Smoke test failed
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /images/{image}/versions/{version}/promote [post]
+func (s *Server) PromoteImageHandler(w http.ResponseWriter, r *http.Request) {
+	image, provider := s.getImageFromRequest(w, r)
+	if image == nil {
+		return
+	}
+
+	version, exists := s.ImageCatalog.Get(image.Name, mux.Vars(r)["version"])
+	if !exists {
+		commons.WriteErrorResponse(w,
+			fmt.Sprintf("%s: %s %s", ErrImageVersionNotFound, image.Name, mux.Vars(r)["version"]),
+			http.StatusNotFound)
+		return
+	}
+	promotedBy := ""
+	if token := TokenFromContext(r.Context()); token != nil {
+		promotedBy = token.Name
+	}
+
+	s.runImageOperation(w, r, OpPromoteImage, image, func(ctx context.Context, progress func(string)) (string, error) {
+		if _, err := s.promoteImage(ctx, image, provider, version, promotedBy, progress); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Snapshot %s promoted as baseline of VM %s", version.Snapshot, image.VM), nil
+	})
+}
+
+// runImageOperation runs an operation of the image workflow holding the
+// lock of the VM, and its lease unless the request has one
+func (s *Server) runImageOperation(w http.ResponseWriter, r *http.Request, operation string, image *Image,
+	run func(ctx context.Context, progress func(string)) (string, error)) {
+	leased := r.Header.Get(LeaseHeader) != ""
+	if leased && !s.checkLease(w, r, image.Provider, image.VM) {
+		return
+	}
+
+	s.runVMOperation(w, r, operation, image.Provider, image.VM, func(ctx context.Context, progress func(string)) (string, error) {
+		if !leased {
+			// Outlives the operation so that the VM isn't reclaimed while it times out
+			release, err := s.holdLease(image.Provider, image.VM, "image "+image.Name, s.timeout(operation)+time.Minute)
+			if err != nil {
+				return "", err
+			}
+			defer release()
+		}
+		defer s.checkStates(context.WithoutCancel(ctx), image.Provider)
+		return run(ctx, progress)
+	})
+}
+
+// getImageFromRequest returns the image of the request with its provider,
+// otherwise the error response is written
+func (s *Server) getImageFromRequest(w http.ResponseWriter, r *http.Request) (*Image, hvlib.VirtualizationProvider) {
+	name := mux.Vars(r)["image"]
+	image, exists := s.Images[name]
+	if !exists {
+		commons.WriteErrorResponse(w, fmt.Sprintf("Image %s not found", name), http.StatusNotFound)
+		return nil, nil
+	}
+
+	provider := s.Providers.GetProvider(image.Provider)
+	if health := s.Providers.Health(image.Provider); provider == nil || !health.Loaded {
+		commons.WriteErrorResponse(w,
+			fmt.Sprintf("Provider %s is unhealthy: %s", image.Provider, health.Error),
+			http.StatusServiceUnavailable)
+		return nil, nil
+	}
+	return image, provider
+}
+
+func (s *Server) imageStatus(image *Image) ImageStatus {
+	status := ImageStatus{Image: image, Versions: s.ImageCatalog.Versions(image.Name)}
+	status.Baseline, _ = s.getBaseline(image.Provider, image.VM)
+	return status
+}
@@ -0,0 +1,577 @@
+package hvapi
+
+import (
+	"TraceForge/pkg/hvlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Operations of the golden image workflow, also keys of [api.timeouts]
+const (
+	OpBuildImage   = "build_image"
+	OpPromoteImage = "promote_image"
+)
+
+// Results of the smoke test of an ImageVersion
+const (
+	SmokeTestSkipped = "skipped" // No smoke test configured
+	SmokeTestPassed  = "passed"
+	SmokeTestFailed  = "failed"
+)
+
+var (
+	ErrImageVersionExists   = errors.New("image version already exists")
+	ErrImageVersionNotFound = errors.New("image version not found")
+	ErrSmokeTestFailed      = errors.New("smoke test failed")
+)
+
+var imageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ImageStep is a provisioning or smoke test step of an Image, it either
+// copies a host file into the guest or runs a program in the guest which
+// must exit with 0
+type ImageStep struct {
+	Name    string   `toml:"name" json:"name,omitempty"`
+	Copy    string   `toml:"copy" json:"copy,omitempty"` // Host path of the file copied to To
+	To      string   `toml:"to" json:"to,omitempty"`     // Guest path
+	Run     string   `toml:"run" json:"run,omitempty"`   // Guest path of the program
+	Args    []string `toml:"args" json:"args,omitempty"`
+	Timeout string   `toml:"timeout" json:"timeout,omitempty"` // Go duration, the copy_to_guest or run_in_guest timeout by default
+
+	timeout time.Duration
+}
+
+func (step *ImageStep) String() string {
+	switch {
+	case step.Name != "":
+		return step.Name
+	case step.Copy != "":
+		return fmt.Sprintf("copy %s to %s", step.Copy, step.To)
+	default:
+		return "run " + step.Run
+	}
+}
+
+// Image is the recipe of a golden image: the VM is booted from a snapshot,
+// provisioned through guest operations, shut down and sealed into a
+// versioned snapshot which can become its baseline
+type Image struct {
+	Name      string      `toml:"-" json:"name"`
+	Provider  string      `toml:"provider" json:"provider"`
+	VM        string      `toml:"vm" json:"vm"`
+	From      string      `toml:"from" json:"from,omitempty"` // Snapshot provisioned, the current state of the VM when empty
+	Steps     []ImageStep `toml:"steps" json:"steps"`
+	SmokeTest []ImageStep `toml:"smoke_test" json:"smoke_test,omitempty"` // Run on the new snapshot before its promotion
+}
+
+// LoadImages reads the [api.images.<name>] sections, the provider of each
+// image must support guest operations:
+//
+//	[api.images.win10]
+//	provider = "vmware"
+//	vm = "win10"
+//	from = "clean-install"
+//
+//	[[api.images.win10.steps]]
+//	copy = "/opt/tools/agent.exe"
+//	to = "C:\\Tools\\agent.exe"
+//
+//	[[api.images.win10.steps]]
+//	name = "install sysmon"
+//	run = "C:\\Tools\\Sysmon64.exe"
+//	args = ["-accepteula", "-i"]
+//	timeout = "10m"
+//
+//	[[api.images.win10.smoke_test]]
+//	run = "C:\\Tools\\agent.exe"
+//	args = ["--version"]
+func LoadImages(loader *hvlib.ConfigLoader, providers *ProviderRegistry) (map[string]*Image, error) {
+	images := make(map[string]*Image)
+	tree, ok := loader.Get("api.images").(*toml.Tree)
+	if !ok {
+		return images, nil
+	}
+
+	for _, name := range tree.Keys() {
+		table, ok := tree.Get(name).(*toml.Tree)
+		if !ok {
+			return nil, fmt.Errorf("invalid api.images.%s, expected a table", name)
+		}
+		if !imageNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid image name %q", name)
+		}
+		image := &Image{}
+		if err := table.Unmarshal(image); err != nil {
+			return nil, fmt.Errorf("invalid api.images.%s: %w", name, err)
+		}
+		image.Name = name
+		if image.VM == "" {
+			return nil, fmt.Errorf("api.images.%s: vm is required", name)
+		}
+		for _, steps := range [][]ImageStep{image.Steps, image.SmokeTest} {
+			for i := range steps {
+				if err := validateImageStep(&steps[i]); err != nil {
+					return nil, fmt.Errorf("api.images.%s: step %d: %w", name, i+1, err)
+				}
+			}
+		}
+
+		provider := providers.GetProvider(image.Provider)
+		if provider == nil {
+			return nil, fmt.Errorf("api.images.%s: provider %q is not enabled", name, image.Provider)
+		}
+		if _, ok := provider.(hvlib.GuestOperations); !ok || !hvlib.HasCapability(provider, hvlib.CapGuestOperations) {
+			return nil, fmt.Errorf("api.images.%s: provider %s doesn't support guest operations", name, image.Provider)
+		}
+		images[name] = image
+	}
+	return images, nil
+}
+
+func validateImageStep(step *ImageStep) error {
+	if (step.Copy == "") == (step.Run == "") {
+		return errors.New("expected either copy or run")
+	}
+	if step.Copy != "" && step.To == "" {
+		return errors.New("to is required to copy a file")
+	}
+	if step.Timeout != "" {
+		timeout, err := time.ParseDuration(step.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", step.Timeout)
+		}
+		step.timeout = timeout
+	}
+	return nil
+}
+
+// ImageVersion is the metadata of a golden image built
+type ImageVersion struct {
+	Image      string            `json:"image"`
+	Version    string            `json:"version"`
+	Provider   string            `json:"provider"`
+	VM         string            `json:"vm"`
+	Snapshot   string            `json:"snapshot"`
+	BuiltBy    string            `json:"built_by"` // Token which built the version
+	BuiltAt    time.Time         `json:"built_at"`
+	Hypervisor string            `json:"hypervisor,omitempty"` // Hypervisor version
+	Tools      map[string]string `json:"tools,omitempty"`      // Versions of the provisioned tools, given by the builder
+	Notes      string            `json:"notes,omitempty"`
+	SmokeTest  string            `json:"smoke_test,omitempty"` // Result of the last smoke test, empty until one is requested
+	SmokeError string            `json:"smoke_error,omitempty"`
+	PromotedBy string            `json:"promoted_by,omitempty"`
+	PromotedAt *time.Time        `json:"promoted_at,omitempty"`
+	Baseline   bool              `json:"baseline"` // Current baseline of the VM
+}
+
+// ImageCatalog keeps the versions of the golden images in a JSON file, the
+// promoted versions are restored as baselines on startup
+type ImageCatalog struct {
+	mu       sync.Mutex
+	path     string // Kept in memory only when empty
+	versions []ImageVersion
+}
+
+// OpenImageCatalog loads the catalog from path, which is created by the
+// first build
+func OpenImageCatalog(path string) (*ImageCatalog, error) {
+	c := &ImageCatalog{path: path}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.versions); err != nil {
+		return nil, fmt.Errorf("invalid image catalog %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ApplyBaselines sets the promoted versions as baselines of their VM, over
+// the [<provider>.baselines] configuration
+func (c *ImageCatalog) ApplyBaselines(baselines map[string]map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, version := range c.versions {
+		if !version.Baseline {
+			continue
+		}
+		if baselines[version.Provider] == nil {
+			baselines[version.Provider] = make(map[string]string)
+		}
+		baselines[version.Provider][version.VM] = version.Snapshot
+	}
+}
+
+// Versions returns the versions of an image, the oldest first
+func (c *ImageCatalog) Versions(image string) []ImageVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions := []ImageVersion{}
+	for _, version := range c.versions {
+		if version.Image == image {
+			versions = append(versions, version)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].BuiltAt.Before(versions[j].BuiltAt) })
+	return versions
+}
+
+// Get returns a version of an image
+func (c *ImageCatalog) Get(image, version string) (ImageVersion, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := c.find(image, version); i >= 0 {
+		return c.versions[i], true
+	}
+	return ImageVersion{}, false
+}
+
+// add records a new version
+func (c *ImageCatalog) add(version ImageVersion) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.find(version.Image, version.Version) >= 0 {
+		return fmt.Errorf("%w: %s %s", ErrImageVersionExists, version.Image, version.Version)
+	}
+	c.versions = append(c.versions, version)
+	return c.save()
+}
+
+// update applies change to a version and saves the catalog
+func (c *ImageCatalog) update(image, version string, change func(v *ImageVersion)) (ImageVersion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.find(image, version)
+	if i < 0 {
+		return ImageVersion{}, fmt.Errorf("%w: %s %s", ErrImageVersionNotFound, image, version)
+	}
+	change(&c.versions[i])
+	return c.versions[i], c.save()
+}
+
+// promote flags a version as the baseline of its VM, in place of the
+// previous one
+func (c *ImageCatalog) promote(image, version, promotedBy string) (ImageVersion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.find(image, version)
+	if i < 0 {
+		return ImageVersion{}, fmt.Errorf("%w: %s %s", ErrImageVersionNotFound, image, version)
+	}
+	promoted := &c.versions[i]
+	for j := range c.versions {
+		if c.versions[j].Provider == promoted.Provider && c.versions[j].VM == promoted.VM {
+			c.versions[j].Baseline = false
+		}
+	}
+	now := time.Now()
+	promoted.Baseline = true
+	promoted.PromotedBy = promotedBy
+	promoted.PromotedAt = &now
+	return *promoted, c.save()
+}
+
+// find returns the index of a version, -1 when it doesn't exist. c.mu must
+// be held.
+func (c *ImageCatalog) find(image, version string) int {
+	for i := range c.versions {
+		if c.versions[i].Image == image && c.versions[i].Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// save rewrites the catalog file, c.mu must be held
+func (c *ImageCatalog) save() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// buildImage boots the VM of the image, runs the provisioning steps, shuts
+// the VM down and takes the snapshot of the new version, which is then
+// promoted when requested. The caller holds the VM lock.
+func (s *Server) buildImage(ctx context.Context, image *Image, provider hvlib.VirtualizationProvider,
+	params ImageBuildRequest, builtBy string, progress func(string)) (ImageVersion, error) {
+	guest := provider.(hvlib.GuestOperations)
+	version := ImageVersion{
+		Image:    image.Name,
+		Version:  params.Version,
+		Provider: image.Provider,
+		VM:       image.VM,
+		Snapshot: image.Name + "-" + params.Version,
+		BuiltBy:  builtBy,
+		Tools:    params.Tools,
+		Notes:    params.Notes,
+	}
+
+	if image.From != "" {
+		progress(fmt.Sprintf("reverting to snapshot %s", image.From))
+		err := s.providerOperation(ctx, image.Provider, hvlib.OpRevert, func(ctx context.Context) error {
+			return hvlib.RevertTo(ctx, provider, image.VM, image.From)
+		})
+		if err != nil {
+			return version, err
+		}
+	}
+
+	if err := s.bootImageVM(ctx, image, provider, progress); err != nil {
+		s.abortImage(ctx, provider, image)
+		return version, err
+	}
+	if err := s.runImageSteps(ctx, image, guest, "provisioning", image.Steps, progress); err != nil {
+		s.abortImage(ctx, provider, image)
+		return version, err
+	}
+
+	progress("shutting down")
+	if err := s.stopImageVM(ctx, image, provider, false); err != nil {
+		s.abortImage(ctx, provider, image)
+		return version, err
+	}
+
+	if err := s.providerOperation(ctx, image.Provider, hvlib.OpVersion, func(ctx context.Context) error {
+		var err error
+		version.Hypervisor, err = provider.Version(ctx)
+		return err
+	}); err != nil {
+		s.Logger.WithError(err).Warnf("Failed to get the hypervisor version of image %s", image.Name)
+	}
+
+	progress(fmt.Sprintf("taking snapshot %s", version.Snapshot))
+	if err := s.providerOperation(ctx, image.Provider, hvlib.OpTakeSnapshot, func(ctx context.Context) error {
+		return provider.TakeSnapshot(ctx, image.VM, version.Snapshot)
+	}); err != nil {
+		return version, err
+	}
+	s.Events.Publish(Event{Type: EventSnapshotTaken, Provider: image.Provider, VM: image.VM, Snapshot: version.Snapshot})
+
+	version.BuiltAt = time.Now()
+	if err := s.ImageCatalog.add(version); err != nil {
+		return version, err
+	}
+	if params.Promote {
+		return s.promoteImage(ctx, image, provider, version, builtBy, progress)
+	}
+	return version, nil
+}
+
+// promoteImage runs the smoke test of the image on the snapshot of the
+// version, when it passes the version becomes the baseline of the VM. The
+// caller holds the VM lock.
+func (s *Server) promoteImage(ctx context.Context, image *Image, provider hvlib.VirtualizationProvider,
+	version ImageVersion, promotedBy string, progress func(string)) (ImageVersion, error) {
+	result, smokeErr := SmokeTestSkipped, error(nil)
+	if len(image.SmokeTest) > 0 {
+		smokeErr = s.smokeTestImage(ctx, image, provider, version.Snapshot, progress)
+		result = SmokeTestPassed
+		if smokeErr != nil {
+			result = SmokeTestFailed
+		}
+	}
+	version, err := s.ImageCatalog.update(image.Name, version.Version, func(v *ImageVersion) {
+		v.SmokeTest = result
+		v.SmokeError = ""
+		if smokeErr != nil {
+			v.SmokeError = smokeErr.Error()
+		}
+	})
+	if err != nil {
+		return version, err
+	}
+	if smokeErr != nil {
+		return version, fmt.Errorf("%w: %v", ErrSmokeTestFailed, smokeErr)
+	}
+
+	progress(fmt.Sprintf("promoting snapshot %s as baseline", version.Snapshot))
+	if version, err = s.ImageCatalog.promote(image.Name, version.Version, promotedBy); err != nil {
+		return version, err
+	}
+	s.setBaseline(image.Provider, image.VM, version.Snapshot)
+	s.Events.Publish(Event{Type: EventBaselinePromoted, Provider: image.Provider, VM: image.VM, Snapshot: version.Snapshot})
+	s.Logger.Infof("Snapshot %s promoted as baseline of VM %s", version.Snapshot, image.VM)
+	return version, nil
+}
+
+// smokeTestImage boots the snapshot and runs the smoke test steps, the VM
+// is then restored to the snapshot whatever the outcome
+func (s *Server) smokeTestImage(ctx context.Context, image *Image, provider hvlib.VirtualizationProvider,
+	snapshotName string, progress func(string)) error {
+	restore := func(ctx context.Context) error {
+		return hvlib.RevertTo(ctx, provider, image.VM, snapshotName)
+	}
+
+	progress(fmt.Sprintf("reverting to snapshot %s", snapshotName))
+	if err := s.providerOperation(ctx, image.Provider, hvlib.OpRevert, restore); err != nil {
+		return err
+	}
+	err := s.bootImageVM(ctx, image, provider, progress)
+	if err == nil {
+		err = s.runImageSteps(ctx, image, provider.(hvlib.GuestOperations), "smoke test", image.SmokeTest, progress)
+	}
+
+	progress(fmt.Sprintf("restoring snapshot %s", snapshotName))
+	cleanupCtx := context.WithoutCancel(ctx)
+	if stopErr := s.stopImageVM(cleanupCtx, image, provider, true); stopErr != nil {
+		s.Logger.WithError(stopErr).Warnf("Failed to power off VM %s after the smoke test", image.VM)
+	}
+	if restoreErr := s.providerOperation(cleanupCtx, image.Provider, hvlib.OpRevert, restore); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+	return err
+}
+
+// bootImageVM starts the VM unless it is running, then waits for its guest
+// OS when the provider can tell it has booted
+func (s *Server) bootImageVM(ctx context.Context, image *Image, provider hvlib.VirtualizationProvider, progress func(string)) error {
+	vmName := image.VM
+	state, err := s.vmState(ctx, provider, vmName)
+	if err != nil {
+		return err
+	}
+	if state != "running" {
+		progress("starting")
+		if err := s.providerOperation(ctx, image.Provider, hvlib.OpStart, func(ctx context.Context) error {
+			return provider.Start(ctx, vmName)
+		}); err != nil {
+			return err
+		}
+	}
+
+	checker, ok := provider.(hvlib.GuestReadinessChecker)
+	if !ok || !hvlib.HasCapability(provider, hvlib.CapGuestReadiness) {
+		return nil
+	}
+	progress("waiting for the guest")
+	return s.providerOperation(ctx, image.Provider, hvlib.OpWait, func(ctx context.Context) error {
+		return hvlib.WaitForGuest(ctx, checker, vmName)
+	})
+}
+
+// stopImageVM powers off the VM unless it is stopped and waits until it is
+func (s *Server) stopImageVM(ctx context.Context, image *Image, provider hvlib.VirtualizationProvider, force bool) error {
+	vmName := image.VM
+	state, err := s.vmState(ctx, provider, vmName)
+	if err != nil || state == "stopped" {
+		return err
+	}
+	if err := s.providerOperation(ctx, image.Provider, hvlib.OpStop, func(ctx context.Context) error {
+		return provider.Stop(ctx, vmName, force)
+	}); err != nil {
+		return err
+	}
+	return s.providerOperation(ctx, image.Provider, hvlib.OpWait, func(ctx context.Context) error {
+		return hvlib.WaitForState(ctx, provider, vmName, "stopped")
+	})
+}
+
+// abortImage powers off the VM of a failed build and restores the snapshot
+// it was provisioned from
+func (s *Server) abortImage(ctx context.Context, provider hvlib.VirtualizationProvider, image *Image) {
+	ctx = context.WithoutCancel(ctx)
+	if err := s.stopImageVM(ctx, image, provider, true); err != nil {
+		s.Logger.WithError(err).Warnf("Failed to power off VM %s of the failed build of image %s", image.VM, image.Name)
+	}
+	if image.From == "" {
+		return
+	}
+	if err := s.providerOperation(ctx, image.Provider, hvlib.OpRevert, func(ctx context.Context) error {
+		return hvlib.RevertTo(ctx, provider, image.VM, image.From)
+	}); err != nil {
+		s.Logger.WithError(err).Warnf("Failed to revert VM %s of the failed build of image %s", image.VM, image.Name)
+	}
+}
+
+// runImageSteps runs the steps in order and stops at the first failure
+func (s *Server) runImageSteps(ctx context.Context, image *Image, guest hvlib.GuestOperations, stage string,
+	steps []ImageStep, progress func(string)) error {
+	for i := range steps {
+		step := &steps[i]
+		progress(fmt.Sprintf("%s step %d of %d: %s", stage, i+1, len(steps), step))
+		if err := s.runImageStep(ctx, image, guest, step); err != nil {
+			return fmt.Errorf("%s step %d (%s): %w", stage, i+1, step, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) runImageStep(ctx context.Context, image *Image, guest hvlib.GuestOperations, step *ImageStep) error {
+	operation := hvlib.OpRunInGuest
+	if step.Copy != "" {
+		operation = hvlib.OpCopyToGuest
+	}
+	timeout := step.timeout
+	if timeout == 0 {
+		timeout = s.timeout(operation)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	if step.Copy != "" {
+		err := guest.CopyFileToGuest(ctx, image.VM, step.Copy, step.To)
+		s.Metrics.ObserveOperation(image.Provider, operation, start, err)
+		return err
+	}
+	exitCode, err := guest.RunProgramInGuest(ctx, image.VM, step.Run, step.Args, true)
+	s.Metrics.ObserveOperation(image.Provider, operation, start, err)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("%s exited with code %d", step.Run, exitCode)
+	}
+	return nil
+}
+
+// providerOperation runs the provider operation fn bounded by the timeout
+// of the operation, and records its metrics
+func (s *Server) providerOperation(ctx context.Context, providerName, operation string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout(operation))
+	defer cancel()
+	start := time.Now()
+	err := fn(ctx)
+	s.Metrics.ObserveOperation(providerName, operation, start, err)
+	return err
+}
+
+// vmState returns the power state of a VM
+func (s *Server) vmState(ctx context.Context, provider hvlib.VirtualizationProvider, vmName string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout(hvlib.OpList))
+	defer cancel()
+	vms, err := provider.List(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, vm := range vms {
+		if vm.Name == vmName {
+			return vm.State, nil
+		}
+	}
+	return "", &hvlib.VmNotFoundError{VmName: vmName}
+}
@@ -0,0 +1,114 @@
+package hvapi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImageCatalogRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.json")
+	catalog, err := OpenImageCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, expected the catalog created by the first build", err)
+	}
+
+	built := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	versions := []ImageVersion{
+		{Image: "win10", Version: "2", Provider: "fake", VM: "win10", Snapshot: "win10-2", BuiltAt: built.Add(time.Hour)},
+		{Image: "win10", Version: "1", Provider: "fake", VM: "win10", Snapshot: "win10-1", BuiltAt: built,
+			Tools: map[string]string{"sysmon": "15.0"}},
+		{Image: "office", Version: "1", Provider: "fake", VM: "win11", Snapshot: "office-1", BuiltAt: built},
+	}
+	for _, version := range versions {
+		if err := catalog.add(version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := catalog.add(versions[0]); !errors.Is(err, ErrImageVersionExists) {
+		t.Errorf("got %v adding a version twice, expected ErrImageVersionExists", err)
+	}
+
+	if _, err := catalog.promote("win10", "1", "ops"); err != nil {
+		t.Fatal(err)
+	}
+	// Replaces version 1 as baseline of the VM
+	promoted, err := catalog.promote("win10", "2", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !promoted.Baseline || promoted.PromotedBy != "ci" || promoted.PromotedAt == nil {
+		t.Errorf("unexpected promoted version %+v", promoted)
+	}
+	if _, err := catalog.promote("win10", "3", "ci"); !errors.Is(err, ErrImageVersionNotFound) {
+		t.Errorf("got %v promoting an unknown version, expected ErrImageVersionNotFound", err)
+	}
+	if _, err := catalog.promote("office", "1", "ops"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reopened catalog has the versions and baselines saved
+	reopened, err := OpenImageCatalog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	win10 := reopened.Versions("win10")
+	if len(win10) != 2 || win10[0].Version != "1" || win10[1].Version != "2" {
+		t.Fatalf("got %+v, expected versions 1 and 2, the oldest first", win10)
+	}
+	if win10[0].Baseline || win10[0].PromotedBy != "ops" || win10[0].Tools["sysmon"] != "15.0" {
+		t.Errorf("unexpected version 1 %+v", win10[0])
+	}
+	if !win10[1].Baseline || win10[1].PromotedBy != "ci" || !win10[1].BuiltAt.Equal(built.Add(time.Hour)) {
+		t.Errorf("unexpected version 2 %+v", win10[1])
+	}
+	if version, exists := reopened.Get("office", "1"); !exists || !version.Baseline {
+		t.Errorf("got %+v, expected office 1 promoted", version)
+	}
+	if _, exists := reopened.Get("office", "2"); exists {
+		t.Error("unknown version found")
+	}
+	if versions := reopened.Versions("unknown"); versions == nil || len(versions) != 0 {
+		t.Errorf("got %+v, expected no version", versions)
+	}
+
+	// The promoted versions override the configured baselines
+	baselines := map[string]map[string]string{"fake": {"win10": "clean", "win12": "clean"}}
+	reopened.ApplyBaselines(baselines)
+	expected := map[string]string{"win10": "win10-2", "win11": "office-1", "win12": "clean"}
+	for vm, snapshot := range expected {
+		if baselines["fake"][vm] != snapshot {
+			t.Errorf("got baseline %q of %s, expected %q", baselines["fake"][vm], vm, snapshot)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, expected the temporary file renamed", err)
+	}
+}
+
+func TestOpenImageCatalog(t *testing.T) {
+	// Kept in memory without path
+	catalog, err := OpenImageCatalog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.add(ImageVersion{Image: "win10", Version: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := catalog.Get("win10", "1"); !exists {
+		t.Error("version not kept in memory")
+	}
+
+	path := filepath.Join(t.TempDir(), "images.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenImageCatalog(path); err == nil {
+		t.Error("expected an error opening an invalid catalog")
+	}
+}
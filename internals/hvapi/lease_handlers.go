@@ -0,0 +1,209 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// LeaseRequest is the body of the lease acquisition and renewal
+type LeaseRequest struct {
+	Owner string `json:"owner"` // Required to acquire, e.g. the sbapi instance and agent
+	TTL   string `json:"ttl"`   // Go duration, 10m by default
+}
+
+// ListLeasesHandler godoc
+// @Summary List the VM leases
+// @Description List the leases of the VMs in the token scope with their owner and expiration, the expired leases being reclaimed are flagged. The lease IDs are only listed to the token holding the lease.
+// @Tags leases
+// @Produce  json
+// @Success 200 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /leases [get]
+func (s *Server) ListLeasesHandler(w http.ResponseWriter, r *http.Request) {
+	token := TokenFromContext(r.Context())
+	leases := []Lease{}
+	for _, lease := range s.Leases.List() {
+		if token == nil {
+			leases = append(leases, lease)
+			continue
+		}
+		if !token.allows(RoleReadOnly, lease.Provider, lease.VM) {
+			continue
+		}
+		if lease.Token != token.Name {
+			lease.ID = ""
+		}
+		leases = append(leases, lease)
+	}
+	commons.WriteSuccessResponse(w, "", leases)
+}
+
+// AcquireLeaseHandler godoc
+// @Summary Lease a virtual machine
+// @Description Grant the exclusive use of a VM to an owner until the lease expires. The mutating endpoints (power actions, snapshots, network, capture, guest operations and file downloads, memory dumps, pool clone releases) require the lease ID in the X-Lease-ID header. The lease is bound to the token which acquired it, only this token can use, renew and release it. A leased VM can't be acquired again, renew the lease instead. An expired lease is reclaimed: the VM is reverted to its baseline snapshot.
+// @Tags leases
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param request body LeaseRequest true "Owner and TTL"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Already leased
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/lease [post]
+func (s *Server) AcquireLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return
+	}
+	vmName := vars["vmname"]
+
+	params, ttl, ok := parseLeaseRequest(w, r)
+	if !ok {
+		return
+	}
+	if params.Owner == "" {
+		commons.WriteErrorResponse(w, "owner is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.operationContext(r, hvlib.OpList)
+	defer cancel()
+	if err := s.vmExists(ctx, provider, vmName); err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	lease, err := s.Leases.Acquire(vars["provider"], vmName, params.Owner, TokenFromContext(r.Context()).name(), ttl)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	s.Events.Publish(Event{Type: EventLeaseAcquired, Provider: lease.Provider, VM: lease.VM, Owner: lease.Owner})
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("VM %s leased to %s until %s", vmName, lease.Owner, lease.ExpiresAt.Format(time.RFC3339)),
+		lease)
+}
+
+// RenewLeaseHandler godoc
+// @Summary Renew a VM lease
+// @Description Extend a lease which hasn't expired to the TTL from now, only the token which acquired the lease can renew it
+// @Tags leases
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Lease ID"
+// @Param request body LeaseRequest false "TTL"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 403 {object} commons.HttpResp // Held by another token, or VM out of the token scope
+// @Failure 404 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /leases/{id}/renew [post]
+func (s *Server) RenewLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	_, ttl, ok := parseLeaseRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.checkLeaseScope(w, r, mux.Vars(r)["id"]); !ok {
+		return
+	}
+
+	lease, err := s.Leases.Renew(mux.Vars(r)["id"], TokenFromContext(r.Context()).name(), ttl)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("Lease of VM %s renewed until %s", lease.VM, lease.ExpiresAt.Format(time.RFC3339)),
+		lease)
+}
+
+// ReleaseLeaseHandler godoc
+// @Summary Release a VM lease
+// @Description End a lease, the VM is left as is for the next owner. Only the token which acquired the lease can release it, or an admin token covering its VM.
+// @Tags leases
+// @Produce  json
+// @Param id path string true "Lease ID"
+// @Success 200 {object} commons.HttpResp
+// @Failure 403 {object} commons.HttpResp // Held by another token, or VM out of the token scope
+// @Failure 404 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /leases/{id} [delete]
+func (s *Server) ReleaseLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	lease, ok := s.checkLeaseScope(w, r, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	token := TokenFromContext(r.Context())
+	holder := token.name()
+	if token != nil && token.allows(RoleAdmin, lease.Provider, lease.VM) {
+		// Frees the VM of a client which didn't release it
+		holder = lease.Token
+	}
+	lease, err := s.Leases.Release(mux.Vars(r)["id"], holder)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	s.Events.Publish(Event{Type: EventLeaseReleased, Provider: lease.Provider, VM: lease.VM, Owner: lease.Owner})
+
+	commons.WriteSuccessResponse(w, fmt.Sprintf("Lease of VM %s released", lease.VM), nil)
+}
+
+// checkLeaseScope verifies the token of the request covers the VM of the
+// lease, the routes of the leases have no provider or VM for the
+// middleware to check. Otherwise the error response is written.
+func (s *Server) checkLeaseScope(w http.ResponseWriter, r *http.Request, id string) (Lease, bool) {
+	lease, exists := s.Leases.Get(id)
+	if !exists {
+		commons.WriteErrorResponse(w, ErrLeaseNotFound.Error(), http.StatusNotFound)
+		return lease, false
+	}
+	if entry := auditEntryFromContext(r.Context()); entry != nil {
+		entry.Provider, entry.VM = lease.Provider, lease.VM
+	}
+	if token := TokenFromContext(r.Context()); token != nil && !token.allows(RoleOperator, lease.Provider, lease.VM) {
+		s.Logger.Warnf("Token %s denied %s %s on VM %s of %s", token.Name, r.Method, r.URL.Path, lease.VM, lease.Provider)
+		commons.WriteErrorResponse(w,
+			fmt.Sprintf("Forbidden, the token needs the %s role on this provider and VM", RoleOperator),
+			http.StatusForbidden)
+		return lease, false
+	}
+	return lease, true
+}
+
+// parseLeaseRequest decodes the optional body of a lease request, otherwise
+// the error response is written
+func parseLeaseRequest(w http.ResponseWriter, r *http.Request) (LeaseRequest, time.Duration, bool) {
+	var params LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		commons.WriteErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return params, 0, false
+	}
+
+	ttl := defaultLeaseTTL
+	if params.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(params.TTL); err != nil || ttl <= 0 || ttl > maxLeaseTTL {
+			commons.WriteErrorResponse(w,
+				fmt.Sprintf("Invalid ttl, expected a Go duration up to %s", maxLeaseTTL),
+				http.StatusBadRequest)
+			return params, 0, false
+		}
+	}
+	return params, ttl, true
+}
@@ -0,0 +1,303 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LeaseHeader carries the lease ID on the requests of the mutating endpoints
+const LeaseHeader = "X-Lease-ID"
+
+const (
+	defaultLeaseTTL   = 10 * time.Minute
+	maxLeaseTTL       = 24 * time.Hour
+	leaseReapInterval = 5 * time.Second
+)
+
+var (
+	ErrLeaseRequired = errors.New("a lease of the VM is required")
+	ErrLeaseHeld     = errors.New("VM is leased by another owner")
+	ErrLeaseNotFound = errors.New("lease not found or expired")
+	ErrLeaseNotHeld  = errors.New("lease is held by another token")
+)
+
+// Lease grants its owner the exclusive use of a VM until it expires, the
+// mutating endpoints require the lease ID in the X-Lease-ID header. The
+// lease is bound to the API token which acquired it, only this token can
+// use, renew and release it: Owner is a free-form description. An expired
+// lease is reclaimed: the VM is reverted to its baseline snapshot.
+type Lease struct {
+	ID         string    `json:"id,omitempty"` // Only listed to the token holding the lease
+	Provider   string    `json:"provider"`
+	VM         string    `json:"vm"`
+	Owner      string    `json:"owner"`
+	Token      string    `json:"token,omitempty"` // Empty for the leases of hvapi itself and without authentication
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Reclaiming bool      `json:"reclaiming,omitempty"` // Expired, the VM is being reverted
+}
+
+func (l *Lease) expired(now time.Time) bool {
+	return l.Reclaiming || !now.Before(l.ExpiresAt)
+}
+
+// find returns the lease id which hasn't expired, held by token
+func (st *LeaseStore) find(id, token string) (*Lease, error) {
+	lease, exists := st.byID[id]
+	if !exists || lease.expired(time.Now()) {
+		return nil, ErrLeaseNotFound
+	}
+	if lease.Token != token {
+		return nil, ErrLeaseNotHeld
+	}
+	return lease, nil
+}
+
+// LeaseStore keeps the leases by ID and by VM
+type LeaseStore struct {
+	mu   sync.Mutex
+	byID map[string]*Lease
+	byVM map[string]*Lease // By leaseKey
+}
+
+func NewLeaseStore() *LeaseStore {
+	return &LeaseStore{
+		byID: make(map[string]*Lease),
+		byVM: make(map[string]*Lease),
+	}
+}
+
+func leaseKey(provider, vmName string) string {
+	return provider + "/" + vmName
+}
+
+// Acquire leases a VM for ttl to the API token named token. A leased VM
+// can't be acquired again, even by the same owner: the leases are renewed
+// with Renew. The VM of an expired lease can only be leased again once it
+// is reclaimed.
+func (st *LeaseStore) Acquire(provider, vmName, owner, token string, ttl time.Duration) (Lease, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	if lease, exists := st.byVM[leaseKey(provider, vmName)]; exists {
+		return Lease{}, fmt.Errorf("%w: %s until %s", ErrLeaseHeld, lease.Owner, lease.ExpiresAt.Format(time.RFC3339))
+	}
+
+	lease := &Lease{
+		ID:         uuid.NewString(),
+		Provider:   provider,
+		VM:         vmName,
+		Owner:      owner,
+		Token:      token,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	st.byID[lease.ID] = lease
+	st.byVM[leaseKey(provider, vmName)] = lease
+	return *lease, nil
+}
+
+// Get returns a copy of a lease which hasn't expired
+func (st *LeaseStore) Get(id string) (Lease, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	lease, exists := st.byID[id]
+	if !exists || lease.expired(time.Now()) {
+		return Lease{}, false
+	}
+	return *lease, true
+}
+
+// Renew extends a lease held by token which hasn't expired to ttl from now
+func (st *LeaseStore) Renew(id, token string, ttl time.Duration) (Lease, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	lease, err := st.find(id, token)
+	if err != nil {
+		return Lease{}, err
+	}
+	lease.ExpiresAt = time.Now().Add(ttl)
+	return *lease, nil
+}
+
+// Release ends a lease held by token which hasn't expired
+func (st *LeaseStore) Release(id, token string) (Lease, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	lease, err := st.find(id, token)
+	if err != nil {
+		return Lease{}, err
+	}
+	st.remove(lease)
+	return *lease, nil
+}
+
+// releaseVM ends the lease of a VM, whatever its state
+func (st *LeaseStore) releaseVM(provider, vmName string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if lease, exists := st.byVM[leaseKey(provider, vmName)]; exists {
+		st.remove(lease)
+	}
+}
+
+func (st *LeaseStore) remove(lease *Lease) {
+	delete(st.byID, lease.ID)
+	delete(st.byVM, leaseKey(lease.Provider, lease.VM))
+}
+
+// Check returns nil when id is the lease of the VM held by token
+func (st *LeaseStore) Check(provider, vmName, id, token string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	current, leased := st.byVM[leaseKey(provider, vmName)]
+	if id == "" {
+		if leased {
+			return fmt.Errorf("%w: %s", ErrLeaseHeld, current.Owner)
+		}
+		return fmt.Errorf("%w, set the %s header", ErrLeaseRequired, LeaseHeader)
+	}
+
+	lease, err := st.find(id, token)
+	if err != nil {
+		return err
+	}
+	if lease != current {
+		return fmt.Errorf("%w: the lease is for VM %s of %s", ErrLeaseRequired, lease.VM, lease.Provider)
+	}
+	return nil
+}
+
+// List returns a copy of the leases, by provider then VM
+func (st *LeaseStore) List() []Lease {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	leases := make([]Lease, 0, len(st.byID))
+	for _, lease := range st.byID {
+		leases = append(leases, *lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leaseKey(leases[i].Provider, leases[i].VM) < leaseKey(leases[j].Provider, leases[j].VM)
+	})
+	return leases
+}
+
+// expire flags the expired leases as reclaiming and returns them
+func (st *LeaseStore) expire() []Lease {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	var expired []Lease
+	for _, lease := range st.byID {
+		if !lease.Reclaiming && lease.expired(now) {
+			lease.Reclaiming = true
+			expired = append(expired, *lease)
+		}
+	}
+	return expired
+}
+
+// StartLeaseReaper reclaims the expired leases until ctx ends
+func (s *Server) StartLeaseReaper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(leaseReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			for _, lease := range s.Leases.expire() {
+				go s.reclaimLease(ctx, lease)
+			}
+		}
+	}()
+}
+
+// reclaimLease reverts the VM of an expired lease to its baseline, or to
+// its current snapshot, then frees the VM. A pool clone is released to its
+// pool instead.
+func (s *Server) reclaimLease(ctx context.Context, lease Lease) {
+	s.Logger.Warnf("Lease of VM %s by %s expired, reclaiming the VM", lease.VM, lease.Owner)
+	s.Events.Publish(Event{Type: EventLeaseExpired, Provider: lease.Provider, VM: lease.VM, Owner: lease.Owner})
+	defer s.Leases.releaseVM(lease.Provider, lease.VM)
+
+	for _, pool := range s.Pools {
+		if pool.Provider == lease.Provider && s.ReleaseClone(pool, lease.VM) == nil {
+			return
+		}
+	}
+
+	provider := s.Providers.GetProvider(lease.Provider)
+	if provider == nil {
+		return
+	}
+
+	// Waits for the operation in progress
+	s.AcquireLock(lease.VM)
+	defer s.ReleaseLock(lease.VM)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout(hvlib.OpRevert))
+	defer cancel()
+	if _, err := s.vmAction(ctx, lease.Provider, provider, lease.VM, hvlib.OpRevert, "", func(string) {}); err != nil {
+		s.Logger.WithError(err).Errorf("Failed to revert VM %s of the expired lease", lease.VM)
+	}
+}
+
+// holdLease leases a VM for an operation of hvapi itself, the returned
+// function releases it. The lease isn't bound to a token, no client can use
+// it.
+func (s *Server) holdLease(providerName, vmName, owner string, ttl time.Duration) (func(), error) {
+	lease, err := s.Leases.Acquire(providerName, vmName, owner, "", ttl)
+	if err != nil {
+		return nil, err
+	}
+	s.Events.Publish(Event{Type: EventLeaseAcquired, Provider: lease.Provider, VM: lease.VM, Owner: lease.Owner})
+	return func() {
+		if _, err := s.Leases.Release(lease.ID, ""); err == nil {
+			s.Events.Publish(Event{Type: EventLeaseReleased, Provider: lease.Provider, VM: lease.VM, Owner: lease.Owner})
+		}
+	}, nil
+}
+
+// checkLease verifies the request holds the lease of the VM, otherwise the
+// error response is written
+func (s *Server) checkLease(w http.ResponseWriter, r *http.Request, providerName, vmName string) bool {
+	if err := s.Leases.Check(providerName, vmName, r.Header.Get(LeaseHeader), TokenFromContext(r.Context()).name()); err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return false
+	}
+	return true
+}
+
+// vmExists returns a VmNotFoundError when the provider has no such VM
+func (s *Server) vmExists(ctx context.Context, provider hvlib.VirtualizationProvider, vmName string) error {
+	vms, err := provider.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if vm.Name == vmName {
+			return nil
+		}
+	}
+	return &hvlib.VmNotFoundError{VmName: vmName}
+}
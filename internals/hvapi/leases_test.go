@@ -0,0 +1,312 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// expireLease moves the expiration of a lease to the past
+func expireLease(st *LeaseStore, id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.byID[id].ExpiresAt = time.Now().Add(-time.Second)
+}
+
+func TestLeaseStoreAcquire(t *testing.T) {
+	st := NewLeaseStore()
+
+	lease, err := st.Acquire("fake", "win10", "sbapi", "ci", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.ID == "" || lease.Owner != "sbapi" || lease.Token != "ci" || lease.ExpiresAt.Sub(lease.AcquiredAt) != time.Minute {
+		t.Errorf("unexpected lease %+v", lease)
+	}
+
+	// The ID of the lease isn't handed out again, even to the same owner
+	// and token
+	for _, owner := range []string{"sbapi", "other"} {
+		again, err := st.Acquire("fake", "win10", owner, "ci", time.Hour)
+		if !errors.Is(err, ErrLeaseHeld) || again.ID != "" {
+			t.Errorf("got %+v and %v acquiring as %s, expected ErrLeaseHeld", again, err, owner)
+		}
+	}
+	// Same VM name on another provider
+	if _, err := st.Acquire("other", "win10", "other", "", time.Minute); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The VM of an expired lease isn't leased again before it is reclaimed
+	expireLease(st, lease.ID)
+	if _, err := st.Acquire("fake", "win10", "sbapi", "ci", time.Minute); !errors.Is(err, ErrLeaseHeld) {
+		t.Errorf("got %v, expected ErrLeaseHeld", err)
+	}
+}
+
+func TestLeaseStoreCheck(t *testing.T) {
+	st := NewLeaseStore()
+	lease, _ := st.Acquire("fake", "win10", "sbapi", "ci", time.Minute)
+	other, _ := st.Acquire("fake", "win11", "sbapi", "ci", time.Minute)
+	expired, _ := st.Acquire("fake", "win12", "sbapi", "ci", time.Minute)
+	internal, _ := st.Acquire("fake", "win14", "bulk", "", time.Minute)
+	expireLease(st, expired.ID)
+
+	tests := []struct {
+		name   string
+		vmName string
+		id     string
+		token  string
+		err    error
+	}{
+		{name: "lease of the VM", vmName: "win10", id: lease.ID, token: "ci"},
+		{name: "no lease", vmName: "win10", token: "ci", err: ErrLeaseHeld},
+		{name: "VM not leased", vmName: "win13", token: "ci", err: ErrLeaseRequired},
+		{name: "lease of another VM", vmName: "win10", id: other.ID, token: "ci", err: ErrLeaseRequired},
+		{name: "unknown lease", vmName: "win10", id: "unknown", token: "ci", err: ErrLeaseNotFound},
+		{name: "expired lease", vmName: "win12", id: expired.ID, token: "ci", err: ErrLeaseNotFound},
+		{name: "lease of another token", vmName: "win10", id: lease.ID, token: "ops", err: ErrLeaseNotHeld},
+		{name: "lease of a token without authentication", vmName: "win10", id: lease.ID, err: ErrLeaseNotHeld},
+		{name: "lease of hvapi", vmName: "win14", id: internal.ID, token: "ci", err: ErrLeaseNotHeld},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := st.Check("fake", tt.vmName, tt.id, tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLeaseStoreRenewRelease(t *testing.T) {
+	st := NewLeaseStore()
+	lease, _ := st.Acquire("fake", "win10", "sbapi", "ci", time.Minute)
+
+	renewed, err := st.Renew(lease.ID, "ci", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(renewed.ExpiresAt) < 59*time.Minute {
+		t.Errorf("got expiration %v, expected in an hour", renewed.ExpiresAt)
+	}
+	if _, err := st.Renew("unknown", "ci", time.Hour); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("got %v, expected ErrLeaseNotFound", err)
+	}
+	// Only by the token holding the lease
+	if _, err := st.Renew(lease.ID, "ops", time.Hour); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("got %v renewing with another token, expected ErrLeaseNotHeld", err)
+	}
+	if _, err := st.Release(lease.ID, "ops"); !errors.Is(err, ErrLeaseNotHeld) {
+		t.Errorf("got %v releasing with another token, expected ErrLeaseNotHeld", err)
+	}
+
+	if _, err := st.Release(lease.ID, "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Release(lease.ID, "ci"); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("got %v releasing twice, expected ErrLeaseNotFound", err)
+	}
+	if _, exists := st.Get(lease.ID); exists {
+		t.Error("released lease found")
+	}
+	// The VM is free for another owner
+	if _, err := st.Acquire("fake", "win10", "other", "", time.Minute); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// An expired lease is left to the reaper
+	lease, _ = st.Acquire("fake", "win11", "sbapi", "ci", time.Minute)
+	expireLease(st, lease.ID)
+	if _, err := st.Renew(lease.ID, "ci", time.Hour); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("got %v renewing an expired lease, expected ErrLeaseNotFound", err)
+	}
+	if _, err := st.Release(lease.ID, "ci"); !errors.Is(err, ErrLeaseNotFound) {
+		t.Errorf("got %v releasing an expired lease, expected ErrLeaseNotFound", err)
+	}
+	if len(st.List()) != 2 {
+		t.Errorf("got leases %+v, expected the expired one kept", st.List())
+	}
+}
+
+func TestLeaseStoreExpire(t *testing.T) {
+	st := NewLeaseStore()
+	lease, _ := st.Acquire("fake", "win10", "sbapi", "", time.Minute)
+	st.Acquire("fake", "win11", "sbapi", "", time.Minute)
+	expireLease(st, lease.ID)
+
+	expired := st.expire()
+	if len(expired) != 1 || expired[0].ID != lease.ID || !expired[0].Reclaiming {
+		t.Fatalf("got %+v, expected lease %s reclaiming", expired, lease.ID)
+	}
+	// Each lease is reclaimed once
+	if expired := st.expire(); len(expired) != 0 {
+		t.Errorf("got %+v expired again", expired)
+	}
+
+	st.releaseVM("fake", "win10")
+	if leases := st.List(); len(leases) != 1 || leases[0].VM != "win11" {
+		t.Errorf("got %+v, expected the lease of win11", leases)
+	}
+}
+
+func TestReclaimLease(t *testing.T) {
+	ctx := context.Background()
+	fake := &hvlib.FakeVP{}
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(ctx, "fake", fake, loader); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Server:    &commons.Server{Logger: quietLogger()},
+		Providers: providers,
+		Leases:    NewLeaseStore(),
+	}
+	if err := fake.Start(ctx, "win10"); err != nil {
+		t.Fatal(err)
+	}
+	lease, _ := s.Leases.Acquire("fake", "win10", "sbapi", "", time.Minute)
+	expireLease(s.Leases, lease.ID)
+
+	for _, expired := range s.Leases.expire() {
+		s.reclaimLease(ctx, expired)
+	}
+
+	vms, err := fake.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vms[0].State != "stopped" {
+		t.Errorf("got state %q, expected the VM reverted to its stopped snapshot", vms[0].State)
+	}
+	if leases := s.Leases.List(); len(leases) != 0 {
+		t.Errorf("got leases %+v, expected the VM free", leases)
+	}
+
+	// The lease is released even when the revert fails
+	lease, _ = s.Leases.Acquire("fake", "win10", "sbapi", "", time.Minute)
+	expireLease(s.Leases, lease.ID)
+	fake.InjectFailure(hvlib.OpRevert, errors.New("disk locked"))
+	for _, expired := range s.Leases.expire() {
+		s.reclaimLease(ctx, expired)
+	}
+	if leases := s.Leases.List(); len(leases) != 0 {
+		t.Errorf("got leases %+v after the failed revert, expected the VM free", leases)
+	}
+}
+
+func TestLeaseHandlersScope(t *testing.T) {
+	s := &Server{Server: &commons.Server{Logger: quietLogger()}, Leases: NewLeaseStore()}
+	operator := &APIToken{Name: "ci", Role: RoleOperator, Providers: []string{"fake"}, VMs: []string{"win10-*"}}
+	other := &APIToken{Name: "ci-2", Role: RoleOperator, Providers: []string{"fake"}}
+	reader := &APIToken{Name: "dashboard", Role: RoleReadOnly}
+	admin := &APIToken{Name: "ops", Role: RoleAdmin}
+
+	renew := (*Server).RenewLeaseHandler
+	release := (*Server).ReleaseLeaseHandler
+	tests := []struct {
+		name     string
+		vmName   string
+		holder   string // Token which acquired the lease
+		token    *APIToken
+		handler  func(*Server, http.ResponseWriter, *http.Request)
+		expected int
+		released bool
+	}{
+		{name: "renew in scope", vmName: "win10-1", holder: "ci", token: operator, handler: renew, expected: http.StatusOK},
+		{name: "renew out of scope", vmName: "win11", holder: "ci", token: operator, handler: renew, expected: http.StatusForbidden},
+		{name: "renew read-only", vmName: "win10-1", holder: "dashboard", token: reader, handler: renew, expected: http.StatusForbidden},
+		{name: "renew by another token", vmName: "win10-1", holder: "ci", token: other, handler: renew, expected: http.StatusForbidden},
+		{name: "renew by an admin", vmName: "win10-1", holder: "ci", token: admin, handler: renew, expected: http.StatusForbidden},
+		{name: "renew a lease of hvapi", vmName: "win10-1", token: operator, handler: renew, expected: http.StatusForbidden},
+		{name: "release in scope", vmName: "win10-1", holder: "ci", token: operator, handler: release, expected: http.StatusOK, released: true},
+		{name: "release out of scope", vmName: "win11", holder: "ci", token: operator, handler: release, expected: http.StatusForbidden},
+		{name: "release by another token", vmName: "win10-1", holder: "ci", token: other, handler: release, expected: http.StatusForbidden},
+		{name: "release by an admin", vmName: "win10-1", holder: "ci", token: admin, handler: release, expected: http.StatusOK, released: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lease, err := s.Leases.Acquire("fake", tt.vmName, "sbapi", tt.holder, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Leases.releaseVM("fake", tt.vmName)
+
+			r := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/leases/"+lease.ID, nil), map[string]string{"id": lease.ID})
+			w := httptest.NewRecorder()
+			tt.handler(s, w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, tt.token)))
+
+			if w.Code != tt.expected {
+				t.Errorf("got status %d, expected %d: %s", w.Code, tt.expected, w.Body)
+			}
+			if _, exists := s.Leases.Get(lease.ID); exists == tt.released {
+				t.Errorf("got lease kept %v, expected %v", exists, !tt.released)
+			}
+		})
+	}
+
+	// Unknown leases are answered 404 whatever the token
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/leases/unknown", nil), map[string]string{"id": "unknown"})
+	w := httptest.NewRecorder()
+	s.ReleaseLeaseHandler(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, operator)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, expected 404", w.Code)
+	}
+}
+
+func TestListLeasesHandler(t *testing.T) {
+	s := &Server{Server: &commons.Server{Logger: quietLogger()}, Leases: NewLeaseStore()}
+	mine, _ := s.Leases.Acquire("fake", "win10-1", "sbapi", "ci", time.Minute)
+	s.Leases.Acquire("fake", "win10-2", "image win10", "", time.Minute)
+	s.Leases.Acquire("fake", "win11", "pool win11", "ops", time.Minute)
+
+	tests := []struct {
+		name     string
+		token    *APIToken
+		expected map[string]bool // VMs listed, whether with the lease ID
+	}{
+		{name: "holder", token: &APIToken{Name: "ci", Role: RoleOperator, Providers: []string{"fake"}, VMs: []string{"win10-*"}},
+			expected: map[string]bool{"win10-1": true, "win10-2": false}},
+		{name: "read-only", token: &APIToken{Name: "dashboard", Role: RoleReadOnly},
+			expected: map[string]bool{"win10-1": false, "win10-2": false, "win11": false}},
+		{name: "out of scope", token: &APIToken{Name: "dashboard", Role: RoleReadOnly, Providers: []string{"vmware"}},
+			expected: map[string]bool{}},
+		{name: "without authentication", expected: map[string]bool{"win10-1": true, "win10-2": true, "win11": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/leases", nil)
+			w := httptest.NewRecorder()
+			s.ListLeasesHandler(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, tt.token)))
+
+			var leases []Lease
+			if err := json.NewDecoder(w.Body).Decode(&commons.HttpResp{Data: &leases}); err != nil {
+				t.Fatal(err)
+			}
+			if leases == nil || len(leases) != len(tt.expected) {
+				t.Fatalf("got %+v, expected the leases of %v", leases, tt.expected)
+			}
+			for _, lease := range leases {
+				withID, listed := tt.expected[lease.VM]
+				if !listed || withID != (lease.ID != "") {
+					t.Errorf("got lease %+v, expected listed %v with ID %v", lease, listed, withID)
+				}
+				if lease.ID != "" && lease.VM == "win10-1" && lease.ID != mine.ID {
+					t.Errorf("got ID %s, expected %s", lease.ID, mine.ID)
+				}
+			}
+		})
+	}
+}
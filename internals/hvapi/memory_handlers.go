@@ -0,0 +1,197 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MemoryDumpUploadRequest is the body of UploadMemoryDumpHandler
+type MemoryDumpUploadRequest struct {
+	S3Prefix string `json:"s3_prefix"` // The files are stored as <api.s3.prefix>/<s3_prefix>/<file name>
+}
+
+// DownloadMemoryDumpHandler godoc
+// @Summary Download a memory dump of a virtual machine
+// @Description Dump the memory of a virtual machine and stream the files as a zip archive. Depending on the provider the VM is left suspended. Large VMs may need a longer dump_memory timeout in [api.timeouts].
+// @Tags memory
+// @Produce  application/zip
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {file} binary
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/memory [get]
+func (s *Server) DownloadMemoryDumpHandler(w http.ResponseWriter, r *http.Request) {
+	vmName := mux.Vars(r)["vmname"]
+
+	dir, paths, ok := s.dumpMemory(w, r)
+	if !ok {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Dumps are mostly incompressible, files are stored as is
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", vmName+"-memory.zip"))
+	archive := zip.NewWriter(w)
+	for _, p := range paths {
+		if err := addFileToZip(archive, p); err != nil {
+			s.Logger.WithError(err).Errorf("Failed to send memory dump of VM %s", vmName)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		s.Logger.WithError(err).Errorf("Failed to send memory dump of VM %s", vmName)
+	}
+}
+
+// UploadMemoryDumpHandler godoc
+// @Summary Upload a memory dump of a virtual machine to S3
+// @Description Dump the memory of a virtual machine and upload the files to the bucket configured in [api.s3], under the configured prefix. The S3 keys are returned. Depending on the provider the VM is left suspended.
+// @Tags memory
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param request body MemoryDumpUploadRequest true "Destination of the files"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/memory [post]
+func (s *Server) UploadMemoryDumpHandler(w http.ResponseWriter, r *http.Request) {
+	vmName := mux.Vars(r)["vmname"]
+
+	if s.Artifacts == nil {
+		commons.WriteErrorResponse(w, "S3 upload is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	var params MemoryDumpUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.S3Prefix == "" {
+		commons.WriteErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	prefix, err := s.Artifacts.Key(strings.TrimSuffix(params.S3Prefix, "/"))
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	dir, paths, ok := s.dumpMemory(w, r)
+	if !ok {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var keys []string
+	for _, p := range paths {
+		key := path.Join(prefix, filepath.Base(p))
+		if err := s.Artifacts.Upload(r.Context(), key, p); err != nil {
+			commons.WriteErrorResponse(w, fmt.Sprintf("Failed to upload %s: %v", key, err), http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("Memory dump of VM %s uploaded", vmName),
+		keys)
+}
+
+// dumpMemory dumps the memory of the VM of the request into a temporary
+// directory, which the caller removes. On failure the error response is
+// written and ok is false.
+func (s *Server) dumpMemory(w http.ResponseWriter, r *http.Request) (dir string, paths []string, ok bool) {
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return "", nil, false
+	}
+
+	dumper, supported := provider.(hvlib.MemoryDumper)
+	if !supported || !hvlib.HasCapability(provider, hvlib.CapMemoryDump) {
+		commons.WriteErrorResponse(w, "Memory dumps are not supported by this provider", http.StatusNotImplemented)
+		return "", nil, false
+	}
+
+	vmName := mux.Vars(r)["vmname"]
+
+	if !s.checkLease(w, r, mux.Vars(r)["provider"], vmName) {
+		return "", nil, false
+	}
+
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return "", nil, false
+	}
+	defer s.ReleaseLock(vmName)
+
+	dir, err := os.MkdirTemp("", "hvapi-memory-*")
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return "", nil, false
+	}
+
+	ctx, cancel := s.operationContext(r, hvlib.OpDumpMemory)
+	defer cancel()
+
+	start := time.Now()
+	paths, err = dumper.DumpMemory(ctx, vmName, dir)
+	s.Metrics.ObserveOperation(mux.Vars(r)["provider"], hvlib.OpDumpMemory, start, err)
+	if err != nil {
+		os.RemoveAll(dir)
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return "", nil, false
+	}
+	return dir, paths, true
+}
+
+func addFileToZip(archive *zip.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Method = zip.Store
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
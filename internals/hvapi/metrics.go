@@ -0,0 +1,172 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Types of the errors counted by hvapi_provider_operation_errors_total
+const (
+	ErrorTypeTimeout          = "timeout"
+	ErrorTypeCanceled         = "canceled"
+	ErrorTypeVmNotFound       = "vm_not_found"
+	ErrorTypeSnapshotNotFound = "snapshot_not_found"
+	ErrorTypeSnapshotExists   = "snapshot_exists"
+	ErrorTypeInvalidName      = "invalid_name"
+	ErrorTypeNotSupported     = "not_supported"
+	ErrorTypeVirtualization   = "virtualization" // The hypervisor or its tool failed (vmrun, PowerShell...)
+	ErrorTypeOther            = "other"
+)
+
+// operationBuckets spans the quick listings to the slow reverts and clones,
+// in seconds
+var operationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Metrics are the Prometheus metrics served by GET /metrics. A nil Metrics
+// records nothing.
+type Metrics struct {
+	registry       *prometheus.Registry
+	durations      *prometheus.HistogramVec
+	errors         *prometheus.CounterVec
+	lockContention *prometheus.CounterVec
+	handler        http.Handler
+}
+
+// NewMetrics registers the hvapi metrics, the power states of the VMs are
+// the last ones seen by the EventBus. Without the state watcher the EventBus
+// only knows the providers checked after an operation, the states of the
+// others aren't exported.
+func NewMetrics(events *EventBus) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hvapi_provider_operation_duration_seconds",
+			Help:    "Duration of the provider operations, failed ones included.",
+			Buckets: operationBuckets,
+		}, []string{"provider", "operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hvapi_provider_operation_errors_total",
+			Help: "Failed provider operations by error type.",
+		}, []string{"provider", "operation", "type"}),
+		lockContention: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hvapi_vm_lock_contention_total",
+			Help: "Operations refused because another operation held the lock of the VM.",
+		}, []string{"vm"}),
+	}
+	m.registry.MustRegister(
+		m.durations,
+		m.errors,
+		m.lockContention,
+		&powerStateCollector{events: events},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// ObserveOperation records the duration of a provider operation started
+// at start, and its error
+func (m *Metrics) ObserveOperation(providerName, operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.durations.WithLabelValues(providerName, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(providerName, operation, errorType(err)).Inc()
+	}
+}
+
+// LockContended counts an operation refused by TryAcquireLock
+func (m *Metrics) LockContended(vmName string) {
+	if m == nil {
+		return
+	}
+	m.lockContention.WithLabelValues(vmName).Inc()
+}
+
+// errorType classifies a provider error, a timeout is reported as such
+// whatever error wraps it
+func errorType(err error) string {
+	var notFound *hvlib.VmNotFoundError
+	var snapshotNotFound *hvlib.SnapshotNotFoundError
+	var snapshotExists *hvlib.SnapshotExistsError
+	var invalidName *hvlib.InvalidNameError
+	var virtualization *hvlib.VirtualizationError
+	var exitErr *hvlib.CommandExitError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTypeTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorTypeCanceled
+	case errors.As(err, &notFound):
+		return ErrorTypeVmNotFound
+	case errors.As(err, &snapshotNotFound):
+		return ErrorTypeSnapshotNotFound
+	case errors.As(err, &snapshotExists):
+		return ErrorTypeSnapshotExists
+	case errors.As(err, &invalidName):
+		return ErrorTypeInvalidName
+	case errors.Is(err, hvlib.ErrNotSupported):
+		return ErrorTypeNotSupported
+	case errors.As(err, &virtualization), errors.As(err, &exitErr):
+		return ErrorTypeVirtualization
+	default:
+		return ErrorTypeOther
+	}
+}
+
+var powerStateDesc = prometheus.NewDesc(
+	"hvapi_vm_power_state",
+	"Power state of the VMs, 1 for the current state. Refreshed by the state watcher and after the operations, without the watcher (api.state_watch_interval = 0) only the providers operated since the start are reported.",
+	[]string{"provider", "vm", "state"}, nil,
+)
+
+// powerStateCollector exports the power states known by the EventBus, so
+// that a scrape doesn't query the hypervisors
+type powerStateCollector struct {
+	events *EventBus
+}
+
+func (c *powerStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- powerStateDesc
+}
+
+func (c *powerStateCollector) Collect(ch chan<- prometheus.Metric) {
+	for providerName, states := range c.events.States() {
+		for vmName, current := range states {
+			for _, state := range hvlib.PowerStates {
+				value := 0.0
+				if state == current {
+					value = 1
+				}
+				ch <- prometheus.MustNewConstMetric(powerStateDesc, prometheus.GaugeValue, value, providerName, vmName, state)
+			}
+		}
+	}
+}
+
+// MetricsHandler godoc
+// @Summary Get the Prometheus metrics
+// @Description Latency histograms and error counters of the provider operations by provider and operation, lock contention by VM and power state of the VMs, in the Prometheus exposition format
+// @Tags metrics
+// @Produce  plain
+// @Success 200 {string} string
+// @Failure 501 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /metrics [get]
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Metrics == nil {
+		commons.WriteErrorResponse(w, "Metrics are disabled", http.StatusNotImplemented)
+		return
+	}
+	s.Metrics.handler.ServeHTTP(w, r)
+}
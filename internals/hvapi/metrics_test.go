@@ -0,0 +1,41 @@
+package hvapi
+
+import (
+	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorType(t *testing.T) {
+	exitErr := &hvlib.CommandExitError{ExitCode: 255}
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{name: "timeout", err: context.DeadlineExceeded, expected: ErrorTypeTimeout},
+		{name: "tool killed by the timeout", err: fmt.Errorf("cmd.Wait %w", context.DeadlineExceeded), expected: ErrorTypeTimeout},
+		{name: "timeout of a guest operation", err: &hvlib.VirtualizationError{Operation: hvlib.OpRunInGuest, Err: context.DeadlineExceeded}, expected: ErrorTypeTimeout},
+		{name: "canceled", err: fmt.Errorf("cmd.Wait %w", context.Canceled), expected: ErrorTypeCanceled},
+		{name: "vm not found", err: &hvlib.VmNotFoundError{VmName: "win10"}, expected: ErrorTypeVmNotFound},
+		{name: "snapshot not found", err: fmt.Errorf("revert: %w", &hvlib.SnapshotNotFoundError{}), expected: ErrorTypeSnapshotNotFound},
+		{name: "snapshot exists", err: &hvlib.SnapshotExistsError{}, expected: ErrorTypeSnapshotExists},
+		{name: "invalid name", err: &hvlib.InvalidNameError{Name: "a;b"}, expected: ErrorTypeInvalidName},
+		{name: "not supported", err: fmt.Errorf("memory dump: %w", hvlib.ErrNotSupported), expected: ErrorTypeNotSupported},
+		{name: "virtualization", err: &hvlib.VirtualizationError{Operation: hvlib.OpStart, Err: errors.New("VM locked")}, expected: ErrorTypeVirtualization},
+		// vmrun, VBoxManage and virsh failures wrapped by execVmCommand
+		{name: "tool exit code", err: fmt.Errorf("%s (%w)", "Error: The virtual machine is not powered on", exitErr), expected: ErrorTypeVirtualization},
+		{name: "powershell exit code", err: &hvlib.VirtualizationError{Operation: hvlib.OpStop, Err: fmt.Errorf("%w, output: %s", exitErr, "")}, expected: ErrorTypeVirtualization},
+		{name: "other", err: errors.New("invalid character"), expected: ErrorTypeOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorType(tt.err); got != tt.expected {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
@@ -2,8 +2,12 @@ package hvapi
 
 import (
 	"TraceForge/internals/commons"
+	"context"
+	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/gorilla/mux"
 )
 
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
@@ -25,13 +29,58 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Validate token
-		if headerParts[1] != s.AuthToken {
+		token := s.findToken(headerParts[1])
+		if token == nil {
 			s.Logger.Warn("Invalid token")
 			commons.WriteErrorResponse(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if entry := auditEntryFromContext(r.Context()); entry != nil {
+			entry.Token = token.Name
+		}
+
+		// Check the role and scope of the token
+		role, providerName, vmName := s.routePermission(r)
+		if !token.allows(role, providerName, vmName) {
+			s.Logger.Warnf("Token %s denied %s %s", token.Name, r.Method, r.URL.Path)
+			commons.WriteErrorResponse(w,
+				fmt.Sprintf("Forbidden, the token needs the %s role on this provider and VM", role),
+				http.StatusForbidden)
+			return
+		}
 
 		// Token is valid, proceed with the request
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
 	})
 }
+
+// routePermission returns the role required by the route of the request,
+// with its provider and VM when it has some
+func (s *Server) routePermission(r *http.Request) (role, providerName, vmName string) {
+	role = RoleOperator
+	if r.Method == http.MethodGet {
+		role = RoleReadOnly
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			if required, exists := routeRoles[r.Method+" "+template]; exists {
+				role = required
+			}
+		}
+	}
+
+	vars := mux.Vars(r)
+	providerName = vars["provider"]
+	if name, exists := vars["name"]; exists {
+		// /providers/{name}
+		providerName = name
+	}
+	if pool, exists := s.Pools[vars["pool"]]; exists {
+		providerName = pool.Provider
+	}
+	vmName = vars["vmname"]
+	if image, exists := s.Images[vars["image"]]; exists {
+		providerName, vmName = image.Provider, image.VM
+	}
+	return role, providerName, vmName
+}
@@ -0,0 +1,100 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ListNetworkProfilesHandler godoc
+// @Summary List the network profiles of a provider
+// @Description List the names of the network profiles configured in [<provider>.network_profiles]
+// @Tags network
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /{provider}/network_profiles [get]
+func (s *Server) ListNetworkProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	configurator := s.getNetworkConfiguratorFromRequest(w, r)
+	if configurator == nil {
+		return
+	}
+	commons.WriteSuccessResponse(w, "", configurator.ListNetworkProfiles())
+}
+
+// SetNetworkProfileHandler godoc
+// @Summary Attach a virtual machine to the network of a profile
+// @Description Apply a network profile (isolated, simulated internet, gateway...) to a virtual machine. Apply it before starting the VM: VMware only edits the configuration of powered off VMs.
+// @Tags network
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param profile path string true "Network profile name"
+// @Param X-Lease-ID header string true "ID of the lease of the VM"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Conflict
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/network/{profile} [post]
+func (s *Server) SetNetworkProfileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	configurator := s.getNetworkConfiguratorFromRequest(w, r)
+	if configurator == nil {
+		return
+	}
+
+	vmName := vars["vmname"]
+	profile := vars["profile"]
+
+	if !s.checkLease(w, r, vars["provider"], vmName) {
+		return
+	}
+
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return
+	}
+	defer s.ReleaseLock(vmName)
+
+	ctx, cancel := s.operationContext(r, hvlib.OpSetNetworkProfile)
+	defer cancel()
+
+	start := time.Now()
+	err := configurator.SetNetworkProfile(ctx, vmName, profile)
+	s.Metrics.ObserveOperation(vars["provider"], hvlib.OpSetNetworkProfile, start, err)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("Network profile %s applied to VM %s", profile, vmName),
+		nil)
+}
+
+// getNetworkConfiguratorFromRequest returns the provider of the request
+// when it supports network profiles, otherwise the error response is written
+func (s *Server) getNetworkConfiguratorFromRequest(w http.ResponseWriter, r *http.Request) hvlib.NetworkConfigurator {
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return nil
+	}
+	configurator, ok := provider.(hvlib.NetworkConfigurator)
+	if !ok || !hvlib.HasCapability(provider, hvlib.CapNetworkProfiles) {
+		commons.WriteErrorResponse(w, "Network profiles are not supported by this provider", http.StatusNotImplemented)
+		return nil
+	}
+	return configurator
+}
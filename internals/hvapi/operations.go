@@ -0,0 +1,255 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Status of an Operation
+const (
+	OperationPending   = "pending"
+	OperationRunning   = "running"
+	OperationSucceeded = "succeeded"
+	OperationFailed    = "failed"
+)
+
+// defaultOperationHistory is the number of operations kept when
+// api.operation_history isn't set
+const defaultOperationHistory = 1000
+
+// Operation is a VM operation accepted with ?async=true, it runs in the
+// background and is polled with GET /operations/{id}
+type Operation struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"` // hvlib.Op* name
+	Provider   string      `json:"provider"`
+	VM         string      `json:"vm"` // Empty for a bulk operation
+	Status     string      `json:"status"`
+	Progress   string      `json:"progress,omitempty"`    // Step in progress
+	Message    string      `json:"message,omitempty"`     // Result of a succeeded operation
+	Error      string      `json:"error,omitempty"`       // Reason of a failed operation
+	StatusCode int         `json:"status_code,omitempty"` // HTTP status the synchronous call would have answered
+	Result     interface{} `json:"result,omitempty"`      // Report of a bulk operation
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+// Done reports whether the operation succeeded or failed
+func (op *Operation) Done() bool {
+	return op.Status == OperationSucceeded || op.Status == OperationFailed
+}
+
+// OperationStore keeps the last operations, the oldest finished ones are
+// dropped beyond its size
+type OperationStore struct {
+	mu    sync.Mutex
+	ops   map[string]*Operation
+	order []string // IDs by creation
+	size  int
+}
+
+func NewOperationStore(size int) *OperationStore {
+	if size <= 0 {
+		size = defaultOperationHistory
+	}
+	return &OperationStore{ops: make(map[string]*Operation), size: size}
+}
+
+// create registers a pending operation
+func (st *OperationStore) create(operation, provider, vmName string) *Operation {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	op := &Operation{
+		ID:        uuid.NewString(),
+		Type:      operation,
+		Provider:  provider,
+		VM:        vmName,
+		Status:    OperationPending,
+		CreatedAt: time.Now(),
+	}
+	st.ops[op.ID] = op
+	st.order = append(st.order, op.ID)
+
+	// Operations still running are kept whatever the size
+	for i := 0; len(st.ops) > st.size && i < len(st.order); {
+		if id := st.order[i]; st.ops[id].Done() {
+			delete(st.ops, id)
+			st.order = append(st.order[:i], st.order[i+1:]...)
+			continue
+		}
+		i++
+	}
+	return op
+}
+
+// update applies change to the operation under the store lock
+func (st *OperationStore) update(op *Operation, change func(op *Operation)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	change(op)
+}
+
+// Get returns a copy of the operation
+func (st *OperationStore) Get(id string) (Operation, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	op, exists := st.ops[id]
+	if !exists {
+		return Operation{}, false
+	}
+	return *op, true
+}
+
+// List returns a copy of the operations, the most recent first
+func (st *OperationStore) List() []Operation {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ops := make([]Operation, 0, len(st.order))
+	for i := len(st.order) - 1; i >= 0; i-- {
+		ops = append(ops, *st.ops[st.order[i]])
+	}
+	return ops
+}
+
+// isAsync reports whether the client asked for an asynchronous operation
+func isAsync(r *http.Request) bool {
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	return async
+}
+
+// runVMOperation runs an operation on a VM holding its lock. By default
+// the response is written once the operation ends. With ?async=true the
+// operation runs in the background and is answered 202 with its ID.
+// run returns the message of the successful response.
+func (s *Server) runVMOperation(w http.ResponseWriter, r *http.Request, operation, providerName, vmName string,
+	run func(ctx context.Context, progress func(string)) (string, error)) {
+	// Acquire the lock for this VM
+	if !s.TryAcquireLock(vmName) {
+		commons.WriteErrorResponse(w, "Another operation is in progress for this VM", http.StatusConflict)
+		return
+	}
+
+	if !isAsync(r) {
+		defer s.ReleaseLock(vmName)
+
+		ctx, cancel := s.operationContext(r, operation)
+		defer cancel()
+
+		message, err := run(ctx, func(string) {})
+		if err != nil {
+			commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+			return
+		}
+		commons.WriteSuccessResponse(w, message, nil)
+		return
+	}
+
+	s.startOperation(w, r, operation, providerName, vmName, s.timeout(operation),
+		func(ctx context.Context, progress func(string)) (string, interface{}, error) {
+			message, err := run(ctx, progress)
+			return message, nil, err
+		},
+		func() { s.ReleaseLock(vmName) })
+}
+
+// startOperation runs an operation in the background and answers 202 with
+// its ID, done is called once it ends. run returns the message and the
+// result of the operation.
+func (s *Server) startOperation(w http.ResponseWriter, r *http.Request, operation, providerName, vmName string,
+	timeout time.Duration, run func(ctx context.Context, progress func(string)) (string, interface{}, error), done func()) {
+	op := s.Operations.create(operation, providerName, vmName)
+	accepted := *op
+	// The audit middleware completes its entry once the handler returns,
+	// the outcome is recorded from a copy
+	var audit *AuditEntry
+	if entry := auditEntryFromContext(r.Context()); entry != nil {
+		entry.Operation = op.ID
+		snapshot := *entry
+		audit = &snapshot
+	}
+	go func() {
+		defer done()
+
+		// The operation outlives the request
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		s.Operations.update(op, func(op *Operation) {
+			now := time.Now()
+			op.Status = OperationRunning
+			op.StartedAt = &now
+		})
+		message, result, err := run(ctx, func(progress string) {
+			s.Operations.update(op, func(op *Operation) { op.Progress = progress })
+		})
+		s.Operations.update(op, func(op *Operation) {
+			now := time.Now()
+			op.FinishedAt = &now
+			op.Progress = ""
+			op.Result = result
+			if err != nil {
+				op.Status = OperationFailed
+				op.Error = err.Error()
+				op.StatusCode = errorStatus(err)
+			} else {
+				op.Status = OperationSucceeded
+				op.Message = message
+				op.StatusCode = http.StatusOK
+			}
+		})
+		if err != nil {
+			s.Logger.WithError(err).Errorf("Operation %s (%s on %s) failed", op.ID, operation, vmName)
+		}
+		if finished, exists := s.Operations.Get(op.ID); exists {
+			s.auditOperation(audit, finished)
+		}
+	}()
+
+	commons.WriteJSONResponse(w, http.StatusAccepted, &commons.HttpResp{
+		Status:  "success",
+		Data:    accepted,
+		Message: fmt.Sprintf("Operation %s accepted", accepted.ID),
+	})
+}
+
+// ListOperationsHandler godoc
+// @Summary List the asynchronous operations
+// @Description List the operations accepted with async=true, the most recent first. Only the last api.operation_history operations are kept.
+// @Tags operations
+// @Produce  json
+// @Success 200 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /operations [get]
+func (s *Server) ListOperationsHandler(w http.ResponseWriter, r *http.Request) {
+	commons.WriteSuccessResponse(w, "", s.Operations.List())
+}
+
+// GetOperationHandler godoc
+// @Summary Get an asynchronous operation
+// @Description Get the status (pending, running, succeeded or failed), progress and error of an operation accepted with async=true
+// @Tags operations
+// @Produce  json
+// @Param id path string true "Operation ID"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /operations/{id} [get]
+func (s *Server) GetOperationHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	op, exists := s.Operations.Get(id)
+	if !exists {
+		commons.WriteErrorResponse(w, fmt.Sprintf("Operation %s not found", id), http.StatusNotFound)
+		return
+	}
+	commons.WriteSuccessResponse(w, "", op)
+}
@@ -0,0 +1,99 @@
+package hvapi
+
+import (
+	"testing"
+)
+
+func finishOperation(st *OperationStore, op *Operation) {
+	st.update(op, func(op *Operation) { op.Status = OperationSucceeded })
+}
+
+func TestNewOperationStore(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		if st := NewOperationStore(size); st.size != defaultOperationHistory {
+			t.Errorf("size %d: got history of %d, expected %d", size, st.size, defaultOperationHistory)
+		}
+	}
+	if st := NewOperationStore(5); st.size != 5 {
+		t.Errorf("got history of %d, expected 5", st.size)
+	}
+}
+
+func TestOperationStoreEviction(t *testing.T) {
+	st := NewOperationStore(3)
+
+	first := st.create("start", "fake", "win10")
+	second := st.create("stop", "fake", "win10")
+	third := st.create("revert", "fake", "win11")
+	finishOperation(st, second)
+	finishOperation(st, third)
+
+	// The oldest finished operation is dropped, the running one is kept
+	fourth := st.create("reset", "fake", "win11")
+	if _, exists := st.Get(second.ID); exists {
+		t.Error("oldest finished operation kept beyond the history size")
+	}
+	for _, op := range []*Operation{first, third, fourth} {
+		if _, exists := st.Get(op.ID); !exists {
+			t.Errorf("operation %s dropped", op.Type)
+		}
+	}
+
+	// Running operations are kept whatever the size
+	finishOperation(st, third)
+	st.create("suspend", "fake", "win10")
+	st.create("start", "fake", "win11")
+	if got := len(st.List()); got != 4 {
+		t.Errorf("got %d operations, expected the 4 running ones", got)
+	}
+	if _, exists := st.Get(first.ID); !exists {
+		t.Error("running operation dropped")
+	}
+
+	// Once finished they are dropped by the next creations
+	for _, op := range st.List() {
+		finishOperation(st, st.ops[op.ID])
+	}
+	st.create("start", "fake", "win10")
+	if got := len(st.List()); got != 3 {
+		t.Errorf("got %d operations, expected 3", got)
+	}
+	if _, exists := st.Get(first.ID); exists {
+		t.Error("oldest operation kept")
+	}
+}
+
+func TestOperationStoreList(t *testing.T) {
+	st := NewOperationStore(10)
+	for _, operation := range []string{"start", "stop", "revert"} {
+		st.create(operation, "fake", "win10")
+	}
+
+	ops := st.List()
+	if len(ops) != 3 || ops[0].Type != "revert" || ops[2].Type != "start" {
+		t.Fatalf("got %+v, expected the most recent first", ops)
+	}
+	for _, op := range ops {
+		if op.Status != OperationPending || op.Provider != "fake" || op.VM != "win10" {
+			t.Errorf("unexpected operation %+v", op)
+		}
+	}
+}
+
+func TestOperationStoreGetCopy(t *testing.T) {
+	st := NewOperationStore(10)
+	op := st.create("start", "fake", "win10")
+
+	got, exists := st.Get(op.ID)
+	if !exists {
+		t.Fatal("operation not found")
+	}
+	got.Status = OperationFailed
+	if stored, _ := st.Get(op.ID); stored.Status != OperationPending {
+		t.Errorf("the copy changed the stored operation to %s", stored.Status)
+	}
+
+	if _, exists := st.Get("unknown"); exists {
+		t.Error("unknown operation found")
+	}
+}
@@ -0,0 +1,151 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// PoolClone is a clone handed out by a pool
+type PoolClone struct {
+	Pool     string `json:"pool"`
+	Provider string `json:"provider"`
+	VM       string `json:"vm"`
+	Lease    Lease  `json:"lease"` // Lease of the clone, it returns to the pool when it expires
+}
+
+// ListPoolsHandler godoc
+// @Summary List the clone pools
+// @Description List the warm clone pools with their utilisation
+// @Tags pools
+// @Produce  json
+// @Success 200 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /pools [get]
+func (s *Server) ListPoolsHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.Pools))
+	for name := range s.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]PoolStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, s.Pools[name].Status())
+	}
+	commons.WriteSuccessResponse(w, "", statuses)
+}
+
+// PoolStatusHandler godoc
+// @Summary Get the utilisation of a clone pool
+// @Description Get the ready, in use, creating and deleting clones of a pool
+// @Tags pools
+// @Produce  json
+// @Param pool path string true "Pool name"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /pools/{pool} [get]
+func (s *Server) PoolStatusHandler(w http.ResponseWriter, r *http.Request) {
+	pool := s.getPoolFromRequest(w, r)
+	if pool == nil {
+		return
+	}
+	commons.WriteSuccessResponse(w, "", pool.Status())
+}
+
+// AcquireCloneHandler godoc
+// @Summary Acquire a clone from a pool
+// @Description Hand out a clone of the golden VM of the pool for one analysis, leased to the owner. A ready clone is returned immediately, otherwise a clone is created when the pool isn't full. Release the clone when the analysis ends, it is also released when its lease expires.
+// @Tags pools
+// @Accept  json
+// @Produce  json
+// @Param pool path string true "Pool name"
+// @Param request body LeaseRequest false "Owner and TTL of the lease of the clone"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Failure 503 {object} commons.HttpResp // Pool exhausted
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /pools/{pool}/acquire [post]
+func (s *Server) AcquireCloneHandler(w http.ResponseWriter, r *http.Request) {
+	pool := s.getPoolFromRequest(w, r)
+	if pool == nil {
+		return
+	}
+
+	params, ttl, ok := parseLeaseRequest(w, r)
+	if !ok {
+		return
+	}
+	if params.Owner == "" {
+		params.Owner = "pool " + pool.Name
+	}
+
+	vmName, err := s.AcquireClone(r.Context(), pool)
+	if err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	lease, err := s.Leases.Acquire(pool.Provider, vmName, params.Owner, TokenFromContext(r.Context()).name(), ttl)
+	if err != nil {
+		s.ReleaseClone(pool, vmName)
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+	s.Events.Publish(Event{Type: EventLeaseAcquired, Provider: lease.Provider, VM: lease.VM, Owner: lease.Owner})
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("Clone %s acquired from pool %s", vmName, pool.Name),
+		PoolClone{Pool: pool.Name, Provider: pool.Provider, VM: vmName, Lease: lease})
+}
+
+// ReleaseCloneHandler godoc
+// @Summary Release a clone to its pool
+// @Description Power off and delete a clone acquired from the pool and end its lease, the deletion runs in the background
+// @Tags pools
+// @Produce  json
+// @Param pool path string true "Pool name"
+// @Param vmname path string true "Clone name"
+// @Param X-Lease-ID header string true "ID of the lease of the clone"
+// @Success 200 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 409 {object} commons.HttpResp // Leased by another owner
+// @Failure 428 {object} commons.HttpResp // Lease required
+// @Security ApiKeyAuth
+// @Router /pools/{pool}/release/{vmname} [post]
+func (s *Server) ReleaseCloneHandler(w http.ResponseWriter, r *http.Request) {
+	pool := s.getPoolFromRequest(w, r)
+	if pool == nil {
+		return
+	}
+
+	vmName := mux.Vars(r)["vmname"]
+	if !s.checkLease(w, r, pool.Provider, vmName) {
+		return
+	}
+	if err := s.ReleaseClone(pool, vmName); err != nil {
+		commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	commons.WriteSuccessResponse(w,
+		fmt.Sprintf("Clone %s released to pool %s", vmName, pool.Name),
+		nil)
+}
+
+// getPoolFromRequest returns the pool of the request, otherwise the error
+// response is written
+func (s *Server) getPoolFromRequest(w http.ResponseWriter, r *http.Request) *Pool {
+	name := mux.Vars(r)["pool"]
+	pool, exists := s.Pools[name]
+	if !exists {
+		commons.WriteErrorResponse(w, fmt.Sprintf("Pool %s not found", name), http.StatusNotFound)
+		return nil
+	}
+	return pool
+}
@@ -0,0 +1,384 @@
+package hvapi
+
+import (
+	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pelletier/go-toml"
+)
+
+var (
+	ErrPoolExhausted = errors.New("all the clones of the pool are in use")
+	ErrNotLeased     = errors.New("VM is not a clone in use of the pool")
+)
+
+var poolNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// cloneSuffixRegexp matches what follows the clone prefix of the pool in
+// the name of its clones
+var cloneSuffixRegexp = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// Pool keeps warm linked clones of a snapshot of a golden VM, each clone
+// is handed out for one analysis and deleted when it is released
+type Pool struct {
+	Name     string
+	Provider string
+	Source   string // Golden VM
+	Snapshot string // Snapshot of Source the clones are created from
+	Size     int    // Ready clones kept
+	Max      int    // Clones at most, ready and in use
+
+	mu       sync.Mutex
+	ready    []string
+	inUse    map[string]time.Time // Clone name to acquisition time
+	creating int
+	deleting int
+	stale    []string // Clones whose deletion failed, deleted again by the pool goroutine
+	refill   chan struct{}
+}
+
+// PoolStatus reports the utilisation of a pool
+type PoolStatus struct {
+	Name        string            `json:"name"`
+	Provider    string            `json:"provider"`
+	Source      string            `json:"source"`
+	Snapshot    string            `json:"snapshot"`
+	Size        int               `json:"size"`
+	Max         int               `json:"max"`
+	Ready       []string          `json:"ready"`
+	InUse       map[string]string `json:"in_use"` // Clone name to acquisition time
+	Creating    int               `json:"creating"`
+	Deleting    int               `json:"deleting"`
+	Stale       []string          `json:"stale"`       // Clones whose deletion failed, retried
+	Utilisation float64           `json:"utilisation"` // Clones in use out of Max
+}
+
+// LoadPools reads the [api.pools.<name>] sections, the provider of each
+// pool must support clones:
+//
+//	[api.pools.win10]
+//	provider = "vmware"
+//	source = "win10-golden"
+//	snapshot = "clean"
+//	size = 2
+//	max = 8
+func LoadPools(loader *hvlib.ConfigLoader, providers *ProviderRegistry) (map[string]*Pool, error) {
+	pools := make(map[string]*Pool)
+	tree, ok := loader.Get("api.pools").(*toml.Tree)
+	if !ok {
+		return pools, nil
+	}
+
+	for _, name := range tree.Keys() {
+		table, ok := tree.Get(name).(*toml.Tree)
+		if !ok {
+			return nil, fmt.Errorf("invalid api.pools.%s, expected a table", name)
+		}
+		if !poolNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid pool name %q", name)
+		}
+		pool := &Pool{
+			Name:     name,
+			Provider: fmt.Sprint(table.GetDefault("provider", "")),
+			Source:   fmt.Sprint(table.GetDefault("source", "")),
+			Snapshot: fmt.Sprint(table.GetDefault("snapshot", "")),
+			inUse:    make(map[string]time.Time),
+			refill:   make(chan struct{}, 1),
+		}
+		size, sizeOk := table.GetDefault("size", int64(0)).(int64)
+		max, maxOk := table.GetDefault("max", int64(0)).(int64)
+		if !sizeOk || !maxOk || size < 0 || max <= 0 || size > max {
+			return nil, fmt.Errorf("api.pools.%s: size and max must be integers, with 0 <= size <= max and max > 0", name)
+		}
+		pool.Size, pool.Max = int(size), int(max)
+		if pool.Source == "" || pool.Snapshot == "" {
+			return nil, fmt.Errorf("api.pools.%s: source and snapshot are required", name)
+		}
+
+		provider := providers.GetProvider(pool.Provider)
+		if provider == nil {
+			return nil, fmt.Errorf("api.pools.%s: provider %q is not enabled", name, pool.Provider)
+		}
+		if _, ok := provider.(hvlib.Cloner); !ok || !hvlib.HasCapability(provider, hvlib.CapClone) {
+			return nil, fmt.Errorf("api.pools.%s: provider %s doesn't support clones", name, pool.Provider)
+		}
+		pools[name] = pool
+	}
+	return pools, nil
+}
+
+// clonePrefix starts the name of every clone of the pool
+func (p *Pool) clonePrefix() string {
+	return p.Name + "-clone-"
+}
+
+// isClone reports whether vmName is the name of a clone of the pool, as
+// created by createClone: <pool>-clone-<8 hex digits>. The clones of a pool
+// named "a-clone-x" don't belong to the pool "a".
+func (p *Pool) isClone(vmName string) bool {
+	suffix, found := strings.CutPrefix(vmName, p.clonePrefix())
+	return found && cloneSuffixRegexp.MatchString(suffix)
+}
+
+// Status returns a snapshot of the pool utilisation
+func (p *Pool) Status() PoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := PoolStatus{
+		Name:        p.Name,
+		Provider:    p.Provider,
+		Source:      p.Source,
+		Snapshot:    p.Snapshot,
+		Size:        p.Size,
+		Max:         p.Max,
+		Ready:       append([]string{}, p.ready...),
+		InUse:       make(map[string]string, len(p.inUse)),
+		Creating:    p.creating,
+		Deleting:    p.deleting,
+		Stale:       append([]string{}, p.stale...),
+		Utilisation: float64(len(p.inUse)) / float64(p.Max),
+	}
+	for name, since := range p.inUse {
+		status.InUse[name] = since.Format(time.RFC3339)
+	}
+	return status
+}
+
+// total counts the clones of the pool, p.mu must be held
+func (p *Pool) total() int {
+	return len(p.ready) + len(p.inUse) + p.creating + p.deleting + len(p.stale)
+}
+
+// notify wakes up the goroutine keeping the pool filled
+func (p *Pool) notify() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// StartPools deletes the clones left by a previous run and keeps every
+// pool filled until ctx ends. The clones whose deletion failed are deleted
+// again at each wake up.
+func (s *Server) StartPools(ctx context.Context) {
+	for _, pool := range s.Pools {
+		go func(pool *Pool) {
+			cleaned := false
+			for {
+				// Waits for a provider which failed to load
+				if s.Providers.Health(pool.Provider).Loaded {
+					if !cleaned {
+						s.deleteStaleClones(ctx, pool)
+						cleaned = true
+					}
+					s.retryDeletions(ctx, pool)
+					s.fillPool(ctx, pool)
+				}
+				select {
+				case <-pool.refill:
+				case <-time.After(time.Minute):
+					// Retry the clones that failed
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(pool)
+	}
+}
+
+// fillPool creates clones, one at a time, until Size are ready
+func (s *Server) fillPool(ctx context.Context, pool *Pool) {
+	for ctx.Err() == nil {
+		pool.mu.Lock()
+		if len(pool.ready)+pool.creating >= pool.Size || pool.total() >= pool.Max {
+			pool.mu.Unlock()
+			return
+		}
+		pool.creating++
+		pool.mu.Unlock()
+
+		name, err := s.createClone(ctx, pool)
+		pool.mu.Lock()
+		pool.creating--
+		if err == nil {
+			pool.ready = append(pool.ready, name)
+		}
+		pool.mu.Unlock()
+		if err != nil {
+			s.Logger.WithError(err).Errorf("Failed to create a clone for pool %s", pool.Name)
+			return
+		}
+	}
+}
+
+// createClone clones the golden VM of the pool, pool.creating must have
+// been incremented by the caller
+func (s *Server) createClone(ctx context.Context, pool *Pool) (string, error) {
+	cloner, ok := s.Providers.GetProvider(pool.Provider).(hvlib.Cloner)
+	if !ok {
+		return "", fmt.Errorf("provider %s doesn't support clones", pool.Provider)
+	}
+
+	name := pool.clonePrefix() + strings.Split(uuid.NewString(), "-")[0]
+	ctx, cancel := context.WithTimeout(ctx, s.timeout(hvlib.OpClone))
+	defer cancel()
+
+	// Clones read the golden VM, it must not change meanwhile
+	s.AcquireLock(pool.Source)
+	defer s.ReleaseLock(pool.Source)
+	start := time.Now()
+	err := cloner.CloneVM(ctx, pool.Source, pool.Snapshot, name)
+	s.Metrics.ObserveOperation(pool.Provider, hvlib.OpClone, start, err)
+	if err != nil {
+		return "", err
+	}
+	s.Logger.Infof("Created clone %s for pool %s", name, pool.Name)
+	return name, nil
+}
+
+// AcquireClone hands out a ready clone, or creates one when none is ready
+// and the pool isn't full
+func (s *Server) AcquireClone(ctx context.Context, pool *Pool) (string, error) {
+	defer pool.notify()
+
+	pool.mu.Lock()
+	if len(pool.ready) > 0 {
+		name := pool.ready[0]
+		pool.ready = pool.ready[1:]
+		pool.inUse[name] = time.Now()
+		pool.mu.Unlock()
+		return name, nil
+	}
+	if pool.total() >= pool.Max {
+		pool.mu.Unlock()
+		return "", ErrPoolExhausted
+	}
+	pool.creating++
+	pool.mu.Unlock()
+
+	name, err := s.createClone(ctx, pool)
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.creating--
+	if err != nil {
+		return "", err
+	}
+	pool.inUse[name] = time.Now()
+	return name, nil
+}
+
+// ReleaseClone deletes a clone handed out by AcquireClone, in the
+// background
+func (s *Server) ReleaseClone(pool *Pool, name string) error {
+	pool.mu.Lock()
+	if _, exists := pool.inUse[name]; !exists {
+		pool.mu.Unlock()
+		return ErrNotLeased
+	}
+	delete(pool.inUse, name)
+	pool.deleting++
+	pool.mu.Unlock()
+	s.Leases.releaseVM(pool.Provider, name)
+
+	go s.removeClone(context.Background(), pool, name)
+	return nil
+}
+
+// removeClone deletes a clone counted in pool.deleting. When the deletion
+// fails the clone is kept in pool.stale to be deleted again.
+func (s *Server) removeClone(ctx context.Context, pool *Pool, name string) {
+	err := s.deleteClone(ctx, pool, name)
+	var notFound *hvlib.VmNotFoundError
+	if errors.As(err, &notFound) {
+		err = nil // Already deleted
+	}
+
+	pool.mu.Lock()
+	pool.deleting--
+	if err != nil {
+		pool.stale = append(pool.stale, name)
+	}
+	pool.mu.Unlock()
+	if err != nil {
+		s.Logger.WithError(err).Errorf("Failed to delete clone %s of pool %s, will retry", name, pool.Name)
+		return
+	}
+	// Not on failure, the pool goroutine would retry at once
+	pool.notify()
+}
+
+// retryDeletions deletes again the clones whose deletion failed
+func (s *Server) retryDeletions(ctx context.Context, pool *Pool) {
+	pool.mu.Lock()
+	names := pool.stale
+	pool.stale = nil
+	pool.deleting += len(names)
+	pool.mu.Unlock()
+
+	for _, name := range names {
+		s.removeClone(ctx, pool, name)
+	}
+}
+
+// deleteClone powers off and deletes a clone, waiting for the operations
+// in progress on it
+func (s *Server) deleteClone(ctx context.Context, pool *Pool, name string) error {
+	provider := s.Providers.GetProvider(pool.Provider)
+	cloner, ok := provider.(hvlib.Cloner)
+	if !ok {
+		return fmt.Errorf("provider %s doesn't support clones", pool.Provider)
+	}
+
+	s.AcquireLock(name)
+	defer s.ReleaseLock(name)
+
+	stopCtx, cancel := context.WithTimeout(ctx, s.timeout(hvlib.OpStop))
+	// Fails when the clone is already off
+	provider.Stop(stopCtx, name, true)
+	cancel()
+
+	ctx, cancel = context.WithTimeout(ctx, s.timeout(hvlib.OpDeleteVM))
+	defer cancel()
+	start := time.Now()
+	err := cloner.DeleteVM(ctx, name)
+	s.Metrics.ObserveOperation(pool.Provider, hvlib.OpDeleteVM, start, err)
+	if err != nil {
+		return err
+	}
+	s.Logger.Infof("Deleted clone %s of pool %s", name, pool.Name)
+	return nil
+}
+
+// deleteStaleClones deletes the clones of the pool left by a previous run
+func (s *Server) deleteStaleClones(ctx context.Context, pool *Pool) {
+	listCtx, cancel := context.WithTimeout(ctx, s.timeout(hvlib.OpList))
+	vms, err := s.Providers.GetProvider(pool.Provider).List(listCtx)
+	cancel()
+	if err != nil {
+		s.Logger.WithError(err).Errorf("Failed to list the stale clones of pool %s", pool.Name)
+		return
+	}
+
+	var names []string
+	for _, vm := range vms {
+		if pool.isClone(vm.Name) {
+			names = append(names, vm.Name)
+		}
+	}
+	sort.Strings(names)
+	pool.mu.Lock()
+	pool.deleting += len(names)
+	pool.mu.Unlock()
+	for _, name := range names {
+		s.removeClone(ctx, pool, name)
+	}
+}
@@ -0,0 +1,225 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// loadTestConfig loads a TOML configuration written to a temporary file
+func loadTestConfig(t *testing.T, content string) *hvlib.ConfigLoader {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loader, err := hvlib.NewConfigLoader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loader
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestPoolIsClone(t *testing.T) {
+	pool := &Pool{Name: "a"}
+	tests := []struct {
+		vmName   string
+		expected bool
+	}{
+		{vmName: "a-clone-0123abcd", expected: true},
+		{vmName: "a-clone-x-clone-0123abcd"}, // Clone of the pool "a-clone-x"
+		{vmName: "a-clone-0123abcd-1"},
+		{vmName: "a-clone-0123ABCD"},
+		{vmName: "a-clone-"},
+		{vmName: "b-clone-0123abcd"},
+		{vmName: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.vmName, func(t *testing.T) {
+			if got := pool.isClone(tt.vmName); got != tt.expected {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReleaseCloneRetry(t *testing.T) {
+	ctx := context.Background()
+	fake := &hvlib.FakeVP{}
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(ctx, "fake", fake, loader); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Server:    &commons.Server{Logger: quietLogger()},
+		Providers: providers,
+		Leases:    NewLeaseStore(),
+	}
+	pool := &Pool{
+		Name: "win10", Provider: "fake", Source: "win10", Snapshot: "clean", Max: 2,
+		inUse:  make(map[string]time.Time),
+		refill: make(chan struct{}, 1),
+	}
+
+	name, err := s.AcquireClone(ctx, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.InjectFailure(hvlib.OpDeleteVM, errors.New("disk locked"))
+	if err := s.ReleaseClone(pool, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReleaseClone(pool, name); !errors.Is(err, ErrNotLeased) {
+		t.Errorf("got %v releasing the clone twice, expected ErrNotLeased", err)
+	}
+
+	// The clone whose deletion failed still counts in the pool
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Status().Deleting > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := pool.Status()
+	if len(status.Stale) != 1 || status.Stale[0] != name {
+		t.Fatalf("got stale clones %v, expected %s", status.Stale, name)
+	}
+	pool.mu.Lock()
+	total := pool.total()
+	pool.mu.Unlock()
+	if total != 1 {
+		t.Errorf("got %d clones in the pool, expected 1", total)
+	}
+
+	s.retryDeletions(ctx, pool)
+	if status := pool.Status(); len(status.Stale) != 0 || status.Deleting != 0 {
+		t.Errorf("got %+v, expected the clone deleted", status)
+	}
+	vms, err := fake.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vm := range vms {
+		if vm.Name == name {
+			t.Errorf("clone %s not deleted", name)
+		}
+	}
+}
+
+func TestDeleteStaleClones(t *testing.T) {
+	ctx := context.Background()
+	fake := &hvlib.FakeVP{}
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(ctx, "fake", fake, loader); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a-clone-0123abcd", "a-clone-x-clone-0123abcd"} {
+		if err := fake.CloneVM(ctx, "win10", "clean", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{Server: &commons.Server{Logger: quietLogger()}, Providers: providers}
+
+	s.deleteStaleClones(ctx, &Pool{Name: "a", Provider: "fake", refill: make(chan struct{}, 1)})
+
+	vms, err := fake.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining := map[string]bool{}
+	for _, vm := range vms {
+		remaining[vm.Name] = true
+	}
+	if remaining["a-clone-0123abcd"] {
+		t.Error("stale clone of the pool not deleted")
+	}
+	if !remaining["a-clone-x-clone-0123abcd"] {
+		t.Error("clone of the pool a-clone-x deleted")
+	}
+}
+
+func TestReleaseCloneHandler(t *testing.T) {
+	ctx := context.Background()
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(ctx, "fake", &hvlib.FakeVP{}, loader); err != nil {
+		t.Fatal(err)
+	}
+	pool := &Pool{
+		Name: "win10", Provider: "fake", Source: "win10", Snapshot: "clean", Max: 2,
+		inUse:  make(map[string]time.Time),
+		refill: make(chan struct{}, 1),
+	}
+	s := &Server{
+		Server:    &commons.Server{Logger: quietLogger()},
+		Providers: providers,
+		Leases:    NewLeaseStore(),
+		Pools:     map[string]*Pool{pool.Name: pool},
+	}
+
+	name, err := s.AcquireClone(ctx, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := s.Leases.Acquire("fake", name, "pool win10", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Leases.Acquire("fake", "win10", "sbapi", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		leaseID  string
+		expected int
+	}{
+		{name: "without lease", expected: http.StatusConflict},
+		{name: "lease of another VM", leaseID: other.ID, expected: http.StatusPreconditionRequired},
+		{name: "unknown lease", leaseID: "unknown", expected: http.StatusNotFound},
+		{name: "lease of the clone", leaseID: lease.ID, expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/pools/win10/release/"+name, nil)
+		r = mux.SetURLVars(r, map[string]string{"pool": "win10", "vmname": name})
+		if tt.leaseID != "" {
+			r.Header.Set(LeaseHeader, tt.leaseID)
+		}
+		w := httptest.NewRecorder()
+		s.ReleaseCloneHandler(w, r)
+		if w.Code != tt.expected {
+			t.Errorf("%s: got status %d, expected %d", tt.name, w.Code, tt.expected)
+		}
+		if released := len(pool.Status().InUse) == 0; released != (tt.expected == http.StatusOK) {
+			t.Errorf("%s: got clone released %v", tt.name, released)
+		}
+	}
+	if _, exists := s.Leases.Get(lease.ID); exists {
+		t.Error("lease of the released clone kept")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Status().Deleting > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,9 +2,21 @@ package hvapi
 
 import (
 	"TraceForge/pkg/hvlib"
-	"log"
+	"context"
+	"fmt"
+	"sort"
+	"time"
 )
 
+// ProviderHealth reports whether the VMs of a provider could be loaded
+type ProviderHealth struct {
+	Name       string    `json:"name"`
+	Healthy    bool      `json:"healthy"`
+	Loaded     bool      `json:"loaded"` // LoadVMs succeeded, the provider serves requests
+	Error      string    `json:"error,omitempty"`
+	LastReload time.Time `json:"last_reload"`
+}
+
 // Register a provider
 func (pr *ProviderRegistry) RegisterProvider(name string, provider hvlib.VirtualizationProvider) {
 	pr.mu.Lock()
@@ -19,15 +31,105 @@ func (pr *ProviderRegistry) GetProvider(name string) hvlib.VirtualizationProvide
 	return pr.Providers[name]
 }
 
-// Initializes a provider and loads VMs
-func InitializeProvider(provider hvlib.VirtualizationProvider, loader *hvlib.ConfigLoader, name string) hvlib.VirtualizationProvider {
-	if err := provider.LoadVMs(loader); err != nil {
-		log.Fatalf("Error loading %s VMs: %v", name, err)
+// InitializeProvider registers a provider and loads its VMs. A provider
+// failing to load is still registered, as unhealthy, and loaded again by
+// the next Reload.
+func (pr *ProviderRegistry) InitializeProvider(ctx context.Context, name string, provider hvlib.VirtualizationProvider, loader *hvlib.ConfigLoader) error {
+	pr.mu.Lock()
+	pr.loader = loader
+	pr.mu.Unlock()
+
+	pr.RegisterProvider(name, provider)
+	_, err := pr.Reload(ctx, name)
+	return err
+}
+
+// Reload discovers the VMs registered since the provider was loaded. A
+// provider which never loaded is loaded again instead. The operations in
+// progress are not affected.
+func (pr *ProviderRegistry) Reload(ctx context.Context, name string) (ProviderHealth, error) {
+	provider := pr.GetProvider(name)
+	if provider == nil {
+		return ProviderHealth{}, fmt.Errorf("provider %s not found", name)
+	}
+
+	// One reload at a time, LoadVMs isn't safe to run concurrently
+	pr.reloadMu.Lock()
+	defer pr.reloadMu.Unlock()
+
+	health := pr.Health(name)
+	var err error
+	if !health.Loaded {
+		if err = provider.LoadVMs(ctx, pr.loader); err == nil {
+			health.Loaded = true
+		}
+	} else if refresher, ok := provider.(hvlib.InventoryRefresher); ok {
+		err = refresher.RefreshVMs(ctx)
+	}
+
+	health.Healthy = err == nil
+	health.Error = ""
+	if err != nil {
+		health.Error = err.Error()
+	}
+	health.LastReload = time.Now()
+
+	pr.mu.Lock()
+	pr.health[name] = health
+	pr.mu.Unlock()
+	return health, err
+}
+
+// Health returns the state of the last load of the provider
+func (pr *ProviderRegistry) Health(name string) ProviderHealth {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	health, exists := pr.health[name]
+	if !exists {
+		health = ProviderHealth{Name: name}
+	}
+	return health
+}
+
+// StartReloads reloads every provider at the given interval until ctx ends
+func (s *Server) StartReloads(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			for _, name := range s.Providers.Names() {
+				reloadCtx, cancel := context.WithTimeout(ctx, s.timeout(hvlib.OpLoadVMs))
+				start := time.Now()
+				_, err := s.Providers.Reload(reloadCtx, name)
+				s.Metrics.ObserveOperation(name, hvlib.OpLoadVMs, start, err)
+				if err != nil {
+					s.Logger.WithError(err).Errorf("Failed to reload %s VMs", name)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// Names returns the names of the registered providers
+func (pr *ProviderRegistry) Names() []string {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	names := make([]string, 0, len(pr.Providers))
+	for name := range pr.Providers {
+		names = append(names, name)
 	}
-	return provider
+	sort.Strings(names)
+	return names
 }
 
 func NewProvider() *ProviderRegistry {
 	providers := make(map[string]hvlib.VirtualizationProvider)
-	return &ProviderRegistry{Providers: providers}
+	return &ProviderRegistry{Providers: providers, health: make(map[string]ProviderHealth)}
 }
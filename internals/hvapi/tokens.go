@@ -0,0 +1,205 @@
+package hvapi
+
+import (
+	"TraceForge/pkg/hvlib"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"path"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Roles of the API tokens, each role has the permissions of the previous
+// ones
+const (
+	RoleReadOnly = "read-only" // List and inspect
+	RoleOperator = "operator"  // Power actions, reverts, snapshots, leases, guest operations...
+	RoleAdmin    = "admin"     // Snapshot deletion and provider reloads
+)
+
+var roleLevels = map[string]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// routeRoles are the roles required by the routes, by method and path
+// template. The other GET routes require RoleReadOnly and the other
+// methods RoleOperator.
+var routeRoles = map[string]string{
+	"GET /{provider}/{vmname}/start":                      RoleOperator,
+	"GET /{provider}/{vmname}/stop":                       RoleOperator,
+	"GET /{provider}/{vmname}/suspend":                    RoleOperator,
+	"GET /{provider}/{vmname}/revert":                     RoleOperator,
+	"GET /{provider}/{vmname}/revert/{snapshotname}":      RoleOperator,
+	"GET /{provider}/{vmname}/reset":                      RoleOperator,
+	"GET /{provider}/{vmname}/snapshot/{snapshotname}":    RoleOperator,
+	"GET /{provider}/{vmname}/memory":                     RoleOperator,
+	"GET /{provider}/{vmname}/guest/file":                 RoleOperator,
+	"DELETE /{provider}/{vmname}/snapshot/{snapshotname}": RoleAdmin,
+	"POST /providers/{name}/reload":                       RoleAdmin,
+	"POST /images/{image}/versions/{version}/promote":     RoleAdmin,
+	"GET /audit": RoleAdmin,
+}
+
+// APIToken is a token of the [api.tokens.<name>] sections. A token scoped
+// to providers or VM name patterns is refused the routes of other
+// providers or VMs, the routes without a provider or VM (/providers,
+// /events...) aren't restricted.
+type APIToken struct {
+	Name      string
+	Role      string
+	Providers []string // All the providers when empty
+	VMs       []string // path.Match patterns, all the VMs when empty
+
+	hash [sha256.Size]byte
+}
+
+// LoadTokens reads the [api.tokens.<name>] sections, api.auth_token is
+// kept as the "default" admin token
+//
+//	[api.tokens.dashboard]
+//	token = "..."
+//	role = "read-only"
+//	providers = ["vmware"]
+//	vms = ["win10-*"]
+func LoadTokens(loader *hvlib.ConfigLoader) ([]APIToken, error) {
+	var tokens []APIToken
+	seen := map[[sha256.Size]byte]string{}
+	add := func(name, value string, token APIToken) error {
+		token.Name = name
+		token.hash = sha256.Sum256([]byte(value))
+		if other, exists := seen[token.hash]; exists {
+			return fmt.Errorf("api.tokens.%s has the same token as %s", name, other)
+		}
+		seen[token.hash] = name
+		tokens = append(tokens, token)
+		return nil
+	}
+
+	if value := loader.GetString("api.auth_token"); value != "" {
+		if err := add("default", value, APIToken{Role: RoleAdmin}); err != nil {
+			return nil, err
+		}
+	}
+
+	tree, ok := loader.Get("api.tokens").(*toml.Tree)
+	if ok {
+		for _, name := range tree.Keys() {
+			table, ok := tree.Get(name).(*toml.Tree)
+			if !ok {
+				return nil, fmt.Errorf("invalid api.tokens.%s, expected a table", name)
+			}
+			value, _ := table.GetDefault("token", "").(string)
+			if value == "" {
+				return nil, fmt.Errorf("api.tokens.%s: token is required", name)
+			}
+			token := APIToken{Role: fmt.Sprint(table.GetDefault("role", RoleReadOnly))}
+			if _, valid := roleLevels[token.Role]; !valid {
+				return nil, fmt.Errorf("api.tokens.%s: invalid role %q, expected %s, %s or %s",
+					name, token.Role, RoleReadOnly, RoleOperator, RoleAdmin)
+			}
+			var err error
+			if token.Providers, err = stringList(table, "providers"); err != nil {
+				return nil, fmt.Errorf("api.tokens.%s: %w", name, err)
+			}
+			if token.VMs, err = stringList(table, "vms"); err != nil {
+				return nil, fmt.Errorf("api.tokens.%s: %w", name, err)
+			}
+			for _, pattern := range token.VMs {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("api.tokens.%s: invalid VM pattern %q", name, pattern)
+				}
+			}
+			if err := add(name, value, token); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no API token, set api.auth_token or [api.tokens.<name>]")
+	}
+	return tokens, nil
+}
+
+// stringList returns the array of strings of a key, nil when it is missing
+func stringList(table *toml.Tree, key string) ([]string, error) {
+	value := table.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of strings", key)
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of strings", key)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// findToken returns the token matching value. Every token is compared in
+// constant time, on hashes so that the length doesn't leak either.
+func (s *Server) findToken(value string) *APIToken {
+	hash := sha256.Sum256([]byte(value))
+	var found *APIToken
+	for i := range s.Tokens {
+		if subtle.ConstantTimeCompare(hash[:], s.Tokens[i].hash[:]) == 1 {
+			found = &s.Tokens[i]
+		}
+	}
+	return found
+}
+
+// allows reports whether the token has the role and covers the provider
+// and VM, empty when the route has none
+func (t *APIToken) allows(role, providerName, vmName string) bool {
+	if roleLevels[t.Role] < roleLevels[role] {
+		return false
+	}
+	if providerName != "" && len(t.Providers) > 0 {
+		allowed := false
+		for _, p := range t.Providers {
+			allowed = allowed || p == providerName
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if vmName != "" && len(t.VMs) > 0 {
+		allowed := false
+		for _, pattern := range t.VMs {
+			matched, _ := path.Match(pattern, vmName)
+			allowed = allowed || matched
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+type tokenContextKey struct{}
+
+// TokenFromContext returns the token which authenticated the request
+func TokenFromContext(ctx context.Context) *APIToken {
+	token, _ := ctx.Value(tokenContextKey{}).(*APIToken)
+	return token
+}
+
+// name returns the name of the token, empty for the nil token of the
+// requests when the authentication is disabled
+func (t *APIToken) name() string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
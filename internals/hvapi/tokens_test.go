@@ -0,0 +1,246 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+const testTokensConfig = `
+[api]
+auth_token = "root"
+[api.tokens.dashboard]
+token = "dashboard"
+[api.tokens.ci]
+token = "ci"
+role = "operator"
+providers = ["fake"]
+vms = ["win10-*"]
+[api.tokens.ops]
+token = "ops"
+role = "admin"
+providers = ["fake"]
+`
+
+func TestAPITokenAllows(t *testing.T) {
+	readOnly := &APIToken{Role: RoleReadOnly}
+	operator := &APIToken{Role: RoleOperator, Providers: []string{"vmware", "fake"}}
+	scoped := &APIToken{Role: RoleAdmin, VMs: []string{"win10-*", "linux"}}
+
+	tests := []struct {
+		name     string
+		token    *APIToken
+		role     string
+		provider string
+		vm       string
+		expected bool
+	}{
+		{name: "read-only reads", token: readOnly, role: RoleReadOnly, provider: "fake", vm: "win10", expected: true},
+		{name: "read-only operates", token: readOnly, role: RoleOperator, provider: "fake", vm: "win10"},
+		{name: "read-only administers", token: readOnly, role: RoleAdmin},
+		{name: "operator reads", token: operator, role: RoleReadOnly, provider: "fake", expected: true},
+		{name: "operator operates", token: operator, role: RoleOperator, provider: "vmware", vm: "win10", expected: true},
+		{name: "operator administers", token: operator, role: RoleAdmin, provider: "fake"},
+		{name: "provider out of scope", token: operator, role: RoleOperator, provider: "kvm", vm: "win10"},
+		{name: "route without provider", token: operator, role: RoleOperator, expected: true},
+		{name: "VM pattern", token: scoped, role: RoleAdmin, provider: "kvm", vm: "win10-1", expected: true},
+		{name: "VM name", token: scoped, role: RoleOperator, provider: "kvm", vm: "linux", expected: true},
+		{name: "VM out of scope", token: scoped, role: RoleOperator, provider: "kvm", vm: "win11"},
+		{name: "pattern matches the whole name", token: scoped, role: RoleOperator, vm: "old-win10-1"},
+		{name: "route without VM", token: scoped, role: RoleOperator, provider: "kvm", expected: true},
+		{name: "unknown role", token: &APIToken{Role: "root"}, role: RoleReadOnly},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.token.allows(tt.role, tt.provider, tt.vm); got != tt.expected {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	tokens, err := LoadTokens(loadTestConfig(t, testTokensConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]APIToken{}
+	for _, token := range tokens {
+		byName[token.Name] = token
+	}
+	if len(byName) != 4 {
+		t.Fatalf("got tokens %+v, expected 4", tokens)
+	}
+	if byName["default"].Role != RoleAdmin {
+		t.Errorf("got default role %q, expected admin", byName["default"].Role)
+	}
+	if byName["dashboard"].Role != RoleReadOnly || byName["dashboard"].Providers != nil {
+		t.Errorf("got %+v, expected an unscoped read-only token", byName["dashboard"])
+	}
+	ci := byName["ci"]
+	if ci.Role != RoleOperator || len(ci.Providers) != 1 || ci.Providers[0] != "fake" || len(ci.VMs) != 1 || ci.VMs[0] != "win10-*" {
+		t.Errorf("unexpected ci token %+v", ci)
+	}
+}
+
+func TestLoadTokensErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string // Part of the error
+	}{
+		{name: "no token", config: "[api]\nport = 8080", expected: "no API token"},
+		{name: "not a table", config: "[api.tokens]\nci = \"x\"", expected: "expected a table"},
+		{name: "missing token", config: "[api.tokens.ci]\nrole = \"operator\"", expected: "token is required"},
+		{name: "empty token", config: "[api.tokens.ci]\ntoken = \"\"", expected: "token is required"},
+		{name: "invalid role", config: "[api.tokens.ci]\ntoken = \"x\"\nrole = \"root\"", expected: "invalid role"},
+		{name: "providers string", config: "[api.tokens.ci]\ntoken = \"x\"\nproviders = \"fake\"", expected: "providers must be an array of strings"},
+		{name: "providers numbers", config: "[api.tokens.ci]\ntoken = \"x\"\nproviders = [1]", expected: "providers must be an array of strings"},
+		{name: "vms string", config: "[api.tokens.ci]\ntoken = \"x\"\nvms = \"win10\"", expected: "vms must be an array of strings"},
+		{name: "invalid pattern", config: "[api.tokens.ci]\ntoken = \"x\"\nvms = [\"win[\"]", expected: "invalid VM pattern"},
+		{name: "duplicate token", config: "[api.tokens.a]\ntoken = \"x\"\n[api.tokens.b]\ntoken = \"x\"", expected: "same token"},
+		{name: "duplicate default token", config: "[api]\nauth_token = \"x\"\n[api.tokens.a]\ntoken = \"x\"", expected: "same token as default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := LoadTokens(loadTestConfig(t, tt.config))
+			if err == nil {
+				t.Fatalf("expected an error, got %+v", tokens)
+			}
+			if !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("got %q, expected %q", err, tt.expected)
+			}
+		})
+	}
+}
+
+// testRouter routes a sample of the hvapi routes to handler
+func testRouter(handler http.HandlerFunc) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/providers/{name}", handler).Methods("GET")
+	router.HandleFunc("/providers/{name}/reload", handler).Methods("POST")
+	router.HandleFunc("/leases", handler).Methods("GET")
+	router.HandleFunc("/audit", handler).Methods("GET")
+	router.HandleFunc("/images/{image}/versions/{version}/promote", handler).Methods("POST")
+	router.HandleFunc("/pools/{pool}/acquire", handler).Methods("POST")
+	router.HandleFunc("/{provider}", handler).Methods("GET")
+	router.HandleFunc("/{provider}/bulk", handler).Methods("POST")
+	router.HandleFunc("/{provider}/{vmname}/snapshot/{snapshotname}", handler).Methods("GET", "DELETE")
+	router.HandleFunc("/{provider}/{vmname}/start", handler).Methods("GET")
+	router.HandleFunc("/{provider}/{vmname}/screenshot", handler).Methods("GET")
+	router.HandleFunc("/{provider}/{vmname}/lease", handler).Methods("POST")
+	return router
+}
+
+func testAuthServer(t *testing.T) *Server {
+	tokens, err := LoadTokens(loadTestConfig(t, testTokensConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		Server: &commons.Server{Logger: quietLogger()},
+		Tokens: tokens,
+		Pools:  map[string]*Pool{"win10": {Name: "win10", Provider: "vmware"}},
+		Images: map[string]*Image{"win10": {Name: "win10", Provider: "fake", VM: "win11"}},
+	}
+}
+
+func TestRoutePermission(t *testing.T) {
+	s := testAuthServer(t)
+	var role, provider, vm string
+	router := testRouter(func(w http.ResponseWriter, r *http.Request) {
+		role, provider, vm = s.routePermission(r)
+	})
+
+	tests := []struct {
+		method   string
+		path     string
+		role     string
+		provider string
+		vm       string
+	}{
+		{method: "GET", path: "/leases", role: RoleReadOnly},
+		{method: "GET", path: "/audit", role: RoleAdmin},
+		{method: "GET", path: "/providers/fake", role: RoleReadOnly, provider: "fake"},
+		{method: "POST", path: "/providers/fake/reload", role: RoleAdmin, provider: "fake"},
+		{method: "GET", path: "/fake", role: RoleReadOnly, provider: "fake"},
+		{method: "POST", path: "/fake/bulk", role: RoleOperator, provider: "fake"},
+		{method: "GET", path: "/fake/win10/screenshot", role: RoleReadOnly, provider: "fake", vm: "win10"},
+		{method: "GET", path: "/fake/win10/start", role: RoleOperator, provider: "fake", vm: "win10"},
+		{method: "GET", path: "/fake/win10/snapshot/clean", role: RoleOperator, provider: "fake", vm: "win10"},
+		{method: "DELETE", path: "/fake/win10/snapshot/clean", role: RoleAdmin, provider: "fake", vm: "win10"},
+		{method: "POST", path: "/fake/win10/lease", role: RoleOperator, provider: "fake", vm: "win10"},
+		{method: "POST", path: "/pools/win10/acquire", role: RoleOperator, provider: "vmware"},
+		{method: "POST", path: "/pools/unknown/acquire", role: RoleOperator},
+		{method: "POST", path: "/images/win10/versions/1/promote", role: RoleAdmin, provider: "fake", vm: "win11"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			role, provider, vm = "", "", ""
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+			if role != tt.role || provider != tt.provider || vm != tt.vm {
+				t.Errorf("got %q %q %q, expected %q %q %q", role, provider, vm, tt.role, tt.provider, tt.vm)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	s := testAuthServer(t)
+	var token *APIToken
+	router := testRouter(func(w http.ResponseWriter, r *http.Request) {
+		token = TokenFromContext(r.Context())
+	})
+	router.Use(s.AuthMiddleware)
+
+	tests := []struct {
+		name          string
+		authorization string
+		method        string
+		path          string
+		expected      int
+	}{
+		{name: "no header", method: "GET", path: "/fake", expected: http.StatusUnauthorized},
+		{name: "not bearer", authorization: "Basic root", method: "GET", path: "/fake", expected: http.StatusUnauthorized},
+		{name: "extra part", authorization: "Bearer root x", method: "GET", path: "/fake", expected: http.StatusUnauthorized},
+		{name: "unknown token", authorization: "Bearer roo", method: "GET", path: "/fake", expected: http.StatusUnauthorized},
+		{name: "default admin", authorization: "Bearer root", method: "DELETE", path: "/kvm/win10/snapshot/clean", expected: http.StatusOK},
+		{name: "read-only reads", authorization: "Bearer dashboard", method: "GET", path: "/fake/win10/screenshot", expected: http.StatusOK},
+		{name: "read-only starts", authorization: "Bearer dashboard", method: "GET", path: "/fake/win10/start", expected: http.StatusForbidden},
+		{name: "read-only leases", authorization: "Bearer dashboard", method: "POST", path: "/fake/win10/lease", expected: http.StatusForbidden},
+		{name: "operator in scope", authorization: "Bearer ci", method: "GET", path: "/fake/win10-1/start", expected: http.StatusOK},
+		{name: "operator VM out of scope", authorization: "Bearer ci", method: "GET", path: "/fake/win11/start", expected: http.StatusForbidden},
+		{name: "operator provider out of scope", authorization: "Bearer ci", method: "GET", path: "/kvm/win10-1/start", expected: http.StatusForbidden},
+		{name: "operator deletes snapshot", authorization: "Bearer ci", method: "DELETE", path: "/fake/win10-1/snapshot/clean", expected: http.StatusForbidden},
+		{name: "operator lists leases", authorization: "Bearer ci", method: "GET", path: "/leases", expected: http.StatusOK},
+		{name: "pool of another provider", authorization: "Bearer ci", method: "POST", path: "/pools/win10/acquire", expected: http.StatusForbidden},
+		{name: "image of the provider", authorization: "Bearer ops", method: "POST", path: "/images/win10/versions/1/promote", expected: http.StatusOK},
+		{name: "scoped admin reloads another provider", authorization: "Bearer ops", method: "POST", path: "/providers/kvm/reload", expected: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token = nil
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.expected {
+				t.Fatalf("got status %d, expected %d: %s", w.Code, tt.expected, w.Body)
+			}
+			if reached := token != nil; reached != (tt.expected == http.StatusOK) {
+				t.Errorf("got handler reached %v with status %d", reached, w.Code)
+			}
+		})
+	}
+}
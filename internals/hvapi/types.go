@@ -4,18 +4,62 @@ import (
 	"TraceForge/internals/commons"
 	"TraceForge/pkg/hvlib"
 	"sync"
+	"time"
 )
 
 // Define a struct to hold provider instances
 type ProviderRegistry struct {
 	Providers map[string]hvlib.VirtualizationProvider
 	mu        sync.Mutex
+
+	health   map[string]ProviderHealth
+	loader   *hvlib.ConfigLoader
+	reloadMu sync.Mutex
 }
 
 type Server struct {
 	*commons.Server
 	Providers *ProviderRegistry
-	AuthToken string
+	Tokens    []APIToken // See LoadTokens
+
+	// Default timeout of each provider operation, by hvlib.Op* name
+	Timeouts map[string]time.Duration
+
+	// Baseline snapshot of the VMs by provider then VM name, a revert
+	// always restores this snapshot when one is configured. Promoting a
+	// golden image replaces it.
+	Baselines   map[string]map[string]string
+	baselinesMu sync.RWMutex
+
+	// Destination of the uploaded artifacts, nil when S3 isn't configured
+	Artifacts *ArtifactStore
+
+	// Directory of the packet captures in progress
+	CaptureDir string
+
+	// Warm clone pools by name, see LoadPools
+	Pools map[string]*Pool
+
+	// Operations accepted with ?async=true
+	Operations *OperationStore
+
+	// Events streamed by GET /events
+	Events *EventBus
+
+	// Leases of the VMs, required by the mutating endpoints
+	Leases *LeaseStore
+
+	// Audit log of the hypervisor actions, nil when disabled
+	Audit *AuditLog
+
+	// Golden image recipes by name, see LoadImages
+	Images map[string]*Image
+
+	// Versions of the golden images built
+	ImageCatalog *ImageCatalog
+
+	// Prometheus metrics served by GET /metrics
+	Metrics *Metrics
 
 	// Add a sync.Map to hold per-VM locks
 	vmLocks sync.Map // map[string]*sync.Mutex
@@ -0,0 +1,102 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WaitVMHandler godoc
+// @Summary Wait for a virtual machine to be ready
+// @Description Wait until the VM reaches a power state and, when guest is true, until its guest OS has booted (VMware Tools, Hyper-V heartbeat, QEMU guest agent or VirtualBox Guest Additions respond). The VM is not locked while waiting.
+// @Tags vms
+// @Produce  json
+// @Param provider path string true "Provider name"
+// @Param vmname path string true "Virtual Machine name"
+// @Param state query string false "Power state: running, stopped, saved or suspended"
+// @Param guest query bool false "Wait for the guest OS"
+// @Param timeout query string false "Go duration, at most the wait timeout of the configuration, which is the default"
+// @Success 200 {object} commons.HttpResp
+// @Failure 400 {object} commons.HttpResp
+// @Failure 404 {object} commons.HttpResp
+// @Failure 500 {object} commons.HttpResp
+// @Failure 501 {object} commons.HttpResp
+// @Failure 504 {object} commons.HttpResp
+// @Security ApiKeyAuth
+// @Router /{provider}/{vmname}/wait [get]
+func (s *Server) WaitVMHandler(w http.ResponseWriter, r *http.Request) {
+	provider := s.getProviderFromRequest(w, r)
+	if provider == nil {
+		return
+	}
+	vmName := mux.Vars(r)["vmname"]
+	query := r.URL.Query()
+
+	state := query.Get("state")
+	guest := false
+	if value := query.Get("guest"); value != "" {
+		var err error
+		if guest, err = strconv.ParseBool(value); err != nil {
+			commons.WriteErrorResponse(w, "Invalid guest parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if state == "" && !guest {
+		commons.WriteErrorResponse(w, "Nothing to wait for, set state or guest", http.StatusBadRequest)
+		return
+	}
+	if state != "" {
+		if err := hvlib.ValidatePowerState(state); err != nil {
+			commons.WriteErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// The configured wait timeout is also the maximum, a waiting request
+	// holds a connection and polls the hypervisor
+	maxTimeout := s.timeout(hvlib.OpWait)
+	timeout := maxTimeout
+	if value := query.Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			commons.WriteErrorResponse(w, "Invalid timeout parameter", http.StatusBadRequest)
+			return
+		}
+		if timeout > maxTimeout {
+			commons.WriteErrorResponse(w, fmt.Sprintf("The timeout must not exceed %s", maxTimeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var checker hvlib.GuestReadinessChecker
+	if guest {
+		var ok bool
+		if checker, ok = provider.(hvlib.GuestReadinessChecker); !ok || !hvlib.HasCapability(provider, hvlib.CapGuestReadiness) {
+			commons.WriteErrorResponse(w, "Guest readiness is not supported by this provider", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if state != "" {
+		if err := hvlib.WaitForState(ctx, provider, vmName, state); err != nil {
+			commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+	if checker != nil {
+		if err := hvlib.WaitForGuest(ctx, checker, vmName); err != nil {
+			commons.WriteErrorResponse(w, err.Error(), errorStatus(err))
+			return
+		}
+	}
+
+	commons.WriteSuccessResponse(w, fmt.Sprintf("VM %s is ready", vmName), nil)
+}
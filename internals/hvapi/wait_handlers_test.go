@@ -0,0 +1,53 @@
+package hvapi
+
+import (
+	"TraceForge/internals/commons"
+	"TraceForge/pkg/hvlib"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestWaitVMHandler(t *testing.T) {
+	providers := NewProvider()
+	loader := loadTestConfig(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"\n")
+	if err := providers.InitializeProvider(context.Background(), "fake", &hvlib.FakeVP{}, loader); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Server:    &commons.Server{Logger: quietLogger()},
+		Providers: providers,
+		Timeouts:  map[string]time.Duration{hvlib.OpWait: time.Minute},
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{query: "state=stopped", expected: http.StatusOK},
+		{query: "state=stopped&timeout=1m", expected: http.StatusOK},
+		{query: "", expected: http.StatusBadRequest},
+		{query: "state=booted", expected: http.StatusBadRequest},
+		{query: "state=Running", expected: http.StatusBadRequest},
+		{query: "state=stopped&timeout=61s", expected: http.StatusBadRequest},
+		{query: "state=stopped&timeout=87600h", expected: http.StatusBadRequest},
+		{query: "state=stopped&timeout=-1s", expected: http.StatusBadRequest},
+		{query: "state=stopped&timeout=soon", expected: http.StatusBadRequest},
+		{query: "state=stopped&guest=maybe", expected: http.StatusBadRequest},
+		{query: "state=running&timeout=10ms", expected: http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/fake/win10/wait?"+tt.query, nil)
+		r = mux.SetURLVars(r, map[string]string{"provider": "fake", "vmname": "win10"})
+		w := httptest.NewRecorder()
+		s.WaitVMHandler(w, r)
+		if w.Code != tt.expected {
+			t.Errorf("%q: got status %d, expected %d", tt.query, w.Code, tt.expected)
+		}
+	}
+}
@@ -41,6 +41,18 @@ func LoadAgentsConfig(filePath string) (*AgentsConfig, error) {
 		if agent.Provider == "" {
 			agent.Provider = agentsConfig.AgentDefaults.Provider
 		}
+		if agent.Baseline == "" {
+			agent.Baseline = agentsConfig.AgentDefaults.Baseline
+		}
+		if agent.PacketCapture == nil {
+			agent.PacketCapture = agentsConfig.AgentDefaults.PacketCapture
+		}
+		if agent.NetworkProfile == "" {
+			agent.NetworkProfile = agentsConfig.AgentDefaults.NetworkProfile
+		}
+		if agent.WaitGuest == nil {
+			agent.WaitGuest = agentsConfig.AgentDefaults.WaitGuest
+		}
 		// Assign the HVAPI server configuration to the agent
 		hvapiConfig, exists := hvapiServers[agent.HvapiName]
 		if !exists {
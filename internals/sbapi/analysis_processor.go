@@ -5,6 +5,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,8 +19,8 @@ func (s *Server) WrapStartAgentTaskWorker(agentID string) func() error {
 }
 
 // Should had a way to stop the task with the taskManager
-// TODO: acquireVMLock should be called if we start mutiple backend
-// or the task should run on only one backend
+// The VM is leased from hvapi for each task, so that several backends
+// can run the workers of the same agent
 func (s *Server) StartAgentTaskWorker(agentID string) error {
 	ctx := context.Background()
 	s.Logger.Infof("Starting task worker for agent %s", agentID)
@@ -38,14 +40,20 @@ func (s *Server) StartAgentTaskWorker(agentID string) error {
 
 	hvClient := NewHvClient(agentConfig.HvapiConfig.URL, agentConfig.HvapiConfig.AuthToken)
 
-	// We are stopping the VM to ensure a clean start
-	_, err = hvClient.StopVM(ctx, agentConfig.Provider, agentConfig.Name)
-	if err != nil {
-		if hvErr, ok := err.(*HvError); ok {
-			s.Logger.Errorf("HV API Error during StopVM - %s: %s", hvErr.Status, hvErr.Message)
-		} else {
-			s.Logger.WithError(err).Error("Failed to stop VM")
+	// We are stopping the VM to ensure a clean start, unless another
+	// backend is using it
+	if leasedClient, release, err := s.leaseVM(ctx, hvClient, agentConfig); err != nil {
+		s.Logger.WithError(err).Warnf("Not stopping VM %s", agentConfig.Name)
+	} else {
+		_, err = leasedClient.StopVM(ctx, agentConfig.Provider, agentConfig.Name)
+		if err != nil {
+			if hvErr, ok := err.(*HvError); ok {
+				s.Logger.Errorf("HV API Error during StopVM - %s: %s", hvErr.Status, hvErr.Message)
+			} else {
+				s.Logger.WithError(err).Error("Failed to stop VM")
+			}
 		}
+		release()
 	}
 
 	for {
@@ -61,19 +69,79 @@ func (s *Server) StartAgentTaskWorker(agentID string) error {
 			continue
 		}
 
+		leasedClient, release, err := s.leaseVM(ctx, hvClient, agentConfig)
+		if err != nil {
+			s.Logger.WithError(err).Warnf("VM %s is not available for task %s", agentConfig.Name, task.ID)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		// Another backend may have run the task while it held the lease
+		task, err = s.DB.GetNextPendingAnalysisTaskForAgent(ctx, agentID)
+		if err != nil || task == nil {
+			release()
+			continue
+		}
+
 		s.Logger.Infof("Processing analysis task %s for agent %s", task.ID, agentID)
-		s.handleAnalysisTask(*task, hvClient)
+		s.handleAnalysisTask(*task, leasedClient)
+		release()
 		time.Sleep(1 * time.Second)
 	}
 }
 
+// vmLeaseTTL is the TTL of the lease of the VM of an agent, it is renewed
+// every third of it. hvapi reverts the VM when the lease expires, if the
+// backend dies during a task.
+var vmLeaseTTL = 5 * time.Minute
+
+// leaseVM leases the VM of the agent from hvapi and keeps the lease renewed
+// until release is called. The returned client sends the lease ID.
+func (s *Server) leaseVM(ctx context.Context, hvClient *HvClient, agentConfig *AgentConfig) (*HvClient, func(), error) {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("sbapi@%s agent %s", hostname, agentConfig.ID)
+	lease, err := hvClient.AcquireLease(ctx, agentConfig.Provider, agentConfig.Name, owner, vmLeaseTTL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lease VM %s: %w", agentConfig.Name, err)
+	}
+
+	renewCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(vmLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-renewCtx.Done():
+				return
+			}
+			if _, err := hvClient.RenewLease(renewCtx, lease.ID, vmLeaseTTL); err != nil && renewCtx.Err() == nil {
+				s.Logger.WithError(err).Errorf("Failed to renew the lease of VM %s", agentConfig.Name)
+			}
+		}
+	}()
+
+	release := func() {
+		cancel()
+		<-done
+		if err := hvClient.ReleaseLease(context.Background(), lease.ID); err != nil {
+			s.Logger.WithError(err).Errorf("Failed to release the lease of VM %s", agentConfig.Name)
+		}
+	}
+	return hvClient.WithLease(lease.ID), release, nil
+}
+
+// bootTimeout bounds the wait for the guest OS after the VM is started
+const bootTimeout = 5 * time.Minute
+
 func (s *Server) handleAnalysisTask(task AnalysisTask, hvClient *HvClient) {
 	ctx := context.Background()
 
 	agentConfig, err := s.getAgentConfigByID(task.AgentID)
 	if err != nil {
 		s.Logger.WithError(err).Error("Failed to get agent config")
-		s.DB.UpdateAnalysisTaskStatus(ctx, task.ID, "failed")
+		s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("failed to get agent config: %v", err))
 		return
 	}
 
@@ -84,18 +152,73 @@ func (s *Server) handleAnalysisTask(task AnalysisTask, hvClient *HvClient) {
 		return
 	}
 
-	// Use HvClient to revert VM
-	_, err = hvClient.RevertVM(ctx, agentConfig.Provider, agentConfig.Name)
+	options, err := parseTaskOptions(task.Args)
+	if err != nil {
+		s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("invalid task options: %v", err))
+		return
+	}
+
+	// Use HvClient to revert VM, to its baseline snapshot when configured
+	if agentConfig.Baseline != "" {
+		_, err = hvClient.RevertVMTo(ctx, agentConfig.Provider, agentConfig.Name, agentConfig.Baseline)
+	} else {
+		_, err = hvClient.RevertVM(ctx, agentConfig.Provider, agentConfig.Name)
+	}
 	if err != nil {
+		reason := fmt.Sprintf("failed to revert VM %s: %v", agentConfig.Name, err)
 		if hvErr, ok := err.(*HvError); ok {
 			s.Logger.Errorf("HV API Error during RevertVM - %s: %s", hvErr.Status, hvErr.Message)
+			if hvErr.StatusCode == http.StatusNotFound && agentConfig.Baseline != "" {
+				reason = fmt.Sprintf("baseline snapshot %s is missing for VM %s: %s",
+					agentConfig.Baseline, agentConfig.Name, hvErr.Message)
+			}
 		} else {
 			s.Logger.WithError(err).Error("Failed to revert VM")
 		}
-		s.DB.UpdateAnalysisTaskStatus(ctx, task.ID, "failed")
+		s.failAnalysisTask(ctx, task.ID, reason)
 		return
 	}
 
+	// The network is set before the VM starts, VMware only edits the
+	// configuration of powered off VMs
+	networkProfile := options.NetworkProfile
+	if networkProfile == "" {
+		networkProfile = agentConfig.NetworkProfile
+	}
+	if networkProfile != "" {
+		if _, err := hvClient.SetNetworkProfile(ctx, agentConfig.Provider, agentConfig.Name, networkProfile); err != nil {
+			s.Logger.WithError(err).Errorf("Failed to set network profile of VM %s", agentConfig.Name)
+			s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("failed to set network profile %s of VM %s: %v", networkProfile, agentConfig.Name, err))
+			return
+		}
+	}
+
+	// The capture starts before the VM, VMware only applies it at power on
+	capturing := false
+	if agentConfig.PacketCapture != nil && *agentConfig.PacketCapture {
+		if _, err := hvClient.StartCapture(ctx, agentConfig.Provider, agentConfig.Name); err != nil {
+			s.Logger.WithError(err).Errorf("Failed to start packet capture of VM %s", agentConfig.Name)
+			s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("failed to start packet capture of VM %s: %v", agentConfig.Name, err))
+			return
+		}
+		capturing = true
+	}
+	// Stopped first thing on failure, the capture would otherwise stay
+	// active and block the next task
+	stopCapture := func() string {
+		if !capturing {
+			return ""
+		}
+		capturing = false
+		key, err := hvClient.StopCapture(ctx, agentConfig.Provider, agentConfig.Name, fmt.Sprintf("tasks/%s/capture.pcap", task.ID))
+		if err != nil {
+			s.Logger.WithError(err).Errorf("Failed to stop packet capture of VM %s", agentConfig.Name)
+			return ""
+		}
+		return key
+	}
+	defer stopCapture()
+
 	// Use HvClient to start VM
 	_, err = hvClient.StartVM(ctx, agentConfig.Provider, agentConfig.Name)
 	if err != nil {
@@ -104,7 +227,21 @@ func (s *Server) handleAnalysisTask(task AnalysisTask, hvClient *HvClient) {
 		} else {
 			s.Logger.WithError(err).Error("Failed to start VM")
 		}
-		s.DB.UpdateAnalysisTaskStatus(ctx, task.ID, "failed")
+		s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("failed to start VM %s: %v", agentConfig.Name, err))
+		return
+	}
+
+	// The agent can only receive the task once the guest has booted
+	waitGuest := agentConfig.WaitGuest == nil || *agentConfig.WaitGuest
+	_, err = hvClient.WaitForVM(ctx, agentConfig.Provider, agentConfig.Name, "running", waitGuest, bootTimeout)
+	if hvErr, ok := err.(*HvError); ok && hvErr.StatusCode == http.StatusNotImplemented {
+		s.Logger.Warnf("Provider %s can't tell when the guest has booted, only waiting for VM %s to run",
+			agentConfig.Provider, agentConfig.Name)
+		_, err = hvClient.WaitForVM(ctx, agentConfig.Provider, agentConfig.Name, "running", false, bootTimeout)
+	}
+	if err != nil {
+		s.Logger.WithError(err).Errorf("VM %s is not ready", agentConfig.Name)
+		s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("VM %s is not ready: %v", agentConfig.Name, err))
 		return
 	}
 
@@ -127,20 +264,50 @@ func (s *Server) handleAnalysisTask(task AnalysisTask, hvClient *HvClient) {
 	// 	}
 	// }()
 
+	var screenshots *screenshotRecorder
+	if options.ScreenshotInterval > 0 {
+		interval := time.Duration(options.ScreenshotInterval) * time.Second
+		screenshots = s.startScreenshots(ctx, task.ID, hvClient, agentConfig, interval)
+	}
+
 	// Send task to agent
 	if err := s.SendTaskToAgent(task); err != nil {
 		s.Logger.WithError(err).Error("Failed to send task to agent")
-		s.DB.UpdateAnalysisTaskStatus(ctx, task.ID, "failed")
+		screenshots.Stop()
+		s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("failed to send task to agent: %v", err))
 		return
 	}
 
 	// Wait for agent to complete task and retrieve result
 	result, err := s.WaitForTaskResult(task.ID, 10*time.Minute)
+	screenshotKeys := screenshots.Stop()
 	if err != nil {
 		s.Logger.WithError(err).Error("Failed to get task result")
-		s.DB.UpdateAnalysisTaskStatus(ctx, task.ID, "failed")
+		s.failAnalysisTask(ctx, task.ID, fmt.Sprintf("failed to get task result: %v", err))
 		return
 	}
+	if len(screenshotKeys) > 0 {
+		result = addTaskArtifact(result, "screenshots", screenshotKeys)
+	}
+
+	if pcapKey := stopCapture(); pcapKey != "" {
+		if err := s.DB.UpdateAnalysisTaskPcap(ctx, task.ID, pcapKey); err != nil {
+			s.Logger.WithError(err).Error("Failed to link packet capture to task")
+		}
+		result = addTaskArtifact(result, "pcap", pcapKey)
+	}
+
+	if options.MemoryDump {
+		prefix := fmt.Sprintf("tasks/%s/memory", task.ID)
+		keys, err := hvClient.UploadMemoryDump(ctx, agentConfig.Provider, agentConfig.Name, prefix)
+		if err != nil {
+			// The agent result is still worth keeping
+			s.Logger.WithError(err).Errorf("Failed to dump memory of VM %s", agentConfig.Name)
+			result = addTaskArtifact(result, "memory_dump_error", err.Error())
+		} else {
+			result = addTaskArtifact(result, "memory_dump", keys)
+		}
+	}
 
 	err = s.DB.UpdateAnalysisTaskResults(ctx, task.ID, result)
 	if err != nil {
@@ -158,6 +325,53 @@ func (s *Server) handleAnalysisTask(task AnalysisTask, hvClient *HvClient) {
 	s.Logger.Infof("Analysis task %s completed", task.ID)
 }
 
+// failAnalysisTask marks the task as failed and stores the reason as its result
+func (s *Server) failAnalysisTask(ctx context.Context, taskID uuid.UUID, reason string) {
+	s.Logger.Errorf("Analysis task %s failed: %s", taskID, reason)
+	err := s.DB.UpdateAnalysisTaskResults(ctx, taskID, map[string]string{"error": reason})
+	if err != nil {
+		s.Logger.WithError(err).Error("Failed to update task result")
+	}
+	s.DB.UpdateAnalysisTaskStatus(ctx, taskID, "failed")
+}
+
+// taskOptionKeys are the keys of TaskOptions in AnalysisTask.Args
+var taskOptionKeys = map[string]bool{
+	"screenshot_interval": true,
+	"memory_dump":         true,
+	"network_profile":     true,
+}
+
+func parseTaskOptions(args json.RawMessage) (TaskOptions, error) {
+	var options TaskOptions
+	if len(args) == 0 {
+		return options, nil
+	}
+	if err := json.Unmarshal(args, &options); err != nil {
+		return options, err
+	}
+	if options.ScreenshotInterval < 0 {
+		return options, fmt.Errorf("screenshot_interval must be positive")
+	}
+	return options, nil
+}
+
+// addTaskArtifact references an artifact collected by sbapi, such as the S3
+// keys of screenshots, in the "artifacts" object of the agent result
+func addTaskArtifact(result interface{}, name string, value interface{}) interface{} {
+	resultMap, ok := result.(map[string]interface{})
+	if !ok {
+		resultMap = map[string]interface{}{"result": result}
+	}
+	artifacts, ok := resultMap["artifacts"].(map[string]interface{})
+	if !ok {
+		artifacts = make(map[string]interface{})
+		resultMap["artifacts"] = artifacts
+	}
+	artifacts[name] = value
+	return resultMap
+}
+
 // SendTaskToAgent sends the analysis task to the specified agent
 func (s *Server) SendTaskToAgent(task AnalysisTask) error {
 	ctx := context.Background()
@@ -187,6 +401,9 @@ func (s *Server) SendTaskToAgent(task AnalysisTask) error {
 		return fmt.Errorf("failed to unmarshal task args: %w", err)
 	}
 	for key, value := range taskArgs {
+		if taskOptionKeys[key] {
+			continue
+		}
 		args[key] = value
 	}
 
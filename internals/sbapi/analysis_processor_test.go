@@ -0,0 +1,198 @@
+package sbapi
+
+import (
+	"TraceForge/internals/commons"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseTaskOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     string
+		expected TaskOptions
+		err      bool
+	}{
+		{name: "no args", args: ""},
+		{name: "agent args only", args: `{"timeout": 60, "cmdline": "-x"}`},
+		{
+			name:     "all options",
+			args:     `{"screenshot_interval": 10, "memory_dump": true, "network_profile": "isolated", "timeout": 60}`,
+			expected: TaskOptions{ScreenshotInterval: 10, MemoryDump: true, NetworkProfile: "isolated"},
+		},
+		{name: "negative interval", args: `{"screenshot_interval": -1}`, err: true},
+		{name: "wrong type", args: `{"memory_dump": "yes"}`, err: true},
+		{name: "not an object", args: `[1, 2]`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := parseTaskOptions(json.RawMessage(tt.args))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", options)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options != tt.expected {
+				t.Errorf("got %+v, expected %+v", options, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAddTaskArtifact(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   interface{}
+		expected interface{}
+	}{
+		{
+			name:   "object result",
+			result: map[string]interface{}{"verdict": "clean"},
+			expected: map[string]interface{}{
+				"verdict":   "clean",
+				"artifacts": map[string]interface{}{"pcap": "tasks/1/capture.pcap"},
+			},
+		},
+		{
+			name: "existing artifacts",
+			result: map[string]interface{}{
+				"artifacts": map[string]interface{}{"screenshots": []string{"a.png"}},
+			},
+			expected: map[string]interface{}{
+				"artifacts": map[string]interface{}{
+					"screenshots": []string{"a.png"},
+					"pcap":        "tasks/1/capture.pcap",
+				},
+			},
+		},
+		{
+			// The agent result isn't an object, it is kept under "result"
+			name:   "scalar result",
+			result: "done",
+			expected: map[string]interface{}{
+				"result":    "done",
+				"artifacts": map[string]interface{}{"pcap": "tasks/1/capture.pcap"},
+			},
+		},
+		{
+			name:   "invalid artifacts",
+			result: map[string]interface{}{"artifacts": "none"},
+			expected: map[string]interface{}{
+				"artifacts": map[string]interface{}{"pcap": "tasks/1/capture.pcap"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addTaskArtifact(tt.result, "pcap", "tasks/1/capture.pcap")
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %#v, expected %#v", got, tt.expected)
+			}
+		})
+	}
+}
+
+// leaseServer answers the lease endpoints of hvapi and records the requests
+type leaseServer struct {
+	mu       sync.Mutex
+	requests []string // Method and path
+	conflict bool     // The VM is leased by another owner
+}
+
+func (ls *leaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ls.mu.Lock()
+	ls.requests = append(ls.requests, r.Method+" "+r.URL.Path)
+	ls.mu.Unlock()
+
+	if ls.conflict {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(HttpResp{Status: "error", Message: "VM is leased by another owner"})
+		return
+	}
+	lease := HvLease{ID: "lease-1", Provider: "fake", VM: "win10", ExpiresAt: time.Now().Add(vmLeaseTTL)}
+	json.NewEncoder(w).Encode(HttpResp{Status: "success", Data: lease})
+}
+
+func (ls *leaseServer) count(request string) int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	n := 0
+	for _, r := range ls.requests {
+		if r == request {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLeaseVM(t *testing.T) {
+	defaultTTL := vmLeaseTTL
+	vmLeaseTTL = 30 * time.Millisecond
+	defer func() { vmLeaseTTL = defaultTTL }()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	s := &Server{Server: &commons.Server{Logger: logger}}
+	agentConfig := &AgentConfig{ID: "1", Name: "win10", Provider: "fake"}
+	ls := &leaseServer{}
+	hv := httptest.NewServer(ls)
+	defer hv.Close()
+
+	leased, release, err := s.leaseVM(context.Background(), NewHvClient(hv.URL, "key"), agentConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased.LeaseID != "lease-1" {
+		t.Errorf("got lease ID %q, expected lease-1", leased.LeaseID)
+	}
+
+	// Renewed every third of the TTL
+	deadline := time.Now().Add(5 * time.Second)
+	for ls.count("POST /leases/lease-1/renew") < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := ls.count("POST /leases/lease-1/renew"); n < 2 {
+		t.Fatalf("got %d renewals, expected at least 2", n)
+	}
+
+	release()
+	if n := ls.count("DELETE /leases/lease-1"); n != 1 {
+		t.Fatalf("got %d releases, expected 1", n)
+	}
+	renewals := ls.count("POST /leases/lease-1/renew")
+	time.Sleep(3 * vmLeaseTTL)
+	if n := ls.count("POST /leases/lease-1/renew"); n != renewals {
+		t.Errorf("got %d renewals after the release, expected %d", n, renewals)
+	}
+	if n := ls.count("POST /fake/win10/lease"); n != 1 {
+		t.Errorf("got %d acquisitions, expected 1", n)
+	}
+}
+
+func TestLeaseVMHeld(t *testing.T) {
+	s := &Server{Server: &commons.Server{Logger: logrus.New()}}
+	hv := httptest.NewServer(&leaseServer{conflict: true})
+	defer hv.Close()
+
+	_, _, err := s.leaseVM(context.Background(), NewHvClient(hv.URL, "key"), &AgentConfig{Name: "win10", Provider: "fake"})
+	var hvErr *HvError
+	if !errors.As(err, &hvErr) || hvErr.StatusCode != http.StatusConflict {
+		t.Fatalf("got %v, expected the 409 of hvapi", err)
+	}
+}
@@ -30,8 +30,11 @@ func (s *Server) CleanOrphanFiles() error {
 	var continuationToken *string
 
 	for {
+		// Only uploads are tracked in the database, task artifacts
+		// (screenshots...) live under tasks/
 		listInput := &s3.ListObjectsV2Input{
 			Bucket:            aws.String(s.Config.S3BucketName),
+			Prefix:            aws.String("uploads/"),
 			ContinuationToken: continuationToken,
 		}
 
@@ -39,9 +39,11 @@ func (d *DB) CreateTables() error {
       status TEXT NOT NULL DEFAULT 'pending',
       args JSONB,
       result JSONB,
+      pcap_key TEXT DEFAULT '',
       created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
       updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
   );
+  ALTER TABLE analysis_tasks ADD COLUMN IF NOT EXISTS pcap_key TEXT DEFAULT '';
   `)
 	return err
 }
@@ -138,7 +140,7 @@ func (d *DB) CreateAnalysisTask(ctx context.Context, task AnalysisTask) error {
 // GetAnalysisTasks retrieves all analysis tasks
 func (d *DB) GetAnalysisTasks(ctx context.Context) ([]AnalysisTask, error) {
 	rows, err := d.DB.QueryContext(ctx, `
-        SELECT id, file_id, agent_id, plugin, status, args, result, created_at, updated_at
+        SELECT id, file_id, agent_id, plugin, status, args, result, COALESCE(pcap_key, ''), created_at, updated_at
         FROM analysis_tasks
         ORDER BY created_at DESC
     `)
@@ -151,7 +153,7 @@ func (d *DB) GetAnalysisTasks(ctx context.Context) ([]AnalysisTask, error) {
 	for rows.Next() {
 		var task AnalysisTask
 		var result sql.NullString
-		err := rows.Scan(&task.ID, &task.FileID, &task.AgentID, &task.Plugin, &task.Status, &task.Args, &result, &task.CreatedAt, &task.UpdatedAt)
+		err := rows.Scan(&task.ID, &task.FileID, &task.AgentID, &task.Plugin, &task.Status, &task.Args, &result, &task.PcapKey, &task.CreatedAt, &task.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -191,9 +193,19 @@ func (d *DB) UpdateAnalysisTaskResults(ctx context.Context, taskID uuid.UUID, re
 	return err
 }
 
+// UpdateAnalysisTaskPcap links the packet capture stored in S3 to a task
+func (d *DB) UpdateAnalysisTaskPcap(ctx context.Context, taskID uuid.UUID, pcapKey string) error {
+	_, err := d.DB.ExecContext(ctx, `
+        UPDATE analysis_tasks
+        SET pcap_key = $1, updated_at = $2
+        WHERE id = $3
+    `, pcapKey, time.Now(), taskID)
+	return err
+}
+
 func (d *DB) GetNextPendingAnalysisTaskForAgent(ctx context.Context, agentID string) (*AnalysisTask, error) {
 	row := d.DB.QueryRowContext(ctx, `
-        SELECT id, file_id, agent_id, plugin, status, args, result, created_at, updated_at
+        SELECT id, file_id, agent_id, plugin, status, args, result, COALESCE(pcap_key, ''), created_at, updated_at
         FROM analysis_tasks
         WHERE status = 'pending' AND agent_id = $1
         ORDER BY created_at ASC
@@ -202,7 +214,7 @@ func (d *DB) GetNextPendingAnalysisTaskForAgent(ctx context.Context, agentID str
 
 	var task AnalysisTask
 	var result sql.NullString
-	err := row.Scan(&task.ID, &task.FileID, &task.AgentID, &task.Plugin, &task.Status, &task.Args, &result, &task.CreatedAt, &task.UpdatedAt)
+	err := row.Scan(&task.ID, &task.FileID, &task.AgentID, &task.Plugin, &task.Status, &task.Args, &result, &task.PcapKey, &task.CreatedAt, &task.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
@@ -217,7 +229,7 @@ func (d *DB) GetNextPendingAnalysisTaskForAgent(ctx context.Context, agentID str
 // GetPendingAnalysisTasks retrieves analysis tasks with 'pending' status
 func (d *DB) GetPendingAnalysisTasks(ctx context.Context) ([]AnalysisTask, error) {
 	rows, err := d.DB.QueryContext(ctx, `
-        SELECT id, file_id, agent_id, plugin, status, args, result, created_at, updated_at
+        SELECT id, file_id, agent_id, plugin, status, args, result, COALESCE(pcap_key, ''), created_at, updated_at
         FROM analysis_tasks
         WHERE status = 'pending'
         ORDER BY created_at ASC
@@ -231,7 +243,7 @@ func (d *DB) GetPendingAnalysisTasks(ctx context.Context) ([]AnalysisTask, error
 	for rows.Next() {
 		var task AnalysisTask
 		var result sql.NullString
-		err := rows.Scan(&task.ID, &task.FileID, &task.AgentID, &task.Plugin, &task.Status, &task.Args, &result, &task.CreatedAt, &task.UpdatedAt)
+		err := rows.Scan(&task.ID, &task.FileID, &task.AgentID, &task.Plugin, &task.Status, &task.Args, &result, &task.PcapKey, &task.CreatedAt, &task.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -1,6 +1,7 @@
 package sbapi
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"time"
@@ -60,6 +61,17 @@ func (s *Server) GeneratePresignedFileURLPut(ctx context.Context, s3Key string,
 	return presignedReq.URL, nil
 }
 
+// uploadToS3 stores data under the given key of the bucket
+func (s *Server) uploadToS3(ctx context.Context, key, contentType string, data []byte) error {
+	_, err := s.S3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Config.S3BucketName),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
 func (s *Server) acquireVMLock(vmName string, timeout time.Duration) (bool, error) {
 	lockKey := fmt.Sprintf("vm_lock:%s", vmName)
 	success, err := s.RedisClient.SetNX(context.Background(), lockKey, "locked", timeout).Result()
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -23,6 +25,7 @@ type HvClient struct {
 	BaseURL    string
 	APIKey     string
 	HTTPClient *http.Client
+	LeaseID    string // Sent to the mutating endpoints, see WithLease
 }
 
 // NewHvClient remains unchanged
@@ -38,8 +41,9 @@ func NewHvClient(baseURL, apiKey string) *HvClient {
 
 // Custom error type for HV API errors
 type HvError struct {
-	Status  string
-	Message string
+	StatusCode int // HTTP status code, 200 when the error is in the body
+	Status     string
+	Message    string
 }
 
 func (e *HvError) Error() string {
@@ -67,6 +71,9 @@ func (c *HvClient) newRequest(ctx context.Context, method, path string, body int
 		req.Header.Set("Content-Type", "application/json")
 	}
 	req.Header.Set("Accept", "application/json")
+	if c.LeaseID != "" {
+		req.Header.Set("X-Lease-ID", c.LeaseID)
+	}
 
 	return req, nil
 }
@@ -84,13 +91,16 @@ func (c *HvClient) do(req *http.Request, v *HttpResp) error {
 		return err
 	}
 
+	// Unmarshal into HttpResp
+	err = json.Unmarshal(bodyBytes, v)
+
 	// Check for HTTP errors
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("API error: %s", string(bodyBytes))
+		if err != nil {
+			return fmt.Errorf("API error: %s", string(bodyBytes))
+		}
+		return &HvError{StatusCode: resp.StatusCode, Status: v.Status, Message: v.Message}
 	}
-
-	// Unmarshal into HttpResp
-	err = json.Unmarshal(bodyBytes, v)
 	if err != nil {
 		return err
 	}
@@ -98,34 +108,205 @@ func (c *HvClient) do(req *http.Request, v *HttpResp) error {
 	return nil
 }
 
-// RevertVM reverts a specific virtual machine.
+// doRaw performs a request whose successful response isn't JSON and
+// returns its body, errors are still reported as JSON by hvapi
+func (c *HvClient) doRaw(req *http.Request) ([]byte, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var v HttpResp
+		if err := json.Unmarshal(bodyBytes, &v); err != nil {
+			return nil, fmt.Errorf("API error: %s", string(bodyBytes))
+		}
+		return nil, &HvError{StatusCode: resp.StatusCode, Status: v.Status, Message: v.Message}
+	}
+	return bodyBytes, nil
+}
+
+// HvOperation is an operation running in the background on hvapi
+type HvOperation struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Status     string `json:"status"` // pending, running, succeeded or failed
+	Progress   string `json:"progress"`
+	Message    string `json:"message"`
+	Error      string `json:"error"`
+	StatusCode int    `json:"status_code"`
+}
+
+// operationPollInterval is the delay between two polls of an operation
+const operationPollInterval = 2 * time.Second
+
+// runOperation asks hvapi to run a VM operation in the background and polls
+// it until it ends, so that slow reverts and starts don't hit the timeout of
+// the HTTP client. A failed operation is returned as an HvError with the
+// status code hvapi would have answered synchronously.
+func (c *HvClient) runOperation(ctx context.Context, path string) (*HttpResp, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, path+"?async=true", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp HttpResp
+	op := HvOperation{}
+	resp.Data = &op
+	err = c.do(req, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != "success" {
+		return nil, &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
+	}
+
+	for op.Status != "succeeded" && op.Status != "failed" {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for operation %s: %w", op.ID, ctx.Err())
+		case <-time.After(operationPollInterval):
+		}
+		if op, err = c.GetOperation(ctx, op.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if op.Status == "failed" {
+		return nil, &HvError{StatusCode: op.StatusCode, Status: "error", Message: op.Error}
+	}
+	return &HttpResp{Data: op, Message: op.Message, Status: "success"}, nil
+}
+
+// GetOperation returns the state of an operation started in the background
+func (c *HvClient) GetOperation(ctx context.Context, id string) (HvOperation, error) {
+	path := fmt.Sprintf("/operations/%s", url.PathEscape(id))
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return HvOperation{}, err
+	}
+
+	var resp HttpResp
+	op := HvOperation{}
+	resp.Data = &op
+	err = c.do(req, &resp)
+	if err != nil {
+		return HvOperation{}, err
+	}
+
+	if resp.Status != "success" {
+		return HvOperation{}, &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
+	}
+	return op, nil
+}
+
+// RevertVM reverts a specific virtual machine, see runOperation.
 func (c *HvClient) RevertVM(ctx context.Context, provider, vmName string) (*HttpResp, error) {
-	path := fmt.Sprintf("/%s/%s/revert", provider, vmName)
+	return c.runOperation(ctx, fmt.Sprintf("/%s/%s/revert", provider, vmName))
+}
+
+// RevertVMTo reverts a virtual machine to the named snapshot, see runOperation.
+func (c *HvClient) RevertVMTo(ctx context.Context, provider, vmName, snapshotName string) (*HttpResp, error) {
+	return c.runOperation(ctx, fmt.Sprintf("/%s/%s/revert/%s", provider, vmName, url.PathEscape(snapshotName)))
+}
+
+// StartVM starts a virtual machine, see runOperation.
+func (c *HvClient) StartVM(ctx context.Context, provider, vmName string) (*HttpResp, error) {
+	return c.runOperation(ctx, fmt.Sprintf("/%s/%s/start", provider, vmName))
+}
+
+// StopVM stops a virtual machine, see runOperation.
+func (c *HvClient) StopVM(ctx context.Context, provider, vmName string) (*HttpResp, error) {
+	return c.runOperation(ctx, fmt.Sprintf("/%s/%s/stop", provider, vmName))
+}
+
+// WaitForVM waits until a virtual machine is in the given power state and,
+// when guest is true, until its guest OS has booted. hvapi answers 501 when
+// the provider can't tell whether the guest has booted.
+func (c *HvClient) WaitForVM(ctx context.Context, provider, vmName, state string, guest bool, timeout time.Duration) (*HttpResp, error) {
+	query := url.Values{}
+	query.Set("state", state)
+	query.Set("guest", strconv.FormatBool(guest))
+	query.Set("timeout", timeout.String())
+	path := fmt.Sprintf("/%s/%s/wait?%s", provider, vmName, query.Encode())
 	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	var resp HttpResp
-	err = c.do(req, &resp)
+	// hvapi answers once the timeout is over, leave it some margin
+	err = c.withTimeout(timeout+30*time.Second).do(req, &resp)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.Status != "success" {
-		return nil, &HvError{Status: resp.Status, Message: resp.Message}
+		return nil, &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
 	}
 
 	return &resp, nil
 }
 
-// StartVM starts a virtual machine.
-func (c *HvClient) StartVM(ctx context.Context, provider, vmName string) (*HttpResp, error) {
-	path := fmt.Sprintf("/%s/%s/start", provider, vmName)
+// CaptureScreen returns a PNG image of the display of a virtual machine.
+func (c *HvClient) CaptureScreen(ctx context.Context, provider, vmName string) ([]byte, error) {
+	path := fmt.Sprintf("/%s/%s/screenshot", provider, vmName)
 	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Accept", "image/png")
+
+	return c.doRaw(req)
+}
+
+// memoryDumpTimeout bounds UploadMemoryDump, dumping and uploading the
+// memory of a large VM takes minutes
+const memoryDumpTimeout = 30 * time.Minute
+
+// UploadMemoryDump dumps the memory of a virtual machine to the S3 bucket of
+// hvapi under the given prefix, relative to the prefix configured in hvapi,
+// and returns the keys of the files.
+func (c *HvClient) UploadMemoryDump(ctx context.Context, provider, vmName, s3Prefix string) ([]string, error) {
+	path := fmt.Sprintf("/%s/%s/memory", provider, vmName)
+	req, err := c.newRequest(ctx, http.MethodPost, path, map[string]string{"s3_prefix": s3Prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp HttpResp
+	err = c.withTimeout(memoryDumpTimeout).do(req, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != "success" {
+		return nil, &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
+	}
+
+	var keys []string
+	values, _ := resp.Data.([]interface{})
+	for _, value := range values {
+		keys = append(keys, fmt.Sprint(value))
+	}
+	return keys, nil
+}
+
+// SetNetworkProfile attaches a virtual machine to the network of one of the
+// profiles configured in hvapi, it is called before the VM is started.
+func (c *HvClient) SetNetworkProfile(ctx context.Context, provider, vmName, profile string) (*HttpResp, error) {
+	path := fmt.Sprintf("/%s/%s/network/%s", provider, vmName, url.PathEscape(profile))
+	req, err := c.newRequest(ctx, http.MethodPost, path, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	var resp HttpResp
 	err = c.do(req, &resp)
@@ -134,16 +315,17 @@ func (c *HvClient) StartVM(ctx context.Context, provider, vmName string) (*HttpR
 	}
 
 	if resp.Status != "success" {
-		return nil, &HvError{Status: resp.Status, Message: resp.Message}
+		return nil, &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
 	}
 
 	return &resp, nil
 }
 
-// StopVM stops a virtual machine.
-func (c *HvClient) StopVM(ctx context.Context, provider, vmName string) (*HttpResp, error) {
-	path := fmt.Sprintf("/%s/%s/stop", provider, vmName)
-	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+// StartCapture starts recording the network traffic of a virtual machine,
+// it is called before the VM is started.
+func (c *HvClient) StartCapture(ctx context.Context, provider, vmName string) (*HttpResp, error) {
+	path := fmt.Sprintf("/%s/%s/capture/start", provider, vmName)
+	req, err := c.newRequest(ctx, http.MethodPost, path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -155,10 +337,99 @@ func (c *HvClient) StopVM(ctx context.Context, provider, vmName string) (*HttpRe
 	}
 
 	if resp.Status != "success" {
-		return nil, &HvError{Status: resp.Status, Message: resp.Message}
+		return nil, &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
 	}
 
 	return &resp, nil
 }
 
+// StopCapture stops the packet capture of a virtual machine and stores the
+// pcap file in the S3 bucket of hvapi under s3Key, relative to the prefix
+// configured in hvapi. The full key is returned.
+func (c *HvClient) StopCapture(ctx context.Context, provider, vmName, s3Key string) (string, error) {
+	path := fmt.Sprintf("/%s/%s/capture/stop", provider, vmName)
+	req, err := c.newRequest(ctx, http.MethodPost, path, map[string]string{"s3_key": s3Key})
+	if err != nil {
+		return "", err
+	}
+
+	var resp HttpResp
+	err = c.withTimeout(captureUploadTimeout).do(req, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Status != "success" {
+		return "", &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
+	}
+
+	key, _ := resp.Data.(string)
+	return key, nil
+}
+
+// captureUploadTimeout bounds StopCapture, which uploads the capture
+const captureUploadTimeout = 10 * time.Minute
+
+// withTimeout returns a copy of the client for slower operations
+func (c *HvClient) withTimeout(timeout time.Duration) *HvClient {
+	httpClient := *c.HTTPClient
+	httpClient.Timeout = timeout
+	return &HvClient{BaseURL: c.BaseURL, APIKey: c.APIKey, HTTPClient: &httpClient, LeaseID: c.LeaseID}
+}
+
+// WithLease returns a copy of the client sending the lease ID
+func (c *HvClient) WithLease(leaseID string) *HvClient {
+	return &HvClient{BaseURL: c.BaseURL, APIKey: c.APIKey, HTTPClient: c.HTTPClient, LeaseID: leaseID}
+}
+
+// HvLease is the lease of a VM granted by hvapi
+type HvLease struct {
+	ID        string    `json:"id"`
+	Provider  string    `json:"provider"`
+	VM        string    `json:"vm"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// AcquireLease leases a virtual machine to owner for ttl, hvapi answers 409
+// when another owner holds it.
+func (c *HvClient) AcquireLease(ctx context.Context, provider, vmName, owner string, ttl time.Duration) (*HvLease, error) {
+	path := fmt.Sprintf("/%s/%s/lease", provider, vmName)
+	body := map[string]string{"owner": owner, "ttl": ttl.String()}
+	return c.leaseRequest(ctx, http.MethodPost, path, body)
+}
+
+// RenewLease extends a lease to ttl from now.
+func (c *HvClient) RenewLease(ctx context.Context, leaseID string, ttl time.Duration) (*HvLease, error) {
+	path := fmt.Sprintf("/leases/%s/renew", url.PathEscape(leaseID))
+	return c.leaseRequest(ctx, http.MethodPost, path, map[string]string{"ttl": ttl.String()})
+}
+
+// ReleaseLease ends a lease.
+func (c *HvClient) ReleaseLease(ctx context.Context, leaseID string) error {
+	path := fmt.Sprintf("/leases/%s", url.PathEscape(leaseID))
+	_, err := c.leaseRequest(ctx, http.MethodDelete, path, nil)
+	return err
+}
+
+func (c *HvClient) leaseRequest(ctx context.Context, method, path string, body interface{}) (*HvLease, error) {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp HttpResp
+	lease := HvLease{}
+	resp.Data = &lease
+	err = c.do(req, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Status != "success" {
+		return nil, &HvError{StatusCode: http.StatusOK, Status: resp.Status, Message: resp.Message}
+	}
+	return &lease, nil
+}
+
 // ... other HvClient methods remain unchanged
@@ -0,0 +1,66 @@
+package sbapi
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// screenshotRecorder periodically captures the screen of the VM of a task
+// and stores the images in S3, under tasks/<task id>/screenshots/
+type screenshotRecorder struct {
+	stop chan struct{}
+	done chan struct{}
+	keys []string
+}
+
+func (s *Server) startScreenshots(ctx context.Context, taskID uuid.UUID, hvClient *HvClient, agentConfig *AgentConfig, interval time.Duration) *screenshotRecorder {
+	rec := &screenshotRecorder{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	capture := func() {
+		key := fmt.Sprintf("tasks/%s/screenshots/%03d.png", taskID, len(rec.keys))
+		image, err := hvClient.CaptureScreen(ctx, agentConfig.Provider, agentConfig.Name)
+		if err != nil {
+			s.Logger.WithError(err).Warnf("Failed to capture screen of VM %s", agentConfig.Name)
+			return
+		}
+		if err := s.uploadToS3(ctx, key, "image/png", image); err != nil {
+			s.Logger.WithError(err).Warnf("Failed to upload screenshot %s", key)
+			return
+		}
+		rec.keys = append(rec.keys, key)
+	}
+
+	go func() {
+		defer close(rec.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				capture()
+			case <-rec.stop:
+				// The final state of the screen is often the most telling
+				capture()
+				return
+			}
+		}
+	}()
+	return rec
+}
+
+// Stop takes a last screenshot and returns the S3 keys of all the images,
+// a nil recorder has no screenshots
+func (rec *screenshotRecorder) Stop() []string {
+	if rec == nil {
+		return nil
+	}
+	close(rec.stop)
+	<-rec.done
+	return rec.keys
+}
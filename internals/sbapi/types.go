@@ -61,9 +61,13 @@ type AgentsConfig struct {
 }
 
 type AgentDefaultsConfig struct {
-	Plugins   []string `toml:"plugins,omitempty"`
-	HvapiName string   `toml:"hvapi_name,omitempty"`
-	Provider  string   `toml:"provider,omitempty"`
+	Plugins        []string `toml:"plugins,omitempty"`
+	HvapiName      string   `toml:"hvapi_name,omitempty"`
+	Provider       string   `toml:"provider,omitempty"`
+	Baseline       string   `toml:"baseline,omitempty"`
+	PacketCapture  *bool    `toml:"packet_capture,omitempty"`
+	NetworkProfile string   `toml:"network_profile,omitempty"`
+	WaitGuest      *bool    `toml:"wait_guest,omitempty"`
 }
 
 type HvapiAgentsConfig struct {
@@ -72,12 +76,16 @@ type HvapiAgentsConfig struct {
 }
 
 type AgentConfig struct {
-	ID          string            `toml:"agent_uuid"`
-	Name        string            `toml:"name"`
-	Provider    string            `toml:"provider,omitempty"`
-	Plugins     []string          `toml:"plugins,omitempty"`
-	HvapiName   string            `toml:"hvapi_name,omitempty"`
-	HvapiConfig HvapiAgentsConfig `toml:"-"`
+	ID             string            `toml:"agent_uuid"`
+	Name           string            `toml:"name"`
+	Provider       string            `toml:"provider,omitempty"`
+	Plugins        []string          `toml:"plugins,omitempty"`
+	HvapiName      string            `toml:"hvapi_name,omitempty"`
+	Baseline       string            `toml:"baseline,omitempty"`        // Snapshot restored before each analysis
+	PacketCapture  *bool             `toml:"packet_capture,omitempty"`  // Record the network traffic of each analysis
+	NetworkProfile string            `toml:"network_profile,omitempty"` // Default network profile of the analyses
+	WaitGuest      *bool             `toml:"wait_guest,omitempty"`      // Wait for the guest OS before sending the task, true by default
+	HvapiConfig    HvapiAgentsConfig `toml:"-"`
 }
 
 type AnalysisTask struct {
@@ -88,10 +96,19 @@ type AnalysisTask struct {
 	Status    string          `json:"status"`
 	Args      json.RawMessage `json:"args,omitempty"`
 	Result    json.RawMessage `json:"result,omitempty"`
+	PcapKey   string          `json:"pcap_key,omitempty"` // S3 key of the packet capture
 	CreatedAt time.Time       `json:"created_at"`
 	UpdatedAt time.Time       `json:"updated_at"`
 }
 
+// TaskOptions are the AnalysisTask.Args handled by sbapi around the run of
+// the task, they aren't forwarded to the agent
+type TaskOptions struct {
+	ScreenshotInterval int    `json:"screenshot_interval,omitempty"` // Seconds between screenshots, 0 to disable
+	MemoryDump         bool   `json:"memory_dump,omitempty"`         // Dump the guest memory once the agent is done
+	NetworkProfile     string `json:"network_profile,omitempty"`     // hvapi network profile of the VM, defaults to the agent one
+}
+
 type AgentInfo struct {
 	ID      string   `json:"id"`
 	Name    string   `json:"name"`
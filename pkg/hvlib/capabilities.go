@@ -0,0 +1,67 @@
+package hvlib
+
+import (
+	"errors"
+	"sort"
+)
+
+// Capabilities advertised by the providers, most match an optional
+// interface which the provider may still not support with its configuration
+const (
+	CapSnapshots            = "snapshots"
+	CapSnapshotCreationTime = "snapshot_creation_time"
+	CapSuspend              = "suspend"
+	CapReset                = "reset"
+	CapGuestOperations      = "guest_operations"
+	CapScreenCapture        = "screen_capture"
+	CapMemoryDump           = "memory_dump"
+	CapPacketCapture        = "packet_capture"
+	CapNetworkProfiles      = "network_profiles"
+	CapClone                = "clone"
+	CapGuestReadiness       = "guest_readiness"
+	CapInventoryRefresh     = "inventory_refresh"
+)
+
+// ErrNotSupported is returned by the operations a provider can't perform,
+// at all or with its configuration
+var ErrNotSupported = errors.New("operation not supported by the provider")
+
+// providerCapabilities returns the capabilities of the optional interfaces
+// implemented by the provider, followed by the given core capabilities and
+// without the excluded ones
+func providerCapabilities(provider VirtualizationProvider, core []string, excluded ...string) []string {
+	implemented := map[string]bool{}
+	_, implemented[CapGuestOperations] = provider.(GuestOperations)
+	_, implemented[CapScreenCapture] = provider.(ScreenCapturer)
+	_, implemented[CapMemoryDump] = provider.(MemoryDumper)
+	_, implemented[CapPacketCapture] = provider.(PacketCapturer)
+	_, implemented[CapNetworkProfiles] = provider.(NetworkConfigurator)
+	_, implemented[CapClone] = provider.(Cloner)
+	_, implemented[CapGuestReadiness] = provider.(GuestReadinessChecker)
+	_, implemented[CapInventoryRefresh] = provider.(InventoryRefresher)
+	for _, capability := range core {
+		implemented[capability] = true
+	}
+	for _, capability := range excluded {
+		implemented[capability] = false
+	}
+
+	var capabilities []string
+	for capability, ok := range implemented {
+		if ok {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	sort.Strings(capabilities)
+	return capabilities
+}
+
+// HasCapability reports whether the provider advertises the capability
+func HasCapability(provider VirtualizationProvider, capability string) bool {
+	for _, c := range provider.Capabilities() {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
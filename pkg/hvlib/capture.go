@@ -0,0 +1,50 @@
+package hvlib
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrCaptureInProgress = errors.New("a packet capture is already in progress")
+	ErrNoCapture         = errors.New("no packet capture in progress")
+)
+
+// packetCapture is the state a provider keeps between StartCapture and
+// StopCapture
+type packetCapture struct {
+	hostPath string
+	stop     func() error // Provider specific cleanup, may be nil
+}
+
+// captureSet tracks the packet captures in progress, at most one per VM
+type captureSet struct {
+	mu       sync.Mutex
+	captures map[string]*packetCapture
+}
+
+// add registers a capture for vmName, it fails if one is already running
+func (c *captureSet) add(vmName string, capture *packetCapture) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.captures[vmName]; exists {
+		return ErrCaptureInProgress
+	}
+	if c.captures == nil {
+		c.captures = make(map[string]*packetCapture)
+	}
+	c.captures[vmName] = capture
+	return nil
+}
+
+// remove unregisters and returns the capture of vmName
+func (c *captureSet) remove(vmName string) (*packetCapture, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	capture, exists := c.captures[vmName]
+	if !exists {
+		return nil, ErrNoCapture
+	}
+	delete(c.captures, vmName)
+	return capture, nil
+}
@@ -0,0 +1,14 @@
+package hvlib
+
+import "regexp"
+
+// cloneNameRegexp restricts clone names to what every hypervisor accepts,
+// and what is safe in file paths
+var cloneNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func validateCloneName(name string) error {
+	if !cloneNameRegexp.MatchString(name) {
+		return &InvalidNameError{Name: name, Reason: "only letters, digits, '.', '_' and '-' are allowed"}
+	}
+	return nil
+}
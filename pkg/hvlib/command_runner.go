@@ -0,0 +1,241 @@
+package hvlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandRunner executes the hypervisor tools (vmrun, powershell, virsh...).
+// Providers use it instead of os/exec so their output can be replayed in tests.
+type CommandRunner interface {
+	// Run returns the stdout and stderr of the program, err is a
+	// *CommandExitError when the program exited with a non-zero code
+	// and the context error when the program was killed because ctx ended
+	Run(ctx context.Context, name string, args ...string) (stdout string, stderr string, err error)
+}
+
+// CommandExitError is the failure of a hypervisor tool, the exec helpers of
+// the providers return it with the output of the tool
+type CommandExitError struct {
+	ExitCode int
+}
+
+func (e *CommandExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.ExitCode)
+}
+
+// CommandTranscript is a recorded execution of a command
+type CommandTranscript struct {
+	Name     string   `json:"name"`
+	Args     []string `json:"args"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	ExitCode int      `json:"exit_code"`
+	Error    string   `json:"error,omitempty"` // Set when the program could not be started
+}
+
+// ExecRunner runs the commands with os/exec, the process is killed
+// when the context ends
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Don't wait forever on the pipes if a grandchild (vmware-vmx...)
+	// inherited them and outlives the killed process
+	cmd.WaitDelay = 5 * time.Second
+
+	stdOutBuf, stdErrBuf := new(strings.Builder), new(strings.Builder)
+	cmd.Stdout = stdOutBuf
+	cmd.Stderr = stdErrBuf
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return stdOutBuf.String(), stdErrBuf.String(), ctx.Err()
+	}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		return stdOutBuf.String(), stdErrBuf.String(), &CommandExitError{ExitCode: exiterr.ExitCode()}
+	}
+	return stdOutBuf.String(), stdErrBuf.String(), err
+}
+
+// RecordingRunner runs the commands with Runner and appends every
+// execution to the fixture file at Path, one JSON transcript per line. The
+// guest passwords are redacted, see redactArgs. A transcript which can't be
+// recorded is reported to OnError, the command result is returned anyway.
+type RecordingRunner struct {
+	Runner  CommandRunner
+	Path    string
+	OnError func(err error) // Optional
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (r *RecordingRunner) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	stdout, stderr, err := r.Runner.Run(ctx, name, args...)
+
+	transcript := CommandTranscript{
+		Name:   name,
+		Args:   redactArgs(args),
+		Stdout: stdout,
+		Stderr: stderr,
+	}
+	if exitErr, ok := err.(*CommandExitError); ok {
+		transcript.ExitCode = exitErr.ExitCode
+	} else if err != nil {
+		transcript.Error = err.Error()
+	}
+
+	if recordErr := r.record(transcript); recordErr != nil && r.OnError != nil {
+		r.OnError(fmt.Errorf("failed to record the transcript of %s: %w", programName(name), recordErr))
+	}
+	return stdout, stderr, err
+}
+
+func (r *RecordingRunner) record(transcript CommandTranscript) error {
+	line, err := json.Marshal(transcript)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		// Only readable by hvapi, the transcripts have the VM paths and
+		// the outputs of the guest commands
+		if r.file, err = os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+			return err
+		}
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// redactedArg replaces the secrets in the recorded arguments
+const redactedArg = "[redacted]"
+
+// psPasswordParam matches the $Password parameter of the PowerShell scripts,
+// a literal quoted by psQuote
+var psPasswordParam = regexp.MustCompile(`\$Password = '(?:[^'\x{2018}-\x{201b}]|['\x{2018}-\x{201b}]{2})*'`)
+
+// redactArgs returns a copy of args without the guest passwords: the value
+// of the vmrun -gp and -vp options and the $Password parameter of the
+// PowerShell scripts
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && (args[i-1] == "-gp" || args[i-1] == "-vp") {
+			redacted[i] = redactedArg
+			continue
+		}
+		redacted[i] = psPasswordParam.ReplaceAllLiteralString(arg, "$Password = '"+redactedArg+"'")
+	}
+	return redacted
+}
+
+// ReplayRunner answers commands from recorded transcripts. Transcripts are
+// consumed in order for a given command line, the last one is reused once
+// they are all consumed.
+type ReplayRunner struct {
+	Transcripts []CommandTranscript
+
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+// NewReplayRunner loads the transcripts of a fixture file, either a JSON
+// array or the JSON lines appended by RecordingRunner
+func NewReplayRunner(fixturePath string) (*ReplayRunner, error) {
+	data, err := os.ReadFile(fixturePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture file: %w", err)
+	}
+
+	var transcripts []CommandTranscript
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &transcripts)
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var transcript CommandTranscript
+			if err = decoder.Decode(&transcript); err != nil {
+				break
+			}
+			transcripts = append(transcripts, transcript)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fixture file: %w", err)
+	}
+	return &ReplayRunner{Transcripts: transcripts}, nil
+}
+
+func (r *ReplayRunner) Run(ctx context.Context, name string, args ...string) (string, string, error) {
+	if ctx.Err() != nil {
+		return "", "", ctx.Err()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.used == nil {
+		r.used = make(map[int]bool)
+	}
+
+	// The passwords of the recorded transcripts are redacted
+	redacted := redactArgs(args)
+	match := -1
+	for i, t := range r.Transcripts {
+		if programName(t.Name) != programName(name) || !slices.Equal(redactArgs(t.Args), redacted) {
+			continue
+		}
+		match = i
+		if !r.used[i] {
+			break
+		}
+	}
+	if match == -1 {
+		return "", "", fmt.Errorf("no transcript recorded for %s %s", name, strings.Join(args, " "))
+	}
+	r.used[match] = true
+
+	t := r.Transcripts[match]
+	if t.Error != "" {
+		return t.Stdout, t.Stderr, fmt.Errorf("%s", t.Error)
+	}
+	if t.ExitCode != 0 {
+		return t.Stdout, t.Stderr, &CommandExitError{ExitCode: t.ExitCode}
+	}
+	return t.Stdout, t.Stderr, nil
+}
+
+// programName strips the directory so transcripts recorded on Windows
+// match whatever install path is configured when replaying
+func programName(name string) string {
+	return path.Base(strings.ReplaceAll(name, "\\", "/"))
+}
+
+// SetRunner replaces the CommandRunner used by the provider
+func (vp *VP) SetRunner(runner CommandRunner) {
+	vp.Runner = runner
+}
+
+func (vp *VP) runner() CommandRunner {
+	if vp.Runner == nil {
+		return ExecRunner{}
+	}
+	return vp.Runner
+}
@@ -0,0 +1,151 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pelletier/go-toml"
+)
+
+// loadConfigString loads a TOML document in the given ConfigLoader
+func loadConfigString(loader *ConfigLoader, content string) error {
+	tree, err := toml.Load(content)
+	if err != nil {
+		return err
+	}
+	loader.config = tree
+	return nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctx := context.Background()
+	source := &ReplayRunner{Transcripts: []CommandTranscript{
+		{Name: `C:\VMware\vmrun.exe`, Args: []string{"-T", "ws", "list"}, Stdout: "Total running VMs: 0\r\n"},
+		{Name: "powershell", Args: []string{"-Command", "Start-VM -VMName win10"}, Stderr: "failed", ExitCode: 1},
+	}}
+
+	fixture := filepath.Join(t.TempDir(), "transcripts.jsonl")
+	recorder := &RecordingRunner{Runner: source, Path: fixture}
+	recorder.Run(ctx, `C:\VMware\vmrun.exe`, "-T", "ws", "list")
+	recorder.Run(ctx, "powershell", "-Command", "Start-VM -VMName win10")
+
+	replay, err := NewReplayRunner(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The install path of the program is ignored when matching
+	stdout, _, err := replay.Run(ctx, "/opt/vmware/vmrun.exe", "-T", "ws", "list")
+	if err != nil || stdout != "Total running VMs: 0\r\n" {
+		t.Errorf("unexpected replay of vmrun list: %q, %v", stdout, err)
+	}
+
+	_, stderr, err := replay.Run(ctx, "powershell", "-Command", "Start-VM -VMName win10")
+	var exitErr *CommandExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 1 || stderr != "failed" {
+		t.Errorf("unexpected replay of Start-VM: %q, %v", stderr, err)
+	}
+
+	if _, _, err := replay.Run(ctx, "powershell", "-Command", "Stop-VM -VMName win10"); err == nil {
+		t.Error("expected an error for a command without transcript")
+	}
+}
+
+func TestRecordingRunnerRedaction(t *testing.T) {
+	ctx := context.Background()
+	guestArgs := []string{"-T", "ws", "-gu", "analyst", "-gp", "s3cret", "listProcessesInGuest", "win10.vmx"}
+	script := `$VMId = 'id'; $Username = 'analyst'; $Password = 'p@ss''word'; $GuestPath = 'C:\a.txt'; Copy-Item`
+	source := &ReplayRunner{Transcripts: []CommandTranscript{
+		{Name: "vmrun", Args: guestArgs, Stdout: "Process list: 0"},
+		{Name: "powershell", Args: []string{"-Command", script}},
+	}}
+
+	fixture := filepath.Join(t.TempDir(), "transcripts.jsonl")
+	recorder := &RecordingRunner{Runner: source, Path: fixture}
+	recorder.Run(ctx, "vmrun", guestArgs...)
+	// A new recorder appends to the same file
+	recorder = &RecordingRunner{Runner: source, Path: fixture}
+	recorder.Run(ctx, "powershell", "-Command", script)
+
+	info, err := os.Stat(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("got mode %o, expected 600", mode)
+	}
+	data, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("got %d lines, expected a transcript per line", len(lines))
+	}
+	for _, secret := range []string{"s3cret", "p@ss"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("password %s recorded", secret)
+		}
+	}
+	if !strings.Contains(string(data), "analyst") || !strings.Contains(string(data), `C:\\a.txt`) {
+		t.Errorf("arguments other than the passwords redacted: %s", data)
+	}
+
+	// The redacted transcripts are replayed whatever the password
+	replay, err := NewReplayRunner(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPassword := append([]string{}, guestArgs...)
+	otherPassword[5] = "other"
+	if stdout, _, err := replay.Run(ctx, "vmrun", otherPassword...); err != nil || stdout != "Process list: 0" {
+		t.Errorf("unexpected replay of the guest command: %q, %v", stdout, err)
+	}
+	if _, _, err := replay.Run(ctx, "powershell", "-Command", strings.Replace(script, "p@ss''word", "x", 1)); err != nil {
+		t.Errorf("unexpected replay of the guest script: %v", err)
+	}
+	otherPassword[6] = "listDirectoryInGuest"
+	if _, _, err := replay.Run(ctx, "vmrun", otherPassword...); err == nil {
+		t.Error("expected an error for another guest command")
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{args: []string{"-gu", "a", "-gp", "b", "-vp", "c", "start"}, expected: []string{"-gu", "a", "-gp", "[redacted]", "-vp", "[redacted]", "start"}},
+		{args: []string{"start", "-gp"}, expected: []string{"start", "-gp"}},
+		{args: []string{"-Command", `$Password = ''''; Get-VM`}, expected: []string{"-Command", `$Password = '[redacted]'; Get-VM`}},
+		{args: []string{"-Command", "$Password = 'a\u2019\u2019b'; $Other = 'c'"}, expected: []string{"-Command", `$Password = '[redacted]'; $Other = 'c'`}},
+		{args: []string{"-Command", `$PasswordFile = 'a'`}, expected: []string{"-Command", `$PasswordFile = 'a'`}},
+	}
+
+	for _, tt := range tests {
+		if got := redactArgs(tt.args); strings.Join(got, " ") != strings.Join(tt.expected, " ") {
+			t.Errorf("got %q, expected %q", got, tt.expected)
+		}
+	}
+}
+
+func TestRecordingRunnerError(t *testing.T) {
+	var recordErr error
+	recorder := &RecordingRunner{
+		Runner:  &ReplayRunner{Transcripts: []CommandTranscript{{Name: "virsh", Args: []string{"list"}, Stdout: "win10"}}},
+		Path:    filepath.Join(t.TempDir(), "missing", "transcripts.jsonl"),
+		OnError: func(err error) { recordErr = err },
+	}
+
+	// The command result is returned even when it can't be recorded
+	stdout, _, err := recorder.Run(context.Background(), "virsh", "list")
+	if err != nil || stdout != "win10" {
+		t.Errorf("got %q and error %v, expected the command output", stdout, err)
+	}
+	if !errors.Is(recordErr, os.ErrNotExist) {
+		t.Errorf("got %v, expected the recording error reported", recordErr)
+	}
+}
@@ -0,0 +1,560 @@
+package hvlib
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pelletier/go-toml"
+)
+
+type fakeVM struct {
+	id        string
+	state     string
+	startedAt time.Time
+	snapshots []*fakeSnapshot
+	current   *fakeSnapshot
+
+	// Guest state, not captured by snapshots
+	files     map[string][]byte
+	processes []GuestProcess
+	nextPID   int
+	network   string // Name of the network profile applied
+}
+
+type fakeSnapshot struct {
+	id           string
+	name         string
+	creationTime time.Time
+	parent       *fakeSnapshot
+	state        string // Power state of the VM when the snapshot was taken
+}
+
+// LoadVMs creates the in-memory VMs from the [fake] section:
+//
+//	[fake]
+//	vms = ["win10", "win11"]
+//	initial_snapshot = "clean"
+//	[fake.latency]
+//	revert = "3s"
+//	boot = "20s" # Until GuestReady, after Start
+//	[fake.failure_rate]
+//	start = 0.1
+func (f *FakeVP) LoadVMs(ctx context.Context, loader *ConfigLoader) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vms := make(map[string]VM)
+	f.vms = make(map[string]*fakeVM)
+	if f.Latencies == nil {
+		f.Latencies = make(map[string]time.Duration)
+	}
+	if f.FailureRates == nil {
+		f.FailureRates = make(map[string]float64)
+	}
+	if f.injected == nil {
+		f.injected = make(map[string]error)
+	}
+
+	names, _ := loader.Get("fake.vms").([]interface{})
+	initialSnapshot := loader.GetString("fake.initial_snapshot")
+	for _, n := range names {
+		name, ok := n.(string)
+		if !ok {
+			return fmt.Errorf("invalid fake.vms entry: %v", n)
+		}
+		vm := &fakeVM{id: uuid.NewString(), state: "stopped", files: make(map[string][]byte)}
+		if initialSnapshot != "" {
+			vm.current = &fakeSnapshot{
+				id:           uuid.NewString(),
+				name:         initialSnapshot,
+				creationTime: time.Now(),
+				state:        "stopped",
+			}
+			vm.snapshots = append(vm.snapshots, vm.current)
+		}
+		f.vms[name] = vm
+		vms[name] = VM{ID: vm.id}
+	}
+	f.setVMs(vms)
+
+	if latencies, ok := loader.Get("fake.latency").(*toml.Tree); ok {
+		for op, value := range latencies.ToMap() {
+			latency, err := time.ParseDuration(fmt.Sprint(value))
+			if err != nil {
+				return fmt.Errorf("invalid fake.latency.%s: %v", op, err)
+			}
+			f.Latencies[op] = latency
+		}
+	}
+
+	if rates, ok := loader.Get("fake.failure_rate").(*toml.Tree); ok {
+		for op, value := range rates.ToMap() {
+			switch rate := value.(type) {
+			case float64:
+				f.FailureRates[op] = rate
+			case int64:
+				f.FailureRates[op] = float64(rate)
+			default:
+				return fmt.Errorf("invalid fake.failure_rate.%s: %v", op, value)
+			}
+		}
+	}
+	return f.loadNetworkProfiles(loader, "fake")
+}
+
+// RefreshVMs has nothing to discover, the fake VMs only change through
+// CloneVM and DeleteVM. Failures can still be injected.
+func (f *FakeVP) RefreshVMs(ctx context.Context) error {
+	return f.simulate(ctx, OpLoadVMs, "")
+}
+
+// InjectFailure makes the next call of the given operation fail with err,
+// it can be called before LoadVMs
+func (f *FakeVP) InjectFailure(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.injected == nil {
+		f.injected = make(map[string]error)
+	}
+	f.injected[operation] = err
+}
+
+func (f *FakeVP) Capabilities() []string {
+	return providerCapabilities(f, []string{CapSnapshots, CapSnapshotCreationTime, CapSuspend, CapReset})
+}
+
+func (f *FakeVP) Version(ctx context.Context) (string, error) {
+	if err := f.simulate(ctx, OpVersion, ""); err != nil {
+		return "", err
+	}
+	return "fake", nil
+}
+
+func (f *FakeVP) List(ctx context.Context) ([]VMStatus, error) {
+	if err := f.simulate(ctx, OpList, ""); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var vms []VMStatus
+	for vmName, vm := range f.vms {
+		vms = append(vms, VMStatus{
+			ID:    vm.id,
+			Name:  vmName,
+			State: vm.state,
+		})
+	}
+	return vms, nil
+}
+
+func (f *FakeVP) ListSnapshots(ctx context.Context, vmName string) ([]Snapshot, error) {
+	if err := f.simulate(ctx, OpListSnapshots, vmName); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vm, exists := f.vms[vmName]
+	if !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+
+	var snapshots []Snapshot
+	for _, snap := range vm.snapshots {
+		var parentID string
+		if snap.parent != nil {
+			parentID = snap.parent.id
+		}
+		snapshots = append(snapshots, Snapshot{
+			ID:           snap.id,
+			Name:         snap.name,
+			CreationTime: snap.creationTime,
+			ParentID:     parentID,
+			IsCurrent:    snap == vm.current,
+		})
+	}
+	return snapshots, nil
+}
+
+func (f *FakeVP) TakeSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return f.execVmCommand(ctx, OpTakeSnapshot, vmName, func(vm *fakeVM) error {
+		if vm.findSnapshot(snapshotName) != nil {
+			return &SnapshotExistsError{VmName: vmName, SnapshotName: snapshotName}
+		}
+		snap := &fakeSnapshot{
+			id:           uuid.NewString(),
+			name:         snapshotName,
+			creationTime: time.Now(),
+			parent:       vm.current,
+			state:        vm.state,
+		}
+		vm.snapshots = append(vm.snapshots, snap)
+		vm.current = snap
+		return nil
+	})
+}
+
+func (f *FakeVP) RestoreSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return f.execVmCommand(ctx, OpRestoreSnapshot, vmName, func(vm *fakeVM) error {
+		snap := vm.findSnapshot(snapshotName)
+		if snap == nil {
+			return &SnapshotNotFoundError{VmName: vmName, SnapshotName: snapshotName}
+		}
+		vm.restore(snap)
+		return nil
+	})
+}
+
+func (f *FakeVP) DeleteSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return f.execVmCommand(ctx, OpDeleteSnapshot, vmName, func(vm *fakeVM) error {
+		snap := vm.findSnapshot(snapshotName)
+		if snap == nil {
+			return &SnapshotNotFoundError{VmName: vmName, SnapshotName: snapshotName}
+		}
+
+		// Children are attached to the parent of the deleted snapshot
+		var snapshots []*fakeSnapshot
+		for _, s := range vm.snapshots {
+			if s == snap {
+				continue
+			}
+			if s.parent == snap {
+				s.parent = snap.parent
+			}
+			snapshots = append(snapshots, s)
+		}
+		vm.snapshots = snapshots
+		if vm.current == snap {
+			vm.current = snap.parent
+		}
+		return nil
+	})
+}
+
+func (f *FakeVP) Start(ctx context.Context, vmName string) error {
+	return f.execVmCommand(ctx, OpStart, vmName, func(vm *fakeVM) error {
+		if vm.state == "running" {
+			return fmt.Errorf("VM is already running")
+		}
+		vm.state = "running"
+		vm.startedAt = time.Now()
+		vm.processes = nil
+		return nil
+	})
+}
+
+func (f *FakeVP) Stop(ctx context.Context, vmName string, force bool) error {
+	return f.execVmCommand(ctx, OpStop, vmName, func(vm *fakeVM) error {
+		if vm.state == "stopped" {
+			return fmt.Errorf("VM is not running")
+		}
+		// A soft stop needs a running guest to handle the shutdown request
+		if !force && vm.state != "running" {
+			return fmt.Errorf("cannot shutdown a %s VM without force", vm.state)
+		}
+		vm.state = "stopped"
+		return nil
+	})
+}
+
+func (f *FakeVP) Suspend(ctx context.Context, vmName string) error {
+	return f.execVmCommand(ctx, OpSuspend, vmName, func(vm *fakeVM) error {
+		if vm.state != "running" {
+			return fmt.Errorf("cannot suspend a %s VM", vm.state)
+		}
+		vm.state = "suspended"
+		return nil
+	})
+}
+
+func (f *FakeVP) Reset(ctx context.Context, vmName string) error {
+	return f.execVmCommand(ctx, OpReset, vmName, func(vm *fakeVM) error {
+		if vm.state != "running" {
+			return fmt.Errorf("cannot reset a %s VM", vm.state)
+		}
+		return nil
+	})
+}
+
+func (f *FakeVP) Revert(ctx context.Context, vmName string) error {
+	return f.execVmCommand(ctx, OpRevert, vmName, func(vm *fakeVM) error {
+		if vm.current == nil {
+			return ErrNoCurrentSnapshot
+		}
+		vm.restore(vm.current)
+		return nil
+	})
+}
+
+// Guest operations need a running VM, they act on an in-memory guest
+// filesystem and process list
+
+func (f *FakeVP) CopyFileToGuest(ctx context.Context, vmName, hostPath, guestPath string) error {
+	content, err := os.ReadFile(hostPath)
+	if err != nil {
+		return &VirtualizationError{Operation: OpCopyToGuest, VMName: vmName, Err: err}
+	}
+	return f.execGuestCommand(ctx, OpCopyToGuest, vmName, func(vm *fakeVM) error {
+		vm.files[guestPath] = content
+		return nil
+	})
+}
+
+func (f *FakeVP) CopyFileFromGuest(ctx context.Context, vmName, guestPath, hostPath string) error {
+	var content []byte
+	err := f.execGuestCommand(ctx, OpCopyFromGuest, vmName, func(vm *fakeVM) error {
+		var ok bool
+		if content, ok = vm.files[guestPath]; !ok {
+			return fmt.Errorf("file %s not found in guest", guestPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(hostPath, content, 0o644); err != nil {
+		return &VirtualizationError{Operation: OpCopyFromGuest, VMName: vmName, Err: err}
+	}
+	return nil
+}
+
+// RunProgramInGuest runs programs that exit immediately with 0, unless
+// wait is false: they then keep running until the VM is restarted
+func (f *FakeVP) RunProgramInGuest(ctx context.Context, vmName, program string, args []string, wait bool) (int, error) {
+	return 0, f.execGuestCommand(ctx, OpRunInGuest, vmName, func(vm *fakeVM) error {
+		if !wait {
+			vm.nextPID += 4
+			vm.processes = append(vm.processes, GuestProcess{
+				PID:     1000 + vm.nextPID,
+				Owner:   "fake\\user",
+				Command: windowsCommandLine(program, args),
+			})
+		}
+		return nil
+	})
+}
+
+func (f *FakeVP) ListProcessesInGuest(ctx context.Context, vmName string) ([]GuestProcess, error) {
+	var processes []GuestProcess
+	err := f.execGuestCommand(ctx, OpListGuestProcesses, vmName, func(vm *fakeVM) error {
+		processes = append(processes, vm.processes...)
+		return nil
+	})
+	return processes, err
+}
+
+// CaptureScreen returns a blank image of the running VM
+func (f *FakeVP) CaptureScreen(ctx context.Context, vmName string) ([]byte, error) {
+	err := f.execGuestCommand(ctx, OpCaptureScreen, vmName, func(vm *fakeVM) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodePNG(image.NewGray(image.Rect(0, 0, 64, 48)))
+}
+
+// DumpMemory writes a small raw image of the running VM
+func (f *FakeVP) DumpMemory(ctx context.Context, vmName, dir string) ([]string, error) {
+	err := f.execGuestCommand(ctx, OpDumpMemory, vmName, func(vm *fakeVM) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, vmName+".raw")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o644); err != nil {
+		return nil, &VirtualizationError{Operation: OpDumpMemory, VMName: vmName, Err: err}
+	}
+	return []string{path}, nil
+}
+
+// GuestReady reports the guest as booted once the VM has been running for
+// the "boot" latency
+func (f *FakeVP) GuestReady(ctx context.Context, vmName string) (bool, error) {
+	ready := false
+	err := f.execVmCommand(ctx, OpGuestReady, vmName, func(vm *fakeVM) error {
+		ready = vm.state == "running" && time.Since(vm.startedAt) >= f.Latencies["boot"]
+		return nil
+	})
+	return ready, err
+}
+
+func (f *FakeVP) execGuestCommand(ctx context.Context, operation, vmName string, apply func(vm *fakeVM) error) error {
+	return f.execVmCommand(ctx, operation, vmName, func(vm *fakeVM) error {
+		if vm.state != "running" {
+			return fmt.Errorf("VM is %s, it must be running", vm.state)
+		}
+		return apply(vm)
+	})
+}
+
+// execVmCommand simulates the latency and failures of an operation,
+// then applies it to the VM state under the provider lock
+func (f *FakeVP) execVmCommand(ctx context.Context, operation, vmName string, apply func(vm *fakeVM) error) error {
+	f.mu.Lock()
+	_, exists := f.vms[vmName]
+	f.mu.Unlock()
+	if !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+
+	if err := f.simulate(ctx, operation, vmName); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vm, exists := f.vms[vmName]
+	if !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+	if err := apply(vm); err != nil {
+		// Like the real providers, the snapshot errors aren't wrapped
+		switch err.(type) {
+		case *SnapshotNotFoundError, *SnapshotExistsError:
+			return err
+		}
+		return &VirtualizationError{Operation: operation, VMName: vmName, Err: err}
+	}
+	return nil
+}
+
+// simulate sleeps for the configured latency of the operation and returns
+// an error if a failure was injected or randomly triggered
+func (f *FakeVP) simulate(ctx context.Context, operation, vmName string) error {
+	f.mu.Lock()
+	latency := f.Latencies[operation]
+	rate := f.FailureRates[operation]
+	injected := f.injected[operation]
+	delete(f.injected, operation)
+	f.mu.Unlock()
+
+	select {
+	case <-time.After(latency):
+	case <-ctx.Done():
+		return &VirtualizationError{Operation: operation, VMName: vmName, Err: ctx.Err()}
+	}
+
+	if injected != nil {
+		return &VirtualizationError{Operation: operation, VMName: vmName, Err: injected}
+	}
+	if rate > 0 && rand.Float64() < rate {
+		return &VirtualizationError{Operation: operation, VMName: vmName, Err: fmt.Errorf("simulated failure")}
+	}
+	return nil
+}
+
+func (vm *fakeVM) findSnapshot(name string) *fakeSnapshot {
+	for _, snap := range vm.snapshots {
+		if snap.name == name {
+			return snap
+		}
+	}
+	return nil
+}
+
+func (vm *fakeVM) restore(snap *fakeSnapshot) {
+	vm.current = snap
+	vm.state = snap.state
+	// Like Hyper-V, a snapshot of a running VM is restored in saved state
+	if vm.state == "running" {
+		vm.state = "saved"
+	}
+}
+
+// pcapHeader is the global header of an empty little-endian pcap file with
+// Ethernet frames
+var pcapHeader = []byte{
+	0xd4, 0xc3, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00,
+}
+
+// StartCapture writes an empty pcap file, no traffic is ever recorded
+func (f *FakeVP) StartCapture(ctx context.Context, vmName, hostPath string) error {
+	return f.execVmCommand(ctx, OpStartCapture, vmName, func(vm *fakeVM) error {
+		if err := f.captures.add(vmName, &packetCapture{hostPath: hostPath}); err != nil {
+			return err
+		}
+		if err := os.WriteFile(hostPath, pcapHeader, 0o644); err != nil {
+			f.captures.remove(vmName)
+			return err
+		}
+		return nil
+	})
+}
+
+func (f *FakeVP) StopCapture(ctx context.Context, vmName string) (string, error) {
+	var hostPath string
+	err := f.execVmCommand(ctx, OpStopCapture, vmName, func(vm *fakeVM) error {
+		capture, err := f.captures.remove(vmName)
+		if err != nil {
+			return err
+		}
+		hostPath = capture.hostPath
+		return nil
+	})
+	return hostPath, err
+}
+
+func (f *FakeVP) SetNetworkProfile(ctx context.Context, vmName, name string) error {
+	return f.execVmCommand(ctx, OpSetNetworkProfile, vmName, func(vm *fakeVM) error {
+		if _, err := f.networkProfile(name); err != nil {
+			return err
+		}
+		vm.network = name
+		return nil
+	})
+}
+
+// CloneVM creates a stopped VM without snapshots, the source snapshot must
+// exist
+func (f *FakeVP) CloneVM(ctx context.Context, vmName, snapshotName, cloneName string) error {
+	if err := validateCloneName(cloneName); err != nil {
+		return err
+	}
+	var clone *fakeVM
+	err := f.execVmCommand(ctx, OpClone, vmName, func(vm *fakeVM) error {
+		if _, exists := f.vms[cloneName]; exists {
+			return fmt.Errorf("VM %s already exists", cloneName)
+		}
+		if vm.findSnapshot(snapshotName) == nil {
+			return &SnapshotNotFoundError{VmName: vmName, SnapshotName: snapshotName}
+		}
+		clone = &fakeVM{id: uuid.NewString(), state: "stopped", files: make(map[string][]byte)}
+		f.vms[cloneName] = clone
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.addVM(cloneName, VM{ID: clone.id})
+	return nil
+}
+
+func (f *FakeVP) DeleteVM(ctx context.Context, vmName string) error {
+	err := f.execVmCommand(ctx, OpDeleteVM, vmName, func(vm *fakeVM) error {
+		if vm.state == "running" {
+			return fmt.Errorf("VM is running")
+		}
+		delete(f.vms, vmName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.removeVM(vmName)
+	return nil
+}
@@ -0,0 +1,305 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newFakeVP(t *testing.T, config string) *FakeVP {
+	t.Helper()
+	vp := &FakeVP{}
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, config); err != nil {
+		t.Fatal(err)
+	}
+	if err := vp.LoadVMs(context.Background(), loader); err != nil {
+		t.Fatal(err)
+	}
+	return vp
+}
+
+// fakeState returns the power state of a fake VM
+func fakeState(t *testing.T, vp *FakeVP, vmName string) string {
+	t.Helper()
+	vms, err := vp.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vm := range vms {
+		if vm.Name == vmName {
+			return vm.State
+		}
+	}
+	t.Fatalf("VM %s not listed", vmName)
+	return ""
+}
+
+func TestFakeLoadVMs(t *testing.T) {
+	vp := newFakeVP(t, `
+[fake]
+vms = ["win10", "win11"]
+initial_snapshot = "clean"
+[fake.latency]
+revert = "3s"
+[fake.failure_rate]
+start = 0.5
+stop = 1
+`)
+
+	if len(vp.VMs) != 2 {
+		t.Fatalf("got %d VMs, expected 2", len(vp.VMs))
+	}
+	if vp.Latencies[OpRevert] != 3*time.Second {
+		t.Errorf("got revert latency %v", vp.Latencies[OpRevert])
+	}
+	if vp.FailureRates[OpStart] != 0.5 || vp.FailureRates[OpStop] != 1 {
+		t.Errorf("got failure rates %v", vp.FailureRates)
+	}
+	snapshots, err := vp.ListSnapshots(context.Background(), "win10")
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != "clean" || !snapshots[0].IsCurrent {
+		t.Errorf("got snapshots %+v and error %v, expected the current snapshot clean", snapshots, err)
+	}
+
+	for _, config := range []string{
+		"[fake]\nvms = [1]",
+		"[fake.latency]\nrevert = \"soon\"",
+		"[fake.failure_rate]\nstart = \"often\"",
+	} {
+		loader := &ConfigLoader{}
+		if err := loadConfigString(loader, config); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&FakeVP{}).LoadVMs(context.Background(), loader); err == nil {
+			t.Errorf("expected an error for %q", config)
+		}
+	}
+}
+
+func TestFakeStateTransitions(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		run      func(vp *FakeVP) error
+		expected string // State of win10 after the operations
+		fails    bool   // The last operation fails
+	}{
+		{name: "start", run: func(vp *FakeVP) error { return vp.Start(ctx, "win10") }, expected: "running"},
+		{name: "start running", run: func(vp *FakeVP) error {
+			vp.Start(ctx, "win10")
+			return vp.Start(ctx, "win10")
+		}, expected: "running", fails: true},
+		{name: "stop stopped", run: func(vp *FakeVP) error { return vp.Stop(ctx, "win10", true) }, expected: "stopped", fails: true},
+		{name: "suspend", run: func(vp *FakeVP) error {
+			vp.Start(ctx, "win10")
+			return vp.Suspend(ctx, "win10")
+		}, expected: "suspended"},
+		{name: "suspend stopped", run: func(vp *FakeVP) error { return vp.Suspend(ctx, "win10") }, expected: "stopped", fails: true},
+		{name: "soft stop suspended", run: func(vp *FakeVP) error {
+			vp.Start(ctx, "win10")
+			vp.Suspend(ctx, "win10")
+			return vp.Stop(ctx, "win10", false)
+		}, expected: "suspended", fails: true},
+		{name: "force stop suspended", run: func(vp *FakeVP) error {
+			vp.Start(ctx, "win10")
+			vp.Suspend(ctx, "win10")
+			return vp.Stop(ctx, "win10", true)
+		}, expected: "stopped"},
+		{name: "reset stopped", run: func(vp *FakeVP) error { return vp.Reset(ctx, "win10") }, expected: "stopped", fails: true},
+		{name: "revert stopped snapshot", run: func(vp *FakeVP) error {
+			vp.Start(ctx, "win10")
+			return vp.Revert(ctx, "win10")
+		}, expected: "stopped"},
+		// Like Hyper-V, a snapshot of a running VM is restored saved
+		{name: "revert running snapshot", run: func(vp *FakeVP) error {
+			vp.Start(ctx, "win10")
+			vp.TakeSnapshot(ctx, "win10", "running")
+			vp.Stop(ctx, "win10", true)
+			return vp.RestoreSnapshot(ctx, "win10", "running")
+		}, expected: "saved"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp := newFakeVP(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"")
+			err := tt.run(vp)
+			if tt.fails {
+				var virtErr *VirtualizationError
+				if !errors.As(err, &virtErr) {
+					t.Errorf("expected VirtualizationError, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if state := fakeState(t, vp, "win10"); state != tt.expected {
+				t.Errorf("got state %q, expected %q", state, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFakeSnapshotErrors(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		run     func(vp *FakeVP) error
+		errType interface{}
+	}{
+		{name: "take existing", run: func(vp *FakeVP) error { return vp.TakeSnapshot(ctx, "win10", "clean") }, errType: new(*SnapshotExistsError)},
+		{name: "restore unknown", run: func(vp *FakeVP) error { return vp.RestoreSnapshot(ctx, "win10", "nope") }, errType: new(*SnapshotNotFoundError)},
+		{name: "delete unknown", run: func(vp *FakeVP) error { return vp.DeleteSnapshot(ctx, "win10", "nope") }, errType: new(*SnapshotNotFoundError)},
+		{name: "clone unknown", run: func(vp *FakeVP) error { return vp.CloneVM(ctx, "win10", "nope", "win10-1") }, errType: new(*SnapshotNotFoundError)},
+		{name: "unknown vm", run: func(vp *FakeVP) error { return vp.TakeSnapshot(ctx, "unknown", "clean") }, errType: new(*VmNotFoundError)},
+		{name: "revert without snapshot", run: func(vp *FakeVP) error {
+			vp.DeleteSnapshot(ctx, "win10", "clean")
+			return vp.Revert(ctx, "win10")
+		}, errType: new(*VirtualizationError)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run(newFakeVP(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\""))
+			if !errors.As(err, tt.errType) {
+				t.Fatalf("got error %v (%T), expected %T", err, err, tt.errType)
+			}
+		})
+	}
+}
+
+func TestFakeSnapshotTree(t *testing.T) {
+	ctx := context.Background()
+	vp := newFakeVP(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"")
+
+	for _, name := range []string{"office", "tools"} {
+		if err := vp.TakeSnapshot(ctx, "win10", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// tools is reattached to clean
+	if err := vp.DeleteSnapshot(ctx, "win10", "office"); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := vp.ListSnapshots(ctx, "win10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("got %d snapshots, expected 2", len(snapshots))
+	}
+	if snapshots[1].Name != "tools" || snapshots[1].ParentID != snapshots[0].ID || !snapshots[1].IsCurrent {
+		t.Errorf("unexpected snapshot tree %+v", snapshots)
+	}
+}
+
+func TestFakeInjectedFailures(t *testing.T) {
+	ctx := context.Background()
+	vp := newFakeVP(t, "[fake]\nvms = [\"win10\"]\n[fake.failure_rate]\nstop = 1")
+
+	injected := errors.New("disk full")
+	vp.InjectFailure(OpStart, injected)
+	err := vp.Start(ctx, "win10")
+	var virtErr *VirtualizationError
+	if !errors.Is(err, injected) || !errors.As(err, &virtErr) || virtErr.Operation != OpStart {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	if state := fakeState(t, vp, "win10"); state != "stopped" {
+		t.Errorf("failed start changed the state to %q", state)
+	}
+
+	// Only the next call fails
+	if err := vp.Start(ctx, "win10"); err != nil {
+		t.Fatalf("unexpected error after the injected failure: %v", err)
+	}
+
+	// A failure rate of 1 always fails
+	for i := 0; i < 3; i++ {
+		if err := vp.Stop(ctx, "win10", true); !errors.As(err, &virtErr) {
+			t.Fatalf("expected a simulated failure, got %v", err)
+		}
+	}
+	if state := fakeState(t, vp, "win10"); state != "running" {
+		t.Errorf("failed stop changed the state to %q", state)
+	}
+}
+
+func TestFakeInjectBeforeLoad(t *testing.T) {
+	vp := &FakeVP{}
+	injected := errors.New("hypervisor unreachable")
+	vp.InjectFailure(OpLoadVMs, injected)
+
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, "[fake]\nvms = [\"win10\"]"); err != nil {
+		t.Fatal(err)
+	}
+	if err := vp.LoadVMs(context.Background(), loader); err != nil {
+		t.Fatal(err)
+	}
+	// The failure is still pending after the load
+	if err := vp.RefreshVMs(context.Background()); !errors.Is(err, injected) {
+		t.Fatalf("got %v, expected the injected failure", err)
+	}
+	if err := vp.RefreshVMs(context.Background()); err != nil {
+		t.Errorf("unexpected error after the injected failure: %v", err)
+	}
+}
+
+func TestFakeLatencies(t *testing.T) {
+	vp := newFakeVP(t, "[fake]\nvms = [\"win10\"]\n[fake.latency]\nstart = \"50ms\"\nboot = \"50ms\"")
+
+	start := time.Now()
+	if err := vp.Start(context.Background(), "win10"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("start took %v, expected at least 50ms", elapsed)
+	}
+
+	// The guest is ready once booted
+	if ready, err := vp.GuestReady(context.Background(), "win10"); err != nil || ready {
+		t.Errorf("got ready %v and error %v right after the start", ready, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ready, err := vp.GuestReady(context.Background(), "win10"); err != nil || !ready {
+		t.Errorf("got ready %v and error %v after the boot", ready, err)
+	}
+
+	// The operation is aborted when its context ends
+	vp.Latencies[OpStop] = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := vp.Stop(ctx, "win10", true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if state := fakeState(t, vp, "win10"); state != "running" {
+		t.Errorf("timed out stop changed the state to %q", state)
+	}
+}
+
+func TestFakeCloneAndDelete(t *testing.T) {
+	ctx := context.Background()
+	vp := newFakeVP(t, "[fake]\nvms = [\"win10\"]\ninitial_snapshot = \"clean\"")
+
+	if err := vp.CloneVM(ctx, "win10", "clean", "win10-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := vp.lookupVM("win10-1"); !exists {
+		t.Fatal("clone not registered")
+	}
+	if err := vp.CloneVM(ctx, "win10", "clean", "win10-1"); err == nil {
+		t.Error("expected an error cloning over an existing VM")
+	}
+
+	vp.Start(ctx, "win10-1")
+	if err := vp.DeleteVM(ctx, "win10-1"); err == nil {
+		t.Error("expected an error deleting a running VM")
+	}
+	vp.Stop(ctx, "win10-1", true)
+	if err := vp.DeleteVM(ctx, "win10-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := vp.lookupVM("win10-1"); exists {
+		t.Error("deleted clone still registered")
+	}
+}
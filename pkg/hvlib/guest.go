@@ -0,0 +1,119 @@
+package hvlib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// ErrNoGuestCredentials is returned by guest operations when no account
+// is configured for the VM
+var ErrNoGuestCredentials = errors.New("no guest credentials configured")
+
+// defaultGuestCredentials is the GuestCredentials key of the account used
+// for the VMs without their own
+const defaultGuestCredentials = ""
+
+// loadGuestCredentials reads the accounts used for guest operations from
+// the [<section>.guest] table. The username and password at the top of the
+// table apply to every VM, a sub-table named after a VM overrides them:
+//
+//	[vmware.guest]
+//	username = "analyst"
+//	password = "secret"
+//	[vmware.guest.win7]
+//	username = "admin"
+//	password = "other"
+func (vp *VP) loadGuestCredentials(loader *ConfigLoader, section string) error {
+	vp.GuestCredentials = make(map[string]GuestCredentials)
+
+	tree, ok := loader.Get(section + ".guest").(*toml.Tree)
+	if !ok {
+		return nil
+	}
+
+	defaults := GuestCredentials{}
+	for _, key := range tree.Keys() {
+		switch value := tree.Get(key).(type) {
+		case string:
+			switch key {
+			case "username":
+				defaults.Username = value
+			case "password":
+				defaults.Password = value
+			default:
+				return fmt.Errorf("unknown key %s.guest.%s", section, key)
+			}
+		case *toml.Tree:
+			vp.GuestCredentials[key] = GuestCredentials{
+				Username: fmt.Sprint(value.GetDefault("username", "")),
+				Password: fmt.Sprint(value.GetDefault("password", "")),
+			}
+		default:
+			return fmt.Errorf("invalid %s.guest.%s: %v", section, key, value)
+		}
+	}
+	if defaults.Username != "" {
+		vp.GuestCredentials[defaultGuestCredentials] = defaults
+	}
+	return nil
+}
+
+// guestCredentials returns the account to use inside a VM
+func (vp *VP) guestCredentials(vmName string) (GuestCredentials, error) {
+	if creds, ok := vp.GuestCredentials[vmName]; ok {
+		return creds, nil
+	}
+	if creds, ok := vp.GuestCredentials[defaultGuestCredentials]; ok {
+		return creds, nil
+	}
+	return GuestCredentials{}, ErrNoGuestCredentials
+}
+
+// windowsCommandLine joins a program and its arguments into a command line
+// that CommandLineToArgvW splits back into the same arguments
+func windowsCommandLine(program string, args []string) string {
+	return strings.TrimSpace(escapeWindowsArg(program) + " " + windowsArguments(args))
+}
+
+// windowsArguments is the arguments part of windowsCommandLine
+func windowsArguments(args []string) string {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		parts = append(parts, escapeWindowsArg(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+func escapeWindowsArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	if !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			// Backslashes before a quote are escaped, then the quote itself
+			b.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		b.WriteByte(c)
+	}
+	// Backslashes before the closing quote are escaped as well
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
@@ -1,50 +1,98 @@
 package hvlib
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
-func (h *HypervVP) LoadVMs(loader *ConfigLoader) error {
-	h.VP.VMs = make(map[string]VM)
+func (h *HypervVP) LoadVMs(ctx context.Context, loader *ConfigLoader) error {
+	vms, err := h.discoverVMs(ctx)
+	if err != nil {
+		return err
+	}
+	h.setVMs(vms)
+	h.Capture = HypervCaptureConfig{
+		VM:        loader.GetString("hyperv.capture.vm"),
+		Interface: loader.GetString("hyperv.capture.interface"),
+		Dumpcap:   loader.GetString("hyperv.capture.dumpcap"),
+	}
+	if h.Capture.Dumpcap == "" {
+		h.Capture.Dumpcap = `C:\Program Files\Wireshark\dumpcap.exe`
+	}
+	h.ClonePath = loader.GetString("hyperv.clone_path")
+	if err := h.loadNetworkProfiles(loader, "hyperv"); err != nil {
+		return err
+	}
+	return h.loadGuestCredentials(loader, "hyperv")
+}
+
+// RefreshVMs lists the VMs registered in Hyper-V again
+func (h *HypervVP) RefreshVMs(ctx context.Context) error {
+	return h.refreshVMs(ctx, h.discoverVMs)
+}
+
+func (h *HypervVP) discoverVMs(ctx context.Context) (map[string]VM, error) {
+	vms := make(map[string]VM)
 
 	// Run PowerShell command to list VMs
-	cmd := exec.Command("powershell", "-Command", "Get-VM | Select-Object Name,Id | ConvertTo-Json")
-	output, err := cmd.Output()
+	output, err := h.execPowershell(ctx, "Get-VM | Select-Object Name,Id | ConvertTo-Json")
 	if err != nil {
-		return fmt.Errorf("failed to list VMs: %v", err)
+		return nil, fmt.Errorf("failed to list VMs: %w", err)
 	}
 
 	// Parse JSON output
-	var vms []struct {
+	var list []struct {
 		Name string `json:"Name"`
 		ID   string `json:"Id"`
 	}
-	if err := json.Unmarshal(output, &vms); err != nil {
-		return fmt.Errorf("failed to parse VMs list: %v", err)
+	if err := unmarshalPowershellList(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse VMs list: %v", err)
 	}
 
 	// Populate the VMs map
-	for _, vm := range vms {
-		h.VP.VMs[vm.Name] = VM{
+	for _, vm := range list {
+		vms[vm.Name] = VM{
 			ID: vm.ID,
 		}
 	}
-	return nil
+	return vms, nil
 }
 
-func (h *HypervVP) List() ([]VMStatus, error) {
-	return h.listVMs("Get-VM | Select-Object Id,Name,State | ConvertTo-Json")
+// Capabilities excludes the packet capture without a capture VM
+func (h *HypervVP) Capabilities() []string {
+	var excluded []string
+	if h.Capture.VM == "" {
+		excluded = append(excluded, CapPacketCapture)
+	}
+	return providerCapabilities(h,
+		[]string{CapSnapshots, CapSnapshotCreationTime, CapSuspend, CapReset},
+		excluded...)
+}
+
+// Version returns the version of Windows, which Hyper-V follows
+func (h *HypervVP) Version(ctx context.Context) (string, error) {
+	output, err := h.execPowershell(ctx, "[Environment]::OSVersion.Version.ToString()")
+	if err != nil {
+		return "", fmt.Errorf("failed to get version: %w, output: %s", err, output)
+	}
+	return "Windows " + strings.TrimSpace(string(output)), nil
+}
+
+func (h *HypervVP) List(ctx context.Context) ([]VMStatus, error) {
+	return h.listVMs(ctx, "Get-VM | Select-Object Id,Name,State | ConvertTo-Json")
 }
 
 // listVMs is a helper function for listing VMs (common for Hyper-V)
-func (h *HypervVP) listVMs(command string) ([]VMStatus, error) {
-	cmd := exec.Command("powershell", "-Command", command)
-	output, err := cmd.Output()
+func (h *HypervVP) listVMs(ctx context.Context, command string) ([]VMStatus, error) {
+	output, err := h.execPowershell(ctx, command)
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +103,7 @@ func (h *HypervVP) listVMs(command string) ([]VMStatus, error) {
 		Name  string `json:"Name"`
 		State int    `json:"State"`
 	}
-	if err := json.Unmarshal(output, &vms); err != nil {
+	if err := unmarshalPowershellList(output, &vms); err != nil {
 		return nil, err
 	}
 
@@ -79,21 +127,31 @@ func (h *HypervVP) listVMs(command string) ([]VMStatus, error) {
 	return results, nil
 }
 
-func (h *HypervVP) ListSnapshots(vmName string) ([]Snapshot, error) {
-	cmd := exec.Command("powershell",
-		"-Command",
-		fmt.Sprintf("Get-VMSnapshot -VMName \"%s\" | Select-Object Id, Name, CreationTime | ConvertTo-Json", vmName))
-	output, err := cmd.Output()
+func (h *HypervVP) ListSnapshots(ctx context.Context, vmName string) ([]Snapshot, error) {
+	vm, exists := h.lookupVM(vmName)
+	if !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+
+	// The current snapshot is the parent snapshot of the VM
+	output, err := h.execPowershell(ctx, psScript(
+		"$VM = Get-VM -Id $VMId; Get-VMSnapshot -VM $VM | "+
+			"Select-Object Id, Name, CreationTime, ParentSnapshotId, Notes, "+
+			"@{Name='IsCurrent'; Expression={$_.Id -eq $VM.ParentSnapshotId}} | ConvertTo-Json",
+		psParam{"VMId", vm.ID}))
 	if err != nil {
-		return nil, err
+		return nil, &VirtualizationError{Operation: OpListSnapshots, VMName: vmName, Err: err}
 	}
 	// Parse JSON output
 	var snapshots []struct {
-		ID           string `json:"Id"`
-		Name         string `json:"Name"`
-		CreationTime string `json:"CreationTime"`
+		ID               string `json:"Id"`
+		Name             string `json:"Name"`
+		CreationTime     string `json:"CreationTime"`
+		ParentSnapshotID string `json:"ParentSnapshotId"`
+		Notes            string `json:"Notes"`
+		IsCurrent        bool   `json:"IsCurrent"`
 	}
-	if err := json.Unmarshal(output, &snapshots); err != nil {
+	if err := unmarshalPowershellList(output, &snapshots); err != nil {
 		return nil, err
 	}
 
@@ -109,87 +167,626 @@ func (h *HypervVP) ListSnapshots(vmName string) ([]Snapshot, error) {
 			ID:           snap.ID,
 			Name:         snap.Name,
 			CreationTime: creationTime,
+			ParentID:     snap.ParentSnapshotID,
+			Description:  snap.Notes,
+			IsCurrent:    snap.IsCurrent,
 		})
 	}
 	return results, nil
 }
 
-func (h *HypervVP) Start(vmName string) error {
-	return h.execVmCommand(vmName, "Start-VM")
+func (h *HypervVP) Start(ctx context.Context, vmName string) error {
+	return h.execVmCommand(ctx, OpStart, vmName, "Get-VM -Id $VMId | Start-VM")
 }
 
-func (h *HypervVP) Stop(vmName string, force bool) error {
-	forceCmd := map[bool]string{true: "-TurnOff", false: ""}[force]
-	return h.execVmCommand(vmName, fmt.Sprintf("Stop-VM %s", forceCmd))
+func (h *HypervVP) Stop(ctx context.Context, vmName string, force bool) error {
+	forceCmd := map[bool]string{true: " -TurnOff", false: ""}[force]
+	return h.execVmCommand(ctx, OpStop, vmName, "Get-VM -Id $VMId | Stop-VM"+forceCmd)
 }
 
-func (h *HypervVP) Suspend(vmName string) error {
-	return h.execVmCommand(vmName, "Suspend-VM")
+func (h *HypervVP) Suspend(ctx context.Context, vmName string) error {
+	return h.execVmCommand(ctx, OpSuspend, vmName, "Get-VM -Id $VMId | Suspend-VM")
 }
 
-func (h *HypervVP) Reset(vmName string) error {
-	return h.execVmCommand(vmName, "Reboot-VM")
+// Reset is a hard reset, -Force skips the confirmation prompt
+func (h *HypervVP) Reset(ctx context.Context, vmName string) error {
+	return h.execVmCommand(ctx, OpReset, vmName, "Get-VM -Id $VMId | Restart-VM -Force")
 }
 
-func (h *HypervVP) TakeSnapshot(vmName, snapshotName string) error {
-	snapshots, err := h.ListSnapshots(vmName)
+func (h *HypervVP) TakeSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	if err := validateSnapshotName(snapshotName); err != nil {
+		return err
+	}
+	snapshots, err := h.ListSnapshots(ctx, vmName)
 	if err != nil {
 		return err
 	}
 	for _, s := range snapshots {
 		if s.Name == snapshotName {
-			return fmt.Errorf("A snapshot with the name already exists")
+			return &SnapshotExistsError{VmName: vmName, SnapshotName: snapshotName}
 		}
 	}
 
-	return h.execVmCommand(vmName,
-		fmt.Sprintf("Checkpoint-VM -SnapshotName %s", snapshotName))
+	return h.execVmCommand(ctx, OpTakeSnapshot, vmName,
+		"Get-VM -Id $VMId | Checkpoint-VM -SnapshotName $SnapshotName",
+		psParam{"SnapshotName", snapshotName})
 }
 
-func (h *HypervVP) RestoreSnapshot(vmName, snapshotName string) error {
-	return h.execVmCommand(vmName,
-		fmt.Sprintf("Restore-VMSnapshot -Name %s -Confirm:$false", snapshotName))
+func (h *HypervVP) RestoreSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	snapshot, err := h.findSnapshot(ctx, vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+	return h.restoreSnapshot(ctx, OpRestoreSnapshot, vmName, snapshot)
+}
+
+func (h *HypervVP) DeleteSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	snapshot, err := h.findSnapshot(ctx, vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+	return h.execVmCommand(ctx, OpDeleteSnapshot, vmName,
+		"Get-VMSnapshot -Id $SnapshotId | Remove-VMSnapshot -Confirm:$false",
+		psParam{"SnapshotId", snapshot.ID})
+}
+
+func (h *HypervVP) Revert(ctx context.Context, vmName string) error {
+	current, err := currentSnapshotForRevert(ctx, h, vmName)
+	if err != nil {
+		return err
+	}
+	return h.restoreSnapshot(ctx, OpRevert, vmName, current)
 }
 
-func (h *HypervVP) DeleteSnapshot(vmName, snapshotName string) error {
-	return h.execVmCommand(vmName,
-		fmt.Sprintf("Remove-VMSnapshot -Name %s -Confirm:$false", snapshotName))
+// findSnapshot looks up a snapshot by its exact name, snapshots are then
+// addressed by ID so names are never interpreted as wildcard patterns
+func (h *HypervVP) findSnapshot(ctx context.Context, vmName, snapshotName string) (Snapshot, error) {
+	snapshots, err := h.ListSnapshots(ctx, vmName)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	for _, s := range snapshots {
+		if s.Name == snapshotName {
+			return s, nil
+		}
+	}
+	return Snapshot{}, &SnapshotNotFoundError{VmName: vmName, SnapshotName: snapshotName}
 }
 
-func (h *HypervVP) Revert(vmName string) error {
-	_, exists := h.VMs[vmName]
+func (h *HypervVP) restoreSnapshot(ctx context.Context, operation, vmName string, snapshot Snapshot) error {
+	return h.execVmCommand(ctx, operation, vmName,
+		"Get-VMSnapshot -Id $SnapshotId | Restore-VMSnapshot -Confirm:$false",
+		psParam{"SnapshotId", snapshot.ID})
+}
+
+// execVmCommand runs a script on a VM, the script refers to the VM with
+// $VMId and to the extra parameters by their name
+func (h *HypervVP) execVmCommand(ctx context.Context, operation, vmName, script string, params ...psParam) error {
+	vm, exists := h.lookupVM(vmName)
 	if !exists {
 		return &VmNotFoundError{VmName: vmName}
 	}
 
-	cmd := exec.Command("powershell",
-		"-Command",
-		fmt.Sprintf("Get-VM -VMName %s | Get-VMSnapshot | Sort CreationTime | Select -Last 1 | Restore-VMSnapshot -Confirm:$false", vmName))
-	output, err := cmd.CombinedOutput()
+	params = append([]psParam{{"VMId", vm.ID}}, params...)
+	output, err := h.execPowershell(ctx, psScript(script, params...))
+	if err != nil {
+		return &VirtualizationError{
+			Operation: operation,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%w, output: %s", err, output),
+		}
+	}
+	return nil
+}
+
+// Size of the thumbnails returned by CaptureScreen, Hyper-V scales the
+// display to fit
+const (
+	thumbnailWidth  = 1024
+	thumbnailHeight = 768
+)
+
+// CaptureScreen asks the virtual system management service for a thumbnail
+// of the display, the pixels are returned as RGB565
+func (h *HypervVP) CaptureScreen(ctx context.Context, vmName string) ([]byte, error) {
+	vm, exists := h.lookupVM(vmName)
+	if !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+
+	output, err := h.execPowershell(ctx, psScript(
+		"$Namespace = 'root\\virtualization\\v2'; "+
+			"$Service = Get-CimInstance -Namespace $Namespace -ClassName Msvm_VirtualSystemManagementService; "+
+			"$VM = Get-CimInstance -Namespace $Namespace -ClassName Msvm_ComputerSystem | Where-Object { $_.Name -eq $VMId }; "+
+			"$Settings = Get-CimAssociatedInstance -InputObject $VM -ResultClassName Msvm_VirtualSystemSettingData | "+
+			"Where-Object { $_.VirtualSystemType -eq 'Microsoft:Hyper-V:System:Realized' }; "+
+			"$Result = Invoke-CimMethod -InputObject $Service -MethodName GetVirtualSystemThumbnailImage "+
+			"-Arguments @{TargetSystem = $Settings; WidthPixels = [uint16]$Width; HeightPixels = [uint16]$Height}; "+
+			"if ($Result.ReturnValue -ne 0) { throw \"GetVirtualSystemThumbnailImage failed: $($Result.ReturnValue)\" }; "+
+			"[Convert]::ToBase64String($Result.ImageData)",
+		psParam{"VMId", vm.ID},
+		psParam{"Width", strconv.Itoa(thumbnailWidth)},
+		psParam{"Height", strconv.Itoa(thumbnailHeight)}))
+	if err != nil {
+		return nil, &VirtualizationError{
+			Operation: OpCaptureScreen,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%w, output: %s", err, output),
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(output)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode thumbnail: %w", err)
+	}
+	img, err := decodeRGB565(data, thumbnailWidth, thumbnailHeight)
+	if err != nil {
+		return nil, err
+	}
+	return encodePNG(img)
+}
+
+// DumpMemory saves the VM and collects its saved state file (.vmrs), which
+// holds the memory. Hyper-V has no raw memory dump: the file has to be
+// converted (vm2dmp, MemProcFS...) before being analysed with Volatility.
+func (h *HypervVP) DumpMemory(ctx context.Context, vmName, dir string) ([]string, error) {
+	vm, exists := h.lookupVM(vmName)
+	if !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+
+	output, err := h.execPowershell(ctx, psScript(
+		"$VM = Get-VM -Id $VMId; "+
+			"if ($VM.State -eq 'Running') { Save-VM -VM $VM }; "+
+			"Join-Path $VM.ConfigurationLocation ('Virtual Machines\\' + $VM.Id + '.vmrs')",
+		psParam{"VMId", vm.ID}))
+	if err != nil {
+		return nil, &VirtualizationError{
+			Operation: OpDumpMemory,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%w, output: %s", err, output),
+		}
+	}
+
+	savedState := strings.TrimSpace(string(output))
+	paths, err := copyFilesToDir(ctx, []string{savedState}, dir)
+	if err != nil {
+		return nil, &VirtualizationError{Operation: OpDumpMemory, VMName: vmName, Err: err}
+	}
+	return paths, nil
+}
+
+// GuestReady checks the heartbeat integration service, its status is Ok*
+// once the guest OS runs the integration services
+func (h *HypervVP) GuestReady(ctx context.Context, vmName string) (bool, error) {
+	vm, exists := h.lookupVM(vmName)
+	if !exists {
+		return false, &VmNotFoundError{VmName: vmName}
+	}
+
+	output, err := h.execPowershell(ctx, psScript(
+		"$VM = Get-VM -Id $VMId; "+
+			"if ($VM.State -eq 'Running') { [string]$VM.Heartbeat } else { 'NoContact' }",
+		psParam{"VMId", vm.ID}))
+	if err != nil {
+		return false, &VirtualizationError{
+			Operation: OpGuestReady,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%w, output: %s", err, output),
+		}
+	}
+	// OkApplicationsHealthy or OkApplicationsUnknown
+	return strings.HasPrefix(strings.TrimSpace(string(output)), "Ok"), nil
+}
+
+// SetNetworkProfile connects the adapters of the VM to the virtual switch
+// of the profile, Hyper-V applies it to a running VM as well
+func (h *HypervVP) SetNetworkProfile(ctx context.Context, vmName, name string) error {
+	if _, exists := h.lookupVM(vmName); !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+	profile, err := h.networkProfile(name)
+	if err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+
+	if profile.Disconnected {
+		return h.execVmCommand(ctx, OpSetNetworkProfile, vmName,
+			"Get-VMNetworkAdapter -VM (Get-VM -Id $VMId) | Disconnect-VMNetworkAdapter")
+	}
+	return h.execVmCommand(ctx, OpSetNetworkProfile, vmName,
+		"Get-VMNetworkAdapter -VM (Get-VM -Id $VMId) | Connect-VMNetworkAdapter -SwitchName $SwitchName",
+		psParam{"SwitchName", profile.Network})
+}
+
+// CloneVM creates a VM booting from a differencing disk whose parent is
+// the disk of the checkpoint, with the generation, memory, processors and
+// switch of the source. Only the first disk of the source is cloned.
+func (h *HypervVP) CloneVM(ctx context.Context, vmName, snapshotName, cloneName string) error {
+	if err := validateCloneName(cloneName); err != nil {
+		return err
+	}
+	if _, exists := h.lookupVM(cloneName); exists {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: fmt.Errorf("VM %s already exists", cloneName)}
+	}
+	vm, exists := h.lookupVM(vmName)
+	if !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+	snapshot, err := h.findSnapshot(ctx, vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	output, err := h.execPowershell(ctx, psScript(
+		"$ErrorActionPreference = 'Stop'; "+
+			"$Source = Get-VM -Id $VMId; "+
+			"$Snapshot = Get-VMSnapshot -VM $Source | Where-Object { $_.Id -eq $SnapshotId }; "+
+			"$Parent = (Get-VMHardDiskDrive -VMSnapshot $Snapshot | Select-Object -First 1).Path; "+
+			"if (-not $ClonePath) { $ClonePath = (Get-VMHost).VirtualMachinePath }; "+
+			"$Dir = Join-Path $ClonePath $CloneName; "+
+			"New-Item -ItemType Directory -Path $Dir | Out-Null; "+
+			"$Disk = New-VHD -Path (Join-Path $Dir ($CloneName + '.vhdx')) -ParentPath $Parent -Differencing; "+
+			"$Clone = New-VM -Name $CloneName -Path $ClonePath -Generation $Source.Generation "+
+			"-MemoryStartupBytes $Source.MemoryStartup -VHDPath $Disk.Path; "+
+			"Set-VMProcessor -VM $Clone -Count $Source.ProcessorCount; "+
+			"if ($Source.Generation -eq 2) { "+
+			"$Firmware = Get-VMFirmware -VM $Source; "+
+			"Set-VMFirmware -VM $Clone -EnableSecureBoot $Firmware.SecureBoot -SecureBootTemplateId $Firmware.SecureBootTemplateId }; "+
+			"$Switch = (Get-VMNetworkAdapter -VM $Source | Select-Object -First 1).SwitchName; "+
+			"if ($Switch) { Get-VMNetworkAdapter -VM $Clone | Connect-VMNetworkAdapter -SwitchName $Switch }; "+
+			"$Clone.Id.Guid",
+		psParam{"VMId", vm.ID},
+		psParam{"SnapshotId", snapshot.ID},
+		psParam{"ClonePath", h.ClonePath},
+		psParam{"CloneName", cloneName}))
+	if err != nil {
+		return &VirtualizationError{
+			Operation: OpClone,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%w, output: %s", err, output),
+		}
+	}
+	h.addVM(cloneName, VM{ID: strings.TrimSpace(string(output))})
+	return nil
+}
+
+// DeleteVM removes the VM and its disks. The directory of the VM is only
+// removed when it is named after the VM, as CloneVM creates it.
+func (h *HypervVP) DeleteVM(ctx context.Context, vmName string) error {
+	err := h.execVmCommand(ctx, OpDeleteVM, vmName,
+		"$ErrorActionPreference = 'Stop'; "+
+			"$VM = Get-VM -Id $VMId; "+
+			"$Disks = @(Get-VMHardDiskDrive -VM $VM | ForEach-Object { $_.Path }); "+
+			"Remove-VM -VM $VM -Force; "+
+			"$Disks | Where-Object { $_ } | Remove-Item -Force; "+
+			"if ((Split-Path $VM.Path -Leaf) -eq $VM.Name) { Remove-Item -Path $VM.Path -Recurse -Force }")
 	if err != nil {
-		return fmt.Errorf("failed to execute command on VM %s: %v, output: %s", vmName, err, string(output))
+		return err
 	}
+	h.removeVM(vmName)
 	return nil
 }
 
-// execVmCommand is a helper function for executing Hyper-V commands
-func (h *HypervVP) execVmCommand(vmName, command string) error {
-	_, exists := h.VMs[vmName]
+// StartCapture mirrors the traffic of the VM adapters to the capture VM of
+// [hyperv.capture], where dumpcap records it. The capture VM must be
+// running, connected to the same virtual switch, and have guest credentials.
+func (h *HypervVP) StartCapture(ctx context.Context, vmName, hostPath string) error {
+	vm, exists := h.lookupVM(vmName)
 	if !exists {
 		return &VmNotFoundError{VmName: vmName}
 	}
+	captureVM, err := h.captureVM()
+	if err != nil {
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
 
-	cmd := exec.Command("powershell",
-		"-Command",
-		fmt.Sprintf("%s -VMName %s", command, vmName))
-	output, err := cmd.CombinedOutput()
-	println(string(output))
+	if err := h.captures.add(vmName, &packetCapture{hostPath: hostPath}); err != nil {
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
+	output, err := h.execPowershell(ctx, psScript(
+		"$ErrorActionPreference = 'Stop'; "+
+			"Get-VMNetworkAdapter -VM (Get-VM -Id $CaptureId) | Set-VMNetworkAdapter -PortMirroring Destination; "+
+			"$Adapters = Get-VMNetworkAdapter -VM (Get-VM -Id $VMId); "+
+			"$Adapters | Set-VMNetworkAdapter -PortMirroring Source; "+
+			"$Adapters.MacAddress",
+		psParam{"VMId", vm.ID},
+		psParam{"CaptureId", captureVM.ID}))
 	if err != nil {
-		return fmt.Errorf("failed to execute command on VM %s: %v, output: %s", vmName, err, string(output))
+		h.captures.remove(vmName)
+		return &VirtualizationError{
+			Operation: OpStartCapture,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%w, output: %s", err, output),
+		}
+	}
+
+	// The capture VM receives the traffic of every mirrored VM of the switch
+	var filters []string
+	for _, mac := range strings.Fields(string(output)) {
+		filters = append(filters, "ether host "+formatMAC(mac))
+	}
+	args := []string{"-q", "-F", "pcap", "-w", captureGuestPath(vm)}
+	if h.Capture.Interface != "" {
+		args = append(args, "-i", h.Capture.Interface)
+	}
+	if len(filters) > 0 {
+		args = append(args, "-f", strings.Join(filters, " or "))
+	}
+	if _, err := h.RunProgramInGuest(ctx, h.Capture.VM, h.Capture.Dumpcap, args, false); err != nil {
+		h.stopMirroring(ctx, vmName)
+		h.captures.remove(vmName)
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
 	}
 	return nil
 }
 
+// StopCapture stops dumpcap and the mirroring, then moves the capture file
+// from the capture VM to the host
+func (h *HypervVP) StopCapture(ctx context.Context, vmName string) (string, error) {
+	vm, exists := h.lookupVM(vmName)
+	if !exists {
+		return "", &VmNotFoundError{VmName: vmName}
+	}
+	if _, err := h.captureVM(); err != nil {
+		return "", &VirtualizationError{Operation: OpStopCapture, VMName: vmName, Err: err}
+	}
+
+	capture, err := h.captures.remove(vmName)
+	if err != nil {
+		return "", &VirtualizationError{Operation: OpStopCapture, VMName: vmName, Err: err}
+	}
+
+	guestPath := captureGuestPath(vm)
+	_, stopErr := h.execGuestScript(ctx, OpStopCapture, h.Capture.VM,
+		"Invoke-Command -Session $Session -ArgumentList $GuestPath -ScriptBlock { "+
+			"param($GuestPath); "+
+			"Get-CimInstance -ClassName Win32_Process -Filter \"Name = 'dumpcap.exe'\" | "+
+			"Where-Object { $_.CommandLine -and $_.CommandLine.Contains($GuestPath) } | "+
+			"Invoke-CimMethod -MethodName Terminate | Out-Null }",
+		psParam{"GuestPath", guestPath})
+	// The mirroring is removed even if dumpcap couldn't be stopped
+	if err := h.stopMirroring(ctx, vmName); err != nil {
+		return "", err
+	}
+	if stopErr != nil {
+		return "", stopErr
+	}
+
+	_, err = h.execGuestScript(ctx, OpStopCapture, h.Capture.VM,
+		"Copy-Item -FromSession $Session -Path $GuestPath -Destination $HostPath; "+
+			"Invoke-Command -Session $Session -ArgumentList $GuestPath -ScriptBlock { "+
+			"param($GuestPath); Remove-Item -Path $GuestPath }",
+		psParam{"GuestPath", guestPath}, psParam{"HostPath", capture.hostPath})
+	if err != nil {
+		return "", err
+	}
+	return capture.hostPath, nil
+}
+
+func (h *HypervVP) stopMirroring(ctx context.Context, vmName string) error {
+	return h.execVmCommand(ctx, OpStopCapture, vmName,
+		"Get-VMNetworkAdapter -VM (Get-VM -Id $VMId) | Set-VMNetworkAdapter -PortMirroring None")
+}
+
+func (h *HypervVP) captureVM() (VM, error) {
+	if h.Capture.VM == "" {
+		return VM{}, fmt.Errorf("%w: no capture VM configured in [hyperv.capture]", ErrNotSupported)
+	}
+	vm, exists := h.lookupVM(h.Capture.VM)
+	if !exists {
+		return VM{}, fmt.Errorf("capture VM %s not found", h.Capture.VM)
+	}
+	return vm, nil
+}
+
+// captureGuestPath is the file written by dumpcap in the capture VM
+func captureGuestPath(vm VM) string {
+	return `C:\Windows\Temp\traceforge-` + vm.ID + ".pcap"
+}
+
+// formatMAC converts the MAC addresses of Hyper-V, 00155D010203, to the
+// notation of capture filters
+func formatMAC(mac string) string {
+	if len(mac) != 12 {
+		return mac
+	}
+	var parts []string
+	for i := 0; i < 12; i += 2 {
+		parts = append(parts, strings.ToLower(mac[i:i+2]))
+	}
+	return strings.Join(parts, ":")
+}
+
+// Guest operations go through PowerShell Direct, a session opened over the
+// VM bus, so they work without any network between the host and the guest
+
+func (h *HypervVP) CopyFileToGuest(ctx context.Context, vmName, hostPath, guestPath string) error {
+	_, err := h.execGuestScript(ctx, OpCopyToGuest, vmName,
+		"Copy-Item -ToSession $Session -Path $HostPath -Destination $GuestPath",
+		psParam{"HostPath", hostPath}, psParam{"GuestPath", guestPath})
+	return err
+}
+
+func (h *HypervVP) CopyFileFromGuest(ctx context.Context, vmName, guestPath, hostPath string) error {
+	_, err := h.execGuestScript(ctx, OpCopyFromGuest, vmName,
+		"Copy-Item -FromSession $Session -Path $GuestPath -Destination $HostPath",
+		psParam{"GuestPath", guestPath}, psParam{"HostPath", hostPath})
+	return err
+}
+
+func (h *HypervVP) RunProgramInGuest(ctx context.Context, vmName, program string, args []string, wait bool) (int, error) {
+	if !wait {
+		// Processes started by the session are killed when it closes,
+		// WMI starts the program outside of it
+		_, err := h.execGuestScript(ctx, OpRunInGuest, vmName,
+			"Invoke-Command -Session $Session -ArgumentList $CommandLine -ScriptBlock { "+
+				"param($CommandLine); "+
+				"$Result = Invoke-CimMethod -ClassName Win32_Process -MethodName Create -Arguments @{CommandLine = $CommandLine}; "+
+				"if ($Result.ReturnValue -ne 0) { throw \"Win32_Process.Create failed: $($Result.ReturnValue)\" } }",
+			psParam{"CommandLine", windowsCommandLine(program, args)})
+		return 0, err
+	}
+
+	output, err := h.execGuestScript(ctx, OpRunInGuest, vmName,
+		"Invoke-Command -Session $Session -ArgumentList $Program, $Arguments -ScriptBlock { "+
+			"param($Program, $Arguments); "+
+			"$Params = @{FilePath = $Program; Wait = $true; PassThru = $true; NoNewWindow = $true}; "+
+			"if ($Arguments) { $Params.ArgumentList = $Arguments }; "+
+			"(Start-Process @Params).ExitCode }",
+		psParam{"Program", program},
+		psParam{"Arguments", windowsArguments(args)})
+	if err != nil {
+		return 0, err
+	}
+	exitCode, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, &VirtualizationError{
+			Operation: OpRunInGuest,
+			VMName:    vmName,
+			Err:       fmt.Errorf("unexpected exit code %q", output),
+		}
+	}
+	return exitCode, nil
+}
+
+func (h *HypervVP) ListProcessesInGuest(ctx context.Context, vmName string) ([]GuestProcess, error) {
+	output, err := h.execGuestScript(ctx, OpListGuestProcesses, vmName,
+		"Invoke-Command -Session $Session -ScriptBlock { "+
+			"Get-Process -IncludeUserName | Select-Object Id, UserName, "+
+			"@{Name='Command'; Expression={if ($_.Path) { $_.Path } else { $_.ProcessName }}} } | "+
+			"Select-Object Id, UserName, Command | ConvertTo-Json")
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []struct {
+		ID       int    `json:"Id"`
+		UserName string `json:"UserName"`
+		Command  string `json:"Command"`
+	}
+	if err := unmarshalPowershellList(output, &processes); err != nil {
+		return nil, err
+	}
+
+	var results []GuestProcess
+	for _, p := range processes {
+		results = append(results, GuestProcess{
+			PID:     p.ID,
+			Owner:   p.UserName,
+			Command: p.Command,
+		})
+	}
+	return results, nil
+}
+
+// execGuestScript runs a script with $Session bound to a PowerShell Direct
+// session opened in the VM with its guest credentials
+func (h *HypervVP) execGuestScript(ctx context.Context, operation, vmName, script string, params ...psParam) ([]byte, error) {
+	vm, exists := h.lookupVM(vmName)
+	if !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+	creds, err := h.guestCredentials(vmName)
+	if err != nil {
+		return nil, &VirtualizationError{Operation: operation, VMName: vmName, Err: err}
+	}
+
+	params = append([]psParam{
+		{"VMId", vm.ID},
+		{"Username", creds.Username},
+		{"Password", creds.Password},
+	}, params...)
+	output, err := h.execPowershell(ctx, psScript(
+		"$ErrorActionPreference = 'Stop'; "+
+			"$Credential = New-Object System.Management.Automation.PSCredential($Username, "+
+			"(ConvertTo-SecureString $Password -AsPlainText -Force)); "+
+			"$Session = New-PSSession -VMId $VMId -Credential $Credential; "+
+			"try { "+script+" } finally { Remove-PSSession $Session }",
+		params...))
+	if err != nil {
+		return nil, &VirtualizationError{
+			Operation: operation,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%w, output: %s", err, output),
+		}
+	}
+	return output, nil
+}
+
+// psParam is a value bound to a PowerShell variable by psScript
+type psParam struct {
+	Name  string
+	Value string
+}
+
+// psScript prefixes the script with the assignment of every parameter to
+// a variable. Values are single-quoted literals: PowerShell doesn't expand
+// or evaluate anything inside them, so the script only ever sees them as data.
+func psScript(script string, params ...psParam) string {
+	var b strings.Builder
+	for _, p := range params {
+		fmt.Fprintf(&b, "$%s = %s; ", p.Name, psQuote(p.Value))
+	}
+	b.WriteString(script)
+	return b.String()
+}
+
+// psQuote returns value as a PowerShell single-quoted string. The only
+// escape in such strings is a doubled quote, PowerShell also accepts the
+// typographic single quotes as delimiters so they are doubled as well.
+func psQuote(value string) string {
+	var b strings.Builder
+	b.WriteRune('\'')
+	for _, r := range value {
+		switch r {
+		case '\'', '\u2018', '\u2019', '\u201a', '\u201b':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteRune('\'')
+	return b.String()
+}
+
+// validateSnapshotName rejects the names Hyper-V can't store or that
+// couldn't be safely passed on a command line
+func validateSnapshotName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return &InvalidNameError{Name: name, Reason: "name is empty"}
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return &InvalidNameError{Name: name, Reason: "name contains control characters"}
+		}
+	}
+	return nil
+}
+
+// execPowershell runs a PowerShell command, on failure the returned
+// output contains both stdout and stderr
+func (h *HypervVP) execPowershell(ctx context.Context, command string) ([]byte, error) {
+	stdout, stderr, err := h.runner().Run(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", command)
+	if err != nil {
+		return []byte(stdout + stderr), err
+	}
+	return []byte(stdout), nil
+}
+
+// unmarshalPowershellList parses the output of ConvertTo-Json into a slice,
+// PowerShell emits a single object instead of an array of one element and
+// nothing at all for an empty pipeline
+func unmarshalPowershellList(output []byte, v interface{}) error {
+	output = bytes.TrimSpace(output)
+	if len(output) == 0 {
+		return nil
+	}
+	if output[0] == '{' {
+		output = append(append([]byte{'['}, output...), ']')
+	}
+	return json.Unmarshal(output, v)
+}
+
 func parseMicrosoftDate(msDate string) (time.Time, error) {
 	// Use a regex to extract the numeric timestamp
 	re := regexp.MustCompile(`/Date\((\d+)\)/`)
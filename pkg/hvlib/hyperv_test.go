@@ -0,0 +1,291 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReplayHypervVP(t *testing.T) *HypervVP {
+	t.Helper()
+	runner, err := NewReplayRunner("testdata/hyperv.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp := &HypervVP{VP: VP{Runner: runner}}
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := vp.LoadVMs(context.Background(), loader); err != nil {
+		t.Fatal(err)
+	}
+	return vp
+}
+
+func TestHypervLoadVMs(t *testing.T) {
+	vp := newReplayHypervVP(t)
+
+	if len(vp.VMs) != 2 {
+		t.Fatalf("got %d VMs, expected 2", len(vp.VMs))
+	}
+	if vp.VMs["win10"].ID != "6f3b1c1e-2c55-4c55-9d3e-0a0d2a1b7e01" {
+		t.Errorf("unexpected ID for win10: %s", vp.VMs["win10"].ID)
+	}
+}
+
+func TestHypervList(t *testing.T) {
+	ctx := context.Background()
+	vp := newReplayHypervVP(t)
+
+	vms, err := vp.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"win10": "running",
+		"win11": "stopped",
+	}
+	for _, vm := range vms {
+		if vm.State != expected[vm.Name] {
+			t.Errorf("VM %s: got state %q, expected %q", vm.Name, vm.State, expected[vm.Name])
+		}
+	}
+}
+
+func TestHypervListSnapshots(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		vmName   string
+		expected []string
+		newest   time.Time
+		current  string
+	}{
+		{vmName: "win10", expected: []string{"clean", "with office"}, newest: time.UnixMilli(1732182765000), current: "with office"},
+		// ConvertTo-Json emits an object, not an array, for a single snapshot
+		{vmName: "win11", expected: []string{"baseline"}, newest: time.UnixMilli(1732096365000)},
+	}
+
+	vp := newReplayHypervVP(t)
+	for _, tt := range tests {
+		t.Run(tt.vmName, func(t *testing.T) {
+			snapshots, err := vp.ListSnapshots(ctx, tt.vmName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, s := range snapshots {
+				names = append(names, s.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.expected, ",") {
+				t.Fatalf("got snapshots %v, expected %v", names, tt.expected)
+			}
+			if last := snapshots[len(snapshots)-1]; !last.CreationTime.Equal(tt.newest) {
+				t.Errorf("got creation time %v, expected %v", last.CreationTime, tt.newest)
+			}
+			if current, ok := CurrentSnapshot(snapshots); ok != (tt.current != "") || current.Name != tt.current {
+				t.Errorf("got current snapshot %q, expected %q", current.Name, tt.current)
+			}
+		})
+	}
+}
+
+func TestHypervCommands(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		run  func(vp *HypervVP) error
+		err  string
+	}{
+		{name: "start", run: func(vp *HypervVP) error { return vp.Start(ctx, "win11") }},
+		{name: "start failure", run: func(vp *HypervVP) error { return vp.Start(ctx, "win10") }, err: "failed to change state"},
+		{name: "reset", run: func(vp *HypervVP) error { return vp.Reset(ctx, "win11") }},
+		{name: "unknown vm", run: func(vp *HypervVP) error { return vp.Stop(ctx, "unknown", true) }, err: "vm unknown not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run(newReplayHypervVP(t))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestHypervSnapshotCommands(t *testing.T) {
+	ctx := context.Background()
+	hostileName := `it's a "test"; Remove-VM -Name * -Force; $(calc)`
+
+	tests := []struct {
+		name    string
+		run     func(vp *HypervVP) error
+		errType interface{}
+	}{
+		{name: "restore", run: func(vp *HypervVP) error { return vp.RestoreSnapshot(ctx, "win10", "with office") }},
+		{name: "delete", run: func(vp *HypervVP) error { return vp.DeleteSnapshot(ctx, "win10", "clean") }},
+		{name: "revert to current", run: func(vp *HypervVP) error { return vp.Revert(ctx, "win10") }},
+		{name: "revert without current", run: func(vp *HypervVP) error { return vp.Revert(ctx, "win11") }, errType: new(*VirtualizationError)},
+		// The fixture only matches if the name is passed as a quoted literal
+		{name: "take hostile name", run: func(vp *HypervVP) error { return vp.TakeSnapshot(ctx, "win11", hostileName) }},
+		{name: "restore wildcard", run: func(vp *HypervVP) error { return vp.RestoreSnapshot(ctx, "win10", "*") }, errType: new(*SnapshotNotFoundError)},
+		{name: "delete hostile name", run: func(vp *HypervVP) error { return vp.DeleteSnapshot(ctx, "win10", hostileName) }, errType: new(*SnapshotNotFoundError)},
+		{name: "take existing", run: func(vp *HypervVP) error { return vp.TakeSnapshot(ctx, "win10", "clean") }, errType: new(*SnapshotExistsError)},
+		{name: "take empty name", run: func(vp *HypervVP) error { return vp.TakeSnapshot(ctx, "win10", " ") }, errType: new(*InvalidNameError)},
+		{name: "take multiline name", run: func(vp *HypervVP) error { return vp.TakeSnapshot(ctx, "win10", "a\nStop-Computer") }, errType: new(*InvalidNameError)},
+		{name: "hostile vm name", run: func(vp *HypervVP) error { return vp.Start(ctx, "win10; Stop-Computer") }, errType: new(*VmNotFoundError)},
+		{name: "command failure", run: func(vp *HypervVP) error { return vp.Start(ctx, "win10") }, errType: new(*VirtualizationError)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run(newReplayHypervVP(t))
+			if tt.errType == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.As(err, tt.errType) {
+				t.Fatalf("got error %v (%T), expected %T", err, err, tt.errType)
+			}
+		})
+	}
+}
+
+func TestHypervGuestOperations(t *testing.T) {
+	ctx := context.Background()
+	vp := newReplayHypervVP(t)
+	vp.GuestCredentials = map[string]GuestCredentials{
+		"": {Username: "analyst", Password: "p@ss'word"},
+	}
+
+	processes, err := vp.ListProcessesInGuest(ctx, "win10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(processes) != 2 {
+		t.Fatalf("got %d processes, expected 2", len(processes))
+	}
+	expected := GuestProcess{PID: 2412, Owner: `WIN10\analyst`, Command: `C:\Windows\explorer.exe`}
+	if processes[1] != expected {
+		t.Errorf("got %+v, expected %+v", processes[1], expected)
+	}
+
+	exitCode, err := vp.RunProgramInGuest(ctx, "win10", `C:\tools\procdump.exe`,
+		[]string{"-ma", "lsass.exe", `C:\dumps\my dump.dmp`}, true)
+	if err != nil || exitCode != 3 {
+		t.Errorf("got exit code %d and error %v, expected 3", exitCode, err)
+	}
+	if _, err := vp.RunProgramInGuest(ctx, "win10", `C:\Program Files\sample.exe`, []string{"--flag"}, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = vp.CopyFileFromGuest(ctx, "win10", `C:\Users\analyst\ransom.txt`, "/tmp/out")
+	var virtErr *VirtualizationError
+	if !errors.As(err, &virtErr) || virtErr.Operation != OpCopyFromGuest {
+		t.Errorf("expected VirtualizationError for %s, got %v", OpCopyFromGuest, err)
+	}
+}
+
+func TestWindowsCommandLine(t *testing.T) {
+	tests := []struct {
+		program  string
+		args     []string
+		expected string
+	}{
+		{program: `C:\tools\a.exe`, expected: `C:\tools\a.exe`},
+		{program: `C:\Program Files\a.exe`, args: []string{"-x"}, expected: `"C:\Program Files\a.exe" -x`},
+		{program: "a.exe", args: []string{""}, expected: `a.exe ""`},
+		{program: "a.exe", args: []string{`say "hi"`}, expected: `a.exe "say \"hi\""`},
+		{program: "a.exe", args: []string{`C:\my dir\`}, expected: `a.exe "C:\my dir\\"`},
+		{program: "a.exe", args: []string{`a\"b c`}, expected: `a.exe "a\\\"b c"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			if got := windowsCommandLine(tt.program, tt.args); got != tt.expected {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPsQuote(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "clean", expected: "'clean'"},
+		{input: "", expected: "''"},
+		{input: "it's", expected: "'it''s'"},
+		{input: "‘smart’", expected: "'‘‘smart’’'"},
+		{input: "$(Stop-Computer)", expected: "'$(Stop-Computer)'"},
+		{input: "a`b\"c", expected: "'a`b\"c'"},
+		{input: "'; Stop-Computer; '", expected: "'''; Stop-Computer; '''"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := psQuote(tt.input); got != tt.expected {
+				t.Errorf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseMicrosoftDate(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected time.Time
+		err      bool
+	}{
+		{input: "/Date(1732096365000)/", expected: time.UnixMilli(1732096365000)},
+		{input: "/Date(0)/", expected: time.UnixMilli(0)},
+		{input: "2024-11-20T10:12:45", err: true},
+		{input: "/Date()/", err: true},
+		{input: "/Date(99999999999999999999)/", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseMicrosoftDate(tt.input)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHypervCapabilities(t *testing.T) {
+	vp := &HypervVP{}
+	if !HasCapability(vp, CapClone) || !HasCapability(vp, CapSnapshotCreationTime) {
+		t.Errorf("missing capabilities in %v", vp.Capabilities())
+	}
+	if HasCapability(vp, CapPacketCapture) {
+		t.Error("packet capture advertised without a capture VM")
+	}
+	vp.Capture.VM = "capture"
+	if !HasCapability(vp, CapPacketCapture) {
+		t.Error("packet capture not advertised with a capture VM")
+	}
+}
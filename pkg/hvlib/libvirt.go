@@ -0,0 +1,650 @@
+package hvlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func (l *LibvirtVP) LoadVMs(ctx context.Context, loader *ConfigLoader) error {
+	l.VirshPath = loader.GetString("libvirt.virsh_path")
+	if l.VirshPath == "" {
+		l.VirshPath = "virsh"
+	}
+	l.URI = loader.GetString("libvirt.uri")
+	if l.URI == "" {
+		l.URI = "qemu:///system"
+	}
+	l.TcpdumpPath = loader.GetString("libvirt.tcpdump_path")
+	if l.TcpdumpPath == "" {
+		l.TcpdumpPath = "tcpdump"
+	}
+	l.QemuImgPath = loader.GetString("libvirt.qemu_img_path")
+	if l.QemuImgPath == "" {
+		l.QemuImgPath = "qemu-img"
+	}
+	l.VirtClonePath = loader.GetString("libvirt.virt_clone_path")
+	if l.VirtClonePath == "" {
+		l.VirtClonePath = "virt-clone"
+	}
+	l.ClonePath = loader.GetString("libvirt.clone_path")
+	if l.ClonePath == "" {
+		l.ClonePath = "/var/lib/libvirt/images"
+	}
+	if err := l.loadNetworkProfiles(loader, "libvirt"); err != nil {
+		return err
+	}
+	vms, err := l.discoverVMs(ctx)
+	if err != nil {
+		return err
+	}
+	l.setVMs(vms)
+	return nil
+}
+
+// RefreshVMs lists the domains defined in libvirt again
+func (l *LibvirtVP) RefreshVMs(ctx context.Context) error {
+	return l.refreshVMs(ctx, l.discoverVMs)
+}
+
+func (l *LibvirtVP) discoverVMs(ctx context.Context) (map[string]VM, error) {
+	vms := make(map[string]VM)
+
+	// List all defined domains, running or not
+	output, err := l.ExecVirsh(ctx, "list", "--all", "--name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %s (%w)", output, err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		vmName := strings.TrimSpace(line)
+		if vmName == "" {
+			continue
+		}
+		uuid, err := l.ExecVirsh(ctx, "domuuid", vmName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get uuid for VM %s: %s (%v)", vmName, uuid, err)
+		}
+		vms[vmName] = VM{
+			ID: strings.TrimSpace(uuid),
+		}
+	}
+	return vms, nil
+}
+
+func (l *LibvirtVP) Capabilities() []string {
+	return providerCapabilities(l, []string{CapSnapshots, CapSnapshotCreationTime, CapSuspend, CapReset})
+}
+
+// Version returns the versions of the hypervisor and of libvirt, from:
+//
+//	Using library: libvirt 8.0.0
+//	Running hypervisor: QEMU 6.2.0
+func (l *LibvirtVP) Version(ctx context.Context) (string, error) {
+	output, err := l.ExecVirsh(ctx, "version")
+	if err != nil {
+		return "", fmt.Errorf("failed to get version: %s (%w)", output, err)
+	}
+
+	var hypervisor, library string
+	for _, line := range strings.Split(output, "\n") {
+		if value, found := strings.CutPrefix(line, "Running hypervisor:"); found {
+			hypervisor = strings.TrimSpace(value)
+		} else if value, found := strings.CutPrefix(line, "Using library:"); found {
+			library = strings.TrimSpace(value)
+		}
+	}
+	if hypervisor == "" {
+		return library, nil
+	}
+	return fmt.Sprintf("%s (%s)", hypervisor, library), nil
+}
+
+func (l *LibvirtVP) List(ctx context.Context) ([]VMStatus, error) {
+	// Map virsh domstate output to the states used by the other providers
+	stateMap := map[string]string{
+		"running":     "running",
+		"idle":        "running",
+		"in shutdown": "running",
+		"shut off":    "stopped",
+		"crashed":     "stopped",
+		"paused":      "suspended",
+		"pmsuspended": "suspended",
+	}
+
+	var vms []VMStatus
+	for vmName, vm := range l.inventory() {
+		output, err := l.ExecVirsh(ctx, "domstate", vmName)
+		if err != nil {
+			return nil, fmt.Errorf("%s (%w)", output, err)
+		}
+
+		state, ok := stateMap[strings.TrimSpace(output)]
+		if !ok {
+			state = strings.TrimSpace(output)
+		}
+		vms = append(vms, VMStatus{
+			ID:    vm.ID,
+			Name:  vmName,
+			State: state,
+		})
+	}
+	return vms, nil
+}
+
+// snapshotListLine matches a row of `virsh snapshot-list --parent`:
+// " office   2024-11-20 10:12:45 +0100   shutoff   clean"
+var snapshotListLine = regexp.MustCompile(
+	`^\s*(.+?)\s+(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} [+-]\d{4})\s+(\S+)(?:\s+(.+?))?\s*$`)
+
+func (l *LibvirtVP) ListSnapshots(ctx context.Context, vmName string) ([]Snapshot, error) {
+	if _, exists := l.lookupVM(vmName); !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+
+	output, err := l.ExecVirsh(ctx, "snapshot-list", vmName, "--parent")
+	if err != nil {
+		return nil, fmt.Errorf("%s (%w)", output, err)
+	}
+
+	// virsh fails when the domain has no current snapshot
+	current, err := l.ExecVirsh(ctx, "snapshot-current", vmName, "--name")
+	if err != nil {
+		current = ""
+	}
+
+	var snapshots []Snapshot
+	for _, line := range strings.Split(output, "\n") {
+		matches := snapshotListLine.FindStringSubmatch(line)
+		if len(matches) < 4 {
+			continue // Header, separator or empty line
+		}
+		creationTime, err := time.Parse("2006-01-02 15:04:05 -0700", matches[2])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot creation time %q: %v", matches[2], err)
+		}
+		// Snapshot names are unique per domain and used as ID
+		snapshots = append(snapshots, Snapshot{
+			ID:           matches[1],
+			Name:         matches[1],
+			CreationTime: creationTime,
+			ParentID:     matches[4],
+			IsCurrent:    matches[1] == current,
+		})
+	}
+	return snapshots, nil
+}
+
+func (l *LibvirtVP) Start(ctx context.Context, vmName string) error {
+	return l.execVmCommand(ctx, vmName, "start")
+}
+
+func (l *LibvirtVP) Stop(ctx context.Context, vmName string, force bool) error {
+	// destroy is an immediate power off, shutdown asks the guest nicely
+	stopCmd := map[bool]string{true: "destroy", false: "shutdown"}[force]
+	return l.execVmCommand(ctx, vmName, stopCmd)
+}
+
+func (l *LibvirtVP) Suspend(ctx context.Context, vmName string) error {
+	return l.execVmCommand(ctx, vmName, "suspend")
+}
+
+func (l *LibvirtVP) Reset(ctx context.Context, vmName string) error {
+	return l.execVmCommand(ctx, vmName, "reset")
+}
+
+func (l *LibvirtVP) TakeSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	// Without --disk-only libvirt creates an internal (qcow2) snapshot
+	return l.execVmCommand(ctx, vmName, "snapshot-create-as", "--name", snapshotName)
+}
+
+func (l *LibvirtVP) RestoreSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return l.execVmCommand(ctx, vmName, "snapshot-revert", "--snapshotname", snapshotName)
+}
+
+func (l *LibvirtVP) DeleteSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return l.execVmCommand(ctx, vmName, "snapshot-delete", "--snapshotname", snapshotName)
+}
+
+func (l *LibvirtVP) Revert(ctx context.Context, vmName string) error {
+	current, err := currentSnapshotForRevert(ctx, l, vmName)
+	if err != nil {
+		return err
+	}
+	return l.execVmCommand(ctx, vmName, "snapshot-revert", "--snapshotname", current.Name)
+}
+
+// CaptureScreen needs a graphical console, QEMU writes the screenshot as PPM
+func (l *LibvirtVP) CaptureScreen(ctx context.Context, vmName string) ([]byte, error) {
+	return captureToFile(func(hostPath string) error {
+		return l.execVmCommand(ctx, vmName, "screenshot", "--file", hostPath)
+	})
+}
+
+// GuestReady pings the QEMU guest agent, the domain needs a guest agent
+// channel and qemu-guest-agent installed in the guest
+func (l *LibvirtVP) GuestReady(ctx context.Context, vmName string) (bool, error) {
+	err := l.execVmCommand(ctx, vmName, "qemu-agent-command", `{"execute":"guest-ping"}`)
+	if err == nil {
+		return true, nil
+	}
+	var notFound *VmNotFoundError
+	if errors.As(err, &notFound) {
+		return false, err
+	}
+	// The agent isn't connected yet, or the domain isn't running
+	if strings.Contains(err.Error(), "agent") || strings.Contains(err.Error(), "not running") {
+		return false, nil
+	}
+	return false, &VirtualizationError{Operation: OpGuestReady, VMName: vmName, Err: err}
+}
+
+// DumpMemory writes an ELF core of the guest memory, the VM keeps running
+func (l *LibvirtVP) DumpMemory(ctx context.Context, vmName, dir string) ([]string, error) {
+	path := filepath.Join(dir, vmName+".elf")
+	err := l.execVmCommand(ctx, vmName, "dump", "--file", path, "--memory-only", "--format", "elf")
+	if err != nil {
+		return nil, err
+	}
+	return []string{path}, nil
+}
+
+// StartCapture runs tcpdump on the host bridge of the first interface of
+// the VM, filtered on its MAC address. The tap device of the VM only exists
+// while it runs and is recreated at each start, capturing on the bridge
+// lets the capture begin before the VM is started and survive its reboots.
+func (l *LibvirtVP) StartCapture(ctx context.Context, vmName, hostPath string) error {
+	if _, exists := l.lookupVM(vmName); !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+
+	bridge, mac, err := l.interfaceBridge(ctx, vmName)
+	if err != nil {
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
+
+	// tcpdump outlives the request, it isn't bound to ctx
+	var stderr bytes.Buffer
+	cmd := exec.Command(l.TcpdumpPath, "-i", bridge, "-U", "-w", hostPath, "ether host "+mac)
+	cmd.Stderr = &stderr
+	exited := make(chan error, 1)
+	capture := &packetCapture{
+		hostPath: hostPath,
+		stop: func() error {
+			// tcpdump flushes the file on SIGINT
+			if err := cmd.Process.Signal(os.Interrupt); err != nil {
+				if errors.Is(err, os.ErrProcessDone) {
+					return nil
+				}
+				return err
+			}
+			select {
+			case <-exited:
+				return nil
+			case <-time.After(tcpdumpStopTimeout):
+				cmd.Process.Kill()
+				return fmt.Errorf("tcpdump didn't exit, killed")
+			}
+		},
+	}
+	if err := l.captures.add(vmName, capture); err != nil {
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
+	if err := cmd.Start(); err != nil {
+		l.captures.remove(vmName)
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
+	go func() { exited <- cmd.Wait() }()
+
+	// A bad interface or a permission error make tcpdump exit at once
+	select {
+	case err := <-exited:
+		l.captures.remove(vmName)
+		return &VirtualizationError{
+			Operation: OpStartCapture,
+			VMName:    vmName,
+			Err:       fmt.Errorf("tcpdump exited: %v, output: %s", err, strings.TrimSpace(stderr.String())),
+		}
+	case <-time.After(tcpdumpStartDelay):
+		return nil
+	}
+}
+
+func (l *LibvirtVP) StopCapture(ctx context.Context, vmName string) (string, error) {
+	if _, exists := l.lookupVM(vmName); !exists {
+		return "", &VmNotFoundError{VmName: vmName}
+	}
+
+	capture, err := l.captures.remove(vmName)
+	if err != nil {
+		return "", &VirtualizationError{Operation: OpStopCapture, VMName: vmName, Err: err}
+	}
+	if err := capture.stop(); err != nil {
+		return "", &VirtualizationError{Operation: OpStopCapture, VMName: vmName, Err: err}
+	}
+	return capture.hostPath, nil
+}
+
+const (
+	tcpdumpStartDelay  = time.Second
+	tcpdumpStopTimeout = 10 * time.Second
+)
+
+// domiflistLine matches a row of `virsh domiflist`, the interface is "-"
+// while the VM is off:
+// " vnet0   network   default   virtio   52:54:00:6b:3c:58"
+var domiflistLine = regexp.MustCompile(`^\s*(\S+)\s+(\S+)\s+(\S+)\s+(\S+)\s+([0-9a-fA-F:]{17})\s*$`)
+
+// domainInterface is a row of `virsh domiflist`
+type domainInterface struct {
+	Type   string
+	Source string
+	Model  string
+	MAC    string
+}
+
+// firstInterface returns the first network interface of the VM
+func (l *LibvirtVP) firstInterface(ctx context.Context, vmName string) (domainInterface, error) {
+	output, err := l.ExecVirsh(ctx, "domiflist", "--domain", vmName)
+	if err != nil {
+		return domainInterface{}, fmt.Errorf("%s (%w)", output, err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		match := domiflistLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		return domainInterface{
+			Type:   match[2],
+			Source: match[3],
+			Model:  match[4],
+			MAC:    strings.ToLower(match[5]),
+		}, nil
+	}
+	return domainInterface{}, fmt.Errorf("VM has no network interface")
+}
+
+// interfaceBridge returns the host bridge and the MAC address of the first
+// interface of the VM
+func (l *LibvirtVP) interfaceBridge(ctx context.Context, vmName string) (string, string, error) {
+	iface, err := l.firstInterface(ctx, vmName)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch iface.Type {
+	case "bridge":
+		return iface.Source, iface.MAC, nil
+	case "network":
+		info, err := l.ExecVirsh(ctx, "net-info", "--network", iface.Source)
+		if err != nil {
+			return "", "", fmt.Errorf("%s (%w)", info, err)
+		}
+		for _, line := range strings.Split(info, "\n") {
+			if name, found := strings.CutPrefix(line, "Bridge:"); found {
+				return strings.TrimSpace(name), iface.MAC, nil
+			}
+		}
+		return "", "", fmt.Errorf("network %s has no bridge", iface.Source)
+	default:
+		return "", "", fmt.Errorf("%w: capture of %s interfaces", ErrNotSupported, iface.Type)
+	}
+}
+
+// SetNetworkProfile updates the first interface of the VM, in its
+// persistent definition and, when it runs, live
+func (l *LibvirtVP) SetNetworkProfile(ctx context.Context, vmName, name string) error {
+	if _, exists := l.lookupVM(vmName); !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+	profile, err := l.networkProfile(name)
+	if err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+
+	iface, err := l.firstInterface(ctx, vmName)
+	if err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+	state, err := l.ExecVirsh(ctx, "domstate", vmName)
+	if err != nil {
+		return &VirtualizationError{
+			Operation: OpSetNetworkProfile,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%s (%w)", state, err),
+		}
+	}
+	scope := []string{"--config"}
+	if state != "shut off" {
+		scope = append(scope, "--live")
+	}
+
+	if profile.Network == "" {
+		for _, flag := range scope {
+			err := l.execVmCommand(ctx, vmName, "domif-setlink",
+				"--interface", iface.MAC, "--state", "down", flag)
+			if err != nil {
+				return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+			}
+		}
+		return nil
+	}
+
+	definition := libvirtInterface{Type: "network"}
+	definition.MAC.Address = iface.MAC
+	definition.Source.Network = profile.Network
+	if iface.Model != "-" {
+		definition.Model = &libvirtModel{Type: iface.Model}
+	}
+	definition.Link.State = "up"
+	if profile.Disconnected {
+		definition.Link.State = "down"
+	}
+	data, err := xml.Marshal(definition)
+	if err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "hvlib-interface-*")
+	if err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "interface.xml")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+
+	args := append([]string{"--file", path}, scope...)
+	if err := l.execVmCommand(ctx, vmName, "update-device", args...); err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+	return nil
+}
+
+// libvirtInterface is the <interface> element passed to update-device, the
+// MAC address identifies the interface to update
+type libvirtInterface struct {
+	XMLName xml.Name `xml:"interface"`
+	Type    string   `xml:"type,attr"`
+	MAC     struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	Source struct {
+		Network string `xml:"network,attr"`
+	} `xml:"source"`
+	Model *libvirtModel `xml:"model"` // Omitted when the interface has no model
+	Link  struct {
+		State string `xml:"state,attr"`
+	} `xml:"link"`
+}
+
+type libvirtModel struct {
+	Type string `xml:"type,attr"`
+}
+
+// CloneVM exports the disk of the internal snapshot once, as the golden
+// image <ClonePath>/<vm>-<snapshot>.qcow2, then gives each clone a qcow2
+// overlay backed by it. virt-clone defines the clone with a new UUID and
+// MAC address. Only single disk VMs are supported and the hypervisor must
+// be local, the images are written by hvapi.
+func (l *LibvirtVP) CloneVM(ctx context.Context, vmName, snapshotName, cloneName string) error {
+	if err := validateCloneName(cloneName); err != nil {
+		return err
+	}
+	if _, exists := l.lookupVM(cloneName); exists {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: fmt.Errorf("VM %s already exists", cloneName)}
+	}
+	if _, exists := l.lookupVM(vmName); !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+
+	disk, err := l.domainDisk(ctx, vmName)
+	if err != nil {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: err}
+	}
+	base, err := l.goldenImage(ctx, vmName, snapshotName, disk)
+	if err != nil {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: err}
+	}
+
+	overlay := filepath.Join(l.ClonePath, cloneName+".qcow2")
+	if output, err := l.execTool(ctx, l.QemuImgPath, "create", "-f", "qcow2", "-F", "qcow2", "-b", base, overlay); err != nil {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: fmt.Errorf("%s (%w)", output, err)}
+	}
+	output, err := l.execTool(ctx, l.VirtClonePath, "--connect", l.URI,
+		"--original", vmName, "--name", cloneName, "--file", overlay, "--preserve-data")
+	if err != nil {
+		os.Remove(overlay)
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: fmt.Errorf("%s (%w)", output, err)}
+	}
+
+	uuid, err := l.ExecVirsh(ctx, "domuuid", cloneName)
+	if err != nil {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: fmt.Errorf("%s (%w)", uuid, err)}
+	}
+	l.addVM(cloneName, VM{ID: uuid})
+	return nil
+}
+
+// goldenImage returns the image holding the disk of the snapshot, it is
+// exported from the disk of the VM the first time
+func (l *LibvirtVP) goldenImage(ctx context.Context, vmName, snapshotName, disk string) (string, error) {
+	l.cloneMu.Lock()
+	defer l.cloneMu.Unlock()
+
+	base := filepath.Join(l.ClonePath, vmName+"-"+unsafeFileChars.ReplaceAllString(snapshotName, "_")+".qcow2")
+	if _, err := os.Stat(base); err == nil {
+		return base, nil
+	}
+
+	// Internal snapshots never change, they can be read while the VM runs
+	tmp := base + ".tmp"
+	output, err := l.execTool(ctx, l.QemuImgPath, "convert", "-U", "-f", "qcow2", "-O", "qcow2",
+		"-l", "snapshot.name="+snapshotName, disk, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("%s (%w)", output, err)
+	}
+	return base, os.Rename(tmp, base)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// DeleteVM undefines the VM, its disk is only deleted when it is in
+// ClonePath, as created by CloneVM
+func (l *LibvirtVP) DeleteVM(ctx context.Context, vmName string) error {
+	if _, exists := l.lookupVM(vmName); !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+
+	disk, err := l.domainDisk(ctx, vmName)
+	if err != nil {
+		return &VirtualizationError{Operation: OpDeleteVM, VMName: vmName, Err: err}
+	}
+	if err := l.execVmCommand(ctx, vmName, "undefine", "--nvram"); err != nil {
+		return &VirtualizationError{Operation: OpDeleteVM, VMName: vmName, Err: err}
+	}
+	l.removeVM(vmName)
+
+	if filepath.Dir(disk) == filepath.Clean(l.ClonePath) {
+		if err := os.Remove(disk); err != nil {
+			return &VirtualizationError{Operation: OpDeleteVM, VMName: vmName, Err: err}
+		}
+	}
+	return nil
+}
+
+// domainDisk returns the image of the only disk of the VM, from
+// `virsh domblklist --details`:
+// " file   disk   vda   /var/lib/libvirt/images/win10.qcow2"
+func (l *LibvirtVP) domainDisk(ctx context.Context, vmName string) (string, error) {
+	output, err := l.ExecVirsh(ctx, "domblklist", "--domain", vmName, "--details")
+	if err != nil {
+		return "", fmt.Errorf("%s (%w)", output, err)
+	}
+
+	var disks []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 4 && fields[1] == "disk" {
+			disks = append(disks, fields[3])
+		}
+	}
+	if len(disks) != 1 {
+		return "", fmt.Errorf("only VMs with a single disk can be cloned, found %d", len(disks))
+	}
+	return disks[0], nil
+}
+
+// execTool runs one of the libvirt command line tools, errors are
+// reported on stderr
+func (l *LibvirtVP) execTool(ctx context.Context, path string, args ...string) (string, error) {
+	stdout, stderr, err := l.runner().Run(ctx, path, args...)
+	if err != nil {
+		if exiterr, ok := err.(*CommandExitError); ok {
+			return strings.TrimSpace(stderr), exiterr
+		}
+		return "", fmt.Errorf("cmd.Wait %w", err)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// execVmCommand is a helper function for executing virsh commands on a domain
+func (l *LibvirtVP) execVmCommand(ctx context.Context, vmName, command string, extraArgs ...string) error {
+	if _, exists := l.lookupVM(vmName); !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+
+	args := append([]string{command, "--domain", vmName}, extraArgs...)
+	output, err := l.ExecVirsh(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("%s (%w)", output, err)
+	}
+	return nil
+}
+
+func (l *LibvirtVP) ExecVirsh(ctx context.Context, args ...string) (string, error) {
+	stdout, stderr, err := l.runner().Run(ctx, l.VirshPath,
+		append([]string{"--connect", l.URI, "--quiet"}, args...)...)
+
+	if err != nil {
+		if exiterr, ok := err.(*CommandExitError); ok {
+			// virsh reports its errors on stderr
+			return strings.TrimSpace(stderr), exiterr
+		} else {
+			return "", fmt.Errorf("cmd.Wait %w", err)
+		}
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
@@ -0,0 +1,202 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReplayLibvirtVP(t *testing.T) *LibvirtVP {
+	t.Helper()
+	runner, err := NewReplayRunner("testdata/libvirt.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp := &LibvirtVP{VP: VP{Runner: runner}}
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := vp.LoadVMs(context.Background(), loader); err != nil {
+		t.Fatal(err)
+	}
+	return vp
+}
+
+func TestLibvirtLoadVMs(t *testing.T) {
+	vp := newReplayLibvirtVP(t)
+
+	if len(vp.VMs) != 5 {
+		t.Fatalf("got %d VMs, expected 5", len(vp.VMs))
+	}
+	if vp.VMs["win10"].ID != "5b1a3f0e-8a2c-4d1e-9b7a-1f2e3d4c5b01" {
+		t.Errorf("unexpected ID for win10: %s", vp.VMs["win10"].ID)
+	}
+	if vp.VirshPath != "virsh" || vp.URI != "qemu:///system" {
+		t.Errorf("unexpected defaults %q %q", vp.VirshPath, vp.URI)
+	}
+}
+
+func TestLibvirtList(t *testing.T) {
+	vp := newReplayLibvirtVP(t)
+
+	vms, err := vp.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"win10": "running",
+		"win11": "running",   // idle
+		"win7":  "suspended", // paused
+		"xp":    "stopped",   // shut off
+		"srv":   "blocked",   // Unknown states are kept as is
+	}
+	if len(vms) != len(expected) {
+		t.Fatalf("got %d VMs, expected %d", len(vms), len(expected))
+	}
+	for _, vm := range vms {
+		if vm.State != expected[vm.Name] {
+			t.Errorf("VM %s: got state %q, expected %q", vm.Name, vm.State, expected[vm.Name])
+		}
+	}
+}
+
+func TestLibvirtListSnapshots(t *testing.T) {
+	vp := newReplayLibvirtVP(t)
+
+	snapshots, err := vp.ListSnapshots(context.Background(), "win10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Snapshot{
+		{ID: "clean", Name: "clean", CreationTime: time.Date(2024, 11, 20, 9, 12, 45, 0, time.UTC)},
+		{ID: "with office", Name: "with office", CreationTime: time.Date(2024, 11, 21, 8, 30, 0, 0, time.UTC), ParentID: "clean", IsCurrent: true},
+		{ID: "office 2021", Name: "office 2021", CreationTime: time.Date(2024, 11, 22, 23, 5, 10, 0, time.UTC), ParentID: "with office"},
+	}
+	if len(snapshots) != len(expected) {
+		t.Fatalf("got %d snapshots, expected %d: %+v", len(snapshots), len(expected), snapshots)
+	}
+	for i, s := range snapshots {
+		e := expected[i]
+		if s.ID != e.ID || s.Name != e.Name || s.ParentID != e.ParentID || s.IsCurrent != e.IsCurrent ||
+			!s.CreationTime.Equal(e.CreationTime) {
+			t.Errorf("got snapshot %+v, expected %+v", s, e)
+		}
+	}
+
+	// Without snapshots virsh fails to get the current one
+	snapshots, err = vp.ListSnapshots(context.Background(), "xp")
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("got %v and error %v, expected no snapshots", snapshots, err)
+	}
+
+	if _, err := vp.ListSnapshots(context.Background(), "unknown"); !errors.As(err, new(*VmNotFoundError)) {
+		t.Errorf("expected VmNotFoundError, got %v", err)
+	}
+}
+
+func TestSnapshotListLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		parent string
+	}{
+		{line: " clean   2024-11-20 10:12:45 +0100   shutoff", name: "clean"},
+		{line: " office   2024-11-20 10:12:45 +0100   shutoff   clean", name: "office", parent: "clean"},
+		{line: " with office  2024-11-20 10:12:45 -0500 running  office 2021  ", name: "with office", parent: "office 2021"},
+		{line: " Name   Creation Time   State   Parent"},
+		{line: "---------------------------------------"},
+		{line: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			matches := snapshotListLine.FindStringSubmatch(tt.line)
+			if tt.name == "" {
+				if matches != nil {
+					t.Fatalf("unexpected match %q", matches)
+				}
+				return
+			}
+			if matches == nil {
+				t.Fatal("line not matched")
+			}
+			if matches[1] != tt.name || matches[4] != tt.parent {
+				t.Errorf("got name %q and parent %q, expected %q and %q", matches[1], matches[4], tt.name, tt.parent)
+			}
+		})
+	}
+}
+
+func TestLibvirtCommands(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		run  func(vp *LibvirtVP) error
+		err  string
+	}{
+		{name: "start", run: func(vp *LibvirtVP) error { return vp.Start(ctx, "xp") }},
+		{name: "start failure", run: func(vp *LibvirtVP) error { return vp.Start(ctx, "win10") }, err: "domain is already running"},
+		{name: "shutdown", run: func(vp *LibvirtVP) error { return vp.Stop(ctx, "win10", false) }},
+		{name: "destroy", run: func(vp *LibvirtVP) error { return vp.Stop(ctx, "win10", true) }},
+		{name: "revert to current", run: func(vp *LibvirtVP) error { return vp.Revert(ctx, "win10") }},
+		{name: "unknown vm", run: func(vp *LibvirtVP) error { return vp.Start(ctx, "unknown") }, err: "vm unknown not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run(newReplayLibvirtVP(t))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLibvirtVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdout   string
+		expected string
+	}{
+		{
+			name:     "qemu",
+			stdout:   "Compiled against library: libvirt 8.0.0\nUsing library: libvirt 8.0.0\nUsing API: QEMU 8.0.0\nRunning hypervisor: QEMU 6.2.0\n",
+			expected: "QEMU 6.2.0 (libvirt 8.0.0)",
+		},
+		{
+			// Without a connection to a hypervisor
+			name:     "library only",
+			stdout:   "Compiled against library: libvirt 9.0.0\nUsing library: libvirt 9.0.0\n",
+			expected: "libvirt 9.0.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vp := &LibvirtVP{
+				VirshPath: "virsh",
+				URI:       "qemu:///system",
+				VP: VP{Runner: &ReplayRunner{Transcripts: []CommandTranscript{
+					{Name: "virsh", Args: []string{"--connect", "qemu:///system", "--quiet", "version"}, Stdout: tt.stdout},
+				}}},
+			}
+			version, err := vp.Version(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.expected {
+				t.Errorf("got version %q, expected %q", version, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package hvlib
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// copyFilesToDir copies files produced by a hypervisor into dir, keeping
+// their names, and returns the paths of the copies
+func copyFilesToDir(ctx context.Context, sources []string, dir string) ([]string, error) {
+	var paths []string
+	for _, source := range sources {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, filepath.Base(source))
+		if err := copyFile(source, path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func copyFile(source, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,90 @@
+package hvlib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/pelletier/go-toml"
+)
+
+// ErrUnknownNetworkProfile is returned when a profile isn't configured for
+// the provider
+var ErrUnknownNetworkProfile = errors.New("unknown network profile")
+
+// NetworkProfile is a named network attachment of the VMs. The profiles
+// (isolated, simulated internet, VPN or Tor gateway...) are built by the
+// operator as virtual networks, a profile only selects one of them.
+type NetworkProfile struct {
+	Name string
+	// No network at all, the adapter is disconnected
+	Disconnected bool
+	// VMware: VMnetN, or nat, hostonly, bridged
+	// Hyper-V: virtual switch name
+	// libvirt: network name
+	Network string
+}
+
+// loadNetworkProfiles reads the [<section>.network_profiles] tables:
+//
+//	[vmware.network_profiles.isolated]
+//	disconnected = true
+//
+//	[vmware.network_profiles.inetsim]
+//	network = "VMnet2"
+func (vp *VP) loadNetworkProfiles(loader *ConfigLoader, section string) error {
+	vp.NetworkProfiles = make(map[string]NetworkProfile)
+
+	tree, ok := loader.Get(section + ".network_profiles").(*toml.Tree)
+	if !ok {
+		return nil
+	}
+
+	for _, name := range tree.Keys() {
+		table, ok := tree.Get(name).(*toml.Tree)
+		if !ok {
+			return fmt.Errorf("invalid %s.network_profiles.%s, expected a table", section, name)
+		}
+		profile := NetworkProfile{Name: name}
+		for _, key := range table.Keys() {
+			switch value := table.Get(key).(type) {
+			case bool:
+				if key != "disconnected" {
+					return fmt.Errorf("unknown key %s.network_profiles.%s.%s", section, name, key)
+				}
+				profile.Disconnected = value
+			case string:
+				if key != "network" {
+					return fmt.Errorf("unknown key %s.network_profiles.%s.%s", section, name, key)
+				}
+				profile.Network = value
+			default:
+				return fmt.Errorf("invalid %s.network_profiles.%s.%s: %v", section, name, key, value)
+			}
+		}
+		if !profile.Disconnected && profile.Network == "" {
+			return fmt.Errorf("%s.network_profiles.%s needs a network or disconnected = true", section, name)
+		}
+		vp.NetworkProfiles[name] = profile
+	}
+	return nil
+}
+
+// networkProfile returns the profile configured under name
+func (vp *VP) networkProfile(name string) (NetworkProfile, error) {
+	profile, exists := vp.NetworkProfiles[name]
+	if !exists {
+		return NetworkProfile{}, fmt.Errorf("%w %s", ErrUnknownNetworkProfile, name)
+	}
+	return profile, nil
+}
+
+// ListNetworkProfiles returns the names of the configured profiles
+func (vp *VP) ListNetworkProfiles() []string {
+	names := make([]string, 0, len(vp.NetworkProfiles))
+	for name := range vp.NetworkProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,129 @@
+package hvlib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// captureToFile runs a capture command writing an image to the given host
+// path, the image is returned as PNG
+func captureToFile(capture func(hostPath string) error) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp("", "hvlib-screen-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	hostPath := filepath.Join(tmpDir, "screen")
+	if err := capture(hostPath); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(hostPath)
+	if err != nil {
+		return nil, err
+	}
+	return toPNG(data)
+}
+
+// toPNG converts the formats produced by the hypervisor tools to PNG,
+// QEMU writes screenshots as PPM
+func toPNG(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, pngSignature) {
+		return data, nil
+	}
+	if bytes.HasPrefix(data, []byte("P6")) {
+		img, err := decodePPM(data)
+		if err != nil {
+			return nil, err
+		}
+		return encodePNG(img)
+	}
+	return nil, fmt.Errorf("unsupported screenshot format")
+}
+
+// decodePPM decodes a binary PPM (P6) image with 8 bits per channel
+func decodePPM(data []byte) (image.Image, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	// The header is the magic, width, height and max value separated by
+	// whitespace, lines starting with # are comments
+	var fields []int
+	for len(fields) < 3 {
+		var token string
+		if _, err := fmt.Fscan(r, &token); err != nil {
+			return nil, fmt.Errorf("invalid PPM header: %w", err)
+		}
+		if token == "P6" && len(fields) == 0 {
+			continue
+		}
+		if token[0] == '#' {
+			if _, err := r.ReadString('\n'); err != nil {
+				return nil, fmt.Errorf("invalid PPM header: %w", err)
+			}
+			continue
+		}
+		var value int
+		if _, err := fmt.Sscan(token, &value); err != nil {
+			return nil, fmt.Errorf("invalid PPM header: %w", err)
+		}
+		fields = append(fields, value)
+	}
+	width, height, maxValue := fields[0], fields[1], fields[2]
+	if maxValue != 255 {
+		return nil, fmt.Errorf("unsupported PPM max value %d", maxValue)
+	}
+	// A single whitespace separates the header from the pixels
+	if _, err := r.ReadByte(); err != nil {
+		return nil, fmt.Errorf("invalid PPM header: %w", err)
+	}
+
+	pixels := make([]byte, width*height*3)
+	if _, err := io.ReadFull(r, pixels); err != nil {
+		return nil, fmt.Errorf("truncated PPM data: %w", err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		img.Set(i%width, i/width, color.RGBA{R: pixels[3*i], G: pixels[3*i+1], B: pixels[3*i+2], A: 0xff})
+	}
+	return img, nil
+}
+
+// decodeRGB565 decodes the little-endian RGB565 pixels of a Hyper-V
+// thumbnail
+func decodeRGB565(data []byte, width, height int) (image.Image, error) {
+	if len(data) < width*height*2 {
+		return nil, fmt.Errorf("got %d bytes of image data, expected %d", len(data), width*height*2)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		v := uint16(data[2*i]) | uint16(data[2*i+1])<<8
+		r := uint8(v >> 11 & 0x1f)
+		g := uint8(v >> 5 & 0x3f)
+		b := uint8(v & 0x1f)
+		img.Set(i%width, i/width, color.RGBA{
+			R: r<<3 | r>>2,
+			G: g<<2 | g>>4,
+			B: b<<3 | b>>2,
+			A: 0xff,
+		})
+	}
+	return img, nil
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,66 @@
+package hvlib
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestToPNG(t *testing.T) {
+	ppm := append([]byte("P6\n# CREATOR: QEMU\n2 1\n255\n"), 0xff, 0x00, 0x00, 0x00, 0x80, 0xff)
+
+	data, err := toPNG(ppm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 1 {
+		t.Fatalf("got size %v, expected 2x1", img.Bounds())
+	}
+	expected := []color.RGBA{{R: 0xff, A: 0xff}, {G: 0x80, B: 0xff, A: 0xff}}
+	for x, c := range expected {
+		if got := color.RGBAModel.Convert(img.At(x, 0)); got != c {
+			t.Errorf("got %v at %d, expected %v", got, x, c)
+		}
+	}
+
+	// PNG images are returned as is
+	if again, err := toPNG(data); err != nil || !bytes.Equal(again, data) {
+		t.Errorf("PNG image was modified: %v", err)
+	}
+
+	if _, err := toPNG(ppm[:len(ppm)-1]); err == nil {
+		t.Error("expected an error for truncated PPM data")
+	}
+	if _, err := toPNG([]byte("GIF89a")); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+func TestDecodeRGB565(t *testing.T) {
+	// White, pure red and pure blue, little-endian
+	data := []byte{0xff, 0xff, 0x00, 0xf8, 0x1f, 0x00}
+
+	img, err := decodeRGB565(data, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []color.RGBA{
+		{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		{R: 0xff, A: 0xff},
+		{B: 0xff, A: 0xff},
+	}
+	for x, c := range expected {
+		if got := img.At(x, 0); got != c {
+			t.Errorf("got %v at %d, expected %v", got, x, c)
+		}
+	}
+
+	if _, err := decodeRGB565(data, 2, 2); err == nil {
+		t.Error("expected an error for missing image data")
+	}
+}
@@ -0,0 +1,81 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// ErrNoCurrentSnapshot is returned by Revert when the VM state is not
+// based on any snapshot
+var ErrNoCurrentSnapshot = errors.New("no current snapshot to revert to")
+
+// BuildSnapshotTree arranges snapshots by parent, the roots are returned.
+// Siblings are sorted by creation time.
+func BuildSnapshotTree(snapshots []Snapshot) []*SnapshotNode {
+	nodes := make(map[string]*SnapshotNode, len(snapshots))
+	for _, snap := range snapshots {
+		nodes[snap.ID] = &SnapshotNode{Snapshot: snap, Children: []*SnapshotNode{}}
+	}
+
+	var roots []*SnapshotNode
+	for _, snap := range snapshots {
+		node := nodes[snap.ID]
+		if parent, ok := nodes[snap.ParentID]; ok && snap.ParentID != "" {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var sortNodes func(nodes []*SnapshotNode)
+	sortNodes = func(nodes []*SnapshotNode) {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].CreationTime.Before(nodes[j].CreationTime)
+		})
+		for _, node := range nodes {
+			sortNodes(node.Children)
+		}
+	}
+	sortNodes(roots)
+	return roots
+}
+
+// CurrentSnapshot returns the snapshot the VM state is based on
+func CurrentSnapshot(snapshots []Snapshot) (Snapshot, bool) {
+	for _, snap := range snapshots {
+		if snap.IsCurrent {
+			return snap, true
+		}
+	}
+	return Snapshot{}, false
+}
+
+// currentSnapshotForRevert lists the snapshots of the VM and returns the
+// current one, every provider reverts to this snapshot
+func currentSnapshotForRevert(ctx context.Context, vp VirtualizationProvider, vmName string) (Snapshot, error) {
+	snapshots, err := vp.ListSnapshots(ctx, vmName)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	current, ok := CurrentSnapshot(snapshots)
+	if !ok {
+		return Snapshot{}, &VirtualizationError{Operation: OpRevert, VMName: vmName, Err: ErrNoCurrentSnapshot}
+	}
+	return current, nil
+}
+
+// RevertTo restores the named snapshot, unlike RestoreSnapshot it first
+// checks the snapshot exists and returns a SnapshotNotFoundError otherwise
+func RevertTo(ctx context.Context, vp VirtualizationProvider, vmName, snapshotName string) error {
+	snapshots, err := vp.ListSnapshots(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snapshots {
+		if snap.Name == snapshotName {
+			return vp.RestoreSnapshot(ctx, vmName, snapshotName)
+		}
+	}
+	return &SnapshotNotFoundError{VmName: vmName, SnapshotName: snapshotName}
+}
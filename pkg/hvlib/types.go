@@ -1,7 +1,9 @@
 package hvlib
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -15,6 +17,15 @@ type Snapshot struct {
 	ID           string
 	Name         string
 	CreationTime time.Time
+	ParentID     string // Empty for a root snapshot
+	Description  string
+	IsCurrent    bool // The running state of the VM derives from this snapshot
+}
+
+// SnapshotNode is a snapshot with its children, see BuildSnapshotTree
+type SnapshotNode struct {
+	Snapshot
+	Children []*SnapshotNode
 }
 
 type VM struct {
@@ -22,6 +33,18 @@ type VM struct {
 	Path string
 }
 
+// GuestCredentials is the account used to log into a VM for guest operations
+type GuestCredentials struct {
+	Username string
+	Password string
+}
+
+type GuestProcess struct {
+	PID     int
+	Owner   string
+	Command string
+}
+
 type VmNotFoundError struct {
 	VmName string
 }
@@ -30,6 +53,33 @@ func (e *VmNotFoundError) Error() string {
 	return fmt.Sprintf("vm %s not found", e.VmName)
 }
 
+type SnapshotNotFoundError struct {
+	VmName       string
+	SnapshotName string
+}
+
+func (e *SnapshotNotFoundError) Error() string {
+	return fmt.Sprintf("snapshot %s not found for VM %s", e.SnapshotName, e.VmName)
+}
+
+type SnapshotExistsError struct {
+	VmName       string
+	SnapshotName string
+}
+
+func (e *SnapshotExistsError) Error() string {
+	return fmt.Sprintf("snapshot %s already exists for VM %s", e.SnapshotName, e.VmName)
+}
+
+type InvalidNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("invalid name %q: %s", e.Name, e.Reason)
+}
+
 type VirtualizationError struct {
 	Operation string
 	VMName    string
@@ -40,30 +90,197 @@ func (e *VirtualizationError) Error() string {
 	return fmt.Sprintf("%s failed for VM %s: %v", e.Operation, e.VMName, e.Err)
 }
 
+func (e *VirtualizationError) Unwrap() error {
+	return e.Err
+}
+
+// Operation names of VirtualizationProvider and of the optional interfaces,
+// used as configuration keys for per-operation settings (timeouts, fake
+// latencies...)
+const (
+	OpList            = "list"
+	OpListSnapshots   = "list_snapshots"
+	OpTakeSnapshot    = "take_snapshot"
+	OpRestoreSnapshot = "restore_snapshot"
+	OpDeleteSnapshot  = "delete_snapshot"
+	OpStart           = "start"
+	OpStop            = "stop"
+	OpSuspend         = "suspend"
+	OpReset           = "reset"
+	OpRevert          = "revert"
+
+	OpCopyToGuest        = "copy_to_guest"
+	OpCopyFromGuest      = "copy_from_guest"
+	OpRunInGuest         = "run_in_guest"
+	OpListGuestProcesses = "list_guest_processes"
+	OpCaptureScreen      = "capture_screen"
+	OpDumpMemory         = "dump_memory"
+	OpStartCapture       = "start_capture"
+	OpStopCapture        = "stop_capture"
+	OpSetNetworkProfile  = "set_network_profile"
+	OpClone              = "clone"
+	OpDeleteVM           = "delete_vm"
+	OpGuestReady         = "guest_ready"
+	OpWait               = "wait"     // WaitForState and WaitForGuest
+	OpLoadVMs            = "load_vms" // LoadVMs and RefreshVMs
+	OpVersion            = "version"
+)
+
 type HypervVP struct {
 	VP
+	Capture   HypervCaptureConfig
+	ClonePath string // Directory of the clones, the Hyper-V default VM path when empty
+}
+
+// HypervCaptureConfig is the [hyperv.capture] section, the traffic of the
+// captured VMs is mirrored to a capture VM running dumpcap
+type HypervCaptureConfig struct {
+	VM        string // Name of the capture VM
+	Interface string // Interface of the capture VM receiving the mirrored traffic
+	Dumpcap   string // Path of dumpcap.exe in the capture VM
 }
 
 type VP struct {
-	VMs map[string]VM
+	VMs              map[string]VM               // Guarded by vmsMu once loaded, see lookupVM
+	Runner           CommandRunner               // Defaults to ExecRunner when nil
+	GuestCredentials map[string]GuestCredentials // By VM name, see loadGuestCredentials
+	NetworkProfiles  map[string]NetworkProfile   // By profile name, see loadNetworkProfiles
+
+	vmsMu        sync.RWMutex
+	vmsGen       uint64            // Incremented on every change of VMs
+	vmsLoadedGen uint64            // vmsGen of the last setVMs
+	vmsChanged   map[string]uint64 // vmsGen of the VMs added or removed during the refreshes in progress
+	refreshing   int               // Refreshes in progress
+	captures     captureSet
 }
 
 type VmwareVP struct {
 	VP
 	InstallPath string
 	VMPath      string
+	Adapter     string // vmx device captured and configured by the network profiles, ethernet0 by default
+	ClonePath   string // Directory of the clones, VMPath by default
+}
+
+type LibvirtVP struct {
+	VP
+	VirshPath     string
+	URI           string
+	TcpdumpPath   string
+	QemuImgPath   string
+	VirtClonePath string
+	ClonePath     string // Directory of the clone disks and of the golden images
+
+	cloneMu sync.Mutex // Serializes the creation of the golden images
+}
+
+type VirtualBoxVP struct {
+	VP
+	InstallPath string
 }
 
+// FakeVP is an in-memory provider used for tests and demos
+type FakeVP struct {
+	VP
+	Latencies    map[string]time.Duration // Simulated duration per operation
+	FailureRates map[string]float64       // Probability of failure per operation
+
+	mu       sync.Mutex
+	vms      map[string]*fakeVM
+	injected map[string]error
+}
+
+// VirtualizationProvider is implemented by every hypervisor backend.
+// Operations are aborted, and the underlying tool killed, when ctx ends.
 type VirtualizationProvider interface {
-	LoadVMs(loader *ConfigLoader) error
-	List() ([]VMStatus, error)
-	ListSnapshots(vmName string) ([]Snapshot, error)
-	TakeSnapshot(vmName, snapshotName string) error
-	RestoreSnapshot(vmName, snapshotName string) error
-	DeleteSnapshot(vmName, snapshotName string) error
-	Start(vmName string) error
-	Stop(vmName string, force bool) error
-	Suspend(vmName string) error
-	Reset(vmName string) error
-	Revert(vmName string) error
+	LoadVMs(ctx context.Context, loader *ConfigLoader) error
+	List(ctx context.Context) ([]VMStatus, error)
+	ListSnapshots(ctx context.Context, vmName string) ([]Snapshot, error)
+	TakeSnapshot(ctx context.Context, vmName, snapshotName string) error
+	RestoreSnapshot(ctx context.Context, vmName, snapshotName string) error
+	DeleteSnapshot(ctx context.Context, vmName, snapshotName string) error
+	Start(ctx context.Context, vmName string) error
+	Stop(ctx context.Context, vmName string, force bool) error
+	Suspend(ctx context.Context, vmName string) error
+	Reset(ctx context.Context, vmName string) error
+	Revert(ctx context.Context, vmName string) error
+	// Capabilities lists the Cap* supported by the provider, with its
+	// configuration
+	Capabilities() []string
+	// Version returns the version of the hypervisor
+	Version(ctx context.Context) (string, error)
+}
+
+// GuestOperations is implemented by the providers able to act inside a
+// running VM without the help of the in-guest agent. Paths inside the
+// guest use the guest OS conventions.
+type GuestOperations interface {
+	CopyFileToGuest(ctx context.Context, vmName, hostPath, guestPath string) error
+	CopyFileFromGuest(ctx context.Context, vmName, guestPath, hostPath string) error
+	// RunProgramInGuest returns the exit code of the program when wait is
+	// true, otherwise it returns as soon as the program is started
+	RunProgramInGuest(ctx context.Context, vmName, program string, args []string, wait bool) (int, error)
+	ListProcessesInGuest(ctx context.Context, vmName string) ([]GuestProcess, error)
+}
+
+// ScreenCapturer is implemented by the providers able to capture the
+// display of a running VM
+type ScreenCapturer interface {
+	// CaptureScreen returns the current display as a PNG image
+	CaptureScreen(ctx context.Context, vmName string) ([]byte, error)
+}
+
+// MemoryDumper is implemented by the providers able to produce an image
+// of the memory of a VM for offline analysis (Volatility...)
+type MemoryDumper interface {
+	// DumpMemory writes the memory image into dir, an existing directory,
+	// and returns the paths of the files written. Depending on the provider
+	// the VM may be left suspended.
+	DumpMemory(ctx context.Context, vmName, dir string) ([]string, error)
+}
+
+// PacketCapturer is implemented by the providers able to record the
+// network traffic of a VM into a pcap file on the host
+type PacketCapturer interface {
+	// StartCapture starts recording the traffic of the VM into hostPath.
+	// It should be called before the VM is started, VMware only applies
+	// the capture setting at power on.
+	StartCapture(ctx context.Context, vmName, hostPath string) error
+	// StopCapture ends the recording and returns the path of the pcap file
+	StopCapture(ctx context.Context, vmName string) (string, error)
+}
+
+// NetworkConfigurator is implemented by the providers able to attach a VM
+// to the networks of the configured NetworkProfile
+type NetworkConfigurator interface {
+	ListNetworkProfiles() []string
+	// SetNetworkProfile attaches the VM to the network of the profile, it
+	// is called before the VM is started
+	SetNetworkProfile(ctx context.Context, vmName, profile string) error
+}
+
+// Cloner is implemented by the providers able to create linked clones,
+// VMs sharing the disk of a snapshot of their source and only storing
+// their own changes. Clones are cold: their memory state isn't cloned.
+type Cloner interface {
+	// CloneVM creates and registers cloneName from the snapshot of vmName
+	CloneVM(ctx context.Context, vmName, snapshotName, cloneName string) error
+	// DeleteVM unregisters a powered off VM and deletes its files
+	DeleteVM(ctx context.Context, vmName string) error
+}
+
+// GuestReadinessChecker is implemented by the providers able to tell when
+// the guest OS has booted, through the integration tools of the hypervisor
+type GuestReadinessChecker interface {
+	// GuestReady reports whether the guest tools of the VM respond, it
+	// returns false without error while the VM is booting or stopped
+	GuestReady(ctx context.Context, vmName string) (bool, error)
+}
+
+// InventoryRefresher is implemented by the providers able to discover the
+// VMs registered since LoadVMs, without reloading their configuration
+type InventoryRefresher interface {
+	// RefreshVMs replaces the known VMs by the ones currently registered
+	// in the hypervisor, it is safe to call while operations run
+	RefreshVMs(ctx context.Context) error
 }
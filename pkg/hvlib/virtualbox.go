@@ -0,0 +1,374 @@
+package hvlib
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vboxListLine matches a row of `VBoxManage list vms`: "win10" {0d3c...}
+var vboxListLine = regexp.MustCompile(`^"(.*)" \{([0-9a-fA-F-]+)\}$`)
+
+func (v *VirtualBoxVP) LoadVMs(ctx context.Context, loader *ConfigLoader) error {
+	v.InstallPath = loader.GetString("virtualbox.install_path")
+	vms, err := v.discoverVMs(ctx)
+	if err != nil {
+		return err
+	}
+	v.setVMs(vms)
+	return nil
+}
+
+// RefreshVMs lists the VMs registered in VirtualBox again
+func (v *VirtualBoxVP) RefreshVMs(ctx context.Context) error {
+	return v.refreshVMs(ctx, v.discoverVMs)
+}
+
+func (v *VirtualBoxVP) discoverVMs(ctx context.Context) (map[string]VM, error) {
+	vms := make(map[string]VM)
+
+	output, err := v.ExecVBoxManage(ctx, "list", "vms")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %s (%w)", output, err)
+	}
+
+	for name, id := range parseVBoxList(output) {
+		vms[name] = VM{
+			ID: id,
+		}
+	}
+	return vms, nil
+}
+
+func (v *VirtualBoxVP) Capabilities() []string {
+	return providerCapabilities(v, []string{CapSnapshots, CapSnapshotCreationTime, CapSuspend, CapReset})
+}
+
+// Version returns the VirtualBox version, like 7.0.10r158379
+func (v *VirtualBoxVP) Version(ctx context.Context) (string, error) {
+	output, err := v.ExecVBoxManage(ctx, "--version")
+	if err != nil {
+		return "", fmt.Errorf("failed to get version: %s (%w)", output, err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (v *VirtualBoxVP) List(ctx context.Context) ([]VMStatus, error) {
+	// Map VMState values to the states used by the other providers. `list
+	// runningvms` can't be used, it also lists the paused and stuck VMs.
+	stateMap := map[string]string{
+		"running":  "running",
+		"poweroff": "stopped",
+		"aborted":  "stopped",
+		"saved":    "saved",
+		"paused":   "suspended",
+	}
+
+	var vms []VMStatus
+	for vmName, vm := range v.inventory() {
+		info, err := v.showVMInfo(ctx, vm.ID)
+		if err != nil {
+			return nil, err
+		}
+		state, ok := stateMap[info["VMState"]]
+		if !ok {
+			state = info["VMState"]
+		}
+
+		vms = append(vms, VMStatus{
+			ID:    vm.ID,
+			Name:  vmName,
+			State: state,
+		})
+	}
+	return vms, nil
+}
+
+func (v *VirtualBoxVP) ListSnapshots(ctx context.Context, vmName string) ([]Snapshot, error) {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+
+	output, err := v.ExecVBoxManage(ctx, "snapshot", vm.ID, "list", "--machinereadable")
+	if err != nil {
+		// VBoxManage exits with an error when the VM has no snapshot
+		if strings.Contains(output, "does not have any snapshots") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s (%w)", output, err)
+	}
+
+	// The machine readable output has no timestamps, they are
+	// only stored in the .vbox settings file of the VM
+	info, err := v.showVMInfo(ctx, vm.ID)
+	if err != nil {
+		return nil, err
+	}
+	creationTimes, err := readVBoxSnapshotTimes(info["CfgFile"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .vbox file for VM %s: %v", vmName, err)
+	}
+
+	// Snapshots are listed depth first as SnapshotName, SnapshotName-1,
+	// SnapshotName-1-1... the suffix is the path of the snapshot in the tree
+	var snapshots []Snapshot
+	bySuffix := make(map[string]int)
+	var currentUUID string
+	for _, kv := range parseMachineReadable(output) {
+		key, value := kv[0], kv[1]
+		switch {
+		case key == "CurrentSnapshotUUID":
+			currentUUID = value
+		case strings.HasPrefix(key, "SnapshotName"):
+			bySuffix[strings.TrimPrefix(key, "SnapshotName")] = len(snapshots)
+			snapshots = append(snapshots, Snapshot{Name: value})
+		case strings.HasPrefix(key, "SnapshotUUID"):
+			if i, ok := bySuffix[strings.TrimPrefix(key, "SnapshotUUID")]; ok {
+				snapshots[i].ID = value
+				snapshots[i].CreationTime = creationTimes[value]
+			}
+		case strings.HasPrefix(key, "SnapshotDescription"):
+			if i, ok := bySuffix[strings.TrimPrefix(key, "SnapshotDescription")]; ok {
+				snapshots[i].Description = value
+			}
+		}
+	}
+
+	for suffix, i := range bySuffix {
+		if suffix != "" {
+			parentSuffix := suffix[:strings.LastIndex(suffix, "-")]
+			snapshots[i].ParentID = snapshots[bySuffix[parentSuffix]].ID
+		}
+		snapshots[i].IsCurrent = snapshots[i].ID == currentUUID
+	}
+	return snapshots, nil
+}
+
+func (v *VirtualBoxVP) Start(ctx context.Context, vmName string) error {
+	return v.execVmCommand(ctx, vmName, "startvm", "", "--type", "headless")
+}
+
+func (v *VirtualBoxVP) Stop(ctx context.Context, vmName string, force bool) error {
+	stopCmd := map[bool]string{true: "poweroff", false: "acpipowerbutton"}[force]
+	return v.execVmCommand(ctx, vmName, "controlvm", stopCmd)
+}
+
+func (v *VirtualBoxVP) Suspend(ctx context.Context, vmName string) error {
+	return v.execVmCommand(ctx, vmName, "controlvm", "pause")
+}
+
+func (v *VirtualBoxVP) Reset(ctx context.Context, vmName string) error {
+	return v.execVmCommand(ctx, vmName, "controlvm", "reset")
+}
+
+func (v *VirtualBoxVP) TakeSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return v.execVmCommand(ctx, vmName, "snapshot", "take", snapshotName)
+}
+
+func (v *VirtualBoxVP) RestoreSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return v.execVmCommand(ctx, vmName, "snapshot", "restore", snapshotName)
+}
+
+func (v *VirtualBoxVP) DeleteSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return v.execVmCommand(ctx, vmName, "snapshot", "delete", snapshotName)
+}
+
+func (v *VirtualBoxVP) Revert(ctx context.Context, vmName string) error {
+	current, err := currentSnapshotForRevert(ctx, v, vmName)
+	if err != nil {
+		return err
+	}
+	return v.execVmCommand(ctx, vmName, "snapshot", "restore", current.ID)
+}
+
+func (v *VirtualBoxVP) CaptureScreen(ctx context.Context, vmName string) ([]byte, error) {
+	return captureToFile(func(hostPath string) error {
+		return v.execVmCommand(ctx, vmName, "controlvm", "screenshotpng", hostPath)
+	})
+}
+
+// GuestReady checks the run level of the Guest Additions, 2 once their
+// userland services are started and 3 once a user is logged in
+func (v *VirtualBoxVP) GuestReady(ctx context.Context, vmName string) (bool, error) {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return false, &VmNotFoundError{VmName: vmName}
+	}
+
+	info, err := v.showVMInfo(ctx, vm.ID)
+	if err != nil {
+		return false, &VirtualizationError{Operation: OpGuestReady, VMName: vmName, Err: err}
+	}
+	level, err := strconv.Atoi(info["GuestAdditionsRunLevel"])
+	return err == nil && level >= 2, nil
+}
+
+// DumpMemory writes an ELF core of the running VM with the VM debugger
+func (v *VirtualBoxVP) DumpMemory(ctx context.Context, vmName, dir string) ([]string, error) {
+	path := filepath.Join(dir, vmName+".elf")
+	err := v.execVmCommand(ctx, vmName, "debugvm", "dumpvmcore", "--filename", path)
+	if err != nil {
+		return nil, err
+	}
+	return []string{path}, nil
+}
+
+// CloneVM creates a linked clone of the snapshot, in the default machine
+// folder of VirtualBox
+func (v *VirtualBoxVP) CloneVM(ctx context.Context, vmName, snapshotName, cloneName string) error {
+	if err := validateCloneName(cloneName); err != nil {
+		return err
+	}
+	if _, exists := v.lookupVM(cloneName); exists {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: fmt.Errorf("VM %s already exists", cloneName)}
+	}
+
+	err := v.execVmCommand(ctx, vmName, "clonevm", "",
+		"--snapshot", snapshotName, "--options", "link", "--name", cloneName, "--register")
+	if err != nil {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: err}
+	}
+	info, err := v.showVMInfo(ctx, cloneName)
+	if err != nil {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: err}
+	}
+	v.addVM(cloneName, VM{ID: info["UUID"]})
+	return nil
+}
+
+// DeleteVM unregisters the VM and deletes its disks and settings
+func (v *VirtualBoxVP) DeleteVM(ctx context.Context, vmName string) error {
+	if err := v.execVmCommand(ctx, vmName, "unregistervm", "", "--delete"); err != nil {
+		return &VirtualizationError{Operation: OpDeleteVM, VMName: vmName, Err: err}
+	}
+	v.removeVM(vmName)
+	return nil
+}
+
+// execVmCommand is a helper function for executing VBoxManage commands,
+// the VM is identified by its UUID and placed right after the command
+func (v *VirtualBoxVP) execVmCommand(ctx context.Context, vmName, command, subCommand string, extraArgs ...string) error {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+
+	args := []string{command, vm.ID}
+	if subCommand != "" {
+		args = append(args, subCommand)
+	}
+	output, err := v.ExecVBoxManage(ctx, append(args, extraArgs...)...)
+	if err != nil {
+		return fmt.Errorf("%s (%w)", output, err)
+	}
+	return nil
+}
+
+// showVMInfo returns the machine readable VM information as a map
+func (v *VirtualBoxVP) showVMInfo(ctx context.Context, vmID string) (map[string]string, error) {
+	output, err := v.ExecVBoxManage(ctx, "showvminfo", vmID, "--machinereadable")
+	if err != nil {
+		return nil, fmt.Errorf("%s (%w)", output, err)
+	}
+
+	info := make(map[string]string)
+	for _, kv := range parseMachineReadable(output) {
+		info[kv[0]] = kv[1]
+	}
+	return info, nil
+}
+
+func (v *VirtualBoxVP) ExecVBoxManage(ctx context.Context, args ...string) (string, error) {
+	vboxManagePath := "VBoxManage"
+	if v.InstallPath != "" {
+		vboxManagePath = filepath.Join(v.InstallPath, "VBoxManage")
+	}
+	stdout, stderr, err := v.runner().Run(ctx, vboxManagePath, append([]string{"--nologo"}, args...)...)
+
+	if err != nil {
+		if exiterr, ok := err.(*CommandExitError); ok {
+			// VBoxManage reports its errors on stderr
+			return strings.TrimSpace(stderr), exiterr
+		} else {
+			return "", fmt.Errorf("cmd.Wait %w", err)
+		}
+	}
+
+	return strings.TrimSpace(stdout), nil
+}
+
+// parseVBoxList parses the output of `VBoxManage list vms`
+// into a map of VM name to UUID
+func parseVBoxList(output string) map[string]string {
+	vms := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		matches := vboxListLine.FindStringSubmatch(strings.TrimSpace(line))
+		if len(matches) < 3 {
+			continue
+		}
+		vms[matches[1]] = matches[2]
+	}
+	return vms
+}
+
+// parseMachineReadable parses key="value" lines of --machinereadable
+// output, keeping the order of the lines
+func parseMachineReadable(output string) [][2]string {
+	var kvs [][2]string
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.Trim(parts[0], "\"")
+		value := strings.Trim(parts[1], "\"")
+		kvs = append(kvs, [2]string{key, value})
+	}
+	return kvs
+}
+
+type vboxSnapshotNode struct {
+	UUID      string             `xml:"uuid,attr"`
+	TimeStamp string             `xml:"timeStamp,attr"`
+	Children  []vboxSnapshotNode `xml:"Snapshots>Snapshot"`
+}
+
+// readVBoxSnapshotTimes reads the snapshot tree of a .vbox settings file
+// and returns the creation time of every snapshot by UUID
+func readVBoxSnapshotTimes(cfgFile string) (map[string]time.Time, error) {
+	content, err := os.ReadFile(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings struct {
+		Snapshot *vboxSnapshotNode `xml:"Machine>Snapshot"`
+	}
+	if err := xml.Unmarshal(content, &settings); err != nil {
+		return nil, err
+	}
+
+	times := make(map[string]time.Time)
+	var walk func(node vboxSnapshotNode)
+	walk = func(node vboxSnapshotNode) {
+		creationTime, err := time.Parse(time.RFC3339, node.TimeStamp)
+		if err == nil {
+			// UUIDs are stored as {uuid} in the settings file
+			times[strings.Trim(node.UUID, "{}")] = creationTime
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	if settings.Snapshot != nil {
+		walk(*settings.Snapshot)
+	}
+	return times, nil
+}
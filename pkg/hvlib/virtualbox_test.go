@@ -0,0 +1,160 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newReplayVirtualBoxVP(t *testing.T) *VirtualBoxVP {
+	t.Helper()
+	runner, err := NewReplayRunner("testdata/virtualbox.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp := &VirtualBoxVP{VP: VP{Runner: runner}}
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := vp.LoadVMs(context.Background(), loader); err != nil {
+		t.Fatal(err)
+	}
+	return vp
+}
+
+func TestVirtualBoxList(t *testing.T) {
+	vp := newReplayVirtualBoxVP(t)
+
+	vms, err := vp.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"win10": "running",
+		"win7":  "suspended", // Paused VMs are listed by `list runningvms` too
+		"xp":    "stopped",
+		"win11": "saved",
+		"srv":   "gurumeditation", // Unknown states are kept as is
+	}
+	if len(vms) != len(expected) {
+		t.Fatalf("got %d VMs, expected %d", len(vms), len(expected))
+	}
+	for _, vm := range vms {
+		if vm.State != expected[vm.Name] {
+			t.Errorf("VM %s: got state %q, expected %q", vm.Name, vm.State, expected[vm.Name])
+		}
+	}
+}
+
+func TestVirtualBoxListSnapshots(t *testing.T) {
+	ctx := context.Background()
+	vp := newReplayVirtualBoxVP(t)
+
+	snapshots, err := vp.ListSnapshots(ctx, "win10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Snapshot{
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c01", Name: "clean", Description: "Fresh install",
+			CreationTime: time.Date(2024, 11, 20, 9, 12, 45, 0, time.UTC)},
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c02", Name: "office", IsCurrent: true,
+			CreationTime: time.Date(2024, 11, 21, 8, 30, 0, 0, time.UTC), ParentID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c01"},
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c03", Name: "office updated",
+			CreationTime: time.Date(2024, 11, 22, 23, 5, 10, 0, time.UTC), ParentID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c02"},
+		// The timestamp of the settings file is invalid
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c04", Name: "tools", ParentID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c01"},
+	}
+	if len(snapshots) != len(expected) {
+		t.Fatalf("got %d snapshots, expected %d: %+v", len(snapshots), len(expected), snapshots)
+	}
+	for i, s := range snapshots {
+		e := expected[i]
+		if s.ID != e.ID || s.Name != e.Name || s.Description != e.Description || s.ParentID != e.ParentID ||
+			s.IsCurrent != e.IsCurrent || !s.CreationTime.Equal(e.CreationTime) {
+			t.Errorf("got snapshot %+v, expected %+v", s, e)
+		}
+	}
+
+	snapshots, err = vp.ListSnapshots(ctx, "xp")
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("got %v and error %v, expected no snapshots", snapshots, err)
+	}
+
+	if _, err := vp.ListSnapshots(ctx, "unknown"); !errors.As(err, new(*VmNotFoundError)) {
+		t.Errorf("expected VmNotFoundError, got %v", err)
+	}
+}
+
+func TestParseVBoxList(t *testing.T) {
+	output := "\"win10\" {3b5e2f1a-7c4d-4e8f-9a1b-2c3d4e5f6a01}\r\n" +
+		"\"my \"quoted\" vm\" {3B5E2F1A-7C4D-4E8F-9A1B-2C3D4E5F6A02}\n" +
+		"\"<inaccessible>\" {not-a-uuid}\n" +
+		"\n"
+
+	vms := parseVBoxList(output)
+	expected := map[string]string{
+		"win10":          "3b5e2f1a-7c4d-4e8f-9a1b-2c3d4e5f6a01",
+		`my "quoted" vm`: "3B5E2F1A-7C4D-4E8F-9A1B-2C3D4E5F6A02",
+	}
+	if len(vms) != len(expected) {
+		t.Fatalf("got %v, expected %v", vms, expected)
+	}
+	for name, id := range expected {
+		if vms[name] != id {
+			t.Errorf("VM %s: got UUID %q, expected %q", name, vms[name], id)
+		}
+	}
+}
+
+func TestParseMachineReadable(t *testing.T) {
+	output := "name=\"win10\"\r\n" +
+		"memory=4096\n" +
+		"\"Forwarding(0)\"=\"rdp,tcp,,3389,,3389\"\n" +
+		"description=\"a=b\"\n" +
+		"no separator\n" +
+		"\n"
+
+	expected := [][2]string{
+		{"name", "win10"},
+		{"memory", "4096"},
+		{"Forwarding(0)", "rdp,tcp,,3389,,3389"},
+		{"description", "a=b"},
+	}
+	kvs := parseMachineReadable(output)
+	if len(kvs) != len(expected) {
+		t.Fatalf("got %v, expected %v", kvs, expected)
+	}
+	for i := range expected {
+		if kvs[i] != expected[i] {
+			t.Errorf("line %d: got %q, expected %q", i, kvs[i], expected[i])
+		}
+	}
+}
+
+func TestReadVBoxSnapshotTimes(t *testing.T) {
+	times, err := readVBoxSnapshotTimes("testdata/vbox/win10.vbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Time{
+		"9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c01": time.Date(2024, 11, 20, 9, 12, 45, 0, time.UTC),
+		"9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c02": time.Date(2024, 11, 21, 8, 30, 0, 0, time.UTC),
+		"9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c03": time.Date(2024, 11, 22, 23, 5, 10, 0, time.UTC),
+	}
+	if len(times) != len(expected) {
+		t.Fatalf("got %v, expected %v", times, expected)
+	}
+	for uuid, creationTime := range expected {
+		if !times[uuid].Equal(creationTime) {
+			t.Errorf("snapshot %s: got %v, expected %v", uuid, times[uuid], creationTime)
+		}
+	}
+
+	if _, err := readVBoxSnapshotTimes("testdata/vbox/missing.vbox"); err == nil {
+		t.Error("expected an error for a missing settings file")
+	}
+}
@@ -1 +1,107 @@
 package hvlib
+
+import "context"
+
+// The VMs of a provider change while it serves requests (clones are added
+// and deleted), VP.VMs is only accessed through these helpers once loaded.
+
+// lookupVM returns the VM registered under vmName
+func (vp *VP) lookupVM(vmName string) (VM, bool) {
+	vp.vmsMu.RLock()
+	defer vp.vmsMu.RUnlock()
+	vm, exists := vp.VMs[vmName]
+	return vm, exists
+}
+
+// inventory returns a copy of the VMs, safe to iterate
+func (vp *VP) inventory() map[string]VM {
+	vp.vmsMu.RLock()
+	defer vp.vmsMu.RUnlock()
+	vms := make(map[string]VM, len(vp.VMs))
+	for name, vm := range vp.VMs {
+		vms[name] = vm
+	}
+	return vms
+}
+
+// setVMs replaces all the VMs, as loaded by LoadVMs
+func (vp *VP) setVMs(vms map[string]VM) {
+	vp.vmsMu.Lock()
+	defer vp.vmsMu.Unlock()
+	vp.VMs = vms
+	vp.vmsGen++
+	vp.vmsLoadedGen = vp.vmsGen
+}
+
+// refreshVMs replaces the VMs by the ones found by discover. The operations
+// in progress keep the VM they looked up. The VMs added or removed while
+// discover runs (clones...) may be missed by discover, they are kept as
+// they are now.
+func (vp *VP) refreshVMs(ctx context.Context, discover func(ctx context.Context) (map[string]VM, error)) error {
+	vp.vmsMu.Lock()
+	gen := vp.vmsGen
+	vp.refreshing++
+	vp.vmsMu.Unlock()
+
+	vms, err := discover(ctx)
+
+	vp.vmsMu.Lock()
+	defer vp.vmsMu.Unlock()
+	vp.refreshing--
+	defer func() {
+		if vp.refreshing == 0 {
+			vp.vmsChanged = nil
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if vp.vmsLoadedGen > gen {
+		// LoadVMs replaced the VMs meanwhile, they are as recent
+		return nil
+	}
+
+	for name, changedGen := range vp.vmsChanged {
+		if changedGen <= gen {
+			continue
+		}
+		if vm, exists := vp.VMs[name]; exists {
+			vms[name] = vm
+		} else {
+			delete(vms, name)
+		}
+	}
+	vp.VMs = vms
+	vp.vmsGen++
+	return nil
+}
+
+func (vp *VP) addVM(vmName string, vm VM) {
+	vp.vmsMu.Lock()
+	defer vp.vmsMu.Unlock()
+	if vp.VMs == nil {
+		vp.VMs = make(map[string]VM)
+	}
+	vp.VMs[vmName] = vm
+	vp.vmChanged(vmName)
+}
+
+func (vp *VP) removeVM(vmName string) {
+	vp.vmsMu.Lock()
+	defer vp.vmsMu.Unlock()
+	delete(vp.VMs, vmName)
+	vp.vmChanged(vmName)
+}
+
+// vmChanged records the change of a VM for the refreshes in progress,
+// vmsMu must be held
+func (vp *VP) vmChanged(vmName string) {
+	vp.vmsGen++
+	if vp.refreshing == 0 {
+		return
+	}
+	if vp.vmsChanged == nil {
+		vp.vmsChanged = make(map[string]uint64)
+	}
+	vp.vmsChanged[vmName] = vp.vmsGen
+}
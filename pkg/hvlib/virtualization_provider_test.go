@@ -0,0 +1,78 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRefreshVMs(t *testing.T) {
+	ctx := context.Background()
+	vp := &VP{}
+	vp.setVMs(map[string]VM{"win10": {ID: "1"}, "win10-old": {ID: "2"}, "win10-gone": {ID: "3"}})
+
+	// The clones are created and deleted while the hypervisor is listed,
+	// the listing sees win10-gone but not win10-new
+	err := vp.refreshVMs(ctx, func(ctx context.Context) (map[string]VM, error) {
+		vp.addVM("win10-new", VM{ID: "4"})
+		vp.removeVM("win10-gone")
+		return map[string]VM{"win10": {ID: "1"}, "win10-gone": {ID: "3"}, "win11": {ID: "5"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"win10", "win10-new", "win11"} {
+		if _, exists := vp.lookupVM(name); !exists {
+			t.Errorf("VM %s missing", name)
+		}
+	}
+	for _, name := range []string{"win10-old", "win10-gone"} {
+		if _, exists := vp.lookupVM(name); exists {
+			t.Errorf("VM %s still registered", name)
+		}
+	}
+	if vp.vmsChanged != nil {
+		t.Errorf("changes still tracked without refresh in progress: %v", vp.vmsChanged)
+	}
+
+	// Changes made before the refresh are not tracked
+	vp.addVM("win10-1", VM{ID: "6"})
+	if vp.vmsChanged != nil {
+		t.Errorf("change tracked without refresh in progress: %v", vp.vmsChanged)
+	}
+}
+
+func TestRefreshVMsFailure(t *testing.T) {
+	vp := &VP{}
+	vp.setVMs(map[string]VM{"win10": {ID: "1"}})
+
+	failure := errors.New("hypervisor unreachable")
+	err := vp.refreshVMs(context.Background(), func(ctx context.Context) (map[string]VM, error) {
+		vp.addVM("win10-1", VM{ID: "2"})
+		return nil, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("got %v, expected the discover error", err)
+	}
+	if len(vp.inventory()) != 2 {
+		t.Errorf("got VMs %v, expected them unchanged", vp.inventory())
+	}
+}
+
+func TestRefreshVMsDuringLoad(t *testing.T) {
+	vp := &VP{}
+	vp.setVMs(map[string]VM{"win10": {ID: "1"}})
+
+	// LoadVMs replaced the VMs while they were listed
+	err := vp.refreshVMs(context.Background(), func(ctx context.Context) (map[string]VM, error) {
+		vp.setVMs(map[string]VM{"win11": {ID: "2"}})
+		return map[string]VM{"win10": {ID: "1"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := vp.lookupVM("win11"); !exists {
+		t.Errorf("got VMs %v, expected the loaded ones", vp.inventory())
+	}
+}
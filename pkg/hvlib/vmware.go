@@ -1,44 +1,99 @@
 package hvlib
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func (v *VmwareVP) LoadVMs(loader *ConfigLoader) error {
+func (v *VmwareVP) LoadVMs(ctx context.Context, loader *ConfigLoader) error {
 	v.InstallPath = loader.GetString("vmware.install_path")
 	v.VMPath = loader.GetString("vmware.vm_path")
-	v.VP.VMs = make(map[string]VM)
+	v.Adapter = loader.GetString("vmware.adapter")
+	if v.Adapter == "" {
+		v.Adapter = "ethernet0"
+	}
+	v.ClonePath = loader.GetString("vmware.clone_path")
+	if v.ClonePath == "" {
+		v.ClonePath = v.VMPath
+	}
+	vms, err := v.discoverVMs(ctx)
+	if err != nil {
+		return err
+	}
+	v.setVMs(vms)
 
-	// Scan VMPath for .vmx files
-	err := filepath.Walk(v.VMPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		// If it's a .vmx file, add it to the VMs map
-		if !info.IsDir() && strings.HasSuffix(info.Name(), ".vmx") {
-			vmName := strings.TrimSuffix(info.Name(), ".vmx")
-			v.VP.VMs[vmName] = VM{
-				Path: path,
-				// ID is optional or can be generated
+	if err := v.loadNetworkProfiles(loader, "vmware"); err != nil {
+		return err
+	}
+	return v.loadGuestCredentials(loader, "vmware")
+}
+
+// RefreshVMs scans the VM directories again for .vmx files
+func (v *VmwareVP) RefreshVMs(ctx context.Context) error {
+	return v.refreshVMs(ctx, v.discoverVMs)
+}
+
+// discoverVMs scans VMPath, and ClonePath, for .vmx files
+func (v *VmwareVP) discoverVMs(ctx context.Context) (map[string]VM, error) {
+	vms := make(map[string]VM)
+	dirs := []string{v.VMPath}
+	if v.ClonePath != v.VMPath {
+		// Created by the first clone
+		if _, err := os.Stat(v.ClonePath); err == nil {
+			dirs = append(dirs, v.ClonePath)
+		}
+	}
+
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
 			}
+			// If it's a .vmx file, add it to the VMs map
+			if !info.IsDir() && strings.HasSuffix(info.Name(), ".vmx") {
+				vmName := strings.TrimSuffix(info.Name(), ".vmx")
+				vms[vmName] = VM{
+					Path: path,
+					// ID is optional or can be generated
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan VMs: %v", err)
 		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to scan VMs: %v", err)
 	}
+	return vms, nil
+}
 
-	return nil
+func (v *VmwareVP) Capabilities() []string {
+	return providerCapabilities(v, []string{CapSnapshots, CapSnapshotCreationTime, CapSuspend, CapReset})
 }
 
-func (v *VmwareVP) List() ([]VMStatus, error) {
-	output, err := v.ExecVmrun("list")
+// vmrunBanner matches the first line of the vmrun usage
+var vmrunBanner = regexp.MustCompile(`vmrun version (\S+ build-\d+)`)
+
+// Version reads the banner printed by vmrun without a command, vmrun then
+// fails
+func (v *VmwareVP) Version(ctx context.Context) (string, error) {
+	output, err := v.ExecVmrun(ctx)
+	if match := vmrunBanner.FindStringSubmatch(output); match != nil {
+		return match[1], nil
+	}
+	return "", fmt.Errorf("failed to get version: no version in vmrun output %q (%v)", output, err)
+}
+
+func (v *VmwareVP) List(ctx context.Context) ([]VMStatus, error) {
+	output, err := v.ExecVmrun(ctx, "list")
 	if err != nil {
-		return nil, fmt.Errorf("%s (%v)", output, err)
+		return nil, fmt.Errorf("%s (%w)", output, err)
 	}
 	// Parse the output of vmrun list
 	lines := strings.Split(string(output), "\n")
@@ -52,7 +107,7 @@ func (v *VmwareVP) List() ([]VMStatus, error) {
 
 	// Check registered VMs and determine their states
 	var vms []VMStatus
-	for vmName, vm := range v.VMs {
+	for vmName, vm := range v.inventory() {
 		state := "stopped" // Default state
 		if runningVMs[vm.Path] {
 			state = "running"
@@ -90,20 +145,20 @@ func (v *VmwareVP) List() ([]VMStatus, error) {
 	return vms, nil
 }
 
-func (v *VmwareVP) ListSnapshots(vmName string) ([]Snapshot, error) {
-	return v.listSnapshots(vmName, "listSnapshots")
+func (v *VmwareVP) ListSnapshots(ctx context.Context, vmName string) ([]Snapshot, error) {
+	return v.listSnapshots(ctx, vmName, "listSnapshots")
 }
 
 // listSnapshots is a helper function for listing snapshots (common for VMware)
-func (v *VmwareVP) listSnapshots(vmName, command string) ([]Snapshot, error) {
-	vm, exists := v.VMs[vmName]
+func (v *VmwareVP) listSnapshots(ctx context.Context, vmName, command string) ([]Snapshot, error) {
+	vm, exists := v.lookupVM(vmName)
 	if !exists {
 		return nil, &VmNotFoundError{VmName: vmName}
 	}
 
-	output, err := v.ExecVmrun(command, vm.Path)
+	output, err := v.ExecVmrun(ctx, command, vm.Path, "showTree")
 	if err != nil {
-		return nil, fmt.Errorf("%s (%v)", output, err)
+		return nil, fmt.Errorf("%s (%w)", output, err)
 	}
 
 	lines := strings.Split(output, "\n")
@@ -111,89 +166,511 @@ func (v *VmwareVP) listSnapshots(vmName, command string) ([]Snapshot, error) {
 		return nil, nil // No snapshots
 	}
 
+	// Children are indented with one tab per level, snapshots are
+	// identified by their path ("clean/office") which vmrun accepts
+	// everywhere a snapshot name is expected
 	var snapshots []Snapshot
+	var path []string
 	for _, line := range lines[1:] { // Skip the first line (total count)
+		line = strings.TrimRight(line, "\r")
 		name := strings.TrimSpace(line)
-		if name != "" {
-			snapshots = append(snapshots, Snapshot{Name: name})
+		if name == "" {
+			continue
+		}
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		if depth > len(path) {
+			depth = len(path)
+		}
+		path = append(path[:depth], name)
+		snapshots = append(snapshots, Snapshot{
+			ID:       strings.Join(path, "/"),
+			Name:     name,
+			ParentID: strings.Join(path[:depth], "/"),
+		})
+	}
+
+	// The snapshot metadata are only available in the .vmsd file
+	vmsd, err := readVmsd(strings.TrimSuffix(vm.Path, ".vmx") + ".vmsd")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read .vmsd file for VM %s: %w", vmName, err)
+	}
+	for i := range snapshots {
+		if entry, ok := vmsd[snapshots[i].ID]; ok {
+			snapshots[i].Description = entry.description
+			snapshots[i].CreationTime = entry.creationTime
+			snapshots[i].IsCurrent = entry.isCurrent
 		}
 	}
 	return snapshots, nil
 }
 
-func (v *VmwareVP) Start(vmName string) error {
-	return v.execVmCommand(vmName, "start")
+type vmsdEntry struct {
+	parent       string
+	displayName  string
+	description  string
+	creationTime time.Time
+	isCurrent    bool
+}
+
+// readVmsd parses the snapshot database of a VM and returns the
+// entries by snapshot path
+func readVmsd(vmsdPath string) (map[string]*vmsdEntry, error) {
+	values, err := readVmxValues(vmsdPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are snapshot0, snapshot1... and reference each other by uid
+	byUID := make(map[string]*vmsdEntry)
+	for i := 0; ; i++ {
+		prefix := fmt.Sprintf("snapshot%d.", i)
+		uid, ok := values[prefix+"uid"]
+		if !ok {
+			break
+		}
+		// The creation time is in microseconds split in two 32 bits values
+		high, _ := strconv.ParseInt(values[prefix+"createTimeHigh"], 10, 32)
+		low, _ := strconv.ParseInt(values[prefix+"createTimeLow"], 10, 32)
+		byUID[uid] = &vmsdEntry{
+			parent:       values[prefix+"parent"],
+			displayName:  values[prefix+"displayName"],
+			description:  values[prefix+"description"],
+			creationTime: time.UnixMicro(high<<32 | int64(uint32(low))),
+			isCurrent:    uid == values["snapshot.current"],
+		}
+	}
+
+	entries := make(map[string]*vmsdEntry)
+	for _, entry := range byUID {
+		names := []string{entry.displayName}
+		for parent := byUID[entry.parent]; parent != nil && len(names) <= len(byUID); parent = byUID[parent.parent] {
+			names = append([]string{parent.displayName}, names...)
+		}
+		entries[strings.Join(names, "/")] = entry
+	}
+	return entries, nil
+}
+
+// readVmxValues parses the key = "value" lines of .vmx and .vmsd files
+func readVmxValues(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			values[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), "\"")
+		}
+	}
+	return values, nil
+}
+
+// setVmxValues sets keys in a .vmx file, an empty value removes the key.
+// The file must not be changed while the VM runs, VMware rewrites it.
+func setVmxValues(path string, values map[string]string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\r\n"), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && hasVmxKey(values, strings.TrimSpace(parts[0])) {
+			continue
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\r"))
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if values[key] != "" {
+			lines = append(lines, fmt.Sprintf("%s = \"%s\"", key, values[key]))
+		}
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), info.Mode())
+}
+
+// hasVmxKey looks for key in values, vmx keys are case-insensitive
+func hasVmxKey(values map[string]string, key string) bool {
+	for k := range values {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
 }
 
-func (v *VmwareVP) Stop(vmName string, force bool) error {
+func (v *VmwareVP) Start(ctx context.Context, vmName string) error {
+	return v.execVmCommand(ctx, vmName, "start")
+}
+
+func (v *VmwareVP) Stop(ctx context.Context, vmName string, force bool) error {
 	forceCmd := map[bool]string{true: "hard", false: "soft"}[force]
-	return v.execVmCommand(vmName, "stop", forceCmd)
+	return v.execVmCommand(ctx, vmName, "stop", forceCmd)
 }
 
-func (v *VmwareVP) Suspend(vmName string) error {
-	return v.execVmCommand(vmName, "suspend")
+func (v *VmwareVP) Suspend(ctx context.Context, vmName string) error {
+	return v.execVmCommand(ctx, vmName, "suspend")
 }
 
-func (v *VmwareVP) Reset(vmName string) error {
-	return v.execVmCommand(vmName, "reset")
+func (v *VmwareVP) Reset(ctx context.Context, vmName string) error {
+	return v.execVmCommand(ctx, vmName, "reset")
 }
 
 // execVmCommand is a helper function for executing vmrun commands (common for VMware)
-func (v *VmwareVP) execVmCommand(vmName, command string, extraArgs ...string) error {
-	vm, exists := v.VMs[vmName]
+func (v *VmwareVP) execVmCommand(ctx context.Context, vmName, command string, extraArgs ...string) error {
+	vm, exists := v.lookupVM(vmName)
 	if !exists {
 		return &VmNotFoundError{VmName: vmName}
 	}
 
 	args := append([]string{command, vm.Path}, extraArgs...)
-	output, err := v.ExecVmrun(args...)
+	output, err := v.ExecVmrun(ctx, args...)
 	if err != nil {
-		return fmt.Errorf("%s (%v)", output, err)
+		return fmt.Errorf("%s (%w)", output, err)
 	}
 	return nil
 }
 
-func (v *VmwareVP) ExecVmrun(args ...string) (string, error) {
+func (v *VmwareVP) ExecVmrun(ctx context.Context, args ...string) (string, error) {
 	vmrunPath := filepath.Join(v.InstallPath, "vmrun.exe")
-	cmd := exec.Command(vmrunPath,
+	stdout, _, err := v.runner().Run(ctx, vmrunPath,
 		append([]string{"-T", "ws"}, args...)...)
 
-	stdOutBuf, stdErrBuf := new(strings.Builder), new(strings.Builder)
-	cmd.Stdout = stdOutBuf
-	cmd.Stderr = stdErrBuf
-
-	err := cmd.Run()
-	// strStdout := stdOutBuf.String()
-	strStdout := strings.TrimSuffix(stdOutBuf.String(), "\r\n")
+	strStdout := strings.TrimSuffix(stdout, "\r\n")
 	if err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
+		if exiterr, ok := err.(*CommandExitError); ok {
 			// Error are in stdout not stderr
-			return strStdout, fmt.Errorf("exit status: %08x", exiterr.ExitCode())
+			return strStdout, exiterr
 		} else {
-			return "", fmt.Errorf("cmd.Wait %v", err)
+			return "", fmt.Errorf("cmd.Wait %w", err)
 		}
 	}
 
 	return strStdout, nil
 }
 
-func (v *VmwareVP) TakeSnapshot(vmName, snapshotName string) error {
-	return v.execVmCommand(vmName, "snapshot", snapshotName)
+func (v *VmwareVP) TakeSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return v.execVmCommand(ctx, vmName, "snapshot", snapshotName)
+}
+
+func (v *VmwareVP) DeleteSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return v.execVmCommand(ctx, vmName, "deleteSnapshot", snapshotName)
+}
+
+func (v *VmwareVP) RestoreSnapshot(ctx context.Context, vmName, snapshotName string) error {
+	return v.execVmCommand(ctx, vmName, "revertToSnapshot", snapshotName)
+}
+
+func (v *VmwareVP) Revert(ctx context.Context, vmName string) error {
+	current, err := currentSnapshotForRevert(ctx, v, vmName)
+	if err != nil {
+		return err
+	}
+	return v.execVmCommand(ctx, vmName, "revertToSnapshot", current.ID)
+}
+
+func (v *VmwareVP) CopyFileToGuest(ctx context.Context, vmName, hostPath, guestPath string) error {
+	_, err := v.execGuestCommand(ctx, OpCopyToGuest, vmName, "copyFileFromHostToGuest", hostPath, guestPath)
+	return err
+}
+
+func (v *VmwareVP) CopyFileFromGuest(ctx context.Context, vmName, guestPath, hostPath string) error {
+	_, err := v.execGuestCommand(ctx, OpCopyFromGuest, vmName, "copyFileFromGuestToHost", guestPath, hostPath)
+	return err
+}
+
+var guestExitCodeRegex = regexp.MustCompile(`Guest program exited with non-zero exit code: (-?\d+)`)
+
+func (v *VmwareVP) RunProgramInGuest(ctx context.Context, vmName, program string, args []string, wait bool) (int, error) {
+	var runArgs []string
+	if !wait {
+		runArgs = append(runArgs, "-noWait")
+	}
+	runArgs = append(append(runArgs, program), args...)
+
+	output, err := v.execGuestCommand(ctx, OpRunInGuest, vmName, "runProgramInGuest", runArgs...)
+	if err != nil {
+		// vmrun fails when the program does, that's a result not an error
+		if matches := guestExitCodeRegex.FindStringSubmatch(output); matches != nil {
+			exitCode, _ := strconv.Atoi(matches[1])
+			return exitCode, nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+var guestProcessRegex = regexp.MustCompile(`^pid=(\d+), owner=(.*?), cmd=(.*)$`)
+
+func (v *VmwareVP) ListProcessesInGuest(ctx context.Context, vmName string) ([]GuestProcess, error) {
+	output, err := v.execGuestCommand(ctx, OpListGuestProcesses, vmName, "listProcessesInGuest")
+	if err != nil {
+		return nil, err
+	}
+
+	// Output format:
+	// Process list: 2
+	// pid=4, owner=NT AUTHORITY\SYSTEM, cmd=System
+	// pid=2412, owner=WIN10\analyst, cmd="C:\Windows\explorer.exe"
+	var processes []GuestProcess
+	for _, line := range strings.Split(output, "\n") {
+		matches := guestProcessRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(matches[1])
+		processes = append(processes, GuestProcess{
+			PID:     pid,
+			Owner:   matches[2],
+			Command: matches[3],
+		})
+	}
+	return processes, nil
+}
+
+// CaptureScreen needs the guest credentials, vmrun captures the screen
+// through VMware Tools
+func (v *VmwareVP) CaptureScreen(ctx context.Context, vmName string) ([]byte, error) {
+	return captureToFile(func(hostPath string) error {
+		_, err := v.execGuestCommand(ctx, OpCaptureScreen, vmName, "captureScreen", hostPath)
+		return err
+	})
 }
 
-func (v *VmwareVP) DeleteSnapshot(vmName, snapshotName string) error {
-	return v.execVmCommand(vmName, "deleteSnapshot", snapshotName)
+// DumpMemory suspends the VM, VMware then writes the device state to the
+// .vmss file referenced by the .vmx and the memory to the .vmem file next
+// to it. Volatility needs both files.
+func (v *VmwareVP) DumpMemory(ctx context.Context, vmName, dir string) ([]string, error) {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return nil, &VmNotFoundError{VmName: vmName}
+	}
+
+	if err := v.execVmCommand(ctx, vmName, "suspend"); err != nil {
+		return nil, &VirtualizationError{Operation: OpDumpMemory, VMName: vmName, Err: err}
+	}
+
+	values, err := readVmxValues(vm.Path)
+	if err != nil {
+		return nil, &VirtualizationError{Operation: OpDumpMemory, VMName: vmName, Err: err}
+	}
+	vmState := values["checkpoint.vmState"]
+	if vmState == "" {
+		return nil, &VirtualizationError{
+			Operation: OpDumpMemory,
+			VMName:    vmName,
+			Err:       fmt.Errorf("no suspended state in %s", vm.Path),
+		}
+	}
+
+	vmDir := filepath.Dir(vm.Path)
+	sources := []string{filepath.Join(vmDir, vmState)}
+	vmem := filepath.Join(vmDir, strings.TrimSuffix(vmState, filepath.Ext(vmState))+".vmem")
+	if _, err := os.Stat(vmem); err == nil {
+		sources = append(sources, vmem)
+	}
+
+	paths, err := copyFilesToDir(ctx, sources, dir)
+	if err != nil {
+		return nil, &VirtualizationError{Operation: OpDumpMemory, VMName: vmName, Err: err}
+	}
+	return paths, nil
 }
 
-func (v *VmwareVP) RestoreSnapshot(vmName, snapshotName string) error {
-	return v.execVmCommand(vmName, "revertToSnapshot", snapshotName)
+// StartCapture sets the pcapFile option of the captured adapter, VMware
+// writes the traffic from the next power on of the VM, which must be off
+func (v *VmwareVP) StartCapture(ctx context.Context, vmName, hostPath string) error {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+
+	running, err := v.isRunning(ctx, vm)
+	if err != nil {
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
+	if running {
+		return &VirtualizationError{
+			Operation: OpStartCapture,
+			VMName:    vmName,
+			Err:       fmt.Errorf("the VM must be powered off"),
+		}
+	}
+
+	if err := v.captures.add(vmName, &packetCapture{hostPath: hostPath}); err != nil {
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
+	if err := setVmxValues(vm.Path, map[string]string{v.Adapter + ".pcapFile": hostPath}); err != nil {
+		v.captures.remove(vmName)
+		return &VirtualizationError{Operation: OpStartCapture, VMName: vmName, Err: err}
+	}
+	return nil
+}
+
+// StopCapture removes the pcapFile option. VMware keeps writing the file
+// until the VM is powered off, the capture is complete only after that.
+func (v *VmwareVP) StopCapture(ctx context.Context, vmName string) (string, error) {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return "", &VmNotFoundError{VmName: vmName}
+	}
+
+	capture, err := v.captures.remove(vmName)
+	if err != nil {
+		return "", &VirtualizationError{Operation: OpStopCapture, VMName: vmName, Err: err}
+	}
+
+	running, err := v.isRunning(ctx, vm)
+	if err != nil {
+		return "", &VirtualizationError{Operation: OpStopCapture, VMName: vmName, Err: err}
+	}
+	if running {
+		// VMware would overwrite the .vmx on power off, the option is
+		// replaced by the next StartCapture
+		return capture.hostPath, nil
+	}
+	if err := setVmxValues(vm.Path, map[string]string{v.Adapter + ".pcapFile": ""}); err != nil {
+		return "", &VirtualizationError{Operation: OpStopCapture, VMName: vmName, Err: err}
+	}
+	return capture.hostPath, nil
 }
 
-func (v *VmwareVP) Revert(vmName string) error {
-	snapshots, err := v.ListSnapshots(vmName)
+// SetNetworkProfile edits the adapter settings in the .vmx, the VM must be
+// powered off
+func (v *VmwareVP) SetNetworkProfile(ctx context.Context, vmName, name string) error {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return &VmNotFoundError{VmName: vmName}
+	}
+	profile, err := v.networkProfile(name)
 	if err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+
+	running, err := v.isRunning(ctx, vm)
+	if err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+	if running {
+		return &VirtualizationError{
+			Operation: OpSetNetworkProfile,
+			VMName:    vmName,
+			Err:       fmt.Errorf("the VM must be powered off"),
+		}
+	}
+
+	values := map[string]string{v.Adapter + ".startConnected": "TRUE"}
+	if profile.Disconnected {
+		values[v.Adapter+".startConnected"] = "FALSE"
+	}
+	switch network := strings.ToLower(profile.Network); network {
+	case "":
+	case "nat", "hostonly", "bridged":
+		values[v.Adapter+".connectionType"] = network
+		values[v.Adapter+".vnet"] = ""
+	default:
+		values[v.Adapter+".connectionType"] = "custom"
+		values[v.Adapter+".vnet"] = profile.Network
+	}
+	if err := setVmxValues(vm.Path, values); err != nil {
+		return &VirtualizationError{Operation: OpSetNetworkProfile, VMName: vmName, Err: err}
+	}
+	return nil
+}
+
+// CloneVM creates a linked clone in <ClonePath>/<clone>/<clone>.vmx
+func (v *VmwareVP) CloneVM(ctx context.Context, vmName, snapshotName, cloneName string) error {
+	if err := validateCloneName(cloneName); err != nil {
 		return err
 	}
-	snapshotName := snapshots[len(snapshots)-1].Name
-	return v.execVmCommand(vmName, "revertToSnapshot", snapshotName)
+	if _, exists := v.lookupVM(cloneName); exists {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: fmt.Errorf("VM %s already exists", cloneName)}
+	}
+
+	clonePath := filepath.Join(v.ClonePath, cloneName, cloneName+".vmx")
+	err := v.execVmCommand(ctx, vmName, "clone", clonePath, "linked",
+		"-snapshot="+snapshotName, "-cloneName="+cloneName)
+	if err != nil {
+		return &VirtualizationError{Operation: OpClone, VMName: vmName, Err: err}
+	}
+	v.addVM(cloneName, VM{Path: clonePath})
+	return nil
+}
+
+// DeleteVM lets vmrun delete the files of the VM
+func (v *VmwareVP) DeleteVM(ctx context.Context, vmName string) error {
+	if err := v.execVmCommand(ctx, vmName, "deleteVM"); err != nil {
+		return &VirtualizationError{Operation: OpDeleteVM, VMName: vmName, Err: err}
+	}
+	v.removeVM(vmName)
+	return nil
+}
+
+// GuestReady checks that VMware Tools run in the guest, vmrun reports
+// "installed" or "unknown" until they are started
+func (v *VmwareVP) GuestReady(ctx context.Context, vmName string) (bool, error) {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return false, &VmNotFoundError{VmName: vmName}
+	}
+
+	output, err := v.ExecVmrun(ctx, "checkToolsState", vm.Path)
+	if err != nil {
+		return false, &VirtualizationError{
+			Operation: OpGuestReady,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%s (%w)", output, err),
+		}
+	}
+	return strings.TrimSpace(output) == "running", nil
+}
+
+// isRunning looks for the VM in the output of vmrun list
+func (v *VmwareVP) isRunning(ctx context.Context, vm VM) (bool, error) {
+	output, err := v.ExecVmrun(ctx, "list")
+	if err != nil {
+		return false, fmt.Errorf("%s (%w)", output, err)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == vm.Path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// execGuestCommand runs a vmrun guest command, authenticated with the
+// guest credentials of the VM. The output is returned even on failure.
+func (v *VmwareVP) execGuestCommand(ctx context.Context, operation, vmName, command string, extraArgs ...string) (string, error) {
+	vm, exists := v.lookupVM(vmName)
+	if !exists {
+		return "", &VmNotFoundError{VmName: vmName}
+	}
+	creds, err := v.guestCredentials(vmName)
+	if err != nil {
+		return "", &VirtualizationError{Operation: operation, VMName: vmName, Err: err}
+	}
+
+	args := append([]string{"-gu", creds.Username, "-gp", creds.Password, command, vm.Path}, extraArgs...)
+	output, err := v.ExecVmrun(ctx, args...)
+	if err != nil {
+		return output, &VirtualizationError{
+			Operation: operation,
+			VMName:    vmName,
+			Err:       fmt.Errorf("%s (%w)", output, err),
+		}
+	}
+	return output, nil
 }
@@ -0,0 +1,569 @@
+package hvlib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReplayVmwareVP(t *testing.T) *VmwareVP {
+	t.Helper()
+	runner, err := NewReplayRunner("testdata/vmware.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp := &VmwareVP{VP: VP{Runner: runner}}
+	vp.VMPath = "testdata/vms"
+	vp.VMs = map[string]VM{
+		"win10": {Path: "testdata/vms/win10/win10.vmx"},
+		"win7":  {Path: "testdata/vms/win7/win7.vmx"},
+		"xp":    {Path: "testdata/vms/xp/xp.vmx"},
+	}
+	return vp
+}
+
+func TestVmwareLoadVMs(t *testing.T) {
+	ctx := context.Background()
+	vp := &VmwareVP{}
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, `
+[vmware]
+install_path = "C:\\Program Files (x86)\\VMware\\VMware Workstation"
+vm_path = "testdata/vms"
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vp.LoadVMs(ctx, loader); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"win10", "win7", "xp"} {
+		if _, ok := vp.VMs[name]; !ok {
+			t.Errorf("VM %s not loaded", name)
+		}
+	}
+	if _, err := vp.guestCredentials("win10"); !errors.Is(err, ErrNoGuestCredentials) {
+		t.Errorf("expected ErrNoGuestCredentials, got %v", err)
+	}
+}
+
+func TestVmwareLoadGuestCredentials(t *testing.T) {
+	vp := &VmwareVP{}
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, `
+[vmware]
+vm_path = "testdata/vms"
+[vmware.guest]
+username = "analyst"
+password = "secret"
+[vmware.guest.xp]
+username = "Administrator"
+password = ""
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vp.LoadVMs(context.Background(), loader); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]GuestCredentials{
+		"win10": {Username: "analyst", Password: "secret"},
+		"xp":    {Username: "Administrator", Password: ""},
+	}
+	for vmName, creds := range expected {
+		got, err := vp.guestCredentials(vmName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != creds {
+			t.Errorf("got %+v for %s, expected %+v", got, vmName, creds)
+		}
+	}
+}
+
+func TestVmwareList(t *testing.T) {
+	ctx := context.Background()
+	vp := newReplayVmwareVP(t)
+
+	vms, err := vp.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"win10": "running",
+		"win7":  "suspended",
+		"xp":    "stopped",
+	}
+	if len(vms) != len(expected) {
+		t.Fatalf("got %d VMs, expected %d", len(vms), len(expected))
+	}
+	for _, vm := range vms {
+		if vm.State != expected[vm.Name] {
+			t.Errorf("VM %s: got state %q, expected %q", vm.Name, vm.State, expected[vm.Name])
+		}
+	}
+}
+
+func TestVmwareListSnapshots(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		vmName   string
+		expected []string
+		err      string
+	}{
+		{vmName: "win10", expected: []string{"clean", "with office", "with tools"}},
+		{vmName: "win7", expected: nil},
+		{vmName: "xp", err: "exit status 255"},
+		{vmName: "unknown", err: "vm unknown not found"},
+	}
+
+	vp := newReplayVmwareVP(t)
+	for _, tt := range tests {
+		t.Run(tt.vmName, func(t *testing.T) {
+			snapshots, err := vp.ListSnapshots(ctx, tt.vmName)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, expected %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, s := range snapshots {
+				names = append(names, s.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("got snapshots %v, expected %v", names, tt.expected)
+			}
+		})
+	}
+}
+
+func TestVmwareSnapshotTree(t *testing.T) {
+	ctx := context.Background()
+	vp := newReplayVmwareVP(t)
+
+	snapshots, err := vp.ListSnapshots(ctx, "win10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := BuildSnapshotTree(snapshots)
+	if len(roots) != 1 || roots[0].Name != "clean" || len(roots[0].Children) != 2 {
+		t.Fatalf("unexpected snapshot tree: %+v", roots)
+	}
+	if roots[0].Description != "Fresh install" || !roots[0].CreationTime.Equal(time.UnixMilli(1732096365000)) {
+		t.Errorf("metadata of the .vmsd file not applied: %+v", roots[0].Snapshot)
+	}
+
+	current, ok := CurrentSnapshot(snapshots)
+	if !ok || current.ID != "clean/with office" || current.ParentID != "clean" {
+		t.Errorf("unexpected current snapshot: %+v", current)
+	}
+}
+
+func TestVmwareCommands(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		run  func(vp *VmwareVP) error
+		err  string
+	}{
+		{name: "revert to current snapshot", run: func(vp *VmwareVP) error { return vp.Revert(ctx, "win10") }},
+		{name: "hard stop", run: func(vp *VmwareVP) error { return vp.Stop(ctx, "win7", true) }},
+		{name: "start failure", run: func(vp *VmwareVP) error { return vp.Start(ctx, "win10") }, err: "The file is already in use"},
+		{name: "unknown vm", run: func(vp *VmwareVP) error { return vp.Suspend(ctx, "unknown") }, err: "vm unknown not found"},
+		{name: "no transcript", run: func(vp *VmwareVP) error { return vp.Reset(ctx, "xp") }, err: "cmd.Wait"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run(newReplayVmwareVP(t))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, expected %q", err, tt.err)
+			}
+		})
+	}
+
+	var notFound *VmNotFoundError
+	if err := newReplayVmwareVP(t).Start(ctx, "unknown"); !errors.As(err, &notFound) {
+		t.Errorf("expected VmNotFoundError, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := newReplayVmwareVP(t).Stop(cancelled, "win7", true); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestVmwareGuestOperations(t *testing.T) {
+	ctx := context.Background()
+	vp := newReplayVmwareVP(t)
+	vp.GuestCredentials = map[string]GuestCredentials{
+		"win10": {Username: "analyst", Password: "secret"},
+	}
+
+	processes, err := vp.ListProcessesInGuest(ctx, "win10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []GuestProcess{
+		{PID: 4, Owner: `NT AUTHORITY\SYSTEM`, Command: "System"},
+		{PID: 2412, Owner: `WIN10\analyst`, Command: `"C:\Windows\explorer.exe"`},
+		{PID: 3120, Owner: `WIN10\analyst`, Command: `"C:\Users\analyst\sample.exe" --install`},
+	}
+	if len(processes) != len(expected) {
+		t.Fatalf("got %d processes, expected %d", len(processes), len(expected))
+	}
+	for i := range expected {
+		if processes[i] != expected[i] {
+			t.Errorf("got %+v, expected %+v", processes[i], expected[i])
+		}
+	}
+
+	// A failing guest program is reported through its exit code
+	exitCode, err := vp.RunProgramInGuest(ctx, "win10", `C:\tools\procdump.exe`, []string{"-ma", "lsass.exe"}, true)
+	if err != nil || exitCode != 1 {
+		t.Errorf("got exit code %d and error %v, expected 1", exitCode, err)
+	}
+	if _, err := vp.RunProgramInGuest(ctx, "win10", `C:\Users\analyst\sample.exe`, nil, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err = vp.CopyFileFromGuest(ctx, "win10", `C:\Users\analyst\ransom.txt`, "/tmp/ransom.txt")
+	if err == nil || !strings.Contains(err.Error(), "A file was not found") {
+		t.Errorf("got error %v, expected vmrun output", err)
+	}
+
+	// win7 has no credentials, vmrun must not be called without them
+	if err := vp.CopyFileToGuest(ctx, "win7", "/tmp/tool.exe", `C:\tool.exe`); !errors.Is(err, ErrNoGuestCredentials) {
+		t.Errorf("expected ErrNoGuestCredentials, got %v", err)
+	}
+}
+
+func TestVmwareDumpMemory(t *testing.T) {
+	ctx := context.Background()
+	vmDir := t.TempDir()
+	vmx := filepath.Join(vmDir, "win10.vmx")
+	files := map[string]string{
+		"win10.vmx":       "displayName = \"win10\"\ncheckpoint.vmState = \"win10-5a1c.vmss\"\n",
+		"win10-5a1c.vmss": "device state",
+		"win10-5a1c.vmem": "memory",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(vmDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vp := &VmwareVP{VP: VP{
+		VMs: map[string]VM{"win10": {Path: vmx}},
+		Runner: &ReplayRunner{Transcripts: []CommandTranscript{
+			{Name: "vmrun.exe", Args: []string{"-T", "ws", "suspend", vmx}},
+		}},
+	}}
+
+	dir := t.TempDir()
+	paths, err := vp.DumpMemory(ctx, "win10", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("got %d files, expected 2", len(paths))
+	}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != files[filepath.Base(path)] {
+			t.Errorf("unexpected content for %s: %q", path, content)
+		}
+	}
+}
+
+func TestVmwareCapture(t *testing.T) {
+	ctx := context.Background()
+	vmx := filepath.Join(t.TempDir(), "win10.vmx")
+	if err := os.WriteFile(vmx, []byte("displayName = \"win10\"\r\nEthernet0.pcapFile = \"old.pcap\"\r\nethernet0.present = \"TRUE\"\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list := []string{"-T", "ws", "list"}
+	vp := &VmwareVP{
+		VP: VP{
+			VMs: map[string]VM{"win10": {Path: vmx}},
+			Runner: &ReplayRunner{Transcripts: []CommandTranscript{
+				{Name: "vmrun.exe", Args: list, Stdout: "Total running VMs: 0\r\n"},
+				{Name: "vmrun.exe", Args: list, Stdout: "Total running VMs: 0\r\n"},
+				{Name: "vmrun.exe", Args: list, Stdout: "Total running VMs: 0\r\n"},
+				{Name: "vmrun.exe", Args: list, Stdout: "Total running VMs: 1\r\n" + vmx + "\r\n"},
+			}},
+		},
+		Adapter: "ethernet0",
+	}
+
+	if err := vp.StartCapture(ctx, "win10", `C:\captures\win10.pcap`); err != nil {
+		t.Fatal(err)
+	}
+	values, err := readVmxValues(vmx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := values["ethernet0.pcapFile"]; got != `C:\captures\win10.pcap` {
+		t.Errorf("got pcapFile %q", got)
+	}
+	if _, exists := values["Ethernet0.pcapFile"]; exists {
+		t.Error("previous pcapFile setting was kept")
+	}
+	if values["ethernet0.present"] != "TRUE" {
+		t.Error("other settings were lost")
+	}
+	if err := vp.StartCapture(ctx, "win10", "other.pcap"); !errors.Is(err, ErrCaptureInProgress) {
+		t.Errorf("got %v, expected ErrCaptureInProgress", err)
+	}
+
+	path, err := vp.StopCapture(ctx, "win10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != `C:\captures\win10.pcap` {
+		t.Errorf("got path %q", path)
+	}
+	values, err = readVmxValues(vmx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := values["ethernet0.pcapFile"]; exists {
+		t.Error("pcapFile setting was not removed")
+	}
+	if _, err := vp.StopCapture(ctx, "win10"); !errors.Is(err, ErrNoCapture) {
+		t.Errorf("got %v, expected ErrNoCapture", err)
+	}
+
+	// The setting is only read at power on
+	if err := vp.StartCapture(ctx, "win10", "running.pcap"); err == nil {
+		t.Error("expected an error for a running VM")
+	}
+}
+
+func TestVmwareSetNetworkProfile(t *testing.T) {
+	ctx := context.Background()
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, `
+[vmware.network_profiles.isolated]
+disconnected = true
+[vmware.network_profiles.inetsim]
+network = "VMnet2"
+[vmware.network_profiles.internet]
+network = "nat"
+`); err != nil {
+		t.Fatal(err)
+	}
+
+	vmx := filepath.Join(t.TempDir(), "win10.vmx")
+	if err := os.WriteFile(vmx, []byte("ethernet0.connectionType = \"nat\"\nethernet0.startConnected = \"TRUE\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vp := &VmwareVP{
+		VP: VP{
+			VMs: map[string]VM{"win10": {Path: vmx}},
+			Runner: &ReplayRunner{Transcripts: []CommandTranscript{
+				{Name: "vmrun.exe", Args: []string{"-T", "ws", "list"}, Stdout: "Total running VMs: 0\r\n"},
+			}},
+		},
+		Adapter: "ethernet0",
+	}
+	if err := vp.loadNetworkProfiles(loader, "vmware"); err != nil {
+		t.Fatal(err)
+	}
+	if got := vp.ListNetworkProfiles(); strings.Join(got, ",") != "inetsim,internet,isolated" {
+		t.Errorf("got profiles %v", got)
+	}
+
+	tests := []struct {
+		profile  string
+		expected map[string]string
+	}{
+		{"inetsim", map[string]string{
+			"ethernet0.connectionType": "custom",
+			"ethernet0.vnet":           "VMnet2",
+			"ethernet0.startConnected": "TRUE",
+		}},
+		{"internet", map[string]string{
+			"ethernet0.connectionType": "nat",
+			"ethernet0.vnet":           "",
+			"ethernet0.startConnected": "TRUE",
+		}},
+		{"isolated", map[string]string{
+			"ethernet0.connectionType": "nat",
+			"ethernet0.startConnected": "FALSE",
+		}},
+	}
+	for _, test := range tests {
+		if err := vp.SetNetworkProfile(ctx, "win10", test.profile); err != nil {
+			t.Fatal(err)
+		}
+		values, err := readVmxValues(vmx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range test.expected {
+			if values[key] != value {
+				t.Errorf("%s: got %s = %q, expected %q", test.profile, key, values[key], value)
+			}
+		}
+	}
+
+	if err := vp.SetNetworkProfile(ctx, "win10", "tor"); !errors.Is(err, ErrUnknownNetworkProfile) {
+		t.Errorf("got %v, expected ErrUnknownNetworkProfile", err)
+	}
+}
+
+func TestVmwareCloneVM(t *testing.T) {
+	ctx := context.Background()
+	source := filepath.Join("vms", "win10", "win10.vmx")
+	clone := filepath.Join("clones", "win10-1", "win10-1.vmx")
+	vp := &VmwareVP{
+		VP: VP{
+			VMs: map[string]VM{"win10": {Path: source}},
+			Runner: &ReplayRunner{Transcripts: []CommandTranscript{
+				{Name: "vmrun.exe", Args: []string{"-T", "ws", "clone", source, clone, "linked", "-snapshot=clean", "-cloneName=win10-1"}},
+				{Name: "vmrun.exe", Args: []string{"-T", "ws", "deleteVM", clone}},
+			}},
+		},
+		ClonePath: "clones",
+	}
+
+	if err := vp.CloneVM(ctx, "win10", "clean", "win10-1"); err != nil {
+		t.Fatal(err)
+	}
+	if vm, exists := vp.lookupVM("win10-1"); !exists || vm.Path != clone {
+		t.Fatalf("clone not registered: %+v", vm)
+	}
+	if err := vp.CloneVM(ctx, "win10", "clean", "win10-1"); err == nil {
+		t.Error("expected an error for an existing VM")
+	}
+	var invalidName *InvalidNameError
+	if err := vp.CloneVM(ctx, "win10", "clean", "../win10"); !errors.As(err, &invalidName) {
+		t.Errorf("got %v, expected InvalidNameError", err)
+	}
+
+	if err := vp.DeleteVM(ctx, "win10-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := vp.lookupVM("win10-1"); exists {
+		t.Error("clone still registered")
+	}
+}
+
+func TestVmwareWaitForGuest(t *testing.T) {
+	defer func(interval time.Duration) { waitPollInterval = interval }(waitPollInterval)
+	waitPollInterval = time.Millisecond
+
+	vmx := filepath.Join("vms", "win10", "win10.vmx")
+	checkTools := []string{"-T", "ws", "checkToolsState", vmx}
+	vp := &VmwareVP{
+		VP: VP{
+			VMs: map[string]VM{"win10": {Path: vmx}},
+			Runner: &ReplayRunner{Transcripts: []CommandTranscript{
+				{Name: "vmrun.exe", Args: checkTools, Stdout: "unknown\r\n"},
+				{Name: "vmrun.exe", Args: checkTools, Stdout: "installed\r\n"},
+				{Name: "vmrun.exe", Args: checkTools, Stdout: "running\r\n"},
+			}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := WaitForGuest(ctx, vp, "win10"); err != nil {
+		t.Fatal(err)
+	}
+
+	var notFound *VmNotFoundError
+	if err := WaitForGuest(ctx, vp, "xp"); !errors.As(err, &notFound) {
+		t.Errorf("got %v, expected VmNotFoundError", err)
+	}
+	var invalidName *InvalidNameError
+	if err := WaitForState(ctx, vp, "win10", "booted"); !errors.As(err, &invalidName) {
+		t.Errorf("got %v, expected InvalidNameError", err)
+	}
+}
+
+func TestVmwareRefreshVMs(t *testing.T) {
+	ctx := context.Background()
+	vmPath := t.TempDir()
+	clonePath := filepath.Join(t.TempDir(), "clones")
+	writeVmx := func(dir, name string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, name+".vmx"), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVmx(vmPath, "win10")
+
+	vp := &VmwareVP{}
+	loader := &ConfigLoader{}
+	if err := loadConfigString(loader, "[vmware]\nvm_path = '"+vmPath+"'\nclone_path = '"+clonePath+"'\n"); err != nil {
+		t.Fatal(err)
+	}
+	// The clone directory doesn't exist yet
+	if err := vp.LoadVMs(ctx, loader); err != nil {
+		t.Fatal(err)
+	}
+
+	writeVmx(vmPath, "win11")
+	writeVmx(clonePath, "win10-1")
+	if err := os.RemoveAll(filepath.Join(vmPath, "win10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := vp.RefreshVMs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"win11", "win10-1"} {
+		if _, exists := vp.lookupVM(name); !exists {
+			t.Errorf("VM %s not discovered", name)
+		}
+	}
+	if _, exists := vp.lookupVM("win10"); exists {
+		t.Error("deleted VM still registered")
+	}
+}
+
+func TestVmwareVersion(t *testing.T) {
+	vp := &VmwareVP{
+		VP: VP{Runner: &ReplayRunner{Transcripts: []CommandTranscript{
+			{
+				Name:     "vmrun.exe",
+				Args:     []string{"-T", "ws"},
+				Stdout:   "\r\nvmrun version 1.17.0 build-21139696\r\n\r\nUsage: vmrun [AUTHENTICATION-FLAGS] COMMAND [PARAMETERS]\r\n",
+				ExitCode: 255,
+			},
+		}}},
+	}
+
+	version, err := vp.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.17.0 build-21139696" {
+		t.Errorf("got version %q", version)
+	}
+}
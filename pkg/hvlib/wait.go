@@ -0,0 +1,72 @@
+package hvlib
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// PowerStates are the states reported in VMStatus by every provider
+var PowerStates = []string{"running", "stopped", "saved", "suspended"}
+
+// waitPollInterval is the delay between two checks of WaitForState and
+// WaitForGuest
+var waitPollInterval = 2 * time.Second
+
+// ValidatePowerState checks that state is one of PowerStates
+func ValidatePowerState(state string) error {
+	for _, s := range PowerStates {
+		if s == state {
+			return nil
+		}
+	}
+	return &InvalidNameError{Name: state, Reason: fmt.Sprintf("the power state must be one of %v", PowerStates)}
+}
+
+// WaitForState polls the provider until the VM is in the given power state
+func WaitForState(ctx context.Context, provider VirtualizationProvider, vmName, state string) error {
+	if err := ValidatePowerState(state); err != nil {
+		return err
+	}
+
+	return poll(ctx, vmName, func() (bool, error) {
+		vms, err := provider.List(ctx)
+		if err != nil {
+			return false, err
+		}
+		for _, vm := range vms {
+			if vm.Name == vmName {
+				return vm.State == state, nil
+			}
+		}
+		return false, &VmNotFoundError{VmName: vmName}
+	})
+}
+
+// WaitForGuest polls the provider until the guest tools of the VM respond,
+// meaning that the guest OS has booted
+func WaitForGuest(ctx context.Context, checker GuestReadinessChecker, vmName string) error {
+	return poll(ctx, vmName, func() (bool, error) {
+		return checker.GuestReady(ctx, vmName)
+	})
+}
+
+// poll calls check every waitPollInterval until it returns true or an
+// error, or ctx ends
+func poll(ctx context.Context, vmName string, check func() (bool, error)) error {
+	for {
+		done, err := check()
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-time.After(waitPollInterval):
+		case <-ctx.Done():
+			return &VirtualizationError{Operation: OpWait, VMName: vmName, Err: ctx.Err()}
+		}
+	}
+}